@@ -3,6 +3,7 @@ import { useAuthStore } from './store/authStore'
 import { useUISettings } from './hooks/useUISettings'
 import Login from './pages/Login'
 import Register from './pages/Register'
+import ResetPassword from './pages/ResetPassword'
 import Chat from './pages/Chat'
 import PrivacyPolicy from './pages/PrivacyPolicy'
 import TermsOfService from './pages/TermsOfService'
@@ -40,6 +41,7 @@ function App() {
         <Routes>
           <Route path="/login" element={!token ? <Login /> : <Navigate to="/chat" replace />} />
           <Route path="/register" element={!token ? <Register /> : <Navigate to="/chat" replace />} />
+          <Route path="/reset-password" element={<ResetPassword />} />
           <Route path="/chat" element={token ? <Chat /> : <Navigate to="/login" replace />} />
           <Route path="/privacy" element={<PrivacyPolicy />} />
           <Route path="/terms" element={<TermsOfService />} />
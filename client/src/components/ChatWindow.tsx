@@ -5,7 +5,7 @@ import { wsService } from '../services/websocket'
 import api from '../services/api'
 import { useAuthStore } from '../store/authStore'
 import UserProfileView from './UserProfileView'
-import MessageImage from './MessageImage'
+import MessageImage, { MessageAttachment } from './MessageImage'
 import MessageContextMenu from './MessageContextMenu'
 import { groupMessagesByDate, formatMessageDate } from '../utils/dateUtils'
 import { useTranslation } from '../hooks/useTranslation'
@@ -28,6 +28,7 @@ interface Message {
   read_at?: string | null
   file_url?: string
   message_type?: string
+  attachments?: MessageAttachment[]
   reply_to_id?: string | null
   replied_message?: Message | null
   pinned_at?: string | null
@@ -193,7 +194,7 @@ export default function ChatWindow({ chat, onlineUsers }: ChatWindowProps) {
     try {
       setLoading(true)
       const response = await api.get(`/api/messages/${chat.id}`)
-      setMessages(response.data || [])
+      setMessages(response.data?.messages || [])
       
       // Mark messages as read when opening chat
       if (wsService.isConnected()) {
@@ -470,7 +471,7 @@ export default function ChatWindow({ chat, onlineUsers }: ChatWindowProps) {
                           
                           {/* Image if present */}
                           {msg.file_url && msg.message_type === 'image' && (
-                            <MessageImage url={msg.file_url} />
+                            <MessageImage url={msg.file_url} attachment={msg.attachments?.[0]} />
                           )}
                           
                           {/* Text and time */}
@@ -1,16 +1,46 @@
-import { useState, memo } from 'react'
+import { useState, useMemo, memo } from 'react'
 import { motion, AnimatePresence } from 'framer-motion'
 import { X, Download, ZoomIn } from 'lucide-react'
+import { blurhashToDataURL } from '../utils/blurhash'
+
+// Вложение сообщения с размерами и превью, которые сервер считает при загрузке
+export interface MessageAttachment {
+  url: string
+  thumbnail_url?: string
+  width?: number
+  height?: number
+  blurhash?: string
+}
 
 interface MessageImageProps {
   url: string
   alt?: string
+  attachment?: MessageAttachment
 }
 
-const MessageImage = memo(function MessageImage({ url, alt = 'Image' }: MessageImageProps) {
+// Наибольший размер картинки в сообщении, как max-w-xs и max-h-64
+const MAX_WIDTH = 320
+const MAX_HEIGHT = 256
+
+const MessageImage = memo(function MessageImage({ url, alt = 'Image', attachment }: MessageImageProps) {
   const [isFullscreen, setIsFullscreen] = useState(false)
   const [isLoading, setIsLoading] = useState(true)
 
+  // Зная размеры, резервируем место под картинку до её загрузки, чтобы чат не прыгал
+  const box = useMemo(() => {
+    if (!attachment?.width || !attachment?.height) return undefined
+    const scale = Math.min(1, MAX_WIDTH / attachment.width, MAX_HEIGHT / attachment.height)
+    return {
+      width: Math.round(attachment.width * scale),
+      height: Math.round(attachment.height * scale),
+    }
+  }, [attachment?.width, attachment?.height])
+
+  const placeholder = useMemo(
+    () => (attachment?.blurhash ? blurhashToDataURL(attachment.blurhash) : undefined),
+    [attachment?.blurhash]
+  )
+
   const handleDownload = async () => {
     try {
       const response = await fetch(url)
@@ -31,16 +61,23 @@ const MessageImage = memo(function MessageImage({ url, alt = 'Image' }: MessageI
   return (
     <>
       {/* Thumbnail in message */}
-      <div className="relative group max-w-xs cursor-pointer" onClick={() => setIsFullscreen(true)}>
-        {isLoading && (
+      <div className="relative group max-w-xs cursor-pointer" style={box} onClick={() => setIsFullscreen(true)}>
+        {isLoading && placeholder && (
+          <img src={placeholder} alt="" aria-hidden className="absolute inset-0 w-full h-full rounded-lg object-cover" />
+        )}
+        {isLoading && !placeholder && (
           <div className="absolute inset-0 flex items-center justify-center bg-white/5 rounded-lg">
             <div className="w-8 h-8 border-2 border-accent border-t-transparent rounded-full animate-spin" />
           </div>
         )}
         <img
-          src={url}
+          src={attachment?.thumbnail_url || url}
           alt={alt}
-          className="rounded-lg max-h-64 w-auto object-cover"
+          width={box?.width}
+          height={box?.height}
+          className={box
+            ? `relative rounded-lg w-full h-full object-cover transition-opacity ${isLoading ? 'opacity-0' : 'opacity-100'}`
+            : 'rounded-lg max-h-64 w-auto object-cover'}
           onLoad={() => setIsLoading(false)}
           loading="lazy"
         />
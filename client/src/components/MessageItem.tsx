@@ -2,7 +2,7 @@ import { memo, useCallback } from 'react'
 import { motion } from 'framer-motion'
 import { Edit, Reply, Forward } from 'lucide-react'
 import MessageText from './MessageText'
-import MessageImage from './MessageImage'
+import MessageImage, { MessageAttachment } from './MessageImage'
 
 interface Reaction {
   id: string
@@ -20,6 +20,7 @@ interface Message {
   is_read?: boolean
   file_url?: string
   message_type?: string
+  attachments?: MessageAttachment[]
   reply_to_id?: string | null
   replied_message?: Message | null
   edited_at?: string | null
@@ -139,7 +140,7 @@ const MessageItem = memo(function MessageItem({
           
           {/* Image */}
           {msg.file_url && msg.message_type === 'image' && (
-            <MessageImage url={msg.file_url} />
+            <MessageImage url={msg.file_url} attachment={msg.attachments?.[0]} />
           )}
 
           {/* Text */}
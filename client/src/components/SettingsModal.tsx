@@ -23,6 +23,7 @@ import { useOpacityStore } from '../store/opacityStore'
 import { useUIStore } from '../store/uiStore'
 import { useAnimationStore, DeleteAnimationType } from '../store/animationStore'
 import { usePrivacyStore } from '../store/privacyStore'
+import { useAuthStore } from '../store/authStore'
 import { useNotifications } from '../hooks/useNotifications'
 import { useTranslation } from '../hooks/useTranslation'
 import CustomSelect from './CustomSelect'
@@ -199,11 +200,63 @@ function PrivacySettings() {
           checked={readReceipts}
           onChange={() => updatePrivacy({ readReceipts: !readReceipts })}
         />
+        <BlockedUsersSettings />
       </div>
     </div>
   )
 }
 
+interface BlockedUser {
+  id: string
+  username: string
+  display_name?: string
+}
+
+// Список заблокированных пользователей
+function BlockedUsersSettings() {
+  const { t } = useTranslation()
+  const [blocked, setBlocked] = useState<BlockedUser[]>([])
+
+  useEffect(() => {
+    api.get('/api/blocks')
+      .then((response) => setBlocked(response.data || []))
+      .catch(() => {})
+  }, [])
+
+  const handleUnblock = async (id: string) => {
+    try {
+      await api.delete(`/api/blocks/${id}`)
+      setBlocked((prev) => prev.filter((user) => user.id !== id))
+    } catch {
+      alert(t('blockFailed'))
+    }
+  }
+
+  return (
+    <div className="glass-hover rounded-xl p-4 space-y-3">
+      <div>
+        <h3 className="font-medium mb-1">{t('blockedUsers')}</h3>
+        <p className="text-sm text-white/60">{t('blockedUsersDesc')}</p>
+      </div>
+      {blocked.length === 0 ? (
+        <p className="text-sm text-white/40">{t('noBlockedUsers')}</p>
+      ) : (
+        blocked.map((user) => (
+          <div key={user.id} className="flex items-center justify-between gap-3">
+            <div className="min-w-0">
+              <p className="font-medium truncate">{user.display_name || user.username}</p>
+              <p className="text-sm text-white/60 truncate">@{user.username}</p>
+            </div>
+            <button onClick={() => handleUnblock(user.id)} className="btn-secondary text-sm">
+              {t('unblockUser')}
+            </button>
+          </div>
+        ))
+      )}
+    </div>
+  )
+}
+
 // Appearance Settings Component
 function AppearanceSettings({ theme, setTheme, accentColor, setAccentColor, onClose }: { 
   theme: string
@@ -724,6 +777,8 @@ function SecuritySettings() {
             </button>
           </div>
 
+          <RecoveryEmailSettings />
+
           <div className="glass-hover rounded-xl p-4">
             <h3 className="font-medium mb-1">{t('twoFactor')}</h3>
             <p className="text-sm text-white/60 mb-3">{t('twoFactorDesc')}</p>
@@ -745,6 +800,8 @@ function SecuritySettings() {
               {t('viewSessions')}
             </button>
           </div>
+
+          <AccountDataSettings />
         </div>
       </div>
 
@@ -765,6 +822,193 @@ function SecuritySettings() {
   )
 }
 
+// Recovery Email
+function RecoveryEmailSettings() {
+  const { t } = useTranslation()
+  const [email, setEmail] = useState('')
+  const [password, setPassword] = useState('')
+  const [loading, setLoading] = useState(false)
+  const [error, setError] = useState('')
+
+  useEffect(() => {
+    api.get('/api/me/email')
+      .then((response) => setEmail(response.data.email || ''))
+      .catch(() => {})
+  }, [])
+
+  // Пустой адрес удаляет почту для восстановления
+  const handleSave = async (e: React.FormEvent) => {
+    e.preventDefault()
+    setError('')
+
+    try {
+      setLoading(true)
+      const response = await api.put('/api/me/email', { email, password })
+      setEmail(response.data.email || '')
+      setPassword('')
+      alert(t('emailSaved'))
+    } catch (err: any) {
+      setError(err.response?.data?.message || t('emailSaveFailed'))
+    } finally {
+      setLoading(false)
+    }
+  }
+
+  return (
+    <form onSubmit={handleSave} className="glass-hover rounded-xl p-4 space-y-3">
+      <div>
+        <h3 className="font-medium mb-1">{t('recoveryEmail')}</h3>
+        <p className="text-sm text-white/60">{t('recoveryEmailDesc')}</p>
+      </div>
+      {error && (
+        <div className="bg-red-500/20 border border-red-500/50 rounded-xl p-3 text-sm text-red-400">
+          {error}
+        </div>
+      )}
+      <input
+        type="email"
+        value={email}
+        onChange={(e) => setEmail(e.target.value)}
+        className="input"
+        placeholder="name@example.com"
+      />
+      <input
+        type="password"
+        value={password}
+        onChange={(e) => setPassword(e.target.value)}
+        className="input"
+        placeholder={t('currentPassword')}
+        required
+      />
+      <button type="submit" className="btn-secondary text-sm" disabled={loading}>
+        {loading ? t('loading') : t('save')}
+      </button>
+    </form>
+  )
+}
+
+// Export and deletion of the account
+function AccountDataSettings() {
+  const { t } = useTranslation()
+  const logout = useAuthStore((state) => state.logout)
+  const [exporting, setExporting] = useState(false)
+  const [confirming, setConfirming] = useState(false)
+  const [password, setPassword] = useState('')
+  const [code, setCode] = useState('')
+  const [loading, setLoading] = useState(false)
+  const [error, setError] = useState('')
+
+  const handleExport = async () => {
+    try {
+      setExporting(true)
+      const response = await api.get('/api/me/export', { responseType: 'blob' })
+      const name = /filename="([^"]+)"/.exec(response.headers['content-disposition'] || '')?.[1] || 'persona-export.zip'
+      const url = URL.createObjectURL(response.data)
+      const link = document.createElement('a')
+      link.href = url
+      link.download = name
+      link.click()
+      URL.revokeObjectURL(url)
+    } catch (err: any) {
+      alert(err.response?.status === 429 ? t('exportRateLimited') : t('exportFailed'))
+    } finally {
+      setExporting(false)
+    }
+  }
+
+  // Код нужен, только если включена 2FA; 6 цифр — код из приложения
+  const handleDelete = async (e: React.FormEvent) => {
+    e.preventDefault()
+    setError('')
+
+    try {
+      setLoading(true)
+      const isTotp = /^\d{6}$/.test(code.trim())
+      await api.delete('/api/me', {
+        data: {
+          password,
+          ...(code.trim() === '' ? {} : isTotp ? { code: code.trim() } : { recovery_code: code.trim() }),
+        },
+      })
+      alert(t('accountDeletionScheduled'))
+      logout()
+      window.location.href = '/login'
+    } catch (err: any) {
+      setError(err.response?.data?.message || t('deleteAccountFailed'))
+    } finally {
+      setLoading(false)
+    }
+  }
+
+  return (
+    <>
+      <div className="glass-hover rounded-xl p-4">
+        <h3 className="font-medium mb-1">{t('exportData')}</h3>
+        <p className="text-sm text-white/60 mb-3">{t('exportDataDesc')}</p>
+        <button onClick={handleExport} className="btn-secondary text-sm" disabled={exporting}>
+          {exporting ? t('loading') : t('requestExport')}
+        </button>
+      </div>
+
+      <div className="glass-hover rounded-xl p-4 border border-red-500/20">
+        <h3 className="font-medium mb-1 text-red-400">{t('deleteAccount')}</h3>
+        <p className="text-sm text-white/60 mb-3">{t('deleteAccountDesc')}</p>
+        {!confirming ? (
+          <button
+            onClick={() => setConfirming(true)}
+            className="px-4 py-2 rounded-xl text-sm bg-red-500/20 text-red-400 hover:bg-red-500/30 transition-all"
+          >
+            {t('deleteAccount')}
+          </button>
+        ) : (
+          <form onSubmit={handleDelete} className="space-y-3">
+            {error && (
+              <div className="bg-red-500/20 border border-red-500/50 rounded-xl p-3 text-sm text-red-400">
+                {error}
+              </div>
+            )}
+            <input
+              type="password"
+              value={password}
+              onChange={(e) => setPassword(e.target.value)}
+              className="input"
+              placeholder={t('currentPassword')}
+              required
+            />
+            <input
+              type="text"
+              value={code}
+              onChange={(e) => setCode(e.target.value)}
+              className="input"
+              placeholder={t('deleteAccountCode')}
+            />
+            <div className="flex gap-3">
+              <button
+                type="button"
+                onClick={() => {
+                  setConfirming(false)
+                  setError('')
+                }}
+                className="flex-1 btn-secondary text-sm"
+                disabled={loading}
+              >
+                {t('cancel')}
+              </button>
+              <button
+                type="submit"
+                className="flex-1 px-4 py-2 rounded-xl text-sm bg-red-500 text-white hover:bg-red-600 transition-all"
+                disabled={loading}
+              >
+                {loading ? t('loading') : t('deleteAccountConfirm')}
+              </button>
+            </div>
+          </form>
+        )}
+      </div>
+    </>
+  )
+}
+
 // Change Password Modal
 function ChangePasswordModal({ isOpen, onClose }: { isOpen: boolean; onClose: () => void }) {
   const { t } = useTranslation()
@@ -790,8 +1034,9 @@ function ChangePasswordModal({ isOpen, onClose }: { isOpen: boolean; onClose: ()
 
     try {
       setLoading(true)
-      await api.post('/api/auth/change-password', {
-        current_password: currentPassword,
+      // Остальные сеансы сервер завершает сам
+      await api.put('/api/me/password', {
+        old_password: currentPassword,
         new_password: newPassword
       })
       
@@ -801,7 +1046,7 @@ function ChangePasswordModal({ isOpen, onClose }: { isOpen: boolean; onClose: ()
       onClose()
       alert(t('passwordChanged'))
     } catch (err: any) {
-      setError(err.response?.data?.error || t('passwordChangeFailed'))
+      setError(err.response?.data?.message || t('passwordChangeFailed'))
     } finally {
       setLoading(false)
     }
@@ -903,22 +1148,33 @@ function ChangePasswordModal({ isOpen, onClose }: { isOpen: boolean; onClose: ()
 // Setup 2FA Modal
 function Setup2FAModal({ isOpen, onClose }: { isOpen: boolean; onClose: () => void }) {
   const { t } = useTranslation()
-  const [step, setStep] = useState<'info' | 'qr' | 'verify'>('info')
+  const [step, setStep] = useState<'info' | 'qr' | 'verify' | 'codes' | 'disable'>('info')
   const [qrCode, setQrCode] = useState('')
   const [secret, setSecret] = useState('')
   const [verifyCode, setVerifyCode] = useState('')
+  const [recoveryCodes, setRecoveryCodes] = useState<string[]>([])
+  const [password, setPassword] = useState('')
   const [loading, setLoading] = useState(false)
   const [error, setError] = useState('')
 
+  // Если 2FA уже включена, вместо настройки предлагаем её отключить
+  useEffect(() => {
+    if (!isOpen) return
+    setError('')
+    api.get('/api/2fa')
+      .then((response) => setStep(response.data.enabled ? 'disable' : 'info'))
+      .catch(() => setStep('info'))
+  }, [isOpen])
+
   const handleEnable2FA = async () => {
     try {
       setLoading(true)
-      const response = await api.post('/api/auth/2fa/enable')
+      const response = await api.post('/api/2fa/setup')
       setQrCode(response.data.qr_code)
       setSecret(response.data.secret)
       setStep('qr')
     } catch (err: any) {
-      setError(err.response?.data?.error || t('2faEnableFailed'))
+      setError(err.response?.data?.message || t('2faEnableFailed'))
     } finally {
       setLoading(false)
     }
@@ -930,16 +1186,41 @@ function Setup2FAModal({ isOpen, onClose }: { isOpen: boolean; onClose: () => vo
 
     try {
       setLoading(true)
-      await api.post('/api/auth/2fa/verify', {
+      const response = await api.post('/api/2fa/confirm', {
         code: verifyCode
       })
-      
-      alert(t('2faEnabled'))
+
+      // Коды восстановления сервер отдаёт только один раз
+      setRecoveryCodes(response.data.recovery_codes)
+      setStep('codes')
+      setVerifyCode('')
+    } catch (err: any) {
+      setError(err.response?.data?.message || t('2faVerifyFailed'))
+    } finally {
+      setLoading(false)
+    }
+  }
+
+  const handleDisable = async (e: React.FormEvent) => {
+    e.preventDefault()
+    setError('')
+
+    // Код из приложения состоит из цифр, всё остальное — код восстановления
+    const code = verifyCode.trim()
+    try {
+      setLoading(true)
+      await api.post('/api/2fa/disable', {
+        password,
+        ...(/^\d{6}$/.test(code) ? { code } : { recovery_code: code }),
+      })
+
+      alert(t('2faDisabled'))
       onClose()
       setStep('info')
+      setPassword('')
       setVerifyCode('')
     } catch (err: any) {
-      setError(err.response?.data?.error || t('2faVerifyFailed'))
+      setError(err.response?.data?.message || t('2faVerifyFailed'))
     } finally {
       setLoading(false)
     }
@@ -1041,6 +1322,73 @@ function Setup2FAModal({ isOpen, onClose }: { isOpen: boolean; onClose: () => vo
                   </button>
                 </form>
               )}
+
+              {step === 'codes' && (
+                <div className="space-y-4">
+                  <p className="text-sm text-white/80">{t('2faRecoveryCodes')}</p>
+                  <div className="grid grid-cols-2 gap-2 bg-slate-700/50 border border-white/10 rounded-xl p-3">
+                    {recoveryCodes.map((code) => (
+                      <code key={code} className="text-sm text-accent text-center">{code}</code>
+                    ))}
+                  </div>
+                  <button
+                    onClick={() => navigator.clipboard.writeText(recoveryCodes.join('\n'))}
+                    className="w-full px-4 py-2 bg-white/5 hover:bg-white/10 rounded-xl transition-all"
+                  >
+                    {t('copy')}
+                  </button>
+                  <button
+                    onClick={() => {
+                      alert(t('2faEnabled'))
+                      onClose()
+                      setStep('info')
+                      setRecoveryCodes([])
+                    }}
+                    className="btn-primary w-full"
+                  >
+                    {t('continue')}
+                  </button>
+                </div>
+              )}
+
+              {step === 'disable' && (
+                <form onSubmit={handleDisable} className="space-y-4">
+                  <p className="text-sm text-white/80">{t('2faActive')}</p>
+                  {error && (
+                    <div className="bg-red-500/20 border border-red-500/50 rounded-xl p-3 text-sm text-red-400">
+                      {error}
+                    </div>
+                  )}
+                  <div>
+                    <label className="block text-sm font-medium mb-2">{t('currentPassword')}</label>
+                    <input
+                      type="password"
+                      value={password}
+                      onChange={(e) => setPassword(e.target.value)}
+                      className="input"
+                      required
+                    />
+                  </div>
+                  <div>
+                    <label className="block text-sm font-medium mb-2">{t('2faEnterCode')}</label>
+                    <input
+                      type="text"
+                      value={verifyCode}
+                      onChange={(e) => setVerifyCode(e.target.value)}
+                      className="input text-center tracking-widest"
+                      placeholder="000000"
+                      required
+                    />
+                  </div>
+                  <button
+                    type="submit"
+                    className="w-full px-4 py-2 bg-red-500/20 hover:bg-red-500/30 text-red-400 rounded-xl transition-all"
+                    disabled={loading}
+                  >
+                    {loading ? t('loading') : t('2faDisable')}
+                  </button>
+                </form>
+              )}
             </div>
           </motion.div>
         </motion.div>
@@ -1064,7 +1412,7 @@ function ActiveSessionsModal({ isOpen, onClose }: { isOpen: boolean; onClose: ()
   const loadSessions = async () => {
     try {
       setLoading(true)
-      const response = await api.get('/api/auth/sessions')
+      const response = await api.get('/api/sessions')
       setSessions(response.data || [])
     } catch (err) {
       console.error('Failed to load sessions:', err)
@@ -1077,13 +1425,24 @@ function ActiveSessionsModal({ isOpen, onClose }: { isOpen: boolean; onClose: ()
     if (!confirm(t('confirmRevokeSession'))) return
 
     try {
-      await api.delete(`/api/auth/sessions/${sessionId}`)
+      await api.delete(`/api/sessions/${sessionId}`)
       setSessions(sessions.filter(s => s.id !== sessionId))
     } catch (err) {
       alert(t('revokeSessionFailed'))
     }
   }
 
+  const handleRevokeOtherSessions = async () => {
+    if (!confirm(t('confirmRevokeOtherSessions'))) return
+
+    try {
+      await api.delete('/api/sessions')
+      setSessions(sessions.filter(s => s.current))
+    } catch (err) {
+      alert(t('revokeSessionFailed'))
+    }
+  }
+
   return (
     <AnimatePresence>
       {isOpen && (
@@ -1124,20 +1483,20 @@ function ActiveSessionsModal({ isOpen, onClose }: { isOpen: boolean; onClose: ()
                       <div className="flex-1">
                         <div className="flex items-center gap-2 mb-1">
                           <p className="font-medium">{session.device || t('unknownDevice')}</p>
-                          {session.is_current && (
+                          {session.current && (
                             <span className="text-xs bg-accent/20 text-accent px-2 py-0.5 rounded-full">
                               {t('currentSession')}
                             </span>
                           )}
                         </div>
                         <p className="text-sm text-white/60">
-                          {session.ip_address} • {session.location || t('unknownLocation')}
+                          {session.ip || t('unknownLocation')}
                         </p>
                         <p className="text-xs text-white/40 mt-1">
-                          {t('lastActive')}: {new Date(session.last_active).toLocaleString()}
+                          {t('lastActive')}: {new Date(session.last_seen_at).toLocaleString()}
                         </p>
                       </div>
-                      {!session.is_current && (
+                      {!session.current && (
                         <button
                           onClick={() => handleRevokeSession(session.id)}
                           className="btn-secondary text-sm text-red-400 hover:bg-red-500/20"
@@ -1147,6 +1506,14 @@ function ActiveSessionsModal({ isOpen, onClose }: { isOpen: boolean; onClose: ()
                       )}
                     </div>
                   ))}
+                  {sessions.some(s => !s.current) && (
+                    <button
+                      onClick={handleRevokeOtherSessions}
+                      className="btn-secondary text-sm text-red-400 hover:bg-red-500/20 w-full"
+                    >
+                      {t('revokeOtherSessions')}
+                    </button>
+                  )}
                 </div>
               )}
             </div>
@@ -70,6 +70,14 @@ export const translations = {
     statusDesc: 'Кто может видеть ваш статус',
     readReceipts: 'Отметки о прочтении',
     readReceiptsDesc: 'Показывать когда вы прочитали сообщения',
+    blockedUsers: 'Заблокированные',
+    blockedUsersDesc: 'Они не могут писать вам, видеть набор текста, прочтение и статус в сети и не найдут вас в поиске — как и вы их',
+    noBlockedUsers: 'Вы никого не заблокировали',
+    blockUser: 'Заблокировать',
+    unblockUser: 'Разблокировать',
+    blockUserConfirm: 'Заблокировать пользователя? Вы перестанете получать от него сообщения и видеть друг друга в сети',
+    blockFailed: 'Не удалось изменить блокировку',
+    cannotMessageBlocked: 'Нельзя написать этому пользователю',
     everyone: 'Все',
     contacts: 'Контакты',
     nobody: 'Никто',
@@ -147,6 +155,16 @@ export const translations = {
     passwordTooShort: 'Пароль должен содержать минимум 6 символов',
     passwordChanged: 'Пароль успешно изменен',
     passwordChangeFailed: 'Не удалось изменить пароль',
+    recoveryEmail: 'Почта для восстановления',
+    recoveryEmailDesc: 'На этот адрес придёт ссылка для сброса пароля, если вы его забудете',
+    emailSaved: 'Адрес сохранён',
+    emailSaveFailed: 'Не удалось сохранить адрес',
+    exportFailed: 'Не удалось экспортировать данные',
+    exportRateLimited: 'Экспорт можно запрашивать не чаще двух раз в час',
+    deleteAccountCode: 'Код 2FA или код восстановления, если 2FA включена',
+    deleteAccountConfirm: 'Удалить навсегда',
+    deleteAccountFailed: 'Не удалось удалить аккаунт',
+    accountDeletionScheduled: 'Аккаунт будет удалён через 14 дней. Войдите до этого, чтобы отменить удаление',
     loading: 'Загрузка...',
     continue: 'Продолжить',
     verify: 'Проверить',
@@ -161,6 +179,10 @@ export const translations = {
     '2faEnabled': '2FA успешно включена',
     '2faEnableFailed': 'Не удалось включить 2FA',
     '2faVerifyFailed': 'Неверный код',
+    '2faActive': 'Двухфакторная аутентификация включена. Чтобы отключить её, введите пароль и код из приложения или код восстановления.',
+    '2faRecoveryCodes': 'Сохраните коды восстановления в надёжном месте. Каждый из них позволяет войти один раз, если приложение недоступно. Больше они показаны не будут.',
+    '2faDisable': 'Отключить 2FA',
+    '2faDisabled': '2FA отключена',
     noActiveSessions: 'Нет активных сеансов',
     unknownDevice: 'Неизвестное устройство',
     unknownLocation: 'Неизвестное местоположение',
@@ -169,6 +191,8 @@ export const translations = {
     revoke: 'Отозвать',
     confirmRevokeSession: 'Вы уверены, что хотите завершить этот сеанс?',
     revokeSessionFailed: 'Не удалось завершить сеанс',
+    revokeOtherSessions: 'Завершить все другие сеансы',
+    confirmRevokeOtherSessions: 'Завершить все сеансы, кроме текущего?',
     
     // About
     aboutTitle: 'О проекте',
@@ -187,11 +211,11 @@ export const translations = {
     releaseDate: 'Дата релиза',
     stableVersion: 'Стабильная версия',
     exportData: 'Экспорт данных',
-    exportDataDesc: 'Скачать копию ваших данных',
+    exportDataDesc: 'Скачайте архив с профилем, сообщениями, реакциями и загруженными файлами',
     clearCache: 'Очистить кэш',
     clearCacheDesc: 'Освободить место на устройстве',
     deleteAccount: 'Удалить аккаунт',
-    deleteAccountDesc: 'Безвозвратно удалить ваш аккаунт',
+    deleteAccountDesc: 'Аккаунт будет удалён через 14 дней; войдите до этого, чтобы отменить удаление. Ваши сообщения в чужих чатах останутся без имени, файлы, а также ваши группы, каналы и серверы будут удалены',
     requestExport: 'Запросить экспорт',
     
     // Profile
@@ -371,6 +395,14 @@ export const translations = {
     statusDesc: 'Who can see your status',
     readReceipts: 'Read receipts',
     readReceiptsDesc: 'Show when you read messages',
+    blockedUsers: 'Blocked users',
+    blockedUsersDesc: 'They cannot message you, see your typing, reads or online status, or find you in search — and neither can you',
+    noBlockedUsers: 'You have not blocked anyone',
+    blockUser: 'Block',
+    unblockUser: 'Unblock',
+    blockUserConfirm: 'Block this user? You will stop getting their messages and seeing each other online',
+    blockFailed: 'Failed to update the block',
+    cannotMessageBlocked: 'You cannot message this user',
     everyone: 'Everyone',
     contacts: 'Contacts',
     nobody: 'Nobody',
@@ -448,6 +480,16 @@ export const translations = {
     passwordTooShort: 'Password must be at least 6 characters',
     passwordChanged: 'Password changed successfully',
     passwordChangeFailed: 'Failed to change password',
+    recoveryEmail: 'Recovery email',
+    recoveryEmailDesc: 'A password reset link is sent to this address if you forget your password',
+    emailSaved: 'Address saved',
+    emailSaveFailed: 'Failed to save address',
+    exportFailed: 'Failed to export data',
+    exportRateLimited: 'An export can be requested at most twice an hour',
+    deleteAccountCode: '2FA code or recovery code, if 2FA is enabled',
+    deleteAccountConfirm: 'Delete forever',
+    deleteAccountFailed: 'Failed to delete account',
+    accountDeletionScheduled: 'Your account will be deleted in 14 days. Log in before then to cancel',
     loading: 'Loading...',
     continue: 'Continue',
     verify: 'Verify',
@@ -462,6 +504,10 @@ export const translations = {
     '2faEnabled': '2FA enabled successfully',
     '2faEnableFailed': 'Failed to enable 2FA',
     '2faVerifyFailed': 'Invalid code',
+    '2faActive': 'Two-factor authentication is on. To turn it off, enter your password and a code from the app or a recovery code.',
+    '2faRecoveryCodes': 'Keep these recovery codes somewhere safe. Each one signs you in once if the app is unavailable. They will not be shown again.',
+    '2faDisable': 'Disable 2FA',
+    '2faDisabled': '2FA disabled',
     noActiveSessions: 'No active sessions',
     unknownDevice: 'Unknown device',
     unknownLocation: 'Unknown location',
@@ -470,6 +516,8 @@ export const translations = {
     revoke: 'Revoke',
     confirmRevokeSession: 'Are you sure you want to end this session?',
     revokeSessionFailed: 'Failed to revoke session',
+    revokeOtherSessions: 'End all other sessions',
+    confirmRevokeOtherSessions: 'End every session except this one?',
     
     // Data
     dataTitle: 'Data and storage',
@@ -478,11 +526,11 @@ export const translations = {
     stableVersion: 'Stable version',
     yearOfHorse: 'Year of the Red Fire Horse',
     exportData: 'Export data',
-    exportDataDesc: 'Download a copy of your data',
+    exportDataDesc: 'Download an archive of your profile, messages, reactions and uploaded files',
     clearCache: 'Clear cache',
     clearCacheDesc: 'Free up device space',
     deleteAccount: 'Delete account',
-    deleteAccountDesc: 'Permanently delete your account',
+    deleteAccountDesc: 'Your account is deleted after 14 days; log in before then to cancel. Your messages in other people\'s chats stay without your name; your files, and the groups, channels and servers you own, are deleted',
     requestExport: 'Request export',
     
     // Profile
@@ -662,6 +710,14 @@ export const translations = {
     statusDesc: 'Хто може бачити ваш статус',
     readReceipts: 'Відмітки про прочитання',
     readReceiptsDesc: 'Показувати коли ви прочитали повідомлення',
+    blockedUsers: 'Заблоковані',
+    blockedUsersDesc: 'Вони не можуть писати вам, бачити набір тексту, прочитання і статус у мережі та не знайдуть вас у пошуку — як і ви їх',
+    noBlockedUsers: 'Ви нікого не заблокували',
+    blockUser: 'Заблокувати',
+    unblockUser: 'Розблокувати',
+    blockUserConfirm: 'Заблокувати користувача? Ви перестанете отримувати від нього повідомлення і бачити одне одного в мережі',
+    blockFailed: 'Не вдалося змінити блокування',
+    cannotMessageBlocked: 'Не можна написати цьому користувачу',
     everyone: 'Всі',
     contacts: 'Контакти',
     nobody: 'Ніхто',
@@ -739,6 +795,16 @@ export const translations = {
     passwordTooShort: 'Пароль повинен містити мінімум 6 символів',
     passwordChanged: 'Пароль успішно змінено',
     passwordChangeFailed: 'Не вдалося змінити пароль',
+    recoveryEmail: 'Пошта для відновлення',
+    recoveryEmailDesc: 'На цю адресу надійде посилання для скидання пароля, якщо ви його забудете',
+    emailSaved: 'Адресу збережено',
+    emailSaveFailed: 'Не вдалося зберегти адресу',
+    exportFailed: 'Не вдалося експортувати дані',
+    exportRateLimited: 'Експорт можна запитувати не частіше двох разів на годину',
+    deleteAccountCode: 'Код 2FA або код відновлення, якщо 2FA увімкнено',
+    deleteAccountConfirm: 'Видалити назавжди',
+    deleteAccountFailed: 'Не вдалося видалити акаунт',
+    accountDeletionScheduled: 'Акаунт буде видалено через 14 днів. Увійдіть до цього, щоб скасувати видалення',
     loading: 'Завантаження...',
     continue: 'Продовжити',
     verify: 'Перевірити',
@@ -753,6 +819,10 @@ export const translations = {
     '2faEnabled': '2FA успішно увімкнено',
     '2faEnableFailed': 'Не вдалося увімкнути 2FA',
     '2faVerifyFailed': 'Невірний код',
+    '2faActive': 'Двофакторну автентифікацію увімкнено. Щоб вимкнути її, введіть пароль і код із додатка або код відновлення.',
+    '2faRecoveryCodes': 'Збережіть коди відновлення в надійному місці. Кожен із них дозволяє увійти один раз, якщо додаток недоступний. Більше вони показані не будуть.',
+    '2faDisable': 'Вимкнути 2FA',
+    '2faDisabled': '2FA вимкнено',
     noActiveSessions: 'Немає активних сеансів',
     unknownDevice: 'Невідомий пристрій',
     unknownLocation: 'Невідоме місцезнаходження',
@@ -761,6 +831,8 @@ export const translations = {
     revoke: 'Відкликати',
     confirmRevokeSession: 'Ви впевнені, що хочете завершити цей сеанс?',
     revokeSessionFailed: 'Не вдалося завершити сеанс',
+    revokeOtherSessions: 'Завершити всі інші сеанси',
+    confirmRevokeOtherSessions: 'Завершити всі сеанси, крім поточного?',
     
     // Data
     dataTitle: 'Дані та сховище',
@@ -769,11 +841,11 @@ export const translations = {
     stableVersion: 'Стабільна версія',
     yearOfHorse: 'Рік Червоного Вогняного Коня',
     exportData: 'Експорт даних',
-    exportDataDesc: 'Завантажити копію ваших даних',
+    exportDataDesc: 'Завантажте архів із профілем, повідомленнями, реакціями та завантаженими файлами',
     clearCache: 'Очистити кеш',
     clearCacheDesc: 'Звільнити місце на пристрої',
     deleteAccount: 'Видалити акаунт',
-    deleteAccountDesc: 'Безповоротно видалити ваш акаунт',
+    deleteAccountDesc: 'Акаунт буде видалено через 14 днів; увійдіть до цього, щоб скасувати видалення. Ваші повідомлення в чужих чатах залишаться без імені, файли, а також ваші групи, канали й сервери буде видалено',
     requestExport: 'Запросити експорт',
     
     // Profile
@@ -935,6 +1007,14 @@ export const translations = {
     statusDesc: '谁可以看到您的状态',
     readReceipts: '已读回执',
     readReceiptsDesc: '显示您何时阅读消息',
+    blockedUsers: '已屏蔽的用户',
+    blockedUsersDesc: '他们无法给您发消息、看到您的输入、已读或在线状态，也无法在搜索中找到您——您也一样',
+    noBlockedUsers: '您没有屏蔽任何人',
+    blockUser: '屏蔽',
+    unblockUser: '取消屏蔽',
+    blockUserConfirm: '屏蔽此用户？您将不再收到其消息，双方也看不到彼此的在线状态',
+    blockFailed: '无法更改屏蔽',
+    cannotMessageBlocked: '无法给此用户发消息',
     everyone: '所有人',
     contacts: '联系人',
     nobody: '无人',
@@ -1012,6 +1092,16 @@ export const translations = {
     passwordTooShort: '密码至少需要 6 个字符',
     passwordChanged: '密码更改成功',
     passwordChangeFailed: '密码更改失败',
+    recoveryEmail: '恢复邮箱',
+    recoveryEmailDesc: '如果您忘记密码，重置链接将发送到此地址',
+    emailSaved: '地址已保存',
+    emailSaveFailed: '保存地址失败',
+    exportFailed: '导出数据失败',
+    exportRateLimited: '每小时最多只能请求两次导出',
+    deleteAccountCode: '如已启用双重验证，请输入验证码或恢复码',
+    deleteAccountConfirm: '永久删除',
+    deleteAccountFailed: '删除账户失败',
+    accountDeletionScheduled: '账户将在 14 天后删除。在此之前登录即可取消',
     loading: '加载中...',
     continue: '继续',
     verify: '验证',
@@ -1026,6 +1116,10 @@ export const translations = {
     '2faEnabled': '2FA 启用成功',
     '2faEnableFailed': '2FA 启用失败',
     '2faVerifyFailed': '代码无效',
+    '2faActive': '双重验证已开启。要关闭它，请输入密码以及应用中的验证码或恢复码。',
+    '2faRecoveryCodes': '请将这些恢复码保存在安全的地方。无法使用应用时，每个恢复码可登录一次。它们不会再次显示。',
+    '2faDisable': '关闭双重验证',
+    '2faDisabled': '双重验证已关闭',
     noActiveSessions: '没有活动会话',
     unknownDevice: '未知设备',
     unknownLocation: '未知位置',
@@ -1034,6 +1128,8 @@ export const translations = {
     revoke: '撤销',
     confirmRevokeSession: '您确定要结束此会话吗？',
     revokeSessionFailed: '撤销会话失败',
+    revokeOtherSessions: '结束所有其他会话',
+    confirmRevokeOtherSessions: '结束除当前会话外的所有会话？',
     
     // Data
     dataTitle: '数据和存储',
@@ -1042,11 +1138,11 @@ export const translations = {
     stableVersion: '稳定版本',
     yearOfHorse: '红火马年',
     exportData: '导出数据',
-    exportDataDesc: '下载您的数据副本',
+    exportDataDesc: '下载包含个人资料、消息、表情回应和上传文件的压缩包',
     clearCache: '清除缓存',
     clearCacheDesc: '释放设备空间',
     deleteAccount: '删除账户',
-    deleteAccountDesc: '永久删除您的账户',
+    deleteAccountDesc: '账户将在 14 天后删除；在此之前登录即可取消。您在他人聊天中的消息将匿名保留，您的文件以及您拥有的群组、频道和服务器将被删除',
     requestExport: '请求导出',
     
     // Profile
@@ -1208,6 +1304,14 @@ export const translations = {
     statusDesc: 'ステータスを見ることができる人',
     readReceipts: '既読通知',
     readReceiptsDesc: 'メッセージを読んだことを表示',
+    blockedUsers: 'ブロック中のユーザー',
+    blockedUsersDesc: '相手はあなたにメッセージを送れず、入力中・既読・オンライン状態も見えず、検索でも見つけられません。あなたも同様です',
+    noBlockedUsers: 'ブロックしているユーザーはいません',
+    blockUser: 'ブロック',
+    unblockUser: 'ブロック解除',
+    blockUserConfirm: 'このユーザーをブロックしますか？メッセージが届かなくなり、お互いのオンライン状態も見えなくなります',
+    blockFailed: 'ブロックを変更できませんでした',
+    cannotMessageBlocked: 'このユーザーにはメッセージを送れません',
     everyone: '全員',
     contacts: '連絡先',
     nobody: '誰にも見せない',
@@ -1285,6 +1389,16 @@ export const translations = {
     passwordTooShort: 'パスワードは6文字以上である必要があります',
     passwordChanged: 'パスワードが正常に変更されました',
     passwordChangeFailed: 'パスワードの変更に失敗しました',
+    recoveryEmail: '復旧用メールアドレス',
+    recoveryEmailDesc: 'パスワードを忘れた場合、このアドレスにリセット用リンクが送信されます',
+    emailSaved: 'アドレスを保存しました',
+    emailSaveFailed: 'アドレスを保存できませんでした',
+    exportFailed: 'データをエクスポートできませんでした',
+    exportRateLimited: 'エクスポートは1時間に2回までです',
+    deleteAccountCode: '二段階認証が有効な場合は認証コードまたはリカバリーコード',
+    deleteAccountConfirm: '完全に削除',
+    deleteAccountFailed: 'アカウントを削除できませんでした',
+    accountDeletionScheduled: 'アカウントは14日後に削除されます。それまでにログインすると取り消せます',
     loading: '読み込み中...',
     continue: '続ける',
     verify: '確認',
@@ -1299,6 +1413,10 @@ export const translations = {
     '2faEnabled': '2FAが正常に有効化されました',
     '2faEnableFailed': '2FAの有効化に失敗しました',
     '2faVerifyFailed': '無効なコード',
+    '2faActive': '二段階認証は有効です。無効にするには、パスワードとアプリのコードまたはリカバリーコードを入力してください。',
+    '2faRecoveryCodes': 'これらのリカバリーコードを安全な場所に保管してください。アプリが使えないとき、各コードで一度だけログインできます。再表示はされません。',
+    '2faDisable': '二段階認証を無効にする',
+    '2faDisabled': '二段階認証を無効にしました',
     noActiveSessions: 'アクティブなセッションはありません',
     unknownDevice: '不明なデバイス',
     unknownLocation: '不明な場所',
@@ -1307,6 +1425,8 @@ export const translations = {
     revoke: '取り消す',
     confirmRevokeSession: 'このセッションを終了してもよろしいですか？',
     revokeSessionFailed: 'セッションの取り消しに失敗しました',
+    revokeOtherSessions: '他のすべてのセッションを終了',
+    confirmRevokeOtherSessions: '現在のセッション以外をすべて終了しますか？',
     
     // Data
     dataTitle: 'データとストレージ',
@@ -1315,11 +1435,11 @@ export const translations = {
     stableVersion: '安定版',
     yearOfHorse: '赤い火の馬の年',
     exportData: 'データをエクスポート',
-    exportDataDesc: 'データのコピーをダウンロード',
+    exportDataDesc: 'プロフィール、メッセージ、リアクション、アップロードしたファイルのアーカイブをダウンロードします',
     clearCache: 'キャッシュをクリア',
     clearCacheDesc: 'デバイスの空き容量を増やす',
     deleteAccount: 'アカウントを削除',
-    deleteAccountDesc: 'アカウントを完全に削除',
+    deleteAccountDesc: 'アカウントは14日後に削除されます。それまでにログインすると取り消せます。他の人のチャットにあるメッセージは名前なしで残り、ファイルと所有するグループ、チャンネル、サーバーは削除されます',
     requestExport: 'エクスポートをリクエスト',
     
     // Profile
@@ -1481,6 +1601,14 @@ export const translations = {
     statusDesc: 'Wer kann Ihren Status sehen',
     readReceipts: 'Lesebestätigungen',
     readReceiptsDesc: 'Anzeigen, wann Sie Nachrichten gelesen haben',
+    blockedUsers: 'Blockierte Nutzer',
+    blockedUsersDesc: 'Sie können Ihnen nicht schreiben, Ihr Tippen, Lesen oder Online-Status nicht sehen und Sie nicht in der Suche finden — und Sie sie ebenso wenig',
+    noBlockedUsers: 'Sie haben niemanden blockiert',
+    blockUser: 'Blockieren',
+    unblockUser: 'Entsperren',
+    blockUserConfirm: 'Diesen Nutzer blockieren? Sie erhalten keine Nachrichten mehr von ihm und sehen einander nicht mehr online',
+    blockFailed: 'Blockierung konnte nicht geändert werden',
+    cannotMessageBlocked: 'Sie können diesem Nutzer nicht schreiben',
     everyone: 'Jeder',
     contacts: 'Kontakte',
     nobody: 'Niemand',
@@ -1558,6 +1686,16 @@ export const translations = {
     passwordTooShort: 'Passwort muss mindestens 6 Zeichen lang sein',
     passwordChanged: 'Passwort erfolgreich geändert',
     passwordChangeFailed: 'Passwort konnte nicht geändert werden',
+    recoveryEmail: 'Wiederherstellungs-E-Mail',
+    recoveryEmailDesc: 'An diese Adresse wird ein Link zum Zurücksetzen gesendet, falls du dein Passwort vergisst',
+    emailSaved: 'Adresse gespeichert',
+    emailSaveFailed: 'Adresse konnte nicht gespeichert werden',
+    exportFailed: 'Daten konnten nicht exportiert werden',
+    exportRateLimited: 'Ein Export kann höchstens zweimal pro Stunde angefordert werden',
+    deleteAccountCode: '2FA-Code oder Wiederherstellungscode, falls 2FA aktiv ist',
+    deleteAccountConfirm: 'Endgültig löschen',
+    deleteAccountFailed: 'Konto konnte nicht gelöscht werden',
+    accountDeletionScheduled: 'Ihr Konto wird in 14 Tagen gelöscht. Melden Sie sich vorher an, um das abzubrechen',
     loading: 'Laden...',
     continue: 'Weiter',
     verify: 'Überprüfen',
@@ -1572,6 +1710,10 @@ export const translations = {
     '2faEnabled': '2FA erfolgreich aktiviert',
     '2faEnableFailed': '2FA konnte nicht aktiviert werden',
     '2faVerifyFailed': 'Ungültiger Code',
+    '2faActive': 'Die Zwei-Faktor-Authentifizierung ist aktiv. Zum Deaktivieren gib dein Passwort und einen Code aus der App oder einen Wiederherstellungscode ein.',
+    '2faRecoveryCodes': 'Bewahre diese Wiederherstellungscodes sicher auf. Mit jedem kannst du dich einmal anmelden, wenn die App nicht verfügbar ist. Sie werden nicht erneut angezeigt.',
+    '2faDisable': '2FA deaktivieren',
+    '2faDisabled': '2FA deaktiviert',
     noActiveSessions: 'Keine aktiven Sitzungen',
     unknownDevice: 'Unbekanntes Gerät',
     unknownLocation: 'Unbekannter Standort',
@@ -1580,6 +1722,8 @@ export const translations = {
     revoke: 'Widerrufen',
     confirmRevokeSession: 'Sind Sie sicher, dass Sie diese Sitzung beenden möchten?',
     revokeSessionFailed: 'Sitzung konnte nicht widerrufen werden',
+    revokeOtherSessions: 'Alle anderen Sitzungen beenden',
+    confirmRevokeOtherSessions: 'Alle Sitzungen außer dieser beenden?',
     
     // Data
     dataTitle: 'Daten und Speicher',
@@ -1588,11 +1732,11 @@ export const translations = {
     stableVersion: 'Stabile Version',
     yearOfHorse: 'Jahr des Roten Feuerpferdes',
     exportData: 'Daten exportieren',
-    exportDataDesc: 'Eine Kopie Ihrer Daten herunterladen',
+    exportDataDesc: 'Laden Sie ein Archiv mit Profil, Nachrichten, Reaktionen und hochgeladenen Dateien herunter',
     clearCache: 'Cache leeren',
     clearCacheDesc: 'Gerätespeicher freigeben',
     deleteAccount: 'Konto löschen',
-    deleteAccountDesc: 'Ihr Konto dauerhaft löschen',
+    deleteAccountDesc: 'Ihr Konto wird nach 14 Tagen gelöscht; melden Sie sich vorher an, um das abzubrechen. Ihre Nachrichten in fremden Chats bleiben ohne Namen erhalten, Ihre Dateien sowie Ihre Gruppen, Kanäle und Server werden gelöscht',
     requestExport: 'Export anfordern',
     
     // Profile
@@ -1754,6 +1898,14 @@ export const translations = {
     statusDesc: 'Хто можа бачыць ваш статус',
     readReceipts: 'Адзнакі пра прачытанне',
     readReceiptsDesc: 'Паказваць калі вы прачыталі паведамленні',
+    blockedUsers: 'Заблакаваныя',
+    blockedUsersDesc: 'Яны не могуць пісаць вам, бачыць набор тэксту, прачытанне і статус у сетцы і не знойдуць вас у пошуку — як і вы іх',
+    noBlockedUsers: 'Вы нікога не заблакавалі',
+    blockUser: 'Заблакаваць',
+    unblockUser: 'Разблакаваць',
+    blockUserConfirm: 'Заблакаваць карыстальніка? Вы перастанеце атрымліваць ад яго паведамленні і бачыць адно аднаго ў сетцы',
+    blockFailed: 'Не ўдалося змяніць блакаванне',
+    cannotMessageBlocked: 'Нельга напісаць гэтаму карыстальніку',
     everyone: 'Усе',
     contacts: 'Кантакты',
     nobody: 'Ніхто',
@@ -1831,6 +1983,16 @@ export const translations = {
     passwordTooShort: 'Пароль павінен утрымліваць мінімум 6 сімвалаў',
     passwordChanged: 'Пароль паспяхова зменены',
     passwordChangeFailed: 'Не ўдалося змяніць пароль',
+    recoveryEmail: 'Пошта для аднаўлення',
+    recoveryEmailDesc: 'На гэты адрас прыйдзе спасылка для скіду пароля, калі вы яго забудзеце',
+    emailSaved: 'Адрас захаваны',
+    emailSaveFailed: 'Не ўдалося захаваць адрас',
+    exportFailed: 'Не ўдалося экспартаваць даныя',
+    exportRateLimited: 'Экспарт можна запытваць не часцей за два разы на гадзіну',
+    deleteAccountCode: 'Код 2FA або код аднаўлення, калі 2FA уключана',
+    deleteAccountConfirm: 'Выдаліць назаўсёды',
+    deleteAccountFailed: 'Не ўдалося выдаліць акаўнт',
+    accountDeletionScheduled: 'Акаўнт будзе выдалены праз 14 дзён. Увайдзіце да гэтага, каб адмяніць выдаленне',
     loading: 'Загрузка...',
     continue: 'Працягнуць',
     verify: 'Праверыць',
@@ -1845,6 +2007,10 @@ export const translations = {
     '2faEnabled': '2FA паспяхова ўключана',
     '2faEnableFailed': 'Не ўдалося ўключыць 2FA',
     '2faVerifyFailed': 'Няправільны код',
+    '2faActive': 'Двухфактарная аўтэнтыфікацыя ўключана. Каб адключыць яе, увядзіце пароль і код з праграмы або код аднаўлення.',
+    '2faRecoveryCodes': 'Захавайце коды аднаўлення ў надзейным месцы. Кожны з іх дазваляе ўвайсці адзін раз, калі праграма недаступная. Больш яны паказаны не будуць.',
+    '2faDisable': 'Адключыць 2FA',
+    '2faDisabled': '2FA адключана',
     noActiveSessions: 'Няма актыўных сеансаў',
     unknownDevice: 'Невядомая прылада',
     unknownLocation: 'Невядомае месцазнаходжанне',
@@ -1853,6 +2019,8 @@ export const translations = {
     revoke: 'Адклікаць',
     confirmRevokeSession: 'Вы ўпэўнены, што хочаце завяршыць гэты сеанс?',
     revokeSessionFailed: 'Не ўдалося завяршыць сеанс',
+    revokeOtherSessions: 'Завяршыць усе іншыя сеансы',
+    confirmRevokeOtherSessions: 'Завяршыць усе сеансы, акрамя бягучага?',
     
     // Data
     dataTitle: 'Даныя і сховішча',
@@ -1861,11 +2029,11 @@ export const translations = {
     stableVersion: 'Стабільная версія',
     yearOfHorse: 'Год Чырвонага Агністага Каня',
     exportData: 'Экспарт даных',
-    exportDataDesc: 'Спампаваць копію вашых даных',
+    exportDataDesc: 'Спампуйце архіў з профілем, паведамленнямі, рэакцыямі і загружанымі файламі',
     clearCache: 'Ачысціць кэш',
     clearCacheDesc: 'Вызваліць месца на прыладзе',
     deleteAccount: 'Выдаліць акаўнт',
-    deleteAccountDesc: 'Бясповаратна выдаліць ваш акаўнт',
+    deleteAccountDesc: 'Акаўнт будзе выдалены праз 14 дзён; увайдзіце да гэтага, каб адмяніць выдаленне. Вашы паведамленні ў чужых чатах застануцца без імя, файлы, а таксама вашы групы, каналы і серверы будуць выдалены',
     requestExport: 'Запытаць экспарт',
     
     // Profile
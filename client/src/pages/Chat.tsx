@@ -1,6 +1,6 @@
 import { useState, useEffect, useRef, ReactNode, useCallback, useMemo } from 'react'
 import { motion, AnimatePresence } from 'framer-motion'
-import { Settings, LogOut, Search, Phone, Video, Paperclip, Smile, Send, Reply, Edit, Forward } from 'lucide-react'
+import { Settings, LogOut, Search, Phone, Video, Paperclip, Smile, Send, Reply, Edit, Forward, Ban } from 'lucide-react'
 import { useAuthStore } from '../store/authStore'
 import { useLayoutStore, LayoutComponent } from '../store/layoutStore'
 import { useLanguageStore } from '../store/languageStore'
@@ -81,6 +81,7 @@ export default function Chat() {
   const messageRefs = useRef<Map<string, HTMLDivElement>>(new Map())
   const [isEmojiPickerOpen, setIsEmojiPickerOpen] = useState(false)
   const [typingUsers, setTypingUsers] = useState<Set<string>>(new Set())
+  const [blockedIds, setBlockedIds] = useState<Set<string>>(new Set())
   const { user } = useAuthStore()
   const { language } = useLanguageStore()
   const { settings: notificationSettings } = useNotificationStore()
@@ -211,13 +212,38 @@ export default function Chat() {
         }))
       }
 
+      // Блокировки меняются и с других устройств
+      const handleUserBlocked = (eventData: any) => {
+        const data = eventData.data || eventData
+        setBlockedIds(prev => new Set(prev).add(data.user_id))
+      }
+
+      const handleUserUnblocked = (eventData: any) => {
+        const data = eventData.data || eventData
+        setBlockedIds(prev => {
+          const newSet = new Set(prev)
+          newSet.delete(data.user_id)
+          return newSet
+        })
+      }
+
+      // Сервер отклонил сообщение — убираем его черновик из чата
+      const handleMessageError = (data: any) => {
+        setMessages(prev => prev.filter(m => !m.isTemp))
+        alert(data.code === 'blocked' ? t('cannotMessageBlocked') : data.error)
+      }
+
       wsService.onNewMessage(handleNewMessage)
       wsService.onTypingStart(handleTypingStart)
       wsService.onTypingStop(handleTypingStop)
       wsService.on('message_deleted', handleGlobalMessageDeleted)
       wsService.on('reaction_added', handleReactionAdded)
       wsService.on('reaction_removed', handleReactionRemoved)
+      wsService.on('user_blocked', handleUserBlocked)
+      wsService.on('user_unblocked', handleUserUnblocked)
+      wsService.on('message_error', handleMessageError)
       loadRecentChats()
+      loadBlocked()
 
       return () => {
         wsService.off('new_message', handleNewMessage)
@@ -226,10 +252,14 @@ export default function Chat() {
         wsService.off('message_deleted', handleGlobalMessageDeleted)
         wsService.off('reaction_added', handleReactionAdded)
         wsService.off('reaction_removed', handleReactionRemoved)
+        wsService.off('user_blocked', handleUserBlocked)
+        wsService.off('user_unblocked', handleUserUnblocked)
+        wsService.off('message_error', handleMessageError)
         // Не отключаем WebSocket при размонтировании, только при логауте
       }
     }
-  }, [token, user?.id])
+    // Токен обновляется каждые несколько минут — переподписываться из-за этого не нужно
+  }, [user?.id])
 
   useEffect(() => {
     if (searchQuery.length >= 2) {
@@ -248,6 +278,38 @@ export default function Chat() {
     }
   }
 
+  const loadBlocked = async () => {
+    try {
+      const response = await api.get('/api/blocks')
+      setBlockedIds(new Set((response.data || []).map((u: User) => u.id)))
+    } catch (error) {
+      console.error('Failed to load blocked users:', error)
+    }
+  }
+
+  // Заблокированный не может писать, видеть набор текста, прочтение и статус в сети
+  const toggleBlock = async (target: User) => {
+    const blocked = blockedIds.has(target.id)
+    if (!blocked && !confirm(t('blockUserConfirm'))) return
+
+    try {
+      if (blocked) {
+        await api.delete(`/api/blocks/${target.id}`)
+        setBlockedIds(prev => {
+          const newSet = new Set(prev)
+          newSet.delete(target.id)
+          return newSet
+        })
+      } else {
+        await api.post(`/api/blocks/${target.id}`)
+        setBlockedIds(prev => new Set(prev).add(target.id))
+      }
+    } catch (error) {
+      console.error('Failed to update block:', error)
+      alert(t('blockFailed'))
+    }
+  }
+
   const searchUsers = async () => {
     try {
       const response = await api.get(`/api/users/search?q=${searchQuery}`)
@@ -270,7 +332,7 @@ export default function Chat() {
   const loadMessages = async (chatId: string) => {
     try {
       const response = await api.get(`/api/messages/${chatId}`)
-      setMessages(response.data || [])
+      setMessages(response.data?.messages || [])
       
       // Mark messages as read when opening chat
       if (wsService.isConnected()) {
@@ -452,8 +514,10 @@ export default function Chat() {
     messagesEndRef.current?.scrollIntoView({ behavior: 'smooth' })
   }, [messages])
 
-  const handleLogout = () => {
+  const handleLogout = async () => {
     wsService.disconnect()
+    // Завершаем сессию на сервере, чтобы refresh token больше не действовал
+    await api.post('/api/logout').catch(() => {})
     logout()
   }
 
@@ -846,6 +910,13 @@ export default function Chat() {
           >
             <Video className="w-5 h-5" />
           </button>
+          <button 
+            className={`p-2 glass-hover rounded-xl transition-all hover:scale-110 ${blockedIds.has(selectedChat.id) ? 'bg-red-500/20 text-red-400' : ''}`}
+            onClick={() => toggleBlock(selectedChat)}
+            title={blockedIds.has(selectedChat.id) ? t('unblockUser') : t('blockUser')}
+          >
+            <Ban className="w-5 h-5" />
+          </button>
         </div>
         </motion.div>
         
@@ -1102,7 +1173,7 @@ export default function Chat() {
                           
                           {/* Image if present */}
                           {msg.file_url && msg.message_type === 'image' && (
-                            <MessageImage url={msg.file_url} />
+                            <MessageImage url={msg.file_url} attachment={msg.attachments?.[0]} />
                           )}
 
                           {/* Text and time */}
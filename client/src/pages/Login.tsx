@@ -11,6 +11,10 @@ export default function Login() {
   const [password, setPassword] = useState('')
   const [error, setError] = useState('')
   const [loading, setLoading] = useState(false)
+  // Второй шаг входа, если включена двухфакторная аутентификация
+  const [challengeToken, setChallengeToken] = useState('')
+  const [code, setCode] = useState('')
+  const [useRecoveryCode, setUseRecoveryCode] = useState(false)
   const navigate = useNavigate()
   const setAuth = useAuthStore((state) => state.setAuth)
 
@@ -20,11 +24,29 @@ export default function Login() {
     setLoading(true)
 
     try {
-      const response = await api.post('/api/login', { username, password })
-      const { token, user } = response.data
-      setAuth(user, token)
+      const response = challengeToken
+        ? await api.post('/api/login/2fa', {
+            challenge_token: challengeToken,
+            ...(useRecoveryCode ? { recovery_code: code } : { code }),
+          })
+        : await api.post('/api/login', { username, password })
+      if (response.data.two_factor_required) {
+        setChallengeToken(response.data.challenge_token)
+        return
+      }
+      const { token, refresh_token, user, account_restored } = response.data
+      setAuth(user, token, refresh_token)
+      // Вход в течение льготного периода отменяет удаление аккаунта
+      if (account_restored) {
+        alert('С возвращением! Удаление аккаунта отменено')
+      }
       navigate('/chat')
     } catch (err: any) {
+      // Время на ввод кода истекло — начинаем вход заново
+      if (err.response?.data?.error === 'INVALID_CHALLENGE') {
+        setChallengeToken('')
+        setCode('')
+      }
       // Обработка различных типов ошибок
       if (err.response?.data?.message) {
         // Сообщение от сервера на русском
@@ -33,12 +55,14 @@ export default function Login() {
         // Код ошибки от сервера
         const errorCode = err.response.data.error
         const errorMessages: Record<string, string> = {
-          'USER_NOT_FOUND': 'Пользователь с таким именем не найден',
-          'INVALID_PASSWORD': 'Неверный пароль',
           'INVALID_CREDENTIALS': 'Неверное имя пользователя или пароль',
+          'INVALID_TWO_FACTOR_CODE': 'Неверный код',
+          'TWO_FACTOR_LOCKED': 'Слишком много попыток. Попробуйте позже',
+          'TOO_MANY_ATTEMPTS': 'Слишком много неудачных попыток входа. Попробуйте позже',
+          'RATE_LIMITED': 'Слишком много запросов. Попробуйте позже',
         }
         setError(errorMessages[errorCode] || 'Ошибка входа')
-      } else if (err.response?.status === 401) {
+      } else if (err.response?.status === 401 && !challengeToken) {
         setError('Неверное имя пользователя или пароль')
       } else if (err.code === 'ERR_NETWORK') {
         setError('Ошибка подключения к серверу. Проверьте интернет-соединение')
@@ -81,31 +105,64 @@ export default function Login() {
             Persona
           </h1>
           <p className="text-center text-white/60 mb-8">
-            Войдите в свой аккаунт
+            {challengeToken
+              ? useRecoveryCode
+                ? 'Введите один из кодов восстановления'
+                : 'Введите код из приложения-аутентификатора'
+              : 'Войдите в свой аккаунт'}
           </p>
 
           <form onSubmit={handleSubmit} className="space-y-4">
-            <div>
-              <input
-                type="text"
-                placeholder="Имя пользователя"
-                value={username}
-                onChange={(e) => setUsername(e.target.value)}
-                className="input"
-                required
-              />
-            </div>
+            {challengeToken ? (
+              <div>
+                <input
+                  type="text"
+                  inputMode={useRecoveryCode ? 'text' : 'numeric'}
+                  autoComplete="one-time-code"
+                  placeholder={useRecoveryCode ? 'XXXX-XXXX-XXXX' : '000000'}
+                  value={code}
+                  onChange={(e) => setCode(e.target.value)}
+                  className="input text-center tracking-widest"
+                  autoFocus
+                  required
+                />
+                <button
+                  type="button"
+                  onClick={() => {
+                    setUseRecoveryCode(!useRecoveryCode)
+                    setCode('')
+                    setError('')
+                  }}
+                  className="mt-2 text-sm text-cyan-400 hover:text-cyan-300 transition-colors"
+                >
+                  {useRecoveryCode ? 'Ввести код из приложения' : 'Нет доступа к приложению?'}
+                </button>
+              </div>
+            ) : (
+              <>
+                <div>
+                  <input
+                    type="text"
+                    placeholder="Имя пользователя"
+                    value={username}
+                    onChange={(e) => setUsername(e.target.value)}
+                    className="input"
+                    required
+                  />
+                </div>
 
-            <div>
-              <input
-                type="password"
-                placeholder="Пароль"
-                value={password}
-                onChange={(e) => setPassword(e.target.value)}
-                className="input"
-                required
-              />
-            </div>
+                <div>
+                  <input
+                    type="password"
+                    placeholder="Пароль"
+                    value={password}
+                    onChange={(e) => setPassword(e.target.value)}
+                    className="input"
+                    required
+                  />
+                </div>
+              </>
+            )}
 
             {error && (
               <motion.div
@@ -137,7 +194,13 @@ export default function Login() {
             </button>
           </form>
 
-          <div className="mt-6 text-center">
+          <div className="mt-6 text-center space-y-2">
+            <Link
+              to="/reset-password"
+              className="block text-sm text-cyan-400 hover:text-cyan-300 transition-colors"
+            >
+              Забыли пароль?
+            </Link>
             <p className="text-white/60">
               Нет аккаунта?{' '}
               <Link
@@ -46,8 +46,8 @@ export default function Register() {
       // Автоматический вход после регистрации
       try {
         const loginResponse = await api.post('/api/login', { username, password })
-        const { token, user } = loginResponse.data
-        setAuth(user, token)
+        const { token, refresh_token, user } = loginResponse.data
+        setAuth(user, token, refresh_token)
         navigate('/chat')
       } catch (loginErr) {
         // Если автовход не удался, переходим на страницу входа
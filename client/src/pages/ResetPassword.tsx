@@ -0,0 +1,183 @@
+import { useState, FormEvent } from 'react'
+import { Link, useSearchParams } from 'react-router-dom'
+import { motion } from 'framer-motion'
+import { KeyRound } from 'lucide-react'
+import Logo from '../components/Logo'
+import api from '../services/api'
+
+// Сброс пароля: запрос ссылки на почту, новый пароль по ссылке из письма
+// или по коду восстановления, если почты у аккаунта нет
+export default function ResetPassword() {
+  const [searchParams] = useSearchParams()
+  const token = searchParams.get('token') || ''
+  const [mode, setMode] = useState<'email' | 'recovery'>('email')
+  const [login, setLogin] = useState('')
+  const [recoveryCode, setRecoveryCode] = useState('')
+  const [password, setPassword] = useState('')
+  const [confirmPassword, setConfirmPassword] = useState('')
+  const [error, setError] = useState('')
+  const [message, setMessage] = useState('')
+  const [done, setDone] = useState(false)
+  const [loading, setLoading] = useState(false)
+
+  // Новый пароль задаётся по ссылке или по коду восстановления
+  const settingPassword = token !== '' || mode === 'recovery'
+
+  const handleSubmit = async (e: FormEvent<HTMLFormElement>) => {
+    e.preventDefault()
+    setError('')
+
+    if (settingPassword && password !== confirmPassword) {
+      setError('Пароли не совпадают')
+      return
+    }
+
+    setLoading(true)
+    try {
+      if (!settingPassword) {
+        const response = await api.post('/api/password/forgot', { login })
+        setMessage(response.data.message)
+      } else {
+        await api.post('/api/password/reset', token
+          ? { token, new_password: password }
+          : { username: login, recovery_code: recoveryCode, new_password: password })
+        setDone(true)
+      }
+    } catch (err: any) {
+      if (err.response?.data?.message) {
+        setError(err.response.data.message)
+      } else if (err.code === 'ERR_NETWORK') {
+        setError('Ошибка подключения к серверу. Проверьте интернет-соединение')
+      } else {
+        setError('Произошла ошибка. Попробуйте позже')
+      }
+    } finally {
+      setLoading(false)
+    }
+  }
+
+  return (
+    <div className="min-h-screen flex items-center justify-center p-4">
+      <motion.div
+        initial={{ opacity: 0, y: 20 }}
+        animate={{ opacity: 1, y: 0 }}
+        className="w-full max-w-md relative z-10"
+      >
+        <div className="card">
+          <div className="flex justify-center mb-8">
+            <Logo size="md" animated />
+          </div>
+
+          <h1 className="text-3xl font-bold text-center mb-2 text-accent">
+            Сброс пароля
+          </h1>
+          <p className="text-center text-white/60 mb-8">
+            {done
+              ? 'Пароль изменён. Все сеансы завершены — войдите с новым паролем'
+              : token
+                ? 'Придумайте новый пароль'
+                : mode === 'recovery'
+                  ? 'Введите имя пользователя и один из кодов восстановления'
+                  : 'Введите имя пользователя или адрес почты, указанный в настройках'}
+          </p>
+
+          {!done && !message && (
+            <form onSubmit={handleSubmit} className="space-y-4">
+              {!token && (
+                <input
+                  type="text"
+                  placeholder={mode === 'recovery' ? 'Имя пользователя' : 'Имя пользователя или почта'}
+                  value={login}
+                  onChange={(e) => setLogin(e.target.value)}
+                  className="input"
+                  required
+                />
+              )}
+
+              {!token && mode === 'recovery' && (
+                <input
+                  type="text"
+                  placeholder="XXXX-XXXX-XXXX"
+                  value={recoveryCode}
+                  onChange={(e) => setRecoveryCode(e.target.value)}
+                  className="input text-center tracking-widest"
+                  required
+                />
+              )}
+
+              {settingPassword && (
+                <>
+                  <input
+                    type="password"
+                    placeholder="Новый пароль"
+                    value={password}
+                    onChange={(e) => setPassword(e.target.value)}
+                    className="input"
+                    minLength={6}
+                    required
+                  />
+                  <input
+                    type="password"
+                    placeholder="Повторите пароль"
+                    value={confirmPassword}
+                    onChange={(e) => setConfirmPassword(e.target.value)}
+                    className="input"
+                    minLength={6}
+                    required
+                  />
+                </>
+              )}
+
+              {error && (
+                <motion.div
+                  initial={{ opacity: 0, y: -10 }}
+                  animate={{ opacity: 1, y: 0 }}
+                  className="p-3 rounded-xl bg-red-500/10 border border-red-500/20 text-red-400 text-sm"
+                >
+                  {error}
+                </motion.div>
+              )}
+
+              <button
+                type="submit"
+                disabled={loading}
+                className="btn-primary w-full flex items-center justify-center gap-2"
+              >
+                <KeyRound className="w-5 h-5" />
+                {settingPassword ? 'Сменить пароль' : 'Отправить ссылку'}
+              </button>
+
+              {!token && (
+                <button
+                  type="button"
+                  onClick={() => {
+                    setMode(mode === 'email' ? 'recovery' : 'email')
+                    setError('')
+                  }}
+                  className="w-full text-sm text-cyan-400 hover:text-cyan-300 transition-colors"
+                >
+                  {mode === 'email' ? 'Нет почты? Используйте код восстановления' : 'Получить ссылку на почту'}
+                </button>
+              )}
+            </form>
+          )}
+
+          {message && (
+            <div className="p-3 rounded-xl bg-cyan-500/10 border border-cyan-500/20 text-cyan-300 text-sm">
+              {message}
+            </div>
+          )}
+
+          <div className="mt-6 text-center">
+            <Link
+              to="/login"
+              className="text-cyan-400 hover:text-cyan-300 transition-colors"
+            >
+              Вернуться ко входу
+            </Link>
+          </div>
+        </div>
+      </motion.div>
+    </div>
+  )
+}
@@ -1,22 +1,90 @@
-import axios from 'axios'
+import axios, { AxiosError, InternalAxiosRequestConfig } from 'axios'
+import { useAuthStore } from '../store/authStore'
 
-const api = axios.create({
-  baseURL: import.meta.env.VITE_API_URL || 'http://localhost:8080',
-})
+const baseURL = import.meta.env.VITE_API_URL || 'http://localhost:8080'
+
+const api = axios.create({ baseURL })
+
+// Токен обновляется заранее, если истекает в ближайшие 30 секунд
+const REFRESH_MARGIN = 30_000
+
+// Время истечения JWT в миллисекундах, или null, если его не прочитать
+function tokenExpiry(token: string): number | null {
+  try {
+    const payload = JSON.parse(atob(token.split('.')[1].replace(/-/g, '+').replace(/_/g, '/')))
+    return typeof payload.exp === 'number' ? payload.exp * 1000 : null
+  } catch {
+    return null
+  }
+}
+
+let refreshing: Promise<string | null> | null = null
 
-api.interceptors.request.use((config) => {
-  const stored = localStorage.getItem('kvant-auth')
-  if (stored) {
-    try {
-      const { token } = JSON.parse(stored)
-      if (token) {
-        config.headers.Authorization = `Bearer ${token}`
+// Обменивает refresh token на новую пару токенов. Одновременные вызовы
+// ждут один запрос, а вкладки обновляют по очереди: refresh token одноразовый.
+export function refreshSession(): Promise<string | null> {
+  if (!refreshing) {
+    const staleToken = useAuthStore.getState().token
+    const run = async () => {
+      const { token, refreshToken, setTokens, logout } = useAuthStore.getState()
+      // Пока ждали, токены могла обновить другая вкладка
+      if (token && token !== staleToken) return token
+      if (!refreshToken) return null
+
+      try {
+        const response = await axios.post(`${baseURL}/api/token/refresh`, { refresh_token: refreshToken })
+        setTokens(response.data.token, response.data.refresh_token)
+        return response.data.token as string
+      } catch (err) {
+        // Сессия завершена или истекла — нужно войти заново
+        if ((err as AxiosError).response?.status === 401) {
+          logout()
+        }
+        return null
       }
-    } catch (e) {
-      console.error('Failed to parse token', e)
     }
+    const locked = navigator.locks
+      ? navigator.locks.request('kvant-token-refresh', run)
+      : run()
+    refreshing = locked.finally(() => {
+      refreshing = null
+    })
+  }
+  return refreshing
+}
+
+// Возвращает действующий токен, обновив его, если он вот-вот истечёт
+export async function getFreshToken(): Promise<string | null> {
+  const { token } = useAuthStore.getState()
+  if (!token) return null
+  const expiry = tokenExpiry(token)
+  if (expiry !== null && expiry - Date.now() < REFRESH_MARGIN) {
+    return refreshSession()
+  }
+  return token
+}
+
+api.interceptors.request.use(async (config) => {
+  const token = await getFreshToken()
+  if (token) {
+    config.headers.Authorization = `Bearer ${token}`
   }
   return config
 })
 
+// Если токен всё же отклонён (например, часы устройства спешат), обновляем его и повторяем запрос один раз
+api.interceptors.response.use(undefined, async (error: AxiosError) => {
+  const config = error.config as (InternalAxiosRequestConfig & { _retried?: boolean }) | undefined
+  if (error.response?.status !== 401 || !config || config._retried || !config.headers.Authorization) {
+    return Promise.reject(error)
+  }
+  config._retried = true
+  const token = await refreshSession()
+  if (!token) {
+    return Promise.reject(error)
+  }
+  config.headers.Authorization = `Bearer ${token}`
+  return api(config)
+})
+
 export default api
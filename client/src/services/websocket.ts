@@ -1,6 +1,11 @@
+import { useAuthStore } from '../store/authStore'
+import { getFreshToken } from './api'
+
 class WebSocketService {
   private ws: WebSocket | null = null
   private isConnecting = false
+  // Сессию завершили с другого устройства — переподключаться незачем
+  private sessionRevoked = false
 
   isConnected(): boolean {
     return this.ws !== null && this.ws.readyState === WebSocket.OPEN
@@ -14,6 +19,7 @@ class WebSocketService {
     }
 
     this.isConnecting = true
+    this.sessionRevoked = false
     
     const wsUrl = `${import.meta.env.VITE_WS_URL || 'ws://localhost:8080'}/api/ws?token=${token}`
     this.ws = new WebSocket(wsUrl)
@@ -27,7 +33,9 @@ class WebSocketService {
     this.ws.onclose = () => {
       console.log('❌ WebSocket disconnected')
       this.isConnecting = false
-      this.attemptReconnect()
+      if (!this.sessionRevoked) {
+        this.attemptReconnect()
+      }
     }
 
     this.ws.onerror = (error) => {
@@ -68,8 +76,9 @@ class WebSocketService {
     const delay = this.reconnectDelay * this.reconnectAttempts
     console.log(`Reconnecting in ${delay}ms... (${this.reconnectAttempts}/${this.maxReconnectAttempts})`)
 
-    this.reconnectTimeout = setTimeout(() => {
-      const token = localStorage.getItem('token')
+    this.reconnectTimeout = setTimeout(async () => {
+      // Токен мог истечь, пока соединения не было
+      const token = await getFreshToken()
       if (token) {
         this.connect(token)
       }
@@ -79,6 +88,12 @@ class WebSocketService {
   private messageHandlers: { [key: string]: ((data: any) => void)[] } = {}
 
   private handleMessage(data: any) {
+    if (data.type === 'session_revoked') {
+      console.log('Session revoked, logging out')
+      this.sessionRevoked = true
+      useAuthStore.getState().logout()
+    }
+
     const handlers = this.messageHandlers[data.type] || []
     handlers.forEach(handler => handler(data))
   }
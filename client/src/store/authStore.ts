@@ -14,28 +14,42 @@ interface User {
 interface AuthState {
   user: User | null
   token: string | null
-  setAuth: (user: User, token: string) => void
+  // Одноразовый токен для получения нового token, когда тот истечёт
+  refreshToken: string | null
+  setAuth: (user: User, token: string, refreshToken: string) => void
+  setTokens: (token: string, refreshToken: string) => void
   updateUser: (user: Partial<User>) => void
   logout: () => void
 }
 
+const save = (state: Pick<AuthState, 'user' | 'token' | 'refreshToken'>) => {
+  localStorage.setItem('kvant-auth', JSON.stringify(state))
+}
+
 export const useAuthStore = create<AuthState>((set) => ({
   user: null,
   token: null,
-  setAuth: (user, token) => {
-    set({ user, token })
-    localStorage.setItem('kvant-auth', JSON.stringify({ user, token }))
+  refreshToken: null,
+  setAuth: (user, token, refreshToken) => {
+    set({ user, token, refreshToken })
+    save({ user, token, refreshToken })
+  },
+  setTokens: (token, refreshToken) => {
+    set((state) => {
+      save({ user: state.user, token, refreshToken })
+      return { token, refreshToken }
+    })
   },
   updateUser: (updatedUser) => {
     set((state) => {
       if (!state.user) return state
       const newUser = { ...state.user, ...updatedUser }
-      localStorage.setItem('kvant-auth', JSON.stringify({ user: newUser, token: state.token }))
+      save({ user: newUser, token: state.token, refreshToken: state.refreshToken })
       return { user: newUser }
     })
   },
   logout: () => {
-    set({ user: null, token: null })
+    set({ user: null, token: null, refreshToken: null })
     localStorage.removeItem('kvant-auth')
   },
 }))
@@ -44,9 +58,25 @@ export const useAuthStore = create<AuthState>((set) => ({
 const stored = localStorage.getItem('kvant-auth')
 if (stored) {
   try {
-    const { user, token } = JSON.parse(stored)
-    useAuthStore.setState({ user, token })
+    const { user, token, refreshToken } = JSON.parse(stored)
+    useAuthStore.setState({ user, token, refreshToken: refreshToken || null })
   } catch (e) {
     console.error('Failed to restore auth', e)
   }
 }
+
+// Другие вкладки обновляют токены: без этого вкладка отправила бы уже
+// использованный refresh token, и сервер завершил бы сессию
+window.addEventListener('storage', (event) => {
+  if (event.key !== 'kvant-auth') return
+  if (!event.newValue) {
+    useAuthStore.setState({ user: null, token: null, refreshToken: null })
+    return
+  }
+  try {
+    const { user, token, refreshToken } = JSON.parse(event.newValue)
+    useAuthStore.setState({ user, token, refreshToken: refreshToken || null })
+  } catch (e) {
+    console.error('Failed to sync auth', e)
+  }
+})
@@ -0,0 +1,89 @@
+// Декодер BlurHash (https://blurha.sh) — размытые превью изображений,
+// которые сервер присылает вместе с размерами, чтобы показать их до загрузки
+
+const DIGITS = '0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~'
+
+function decode83(str: string): number {
+  let value = 0
+  for (const char of str) {
+    value = value * 83 + DIGITS.indexOf(char)
+  }
+  return value
+}
+
+function sRGBToLinear(value: number): number {
+  const v = value / 255
+  return v <= 0.04045 ? v / 12.92 : Math.pow((v + 0.055) / 1.055, 2.4)
+}
+
+function linearToSRGB(value: number): number {
+  const v = Math.max(0, Math.min(1, value))
+  return v <= 0.0031308
+    ? Math.round(v * 12.92 * 255)
+    : Math.round((1.055 * Math.pow(v, 1 / 2.4) - 0.055) * 255)
+}
+
+function signPow(value: number, exp: number): number {
+  return Math.sign(value) * Math.pow(Math.abs(value), exp)
+}
+
+// Возвращает пиксели RGBA размером width x height или null, если хеш некорректный
+export function decodeBlurhash(hash: string, width: number, height: number): Uint8ClampedArray | null {
+  if (hash.length < 6) return null
+
+  const sizeFlag = decode83(hash[0])
+  const numY = Math.floor(sizeFlag / 9) + 1
+  const numX = (sizeFlag % 9) + 1
+  if (hash.length !== 4 + 2 * numX * numY) return null
+
+  const maxValue = (decode83(hash[1]) + 1) / 166
+  const colors: number[][] = []
+  for (let i = 0; i < numX * numY; i++) {
+    if (i === 0) {
+      const value = decode83(hash.substring(2, 6))
+      colors.push([sRGBToLinear(value >> 16), sRGBToLinear((value >> 8) & 255), sRGBToLinear(value & 255)])
+    } else {
+      const value = decode83(hash.substring(4 + i * 2, 6 + i * 2))
+      const quant = (q: number) => signPow((q - 9) / 9, 2) * maxValue
+      colors.push([quant(Math.floor(value / 361)), quant(Math.floor(value / 19) % 19), quant(value % 19)])
+    }
+  }
+
+  const pixels = new Uint8ClampedArray(width * height * 4)
+  for (let y = 0; y < height; y++) {
+    for (let x = 0; x < width; x++) {
+      let r = 0
+      let g = 0
+      let b = 0
+      for (let j = 0; j < numY; j++) {
+        for (let i = 0; i < numX; i++) {
+          const basis = Math.cos((Math.PI * x * i) / width) * Math.cos((Math.PI * y * j) / height)
+          const color = colors[i + j * numX]
+          r += color[0] * basis
+          g += color[1] * basis
+          b += color[2] * basis
+        }
+      }
+      const offset = 4 * (x + y * width)
+      pixels[offset] = linearToSRGB(r)
+      pixels[offset + 1] = linearToSRGB(g)
+      pixels[offset + 2] = linearToSRGB(b)
+      pixels[offset + 3] = 255
+    }
+  }
+  return pixels
+}
+
+// Рисует BlurHash в data URL, чтобы показать его как обычную картинку
+export function blurhashToDataURL(hash: string, width = 32, height = 32): string | undefined {
+  const pixels = decodeBlurhash(hash, width, height)
+  if (!pixels) return undefined
+
+  const canvas = document.createElement('canvas')
+  canvas.width = width
+  canvas.height = height
+  const ctx = canvas.getContext('2d')
+  if (!ctx) return undefined
+  ctx.putImageData(new ImageData(pixels, width, height), 0, 0)
+  return canvas.toDataURL()
+}
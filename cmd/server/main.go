@@ -1,16 +1,28 @@
 package main
 
 import (
+	"database/sql"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	"github.com/kvant/messenger/internal/database"
 	"github.com/kvant/messenger/internal/handlers"
 	"github.com/kvant/messenger/internal/middleware"
+	"github.com/kvant/messenger/internal/notify"
+	"github.com/kvant/messenger/internal/permissions"
+	"github.com/kvant/messenger/internal/ratelimit"
+	"github.com/kvant/messenger/internal/scheduler"
+	"github.com/kvant/messenger/internal/storage"
+	"github.com/kvant/messenger/internal/store"
 	"github.com/kvant/messenger/internal/websocket"
+	"github.com/kvant/messenger/pkg/utils"
 	"github.com/rs/cors"
 )
 
@@ -36,19 +48,114 @@ func main() {
 	}
 	defer db.Close()
 
+	// "migrate up|down [n]|status" manages the schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(db, os.Args[2:])
+		return
+	}
+
 	// Run migrations
 	if err := database.Migrate(db); err != nil {
 		log.Fatal("Failed to run migrations:", err)
 	}
 
-	// Initialize WebSocket hub
-	hub := websocket.NewHub()
+	// Initialize WebSocket hub. Events are kept for a week for clients resuming after a disconnect.
+	events := websocket.NewEventLog(db, 7*24*time.Hour)
+	go events.RunPruner()
+
+	// Hubs of all processes sharing the database deliver and track presence through the backplane
+	var backplane websocket.Backplane
+	switch mode := os.Getenv("BACKPLANE"); {
+	case mode == "memory" || mode == "" && utils.IsSQLite():
+		backplane = websocket.NewMemoryBackplane()
+	case mode == "postgres" || mode == "":
+		if utils.IsSQLite() {
+			log.Fatal("The postgres backplane requires a PostgreSQL database")
+		}
+		backplane, err = websocket.NewPostgresBackplane(db, database.PostgresConnString(), "kvant_hub")
+		if err != nil {
+			log.Fatal("Failed to start backplane:", err)
+		}
+	default:
+		log.Fatalf("Unknown BACKPLANE %q", mode)
+	}
+	defer backplane.Close()
+
+	hub := websocket.NewHub(events, backplane, store.New(db).Blocks)
 	go hub.Run()
 
+	// Uploaded files are kept by the driver chosen with STORAGE_DRIVER
+	blobs, err := storage.FromEnv()
+	if err != nil {
+		log.Fatal("Failed to configure storage:", err)
+	}
+
+	// Resumable uploads are put together on the local disk
+	spoolDir := os.Getenv("UPLOAD_SPOOL_DIR")
+	if spoolDir == "" {
+		spoolDir = filepath.Join(os.TempDir(), "kvant-uploads")
+	}
+	spool, err := storage.NewSpool(spoolDir)
+	if err != nil {
+		log.Fatal("Failed to configure storage:", err)
+	}
+
+	// Delete self-destructing messages as their timers run out, ended sessions
+	// and accounts whose deletion grace period is over
+	go scheduler.NewReaper(db, hub, blobs, spool, 5*time.Second).Run()
+
+	// Send scheduled messages when they are due
+	go scheduler.NewDispatcher(db, hub, 5*time.Second).Run()
+
+	// Limits on logins and sign-ups, per client address
+	limits := ratelimit.NewMemoryStore()
+	loginLimit, err := ratelimit.LimitFromEnv("LOGIN_RATE_LIMIT", "10/1m")
+	if err != nil {
+		log.Fatal("Failed to configure rate limits:", err)
+	}
+	registerLimit, err := ratelimit.LimitFromEnv("REGISTER_RATE_LIMIT", "5/1h")
+	if err != nil {
+		log.Fatal("Failed to configure rate limits:", err)
+	}
+	resetLimit, err := ratelimit.LimitFromEnv("PASSWORD_RESET_RATE_LIMIT", "5/1h")
+	if err != nil {
+		log.Fatal("Failed to configure rate limits:", err)
+	}
+	limitLogins := middleware.NewRateLimitMiddleware(ratelimit.NewLimiter(limits, "login-ip", loginLimit), utils.ClientIP)
+	limitRegistrations := middleware.NewRateLimitMiddleware(ratelimit.NewLimiter(limits, "register-ip", registerLimit), utils.ClientIP)
+	limitResets := middleware.NewRateLimitMiddleware(ratelimit.NewLimiter(limits, "password-reset-ip", resetLimit), utils.ClientIP)
+
+	// Refresh tokens are long random strings, but guessing at them should still cost
+	refreshLimit, err := ratelimit.LimitFromEnv("REFRESH_RATE_LIMIT", "30/1m")
+	if err != nil {
+		log.Fatal("Failed to configure rate limits:", err)
+	}
+	limitRefreshes := middleware.NewRateLimitMiddleware(ratelimit.NewLimiter(limits, "refresh-ip", refreshLimit), utils.ClientIP)
+
+	// Data exports read every file of the user back, so they are limited per user
+	exportLimit, err := ratelimit.LimitFromEnv("EXPORT_RATE_LIMIT", "2/1h")
+	if err != nil {
+		log.Fatal("Failed to configure rate limits:", err)
+	}
+	limitExports := middleware.NewRateLimitMiddleware(ratelimit.NewLimiter(limits, "export-user", exportLimit), middleware.GetUserID)
+
+	// Password reset links are sent by the driver chosen with NOTIFIER
+	notifier, err := notify.FromEnv()
+	if err != nil {
+		log.Fatal("Failed to configure notifications:", err)
+	}
+
 	// Initialize handlers
-	authHandler := handlers.NewAuthHandler(db)
-	userHandler := handlers.NewUserHandler(db)
-	messageHandler := handlers.NewMessageHandler(db, hub)
+	authHandler := handlers.NewAuthHandler(db, hub, limits, notifier)
+	userHandler := handlers.NewUserHandler(db, blobs)
+	blockHandler := handlers.NewBlockHandler(db, hub)
+	messageHandler := handlers.NewMessageHandler(db, hub, blobs)
+	groupHandler := handlers.NewGroupHandler(db, hub)
+	channelHandler := handlers.NewChannelHandler(db, hub)
+	serverHandler := handlers.NewServerHandler(db, hub)
+	roleHandler := handlers.NewRoleHandler(db, hub)
+	scheduledHandler := handlers.NewScheduledMessageHandler(db, hub)
+	uploadHandler := handlers.NewUploadHandler(db, blobs, spool)
 	wsHandler := handlers.NewWebSocketHandler(hub, db)
 
 	// CORS configuration
@@ -75,8 +182,9 @@ func main() {
 
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowedMethods:   []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", "Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata", "Upload-Checksum"},
+		ExposedHeaders:   []string{"Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Tus-Checksum-Algorithm", "Upload-Offset", "Upload-Length", "Upload-Expires", "Attachment-Id", "Retry-After"},
 		AllowCredentials: false, // Must be false when AllowedOrigins is *
 	})
 
@@ -86,18 +194,48 @@ func main() {
 	// WebSocket handler (NO middleware at all)
 	mainMux.HandleFunc("/api/ws", wsHandler.HandleWebSocket)
 
+	// Files of the local disk store, which UPLOAD_BASE_URL points at
+	if local, ok := blobs.(*storage.LocalStore); ok {
+		mainMux.Handle("/uploads/", http.StripPrefix("/uploads", local))
+	}
+
 	// HTTP API router with CORS and logging
 	apiRouter := mux.NewRouter()
 	
 	// Public routes
 	apiRouter.HandleFunc("/api/health", handlers.HealthCheck).Methods("GET")
 	apiRouter.HandleFunc("/api/version", handlers.GetVersion).Methods("GET")
-	apiRouter.HandleFunc("/api/register", authHandler.Register).Methods("POST")
-	apiRouter.HandleFunc("/api/login", authHandler.Login).Methods("POST")
+	apiRouter.Handle("/api/register", limitRegistrations(http.HandlerFunc(authHandler.Register))).Methods("POST")
+	apiRouter.Handle("/api/login", limitLogins(http.HandlerFunc(authHandler.Login))).Methods("POST")
+	apiRouter.Handle("/api/login/2fa", limitLogins(http.HandlerFunc(authHandler.LoginTwoFactor))).Methods("POST")
+	apiRouter.Handle("/api/token/refresh", limitRefreshes(http.HandlerFunc(authHandler.Refresh))).Methods("POST")
+	apiRouter.Handle("/api/password/forgot", limitResets(http.HandlerFunc(authHandler.ForgotPassword))).Methods("POST")
+	apiRouter.Handle("/api/password/reset", limitResets(http.HandlerFunc(authHandler.ResetPassword))).Methods("POST")
+	apiRouter.HandleFunc("/api/uploads", uploadHandler.Options).Methods("OPTIONS")
 
 	// Protected routes
 	api := apiRouter.PathPrefix("/api").Subrouter()
-	api.Use(middleware.AuthMiddleware)
+	api.Use(middleware.NewAuthMiddleware(store.New(db).Sessions))
+
+	// Session routes
+	api.HandleFunc("/logout", authHandler.Logout).Methods("POST")
+	api.HandleFunc("/sessions", authHandler.GetSessions).Methods("GET")
+	api.HandleFunc("/sessions", authHandler.RevokeOtherSessions).Methods("DELETE")
+	api.HandleFunc("/sessions/{id}", authHandler.RevokeSession).Methods("DELETE")
+
+	// Two-factor authentication routes
+	api.HandleFunc("/2fa", authHandler.GetTwoFactor).Methods("GET")
+	api.HandleFunc("/2fa/setup", authHandler.SetupTwoFactor).Methods("POST")
+	api.HandleFunc("/2fa/confirm", authHandler.ConfirmTwoFactor).Methods("POST")
+	api.HandleFunc("/2fa/disable", authHandler.DisableTwoFactor).Methods("POST")
+	api.HandleFunc("/2fa/recovery-codes", authHandler.RegenerateRecoveryCodes).Methods("POST")
+
+	// Account routes
+	api.HandleFunc("/me/password", authHandler.ChangePassword).Methods("PUT")
+	api.HandleFunc("/me/email", authHandler.GetEmail).Methods("GET")
+	api.HandleFunc("/me/email", authHandler.SetEmail).Methods("PUT")
+	api.HandleFunc("/me", authHandler.DeleteAccount).Methods("DELETE")
+	api.Handle("/me/export", limitExports(http.HandlerFunc(userHandler.ExportData))).Methods("GET")
 
 	// User routes
 	api.HandleFunc("/users/search", userHandler.SearchUsers).Methods("GET")
@@ -106,9 +244,27 @@ func main() {
 	api.HandleFunc("/users/{id}/avatar", userHandler.UploadAvatar).Methods("POST")
 	api.HandleFunc("/users/{id}/banner", userHandler.UploadBanner).Methods("POST")
 
+	// Block routes
+	api.HandleFunc("/blocks", blockHandler.GetBlocked).Methods("GET")
+	api.HandleFunc("/blocks/{userId}", blockHandler.BlockUser).Methods("POST")
+	api.HandleFunc("/blocks/{userId}", blockHandler.UnblockUser).Methods("DELETE")
+
 	// Message routes
+	api.HandleFunc("/messages", messageHandler.SendMessage).Methods("POST")
 	api.HandleFunc("/messages/recent", messageHandler.GetRecentChats).Methods("GET")
+	api.HandleFunc("/messages/scheduled", scheduledHandler.GetScheduledMessages).Methods("GET")
+	api.HandleFunc("/messages/scheduled", scheduledHandler.ScheduleMessage).Methods("POST")
+	api.HandleFunc("/messages/scheduled/{id}", scheduledHandler.UpdateScheduledMessage).Methods("PUT")
+	api.HandleFunc("/messages/scheduled/{id}", scheduledHandler.CancelScheduledMessage).Methods("DELETE")
+	api.HandleFunc("/messages/search", messageHandler.SearchMessages).Methods("GET")
 	api.HandleFunc("/messages/upload", messageHandler.UploadFile).Methods("POST")
+
+	// Resumable uploads (tus)
+	api.HandleFunc("/uploads", uploadHandler.CreateUpload).Methods("POST")
+	api.HandleFunc("/uploads/{id}", uploadHandler.HeadUpload).Methods("HEAD")
+	api.HandleFunc("/uploads/{id}", uploadHandler.GetUpload).Methods("GET")
+	api.HandleFunc("/uploads/{id}", uploadHandler.PatchUpload).Methods("PATCH")
+	api.HandleFunc("/uploads/{id}", uploadHandler.DeleteUpload).Methods("DELETE")
 	api.HandleFunc("/messages/{messageId}/edit", messageHandler.EditMessage).Methods("PUT")
 	api.HandleFunc("/messages/{messageId}/delete", messageHandler.DeleteMessage).Methods("DELETE")
 	api.HandleFunc("/messages/{messageId}/reactions", messageHandler.AddReaction).Methods("POST")
@@ -118,6 +274,64 @@ func main() {
 	api.HandleFunc("/messages/{userId}/read", messageHandler.MarkAsRead).Methods("POST")
 	api.HandleFunc("/messages/{userId}", messageHandler.GetMessages).Methods("GET")
 
+	// Group routes
+	api.HandleFunc("/groups", groupHandler.GetMyGroups).Methods("GET")
+	api.HandleFunc("/groups", groupHandler.CreateGroup).Methods("POST")
+	api.HandleFunc("/groups/{id}", groupHandler.GetGroup).Methods("GET")
+	api.HandleFunc("/groups/{id}", groupHandler.UpdateGroup).Methods("PUT")
+	api.HandleFunc("/groups/{id}", groupHandler.DeleteGroup).Methods("DELETE")
+	api.HandleFunc("/groups/{id}/members", groupHandler.GetMembers).Methods("GET")
+	api.HandleFunc("/groups/{id}/members", groupHandler.AddMember).Methods("POST")
+	api.HandleFunc("/groups/{id}/members/{userId}", groupHandler.UpdateMemberRole).Methods("PUT")
+	api.HandleFunc("/groups/{id}/members/{userId}", groupHandler.RemoveMember).Methods("DELETE")
+	api.HandleFunc("/groups/{id}/leave", groupHandler.LeaveGroup).Methods("POST")
+	api.HandleFunc("/groups/{id}/messages", messageHandler.GetGroupMessages).Methods("GET")
+	api.HandleFunc("/groups/{id}/roles", roleHandler.ListRoles(permissions.ScopeGroup)).Methods("GET")
+	api.HandleFunc("/groups/{id}/roles", roleHandler.CreateRole(permissions.ScopeGroup)).Methods("POST")
+	api.HandleFunc("/groups/{id}/roles/{role}", roleHandler.UpdateRole(permissions.ScopeGroup)).Methods("PUT")
+	api.HandleFunc("/groups/{id}/roles/{role}", roleHandler.DeleteRole(permissions.ScopeGroup)).Methods("DELETE")
+
+	// Channel routes
+	api.HandleFunc("/channels", channelHandler.GetMyChannels).Methods("GET")
+	api.HandleFunc("/channels", channelHandler.CreateChannel).Methods("POST")
+	api.HandleFunc("/channels/invite/{slug}", channelHandler.GetChannelBySlug).Methods("GET")
+	api.HandleFunc("/channels/invite/{slug}/subscribe", channelHandler.SubscribeBySlug).Methods("POST")
+	api.HandleFunc("/channels/{id}", channelHandler.GetChannel).Methods("GET")
+	api.HandleFunc("/channels/{id}", channelHandler.UpdateChannel).Methods("PUT")
+	api.HandleFunc("/channels/{id}", channelHandler.DeleteChannel).Methods("DELETE")
+	api.HandleFunc("/channels/{id}/subscribe", channelHandler.Subscribe).Methods("POST")
+	api.HandleFunc("/channels/{id}/subscribe", channelHandler.Unsubscribe).Methods("DELETE")
+	api.HandleFunc("/channels/{id}/subscribers", channelHandler.GetSubscribers).Methods("GET")
+	api.HandleFunc("/channels/{id}/subscribers/{userId}", channelHandler.SetSubscriberRole).Methods("PUT")
+	api.HandleFunc("/channels/{id}/posts", messageHandler.GetChannelPosts).Methods("GET")
+	api.HandleFunc("/channels/{id}/posts", channelHandler.CreatePost).Methods("POST")
+
+	// Server routes
+	api.HandleFunc("/servers", serverHandler.GetMyServers).Methods("GET")
+	api.HandleFunc("/servers", serverHandler.CreateServer).Methods("POST")
+	api.HandleFunc("/servers/invite/{slug}", serverHandler.GetServerBySlug).Methods("GET")
+	api.HandleFunc("/servers/invite/{slug}/join", serverHandler.JoinServerBySlug).Methods("POST")
+	api.HandleFunc("/servers/{id}", serverHandler.GetServer).Methods("GET")
+	api.HandleFunc("/servers/{id}", serverHandler.UpdateServer).Methods("PUT")
+	api.HandleFunc("/servers/{id}", serverHandler.DeleteServer).Methods("DELETE")
+	api.HandleFunc("/servers/{id}/join", serverHandler.JoinServer).Methods("POST")
+	api.HandleFunc("/servers/{id}/leave", serverHandler.LeaveServer).Methods("POST")
+	api.HandleFunc("/servers/{id}/members", serverHandler.GetMembers).Methods("GET")
+	api.HandleFunc("/servers/{id}/members/{userId}", serverHandler.UpdateMember).Methods("PUT")
+	api.HandleFunc("/servers/{id}/members/{userId}", serverHandler.KickMember).Methods("DELETE")
+	api.HandleFunc("/servers/{id}/roles", roleHandler.ListRoles(permissions.ScopeServer)).Methods("GET")
+	api.HandleFunc("/servers/{id}/roles", roleHandler.CreateRole(permissions.ScopeServer)).Methods("POST")
+	api.HandleFunc("/servers/{id}/roles/{role}", roleHandler.UpdateRole(permissions.ScopeServer)).Methods("PUT")
+	api.HandleFunc("/servers/{id}/roles/{role}", roleHandler.DeleteRole(permissions.ScopeServer)).Methods("DELETE")
+	api.HandleFunc("/servers/{id}/categories", serverHandler.CreateCategory).Methods("POST")
+	api.HandleFunc("/servers/{id}/categories/{categoryId}", serverHandler.UpdateCategory).Methods("PUT")
+	api.HandleFunc("/servers/{id}/categories/{categoryId}", serverHandler.DeleteCategory).Methods("DELETE")
+	api.HandleFunc("/servers/{id}/channels", serverHandler.GetChannelTree).Methods("GET")
+	api.HandleFunc("/servers/{id}/channels", serverHandler.CreateChannel).Methods("POST")
+	api.HandleFunc("/servers/{id}/channels/{channelId}", serverHandler.UpdateChannel).Methods("PUT")
+	api.HandleFunc("/servers/{id}/channels/{channelId}", serverHandler.DeleteChannel).Methods("DELETE")
+	api.HandleFunc("/servers/{id}/channels/{channelId}/messages", messageHandler.GetServerChannelMessages).Methods("GET")
+
 	// Wrap API router with CORS and logging
 	apiHandler := middleware.LoggingMiddleware(c.Handler(apiRouter))
 	mainMux.Handle("/api/", apiHandler)
@@ -132,3 +346,44 @@ func main() {
 	log.Printf("🌐 CORS enabled for: %v", allowedOrigins)
 	log.Fatal(http.ListenAndServe("0.0.0.0:"+port, mainMux))
 }
+
+// runMigrate applies, reverts or lists schema migrations. Without arguments it applies them all.
+func runMigrate(db *sql.DB, args []string) {
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		if err := database.Migrate(db); err != nil {
+			log.Fatal("Failed to run migrations:", err)
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				log.Fatal("Usage: migrate down [steps]")
+			}
+			steps = n
+		}
+		if err := database.MigrateDown(db, steps); err != nil {
+			log.Fatal("Failed to revert migrations:", err)
+		}
+	case "status":
+		states, err := database.MigrationStatus(db)
+		if err != nil {
+			log.Fatal("Failed to get migration status:", err)
+		}
+		for _, state := range states {
+			applied := "pending"
+			if state.AppliedAt != nil {
+				applied = "applied " + state.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d  %-20s  %s\n", state.Version, state.Name, applied)
+		}
+	default:
+		log.Fatal("Usage: migrate up | down [steps] | status")
+	}
+}
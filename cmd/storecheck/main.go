@@ -0,0 +1,109 @@
+// Command storecheck runs the store contract of package storetest against
+// SQLite in a temporary database, and against PostgreSQL when DB_HOST
+// configures one. PostgreSQL is checked in a scratch schema that is dropped
+// afterwards, so any database the user can create schemas in will do.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/kvant/messenger/internal/database"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/internal/store/storetest"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+func main() {
+	godotenv.Load()
+	log.SetFlags(0)
+
+	// The dialect is chosen through the environment, like the server does
+	withPostgres := os.Getenv("DB_HOST") != ""
+
+	failed := !check("sqlite", checkSQLite)
+	if withPostgres {
+		failed = !check("postgres", checkPostgres) || failed
+	} else {
+		log.Println("⏭️  postgres: skipped, DB_HOST is not set")
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// check runs the contract on the database opened by open and reports the result
+func check(name string, open func() (*sql.DB, func(), error)) bool {
+	db, cleanup, err := open()
+	if err != nil {
+		log.Printf("❌ %s: %v", name, err)
+		return false
+	}
+	defer cleanup()
+
+	if err := database.MigrateUp(db); err != nil {
+		log.Printf("❌ %s: migrating: %v", name, err)
+		return false
+	}
+
+	failures := storetest.Run(context.Background(), store.New(db))
+	for _, failure := range failures {
+		log.Printf("❌ %s: %v", name, failure)
+	}
+	if len(failures) > 0 {
+		return false
+	}
+	log.Printf("✅ %s: %d checks passed", name, len(storetest.Checks))
+	return true
+}
+
+func checkSQLite() (*sql.DB, func(), error) {
+	dir, err := os.MkdirTemp("", "storecheck")
+	if err != nil {
+		return nil, nil, err
+	}
+	os.Setenv("USE_SQLITE", "true")
+	os.Setenv("SQLITE_DB_PATH", filepath.Join(dir, "storecheck.db"))
+
+	db, err := database.Connect()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}, nil
+}
+
+func checkPostgres() (*sql.DB, func(), error) {
+	os.Setenv("USE_SQLITE", "false")
+
+	db, err := database.Connect()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// One connection keeps the search_path of the scratch schema
+	db.SetMaxOpenConns(1)
+	schema := "storecheck_" + strings.ReplaceAll(utils.GenerateUUID()[:8], "-", "")
+	for _, stmt := range []string{`CREATE SCHEMA ` + schema, `SET search_path TO ` + schema} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, nil, fmt.Errorf("creating scratch schema: %w", err)
+		}
+	}
+	return db, func() {
+		if _, err := db.Exec(`DROP SCHEMA ` + schema + ` CASCADE`); err != nil {
+			log.Printf("Failed to drop scratch schema %s: %v", schema, err)
+		}
+		db.Close()
+	}, nil
+}
@@ -0,0 +1,242 @@
+// Package conversation resolves which chat a message belongs to and who
+// takes part in it. A message targets either a single user (direct chat,
+// receiver_id is set), a group (group_id is set), a text channel of a
+// server (server_channel_id is set) or is a post in a broadcast channel
+// (channel_id is set).
+package conversation
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/store"
+)
+
+const (
+	TypeDirect        = "direct"
+	TypeGroup         = "group"
+	TypeChannel       = "channel"
+	TypeServerChannel = "server_channel"
+)
+
+// Message holds the routing information of a stored message
+type Message struct {
+	ID         string
+	SenderID   string
+	ReceiverID *string
+	GroupID    *string
+	ChannelID  *string
+	// ServerChannelID is a text channel inside a server
+	ServerChannelID *string
+}
+
+// Type returns the conversation type of the message
+func (m *Message) Type() string {
+	if m.GroupID != nil {
+		return TypeGroup
+	}
+	if m.ChannelID != nil {
+		return TypeChannel
+	}
+	if m.ServerChannelID != nil {
+		return TypeServerChannel
+	}
+	return TypeDirect
+}
+
+// Load fetches routing information of a message.
+// Returns sql.ErrNoRows if the message does not exist.
+func Load(db *sql.DB, messageID string) (*Message, error) {
+	msg, err := store.New(db).Messages.Get(context.Background(), messageID)
+	if err == store.ErrNotFound {
+		return nil, sql.ErrNoRows
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		ID:              msg.ID,
+		SenderID:        msg.SenderID,
+		ReceiverID:      msg.ReceiverID,
+		GroupID:         msg.GroupID,
+		ChannelID:       msg.ChannelID,
+		ServerChannelID: msg.ServerChannelID,
+	}, nil
+}
+
+// CanAccess reports whether the user takes part in the conversation of the message
+func CanAccess(db *sql.DB, msg *Message, userID string) (bool, error) {
+	if msg.GroupID != nil {
+		return IsGroupMember(db, *msg.GroupID, userID)
+	}
+	if msg.ChannelID != nil {
+		return CanReadChannel(db, *msg.ChannelID, userID)
+	}
+	if msg.ServerChannelID != nil {
+		return IsServerChannelMember(db, *msg.ServerChannelID, userID)
+	}
+	return msg.SenderID == userID || (msg.ReceiverID != nil && *msg.ReceiverID == userID), nil
+}
+
+// Participants returns the IDs of every user that should receive events about the message
+func Participants(db *sql.DB, msg *Message) ([]string, error) {
+	if msg.GroupID != nil {
+		return GroupMemberIDs(db, *msg.GroupID)
+	}
+	if msg.ChannelID != nil {
+		return ChannelSubscriberIDs(db, *msg.ChannelID)
+	}
+	if msg.ServerChannelID != nil {
+		return ServerChannelMemberIDs(db, *msg.ServerChannelID)
+	}
+	ids := []string{msg.SenderID}
+	if msg.ReceiverID != nil && *msg.ReceiverID != msg.SenderID {
+		ids = append(ids, *msg.ReceiverID)
+	}
+	return ids, nil
+}
+
+// Target is the destination of a new message or typing event sent over the
+// WebSocket. Exactly one of the fields is set.
+type Target struct {
+	ReceiverID      string
+	GroupID         string
+	ServerChannelID string
+	// ChannelID is a broadcast channel; only its owner and admins post there
+	ChannelID string
+}
+
+// Valid reports whether exactly one destination is set
+func (t Target) Valid() bool {
+	set := 0
+	for _, id := range []string{t.ReceiverID, t.GroupID, t.ServerChannelID, t.ChannelID} {
+		if id != "" {
+			set++
+		}
+	}
+	return set == 1
+}
+
+// Chat returns the conversation userID sends to the target, as they see it
+func (t Target) Chat(userID string) store.Chat {
+	return store.Chat{
+		UserID:          userID,
+		OtherUserID:     t.ReceiverID,
+		GroupID:         t.GroupID,
+		ChannelID:       t.ChannelID,
+		ServerChannelID: t.ServerChannelID,
+	}
+}
+
+// Recipients returns the users that receive what senderID sends to the target,
+// excluding the sender. Returns ok == false if the sender may not post there.
+func Recipients(db *sql.DB, target Target, senderID string) (recipients []string, ok bool, err error) {
+	if target.ReceiverID != "" {
+		return []string{target.ReceiverID}, true, nil
+	}
+
+	var memberIDs []string
+	if target.ChannelID != "" {
+		// Subscribers only read a channel
+		var role string
+		if role, err = ChannelRole(db, target.ChannelID, senderID); err != nil || (role != models.ChannelRoleOwner && role != models.ChannelRoleAdmin) {
+			return nil, false, err
+		}
+		memberIDs, err = ChannelSubscriberIDs(db, target.ChannelID)
+	} else if target.GroupID != "" {
+		memberIDs, err = GroupMemberIDs(db, target.GroupID)
+	} else {
+		memberIDs, err = ServerChannelMemberIDs(db, target.ServerChannelID)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	recipients = make([]string, 0, len(memberIDs))
+	for _, id := range memberIDs {
+		if id == senderID {
+			ok = true
+			continue
+		}
+		recipients = append(recipients, id)
+	}
+	return recipients, ok, nil
+}
+
+// IsGroupMember reports whether the user is a member of the group
+func IsGroupMember(db *sql.DB, groupID, userID string) (bool, error) {
+	_, err := store.New(db).Groups.Role(context.Background(), groupID, userID)
+	return member(err)
+}
+
+// GroupMemberIDs returns the IDs of all members of the group
+func GroupMemberIDs(db *sql.DB, groupID string) ([]string, error) {
+	return store.New(db).Groups.MemberIDs(context.Background(), groupID)
+}
+
+// ChannelRole returns the role of the user in the channel, or "" if the user is not subscribed
+func ChannelRole(db *sql.DB, channelID, userID string) (string, error) {
+	role, err := store.New(db).Channels.Role(context.Background(), channelID, userID)
+	if err == store.ErrNotFound {
+		return "", nil
+	}
+	return role, err
+}
+
+// CanReadChannel reports whether the user may read posts of the channel:
+// subscribers can read any channel, everyone else only public ones
+func CanReadChannel(db *sql.DB, channelID, userID string) (bool, error) {
+	return store.New(db).Channels.CanRead(context.Background(), channelID, userID)
+}
+
+// ChannelSubscriberIDs returns the IDs of all subscribers of the channel
+func ChannelSubscriberIDs(db *sql.DB, channelID string) ([]string, error) {
+	return store.New(db).Channels.SubscriberIDs(context.Background(), channelID)
+}
+
+// ServerRole returns the role of the user in the server, or "" if the user is not a member
+func ServerRole(db *sql.DB, serverID, userID string) (string, error) {
+	role, err := store.New(db).Servers.Role(context.Background(), serverID, userID)
+	if err == store.ErrNotFound {
+		return "", nil
+	}
+	return role, err
+}
+
+// IsServerChannelMember reports whether the user is a member of the server that owns the text channel
+func IsServerChannelMember(db *sql.DB, serverChannelID, userID string) (bool, error) {
+	servers := store.New(db).Servers
+	serverID, err := servers.ChannelServer(context.Background(), serverChannelID)
+	if err != nil {
+		return member(err)
+	}
+	_, err = servers.Role(context.Background(), serverID, userID)
+	return member(err)
+}
+
+// ServerChannelMemberIDs returns the IDs of all members of the server that owns the text channel
+func ServerChannelMemberIDs(db *sql.DB, serverChannelID string) ([]string, error) {
+	servers := store.New(db).Servers
+	serverID, err := servers.ChannelServer(context.Background(), serverChannelID)
+	if err == store.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return servers.MemberIDs(context.Background(), serverID)
+}
+
+// ServerMemberIDs returns the IDs of all members of the server
+func ServerMemberIDs(db *sql.DB, serverID string) ([]string, error) {
+	return store.New(db).Servers.MemberIDs(context.Background(), serverID)
+}
+
+// member maps the error of a role lookup to whether there is a membership
+func member(err error) (bool, error) {
+	if err == store.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -5,30 +5,34 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/kvant/messenger/pkg/utils"
 	_ "github.com/lib/pq"
 	_ "modernc.org/sqlite"
 )
 
 func Connect() (*sql.DB, error) {
 	// Check if we should use SQLite
-	useSQLite := os.Getenv("USE_SQLITE")
-	if useSQLite == "true" || os.Getenv("DB_HOST") == "" {
+	if utils.IsSQLite() {
 		return ConnectSQLite()
 	}
 
-	// Check if DATABASE_URL is provided (Supabase/Render format)
-	databaseURL := os.Getenv("DATABASE_URL")
-	if databaseURL != "" {
-		db, err := sql.Open("postgres", databaseURL)
-		if err != nil {
-			return nil, err
-		}
+	db, err := sql.Open("postgres", PostgresConnString())
+	if err != nil {
+		return nil, err
+	}
 
-		if err := db.Ping(); err != nil {
-			return nil, err
-		}
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
 
-		return db, nil
+	return db, nil
+}
+
+// PostgresConnString returns the PostgreSQL connection string from the environment
+func PostgresConnString() string {
+	// Check if DATABASE_URL is provided (Supabase/Render format)
+	if databaseURL := os.Getenv("DATABASE_URL"); databaseURL != "" {
+		return databaseURL
 	}
 
 	// Use PostgreSQL with individual parameters
@@ -44,30 +48,8 @@ func Connect() (*sql.DB, error) {
 		sslMode = "require"
 	}
 
-	connStr := fmt.Sprintf(
+	return fmt.Sprintf(
 		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
 		host, port, user, password, dbname, sslMode,
 	)
-
-	db, err := sql.Open("postgres", connStr)
-	if err != nil {
-		return nil, err
-	}
-
-	if err := db.Ping(); err != nil {
-		return nil, err
-	}
-
-	return db, nil
-}
-
-func Migrate(db *sql.DB) error {
-	// Check if we're using SQLite
-	if os.Getenv("USE_SQLITE") == "true" || os.Getenv("DB_HOST") == "" {
-		return MigrateSQLite(db)
-	}
-	
-	// PostgreSQL migrations - call from migrations.go
-	return migratePostgreSQL(db)
 }
-
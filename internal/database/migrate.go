@@ -0,0 +1,288 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// migrationLockKey is the PostgreSQL advisory lock held while migrating, so
+// that replicas starting at the same time apply each migration once
+const migrationLockKey = 4207319
+
+// execer runs statements on a connection or inside a transaction
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// migration is one numbered schema change of a dialect. Versions are shared
+// by both dialects: after the same version they have the same schema.
+type migration struct {
+	version int
+	name    string
+	up      func(ctx context.Context, db execer) error
+	down    func(ctx context.Context, db execer) error
+}
+
+// statements returns a migration step executing the statements in order
+func statements(stmts ...string) func(ctx context.Context, db execer) error {
+	return func(ctx context.Context, db execer) error {
+		for _, stmt := range stmts {
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// MigrationState is a known or applied migration; AppliedAt is nil while it is pending
+type MigrationState struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// Migrate applies every pending migration; the server runs it on startup
+func Migrate(db *sql.DB) error {
+	if err := MigrateUp(db); err != nil {
+		log.Printf("Migration error: %v", err)
+		return err
+	}
+	log.Println("✅ Database migrations completed")
+	return nil
+}
+
+// MigrateUp applies the pending migrations in order
+func MigrateUp(db *sql.DB) error {
+	return withMigrator(db, func(m *migrator, applied map[int]bool) error {
+		for _, mig := range m.migrations {
+			if applied[mig.version] {
+				continue
+			}
+			err := m.step(func(ex execer) error {
+				if err := mig.up(m.ctx, ex); err != nil {
+					return err
+				}
+				_, err := ex.ExecContext(m.ctx, utils.AdaptQuery(`
+					INSERT INTO schema_migrations (version, name) VALUES ($1, $2)
+				`), mig.version, mig.name)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %04d %s: %w", mig.version, mig.name, err)
+			}
+			log.Printf("✅ Applied migration %04d %s", mig.version, mig.name)
+		}
+		return nil
+	})
+}
+
+// MigrateDown reverts the last steps applied migrations, newest first
+func MigrateDown(db *sql.DB, steps int) error {
+	return withMigrator(db, func(m *migrator, applied map[int]bool) error {
+		for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+			mig := m.migrations[i]
+			if !applied[mig.version] {
+				continue
+			}
+			err := m.step(func(ex execer) error {
+				if err := mig.down(m.ctx, ex); err != nil {
+					return err
+				}
+				_, err := ex.ExecContext(m.ctx, utils.AdaptQuery(`
+					DELETE FROM schema_migrations WHERE version = $1
+				`), mig.version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("reverting migration %04d %s: %w", mig.version, mig.name, err)
+			}
+			log.Printf("↩️  Reverted migration %04d %s", mig.version, mig.name)
+			steps--
+		}
+		return nil
+	})
+}
+
+// MigrationStatus lists the migrations of this build and any applied by a newer one
+func MigrationStatus(db *sql.DB) ([]MigrationState, error) {
+	ctx := context.Background()
+	var states []MigrationState
+	known := make(map[int]bool)
+	for _, mig := range dialectMigrations() {
+		states = append(states, MigrationState{Version: mig.version, Name: mig.name})
+		known[mig.version] = true
+	}
+
+	var exists bool
+	query := `SELECT to_regclass('schema_migrations') IS NOT NULL`
+	if utils.IsSQLite() {
+		query = `SELECT COUNT(*) > 0 FROM sqlite_master WHERE type='table' AND name='schema_migrations'`
+	}
+	if err := db.QueryRowContext(ctx, query).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return states, nil
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT version, name, applied_at FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var state MigrationState
+		var appliedAt time.Time
+		if err := rows.Scan(&state.Version, &state.Name, &appliedAt); err != nil {
+			return nil, err
+		}
+		state.AppliedAt = &appliedAt
+		if !known[state.Version] {
+			states = append(states, state)
+			continue
+		}
+		for i := range states {
+			if states[i].Version == state.Version {
+				states[i].AppliedAt = state.AppliedAt
+			}
+		}
+	}
+	return states, rows.Err()
+}
+
+func dialectMigrations() []migration {
+	if utils.IsSQLite() {
+		return sqliteMigrations
+	}
+	return postgresMigrations
+}
+
+// migrator applies migrations on one connection holding the migration lock.
+// PostgreSQL runs every migration in its own transaction under an advisory
+// lock. SQLite runs them all in one BEGIN IMMEDIATE transaction, which is its
+// lock, with foreign keys off so that tables can be rebuilt.
+type migrator struct {
+	ctx        context.Context
+	conn       *sql.Conn
+	sqlite     bool
+	migrations []migration
+}
+
+// withMigrator takes the migration lock, makes sure schema_migrations exists
+// and calls fn with the applied versions
+func withMigrator(db *sql.DB, fn func(m *migrator, applied map[int]bool) error) (err error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	m := &migrator{ctx: ctx, conn: conn, sqlite: utils.IsSQLite(), migrations: dialectMigrations()}
+	if err := m.lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if unlockErr := m.unlock(err == nil); err == nil {
+			err = unlockErr
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR(100) NOT NULL,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return err
+	}
+
+	rows, err := conn.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return fn(m, applied)
+}
+
+func (m *migrator) lock() error {
+	if !m.sqlite {
+		_, err := m.conn.ExecContext(m.ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey)
+		return err
+	}
+
+	// foreign_keys cannot change inside a transaction
+	for _, stmt := range []string{`PRAGMA busy_timeout = 60000`, `PRAGMA foreign_keys = OFF`, `BEGIN IMMEDIATE`} {
+		if _, err := m.conn.ExecContext(m.ctx, stmt); err != nil {
+			m.conn.ExecContext(m.ctx, `PRAGMA foreign_keys = ON`)
+			return err
+		}
+	}
+	return nil
+}
+
+// unlock releases the lock; on SQLite it commits the migrations if ok is set
+// and rolls them back otherwise
+func (m *migrator) unlock(ok bool) error {
+	if !m.sqlite {
+		_, err := m.conn.ExecContext(m.ctx, `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+		return err
+	}
+
+	// The pooled connection must get its foreign keys back whatever happens
+	defer m.conn.ExecContext(m.ctx, `PRAGMA foreign_keys = ON`)
+
+	if !ok {
+		_, err := m.conn.ExecContext(m.ctx, `ROLLBACK`)
+		return err
+	}
+
+	var violations int
+	if err := m.conn.QueryRowContext(m.ctx, `SELECT COUNT(*) FROM pragma_foreign_key_check`).Scan(&violations); err == nil && violations > 0 {
+		log.Printf("Warning: %d rows violate foreign keys after migrating", violations)
+	}
+
+	_, err := m.conn.ExecContext(m.ctx, `COMMIT`)
+	return err
+}
+
+// step runs fn atomically: in a transaction of its own on PostgreSQL, and in
+// the transaction of the whole run on SQLite
+func (m *migrator) step(fn func(ex execer) error) error {
+	if m.sqlite {
+		return fn(m.conn)
+	}
+
+	tx, err := m.conn.BeginTx(m.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
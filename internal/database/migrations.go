@@ -1,121 +1,480 @@
 package database
 
-import (
-	"database/sql"
-	"log"
-)
-
-func migratePostgreSQL(db *sql.DB) error {
-	migrations := []string{
-		// Users table
-		`CREATE TABLE IF NOT EXISTS users (
-			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-			username VARCHAR(50) UNIQUE NOT NULL,
-			password_hash VARCHAR(255) NOT NULL,
-			display_name VARCHAR(100),
-			bio TEXT,
-			avatar_url TEXT,
-			banner_url TEXT,
-			tag VARCHAR(10) UNIQUE,
-			role VARCHAR(20) DEFAULT 'user',
-			is_premium BOOLEAN DEFAULT FALSE,
-			premium_until TIMESTAMP,
-			name_color VARCHAR(7),
-			profile_theme VARCHAR(50) DEFAULT 'default',
-			bubble_style VARCHAR(50) DEFAULT 'default',
-			hide_online BOOLEAN DEFAULT FALSE,
-			status VARCHAR(20) DEFAULT 'online',
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)`,
-
-		// Messages table
-		`CREATE TABLE IF NOT EXISTS messages (
-			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-			sender_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-			receiver_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-			text TEXT NOT NULL,
-			message_type VARCHAR(20) DEFAULT 'text',
-			file_url TEXT,
-			is_read BOOLEAN DEFAULT FALSE,
-			reply_to_id UUID REFERENCES messages(id) ON DELETE SET NULL,
-			self_destruct_at TIMESTAMP,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP,
-			pinned_at TIMESTAMP
-		)`,
-
-		// Indexes for messages
-		`CREATE INDEX IF NOT EXISTS idx_messages_sender ON messages(sender_id)`,
-		`CREATE INDEX IF NOT EXISTS idx_messages_receiver ON messages(receiver_id)`,
-		`CREATE INDEX IF NOT EXISTS idx_messages_created ON messages(created_at DESC)`,
-
-		// Reactions table
-		`CREATE TABLE IF NOT EXISTS reactions (
-			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-			message_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
-			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-			emoji VARCHAR(10) NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			UNIQUE(message_id, user_id, emoji)
-		)`,
-
-		// Groups table
-		`CREATE TABLE IF NOT EXISTS groups (
-			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-			name VARCHAR(100) NOT NULL,
-			description TEXT,
-			avatar_url TEXT,
-			owner_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-			is_public BOOLEAN DEFAULT FALSE,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)`,
-
-		// Group members table
-		`CREATE TABLE IF NOT EXISTS group_members (
-			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-			group_id UUID NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
-			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-			role VARCHAR(20) DEFAULT 'member',
-			joined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			UNIQUE(group_id, user_id)
-		)`,
-
-		// Channels table
-		`CREATE TABLE IF NOT EXISTS channels (
-			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-			name VARCHAR(100) NOT NULL,
-			description TEXT,
-			avatar_url TEXT,
-			owner_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-			is_public BOOLEAN DEFAULT TRUE,
-			subscriber_count INTEGER DEFAULT 0,
-			invite_slug VARCHAR(50) UNIQUE,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)`,
-
-		// Servers table
-		`CREATE TABLE IF NOT EXISTS servers (
-			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-			name VARCHAR(100) NOT NULL,
-			description TEXT,
-			icon_url TEXT,
-			banner_url TEXT,
-			owner_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-			is_public BOOLEAN DEFAULT TRUE,
-			member_count INTEGER DEFAULT 0,
-			invite_slug VARCHAR(50) UNIQUE,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)`,
-	}
-
-	for _, migration := range migrations {
-		if _, err := db.Exec(migration); err != nil {
-			log.Printf("Migration error: %v", err)
-			return err
-		}
-	}
-
-	log.Println("✅ Database migrations completed")
-	return nil
+// postgresMigrations is the schema history of PostgreSQL databases. Never edit
+// an applied migration; add a new one, and the SQLite counterpart with the
+// same version in sqliteMigrations.
+var postgresMigrations = []migration{
+	{
+		// The schema before versioned migrations. Every statement is idempotent,
+		// so databases created by earlier releases adopt it as they are.
+		version: 1,
+		name:    "baseline",
+		up: statements(
+			// Users table
+			`CREATE TABLE IF NOT EXISTS users (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				username VARCHAR(50) UNIQUE NOT NULL,
+				password_hash VARCHAR(255) NOT NULL,
+				display_name VARCHAR(100),
+				bio TEXT,
+				avatar_url TEXT,
+				banner_url TEXT,
+				tag VARCHAR(10) UNIQUE,
+				role VARCHAR(20) DEFAULT 'user',
+				is_premium BOOLEAN DEFAULT FALSE,
+				premium_until TIMESTAMP,
+				name_color VARCHAR(7),
+				profile_theme VARCHAR(50) DEFAULT 'default',
+				bubble_style VARCHAR(50) DEFAULT 'default',
+				hide_online BOOLEAN DEFAULT FALSE,
+				status VARCHAR(20) DEFAULT 'online',
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+
+			// Messages table
+			`CREATE TABLE IF NOT EXISTS messages (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				sender_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				receiver_id UUID REFERENCES users(id) ON DELETE CASCADE,
+				text TEXT NOT NULL,
+				message_type VARCHAR(20) DEFAULT 'text',
+				file_url TEXT,
+				is_read BOOLEAN DEFAULT FALSE,
+				reply_to_id UUID REFERENCES messages(id) ON DELETE SET NULL,
+				self_destruct_at TIMESTAMP,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP,
+				pinned_at TIMESTAMP
+			)`,
+
+			// Indexes for messages
+			`CREATE INDEX IF NOT EXISTS idx_messages_sender ON messages(sender_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_messages_receiver ON messages(receiver_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_messages_created ON messages(created_at DESC)`,
+
+			// Reactions table
+			`CREATE TABLE IF NOT EXISTS reactions (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				message_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				emoji VARCHAR(10) NOT NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE(message_id, user_id, emoji)
+			)`,
+
+			// Groups table
+			`CREATE TABLE IF NOT EXISTS groups (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				name VARCHAR(100) NOT NULL,
+				description TEXT,
+				avatar_url TEXT,
+				owner_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				is_public BOOLEAN DEFAULT FALSE,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+
+			// Group members table
+			`CREATE TABLE IF NOT EXISTS group_members (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				group_id UUID NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				role VARCHAR(20) DEFAULT 'member',
+				joined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE(group_id, user_id)
+			)`,
+
+			// Group messages: a message targets either a user (receiver_id) or a group (group_id)
+			`ALTER TABLE messages ALTER COLUMN receiver_id DROP NOT NULL`,
+			`ALTER TABLE messages ADD COLUMN IF NOT EXISTS group_id UUID REFERENCES groups(id) ON DELETE CASCADE`,
+			`CREATE INDEX IF NOT EXISTS idx_messages_group ON messages(group_id, created_at)`,
+
+			// Per-user "delete for me" of group messages
+			`CREATE TABLE IF NOT EXISTS message_deletions (
+				message_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				deleted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (message_id, user_id)
+			)`,
+
+			// Channels table
+			`CREATE TABLE IF NOT EXISTS channels (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				name VARCHAR(100) NOT NULL,
+				description TEXT,
+				avatar_url TEXT,
+				owner_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				is_public BOOLEAN DEFAULT TRUE,
+				subscriber_count INTEGER DEFAULT 0,
+				invite_slug VARCHAR(50) UNIQUE,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+
+			// Channel subscribers table
+			`CREATE TABLE IF NOT EXISTS channel_subscribers (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				channel_id UUID NOT NULL REFERENCES channels(id) ON DELETE CASCADE,
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				role VARCHAR(20) DEFAULT 'subscriber',
+				subscribed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE(channel_id, user_id)
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_channel_subscribers_user ON channel_subscribers(user_id)`,
+
+			// Channel posts are messages with channel_id set
+			`ALTER TABLE messages ADD COLUMN IF NOT EXISTS channel_id UUID REFERENCES channels(id) ON DELETE CASCADE`,
+			`CREATE INDEX IF NOT EXISTS idx_messages_channel ON messages(channel_id, created_at)`,
+
+			// Servers table
+			`CREATE TABLE IF NOT EXISTS servers (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				name VARCHAR(100) NOT NULL,
+				description TEXT,
+				icon_url TEXT,
+				banner_url TEXT,
+				owner_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				is_public BOOLEAN DEFAULT TRUE,
+				member_count INTEGER DEFAULT 0,
+				invite_slug VARCHAR(50) UNIQUE,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+
+			// Server members table
+			`CREATE TABLE IF NOT EXISTS server_members (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				server_id UUID NOT NULL REFERENCES servers(id) ON DELETE CASCADE,
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				role VARCHAR(20) DEFAULT 'member',
+				nickname VARCHAR(100),
+				joined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE(server_id, user_id)
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_server_members_user ON server_members(user_id)`,
+
+			// Server categories table
+			`CREATE TABLE IF NOT EXISTS server_categories (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				server_id UUID NOT NULL REFERENCES servers(id) ON DELETE CASCADE,
+				name VARCHAR(100) NOT NULL,
+				position INTEGER DEFAULT 0,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+
+			// Server text channels table
+			`CREATE TABLE IF NOT EXISTS server_channels (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				server_id UUID NOT NULL REFERENCES servers(id) ON DELETE CASCADE,
+				category_id UUID REFERENCES server_categories(id) ON DELETE SET NULL,
+				name VARCHAR(100) NOT NULL,
+				topic TEXT,
+				position INTEGER DEFAULT 0,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_server_channels_server ON server_channels(server_id, position)`,
+
+			// Server channel messages are messages with server_channel_id set
+			`ALTER TABLE messages ADD COLUMN IF NOT EXISTS server_channel_id UUID REFERENCES server_channels(id) ON DELETE CASCADE`,
+			`CREATE INDEX IF NOT EXISTS idx_messages_server_channel ON messages(server_channel_id, created_at)`,
+
+			// Client-generated message ids make resending a message idempotent
+			`ALTER TABLE messages ADD COLUMN IF NOT EXISTS client_message_id VARCHAR(64)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_client_message ON messages(sender_id, client_message_id)`,
+
+			// Per-user event log for resuming WebSocket sessions
+			`CREATE TABLE IF NOT EXISTS user_event_seqs (
+				user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+				last_seq BIGINT NOT NULL DEFAULT 0
+			)`,
+			`CREATE TABLE IF NOT EXISTS user_events (
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				seq BIGINT NOT NULL,
+				payload TEXT NOT NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (user_id, seq)
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_user_events_created ON user_events(created_at)`,
+
+			// Roles of groups and servers (scope_type is 'group' or 'server')
+			`CREATE TABLE IF NOT EXISTS roles (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				scope_type VARCHAR(10) NOT NULL,
+				scope_id UUID NOT NULL,
+				name VARCHAR(20) NOT NULL,
+				permissions BIGINT NOT NULL DEFAULT 0,
+				position INTEGER NOT NULL DEFAULT 0,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE(scope_type, scope_id, name)
+			)`,
+
+			// Full-text search over message text. The 'simple' configuration does no
+			// stemming, so Russian and English text are matched alike.
+			`ALTER TABLE messages ADD COLUMN IF NOT EXISTS search_vector tsvector
+				GENERATED ALWAYS AS (to_tsvector('simple', coalesce(text, ''))) STORED`,
+			`CREATE INDEX IF NOT EXISTS idx_messages_search ON messages USING GIN(search_vector)`,
+
+			// Self-destructing messages: self_destruct_in is the timer in seconds;
+			// self_destruct_at is set when it starts, on send or on read
+			`ALTER TABLE messages ADD COLUMN IF NOT EXISTS self_destruct_in INTEGER`,
+			`CREATE INDEX IF NOT EXISTS idx_messages_self_destruct ON messages(self_destruct_at) WHERE self_destruct_at IS NOT NULL`,
+
+			// Messages queued to be sent later (status: pending, sending, failed)
+			`CREATE TABLE IF NOT EXISTS scheduled_messages (
+				id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+				sender_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				receiver_id UUID REFERENCES users(id) ON DELETE CASCADE,
+				group_id UUID REFERENCES groups(id) ON DELETE CASCADE,
+				server_channel_id UUID REFERENCES server_channels(id) ON DELETE CASCADE,
+				text TEXT NOT NULL,
+				reply_to_id UUID REFERENCES messages(id) ON DELETE SET NULL,
+				self_destruct_in INTEGER,
+				self_destruct_after_read BOOLEAN NOT NULL DEFAULT false,
+				send_at TIMESTAMP NOT NULL,
+				status VARCHAR(10) NOT NULL DEFAULT 'pending',
+				error TEXT,
+				claimed_at TIMESTAMP,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_scheduled_messages_due ON scheduled_messages(status, send_at)`,
+			`CREATE INDEX IF NOT EXISTS idx_scheduled_messages_sender ON scheduled_messages(sender_id, send_at)`,
+		),
+		down: statements(
+			`DROP TABLE IF EXISTS scheduled_messages, roles, user_events, user_event_seqs, server_members,
+				server_channels, server_categories, servers, channel_subscribers, channels, message_deletions,
+				group_members, groups, reactions, messages, users CASCADE`,
+		),
+	},
+	{
+		// Columns SQLite databases always had and the handlers rely on
+		version: 2,
+		name:    "align_dialects",
+		up: statements(
+			`ALTER TABLE messages ADD COLUMN IF NOT EXISTS read_at TIMESTAMP`,
+			`ALTER TABLE messages ADD COLUMN IF NOT EXISTS edited_at TIMESTAMP`,
+			`ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP`,
+			`ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_for_sender INTEGER DEFAULT 0`,
+			`ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_for_receiver INTEGER DEFAULT 0`,
+		),
+		down: statements(
+			`ALTER TABLE messages
+				DROP COLUMN IF EXISTS read_at,
+				DROP COLUMN IF EXISTS edited_at,
+				DROP COLUMN IF EXISTS deleted_at,
+				DROP COLUMN IF EXISTS deleted_for_sender,
+				DROP COLUMN IF EXISTS deleted_for_receiver`,
+		),
+	},
+	{
+		// Files uploaded by users; message_id is set when one is sent
+		version: 3,
+		name:    "attachments",
+		up: statements(
+			`CREATE TABLE IF NOT EXISTS attachments (
+				id UUID PRIMARY KEY,
+				uploader_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				message_id UUID REFERENCES messages(id) ON DELETE CASCADE,
+				position INTEGER NOT NULL DEFAULT 0,
+				url TEXT NOT NULL,
+				filename VARCHAR(255) NOT NULL,
+				mime_type VARCHAR(100) NOT NULL,
+				kind VARCHAR(10) NOT NULL,
+				size BIGINT NOT NULL,
+				width INTEGER,
+				height INTEGER,
+				duration_ms INTEGER,
+				checksum VARCHAR(64) NOT NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_attachments_message ON attachments(message_id, position)`,
+			`CREATE INDEX IF NOT EXISTS idx_attachments_unsent ON attachments(created_at) WHERE message_id IS NULL`,
+		),
+		down: statements(
+			`DROP TABLE IF EXISTS attachments`,
+		),
+	},
+	{
+		// Resumable uploads; the data of unfinished ones is in the upload spool
+		version: 4,
+		name:    "uploads",
+		up: statements(
+			`CREATE TABLE IF NOT EXISTS uploads (
+				id UUID PRIMARY KEY,
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				filename VARCHAR(255) NOT NULL,
+				length BIGINT NOT NULL,
+				upload_offset BIGINT NOT NULL DEFAULT 0,
+				checksum VARCHAR(64),
+				attachment_id UUID REFERENCES attachments(id) ON DELETE SET NULL,
+				expires_at TIMESTAMP NOT NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_uploads_expires ON uploads(expires_at)`,
+		),
+		down: statements(
+			`DROP TABLE IF EXISTS uploads`,
+		),
+	},
+	{
+		// Thumbnails and blurhash placeholders of uploaded images
+		version: 5,
+		name:    "image_variants",
+		up: statements(
+			`ALTER TABLE attachments ADD COLUMN IF NOT EXISTS thumbnail_url TEXT`,
+			`ALTER TABLE attachments ADD COLUMN IF NOT EXISTS blurhash VARCHAR(64)`,
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_blurhash VARCHAR(64)`,
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS banner_blurhash VARCHAR(64)`,
+		),
+		down: statements(
+			`ALTER TABLE attachments DROP COLUMN IF EXISTS thumbnail_url, DROP COLUMN IF EXISTS blurhash`,
+			`ALTER TABLE users DROP COLUMN IF EXISTS avatar_blurhash, DROP COLUMN IF EXISTS banner_blurhash`,
+		),
+	},
+	{
+		// Logins, each with a refresh token of which only the hash is kept
+		version: 6,
+		name:    "sessions",
+		up: statements(
+			`CREATE TABLE IF NOT EXISTS sessions (
+				id UUID PRIMARY KEY,
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				refresh_hash VARCHAR(64) UNIQUE NOT NULL,
+				previous_hash VARCHAR(64),
+				device VARCHAR(255) NOT NULL DEFAULT '',
+				ip VARCHAR(64) NOT NULL DEFAULT '',
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				last_seen_at TIMESTAMP NOT NULL,
+				expires_at TIMESTAMP NOT NULL,
+				revoked_at TIMESTAMP
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id, last_seen_at)`,
+			`CREATE INDEX IF NOT EXISTS idx_sessions_previous ON sessions(previous_hash)`,
+			`CREATE INDEX IF NOT EXISTS idx_sessions_expires ON sessions(expires_at)`,
+		),
+		down: statements(
+			`DROP TABLE IF EXISTS sessions`,
+		),
+	},
+	{
+		// TOTP two-factor authentication; secrets are sealed, recovery codes hashed
+		version: 7,
+		name:    "two_factor",
+		up: statements(
+			`CREATE TABLE IF NOT EXISTS two_factor (
+				user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+				secret TEXT NOT NULL,
+				enabled_at TIMESTAMP,
+				last_step BIGINT NOT NULL DEFAULT 0,
+				failed_attempts INTEGER NOT NULL DEFAULT 0,
+				locked_until TIMESTAMP,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE TABLE IF NOT EXISTS recovery_codes (
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				code_hash VARCHAR(64) NOT NULL,
+				used_at TIMESTAMP,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (user_id, code_hash)
+			)`,
+		),
+		down: statements(
+			`DROP TABLE IF EXISTS recovery_codes`,
+			`DROP TABLE IF EXISTS two_factor`,
+		),
+	},
+	{
+		// An email address to send password resets to, and the single-use
+		// reset tokens, of which only the hash is kept
+		version: 8,
+		name:    "password_resets",
+		up: statements(
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS email VARCHAR(255)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email ON users(email)`,
+			`CREATE TABLE IF NOT EXISTS password_resets (
+				token_hash VARCHAR(64) PRIMARY KEY,
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				expires_at TIMESTAMP NOT NULL,
+				used_at TIMESTAMP,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_password_resets_user ON password_resets(user_id)`,
+		),
+		down: statements(
+			`DROP TABLE IF EXISTS password_resets`,
+			`DROP INDEX IF EXISTS idx_users_email`,
+			`ALTER TABLE users DROP COLUMN IF EXISTS email`,
+		),
+	},
+	{
+		// Accounts their users deleted: a deletion is scheduled for the end
+		// of a grace period, after which the row stays as an anonymous
+		// tombstone that the messages left in other chats point at
+		version: 9,
+		name:    "account_deletion",
+		up: statements(
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS deletion_scheduled_at TIMESTAMP`,
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP`,
+			`CREATE INDEX IF NOT EXISTS idx_users_deletion_scheduled ON users(deletion_scheduled_at)`,
+		),
+		down: statements(
+			`DROP INDEX IF EXISTS idx_users_deletion_scheduled`,
+			`ALTER TABLE users DROP COLUMN IF EXISTS deleted_at`,
+			`ALTER TABLE users DROP COLUMN IF EXISTS deletion_scheduled_at`,
+		),
+	},
+	{
+		// Users a user blocked. Either way a block keeps two users from
+		// messaging, seeing the typing, reads and presence of, and finding
+		// each other.
+		version: 10,
+		name:    "user_blocks",
+		up: statements(
+			`CREATE TABLE IF NOT EXISTS user_blocks (
+				blocker_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				blocked_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (blocker_id, blocked_id)
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_user_blocks_blocked ON user_blocks(blocked_id)`,
+		),
+		down: statements(
+			`DROP TABLE IF EXISTS user_blocks`,
+		),
+	},
+	{
+		// Rekeys the SQLite search index; search_vector is a column of
+		// messages here, so there is nothing to do
+		version: 11,
+		name:    "message_search_keys",
+		up:      statements(),
+		down:    statements(),
+	},
+	{
+		// Every refresh token a session has spent, not only the last one, so
+		// that replaying any of them ends the session
+		version: 12,
+		name:    "retired_refresh_tokens",
+		up: statements(
+			`CREATE TABLE IF NOT EXISTS retired_refresh_tokens (
+				token_hash VARCHAR(64) PRIMARY KEY,
+				session_id UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+				retired_at TIMESTAMP NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_retired_refresh_tokens_session ON retired_refresh_tokens(session_id)`,
+			`INSERT INTO retired_refresh_tokens (token_hash, session_id, retired_at)
+			 SELECT previous_hash, id, last_seen_at FROM sessions WHERE previous_hash IS NOT NULL
+			 ON CONFLICT DO NOTHING`,
+			`DROP INDEX IF EXISTS idx_sessions_previous`,
+			`ALTER TABLE sessions DROP COLUMN IF EXISTS previous_hash`,
+		),
+		down: statements(
+			`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS previous_hash VARCHAR(64)`,
+			`UPDATE sessions SET previous_hash = (
+				SELECT token_hash FROM retired_refresh_tokens
+				WHERE session_id = sessions.id
+				ORDER BY retired_at DESC LIMIT 1
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_sessions_previous ON sessions(previous_hash)`,
+			`DROP TABLE IF EXISTS retired_refresh_tokens`,
+		),
+	},
 }
@@ -1,9 +1,11 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"log"
 	"os"
+	"strings"
 
 	_ "modernc.org/sqlite"
 )
@@ -14,17 +16,28 @@ func ConnectSQLite() (*sql.DB, error) {
 		dbPath = "./kvant.db"
 	}
 
-	db, err := sql.Open("sqlite", dbPath)
-	if err != nil {
-		return nil, err
+	// Enable foreign keys on every pooled connection, not just the first one,
+	// so ON DELETE CASCADE / SET NULL always apply. Writers from concurrent
+	// requests and hub workers wait for each other instead of failing busy.
+	dsn := dbPath
+	for _, pragma := range []string{"foreign_keys(1)", "busy_timeout(5000)"} {
+		name := pragma[:strings.Index(pragma, "(")]
+		if strings.Contains(dsn, "_pragma="+name) {
+			continue
+		}
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn += sep + "_pragma=" + pragma
 	}
 
-	if err := db.Ping(); err != nil {
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
 		return nil, err
 	}
 
-	// Enable foreign keys
-	if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
+	if err := db.Ping(); err != nil {
 		return nil, err
 	}
 
@@ -32,174 +45,711 @@ func ConnectSQLite() (*sql.DB, error) {
 	return db, nil
 }
 
-func MigrateSQLite(db *sql.DB) error {
-	migrations := []string{
-		// Users table
-		`CREATE TABLE IF NOT EXISTS users (
-			id TEXT PRIMARY KEY,
-			username TEXT UNIQUE NOT NULL,
-			password_hash TEXT NOT NULL,
-			display_name TEXT,
-			bio TEXT,
-			avatar_url TEXT,
-			banner_url TEXT,
-			role TEXT DEFAULT 'user',
-			is_premium INTEGER DEFAULT 0,
-			premium_until DATETIME,
-			name_color TEXT,
-			profile_theme TEXT DEFAULT 'default',
-			bubble_style TEXT DEFAULT 'default',
-			hide_online INTEGER DEFAULT 0,
-			status TEXT DEFAULT 'online',
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		)`,
+// sqliteMigrations is the schema history of SQLite databases; see postgresMigrations
+var sqliteMigrations = []migration{
+	{
+		// The schema before versioned migrations. Databases created by earlier
+		// releases adopt it, getting the columns they are missing on the way.
+		version: 1,
+		name:    "baseline",
+		up: func(ctx context.Context, db execer) error {
+			if err := statements(sqliteTables...)(ctx, db); err != nil {
+				return err
+			}
+			if err := upgradeLegacyMessages(ctx, db); err != nil {
+				return err
+			}
+			err := statements(
+				`CREATE INDEX IF NOT EXISTS idx_messages_group ON messages(group_id, created_at)`,
+				`CREATE INDEX IF NOT EXISTS idx_messages_channel ON messages(channel_id, created_at)`,
+				`CREATE INDEX IF NOT EXISTS idx_messages_server_channel ON messages(server_channel_id, created_at)`,
+				`CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_client_message ON messages(sender_id, client_message_id)`,
+				`CREATE INDEX IF NOT EXISTS idx_messages_self_destruct ON messages(self_destruct_at) WHERE self_destruct_at IS NOT NULL`,
+			)(ctx, db)
+			if err != nil {
+				return err
+			}
+			// Full-text search index over message text
+			return createMessagesFTS(ctx, db)
+		},
+		down: statements(
+			`DROP TABLE IF EXISTS messages_fts`,
+			`DROP TABLE IF EXISTS scheduled_messages`,
+			`DROP TABLE IF EXISTS roles`,
+			`DROP TABLE IF EXISTS user_events`,
+			`DROP TABLE IF EXISTS user_event_seqs`,
+			`DROP TABLE IF EXISTS server_members`,
+			`DROP TABLE IF EXISTS server_channels`,
+			`DROP TABLE IF EXISTS server_categories`,
+			`DROP TABLE IF EXISTS servers`,
+			`DROP TABLE IF EXISTS channel_subscribers`,
+			`DROP TABLE IF EXISTS channels`,
+			`DROP TABLE IF EXISTS message_deletions`,
+			`DROP TABLE IF EXISTS group_members`,
+			`DROP TABLE IF EXISTS groups`,
+			`DROP TABLE IF EXISTS reactions`,
+			`DROP TABLE IF EXISTS messages`,
+			`DROP TABLE IF EXISTS users`,
+		),
+	},
+	{
+		// The user tag PostgreSQL databases always had. SQLite cannot add a
+		// UNIQUE column, so uniqueness comes from an index.
+		version: 2,
+		name:    "align_dialects",
+		up: statements(
+			`ALTER TABLE users ADD COLUMN tag TEXT`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_tag ON users(tag)`,
+		),
+		down: statements(
+			`DROP INDEX IF EXISTS idx_users_tag`,
+			`ALTER TABLE users DROP COLUMN tag`,
+		),
+	},
+	{
+		version: 3,
+		name:    "attachments",
+		up: statements(
+			`CREATE TABLE IF NOT EXISTS attachments (
+				id TEXT PRIMARY KEY,
+				uploader_id TEXT NOT NULL,
+				message_id TEXT,
+				position INTEGER NOT NULL DEFAULT 0,
+				url TEXT NOT NULL,
+				filename TEXT NOT NULL,
+				mime_type TEXT NOT NULL,
+				kind TEXT NOT NULL,
+				size INTEGER NOT NULL,
+				width INTEGER,
+				height INTEGER,
+				duration_ms INTEGER,
+				checksum TEXT NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (uploader_id) REFERENCES users(id) ON DELETE CASCADE,
+				FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_attachments_message ON attachments(message_id, position)`,
+			`CREATE INDEX IF NOT EXISTS idx_attachments_unsent ON attachments(created_at) WHERE message_id IS NULL`,
+		),
+		down: statements(
+			`DROP TABLE IF EXISTS attachments`,
+		),
+	},
+	{
+		version: 4,
+		name:    "uploads",
+		up: statements(
+			`CREATE TABLE IF NOT EXISTS uploads (
+				id TEXT PRIMARY KEY,
+				user_id TEXT NOT NULL,
+				filename TEXT NOT NULL,
+				length INTEGER NOT NULL,
+				upload_offset INTEGER NOT NULL DEFAULT 0,
+				checksum TEXT,
+				attachment_id TEXT,
+				expires_at DATETIME NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+				FOREIGN KEY (attachment_id) REFERENCES attachments(id) ON DELETE SET NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_uploads_expires ON uploads(expires_at)`,
+		),
+		down: statements(
+			`DROP TABLE IF EXISTS uploads`,
+		),
+	},
+	{
+		version: 5,
+		name:    "image_variants",
+		up: statements(
+			`ALTER TABLE attachments ADD COLUMN thumbnail_url TEXT`,
+			`ALTER TABLE attachments ADD COLUMN blurhash TEXT`,
+			`ALTER TABLE users ADD COLUMN avatar_blurhash TEXT`,
+			`ALTER TABLE users ADD COLUMN banner_blurhash TEXT`,
+		),
+		down: statements(
+			`ALTER TABLE attachments DROP COLUMN thumbnail_url`,
+			`ALTER TABLE attachments DROP COLUMN blurhash`,
+			`ALTER TABLE users DROP COLUMN avatar_blurhash`,
+			`ALTER TABLE users DROP COLUMN banner_blurhash`,
+		),
+	},
+	{
+		version: 6,
+		name:    "sessions",
+		up: statements(
+			`CREATE TABLE IF NOT EXISTS sessions (
+				id TEXT PRIMARY KEY,
+				user_id TEXT NOT NULL,
+				refresh_hash TEXT UNIQUE NOT NULL,
+				previous_hash TEXT,
+				device TEXT NOT NULL DEFAULT '',
+				ip TEXT NOT NULL DEFAULT '',
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				last_seen_at DATETIME NOT NULL,
+				expires_at DATETIME NOT NULL,
+				revoked_at DATETIME,
+				FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id, last_seen_at)`,
+			`CREATE INDEX IF NOT EXISTS idx_sessions_previous ON sessions(previous_hash)`,
+			`CREATE INDEX IF NOT EXISTS idx_sessions_expires ON sessions(expires_at)`,
+		),
+		down: statements(
+			`DROP TABLE IF EXISTS sessions`,
+		),
+	},
+	{
+		version: 7,
+		name:    "two_factor",
+		up: statements(
+			`CREATE TABLE IF NOT EXISTS two_factor (
+				user_id TEXT PRIMARY KEY,
+				secret TEXT NOT NULL,
+				enabled_at DATETIME,
+				last_step INTEGER NOT NULL DEFAULT 0,
+				failed_attempts INTEGER NOT NULL DEFAULT 0,
+				locked_until DATETIME,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			)`,
+			`CREATE TABLE IF NOT EXISTS recovery_codes (
+				user_id TEXT NOT NULL,
+				code_hash TEXT NOT NULL,
+				used_at DATETIME,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (user_id, code_hash),
+				FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			)`,
+		),
+		down: statements(
+			`DROP TABLE IF EXISTS recovery_codes`,
+			`DROP TABLE IF EXISTS two_factor`,
+		),
+	},
+	{
+		version: 8,
+		name:    "password_resets",
+		up: statements(
+			`ALTER TABLE users ADD COLUMN email TEXT`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email ON users(email)`,
+			`CREATE TABLE IF NOT EXISTS password_resets (
+				token_hash TEXT PRIMARY KEY,
+				user_id TEXT NOT NULL,
+				expires_at DATETIME NOT NULL,
+				used_at DATETIME,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_password_resets_user ON password_resets(user_id)`,
+		),
+		down: statements(
+			`DROP TABLE IF EXISTS password_resets`,
+			`DROP INDEX IF EXISTS idx_users_email`,
+			`ALTER TABLE users DROP COLUMN email`,
+		),
+	},
+	{
+		version: 9,
+		name:    "account_deletion",
+		up: statements(
+			`ALTER TABLE users ADD COLUMN deletion_scheduled_at DATETIME`,
+			`ALTER TABLE users ADD COLUMN deleted_at DATETIME`,
+			`CREATE INDEX IF NOT EXISTS idx_users_deletion_scheduled ON users(deletion_scheduled_at)`,
+		),
+		down: statements(
+			`DROP INDEX IF EXISTS idx_users_deletion_scheduled`,
+			`ALTER TABLE users DROP COLUMN deleted_at`,
+			`ALTER TABLE users DROP COLUMN deletion_scheduled_at`,
+		),
+	},
+	{
+		version: 10,
+		name:    "user_blocks",
+		up: statements(
+			`CREATE TABLE IF NOT EXISTS user_blocks (
+				blocker_id TEXT NOT NULL,
+				blocked_id TEXT NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (blocker_id, blocked_id),
+				FOREIGN KEY (blocker_id) REFERENCES users(id) ON DELETE CASCADE,
+				FOREIGN KEY (blocked_id) REFERENCES users(id) ON DELETE CASCADE
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_user_blocks_blocked ON user_blocks(blocked_id)`,
+		),
+		down: statements(
+			`DROP TABLE IF EXISTS user_blocks`,
+		),
+	},
+	{
+		// The search index of the baseline refers to messages by their
+		// implicit rowid, which a VACUUM or a rebuild of the table may
+		// renumber. It becomes a regular FTS5 table keyed on messages_fts_keys,
+		// whose INTEGER PRIMARY KEY is stable.
+		version: 11,
+		name:    "message_search_keys",
+		up:      keyMessagesFTS,
+		down: func(ctx context.Context, db execer) error {
+			err := statements(
+				`DROP TRIGGER IF EXISTS messages_fts_insert`,
+				`DROP TRIGGER IF EXISTS messages_fts_delete`,
+				`DROP TRIGGER IF EXISTS messages_fts_update`,
+				`DROP TABLE IF EXISTS messages_fts`,
+				`DROP TABLE IF EXISTS messages_fts_keys`,
+			)(ctx, db)
+			if err != nil {
+				return err
+			}
+			return createMessagesFTS(ctx, db)
+		},
+	},
+	{
+		// Every refresh token a session has spent, not only the last one, so
+		// that replaying any of them ends the session
+		version: 12,
+		name:    "retired_refresh_tokens",
+		up: statements(
+			`CREATE TABLE IF NOT EXISTS retired_refresh_tokens (
+				token_hash TEXT PRIMARY KEY,
+				session_id TEXT NOT NULL,
+				retired_at DATETIME NOT NULL,
+				FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_retired_refresh_tokens_session ON retired_refresh_tokens(session_id)`,
+			`INSERT OR IGNORE INTO retired_refresh_tokens (token_hash, session_id, retired_at)
+			 SELECT previous_hash, id, last_seen_at FROM sessions WHERE previous_hash IS NOT NULL`,
+			`DROP INDEX IF EXISTS idx_sessions_previous`,
+			`ALTER TABLE sessions DROP COLUMN previous_hash`,
+		),
+		down: statements(
+			`ALTER TABLE sessions ADD COLUMN previous_hash TEXT`,
+			`UPDATE sessions SET previous_hash = (
+				SELECT token_hash FROM retired_refresh_tokens
+				WHERE session_id = sessions.id
+				ORDER BY retired_at DESC LIMIT 1
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_sessions_previous ON sessions(previous_hash)`,
+			`DROP TABLE IF EXISTS retired_refresh_tokens`,
+		),
+	},
+}
 
-		// Messages table
-		`CREATE TABLE IF NOT EXISTS messages (
-			id TEXT PRIMARY KEY,
-			sender_id TEXT NOT NULL,
-			receiver_id TEXT NOT NULL,
-			text TEXT NOT NULL,
-			message_type TEXT DEFAULT 'text',
-			file_url TEXT,
-			is_read INTEGER DEFAULT 0,
-			reply_to_id TEXT,
-			self_destruct_at DATETIME,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			updated_at DATETIME,
-			pinned_at DATETIME,
-			FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE CASCADE,
-			FOREIGN KEY (receiver_id) REFERENCES users(id) ON DELETE CASCADE
-		)`,
+// sqliteTables creates the tables of the baseline schema
+var sqliteTables = []string{
+	// Users table
+	`CREATE TABLE IF NOT EXISTS users (
+		id TEXT PRIMARY KEY,
+		username TEXT UNIQUE NOT NULL,
+		password_hash TEXT NOT NULL,
+		display_name TEXT,
+		bio TEXT,
+		avatar_url TEXT,
+		banner_url TEXT,
+		role TEXT DEFAULT 'user',
+		is_premium INTEGER DEFAULT 0,
+		premium_until DATETIME,
+		name_color TEXT,
+		profile_theme TEXT DEFAULT 'default',
+		bubble_style TEXT DEFAULT 'default',
+		hide_online INTEGER DEFAULT 0,
+		status TEXT DEFAULT 'online',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`,
 
-		// Indexes for messages
-		`CREATE INDEX IF NOT EXISTS idx_messages_sender ON messages(sender_id)`,
-		`CREATE INDEX IF NOT EXISTS idx_messages_receiver ON messages(receiver_id)`,
-		`CREATE INDEX IF NOT EXISTS idx_messages_created ON messages(created_at DESC)`,
+	// Messages table. It targets a user, group, channel or server channel;
+	// deleted_for_* hide a direct message from one side.
+	`CREATE TABLE IF NOT EXISTS messages (
+		id TEXT PRIMARY KEY,
+		sender_id TEXT NOT NULL,
+		receiver_id TEXT,
+		group_id TEXT,
+		channel_id TEXT REFERENCES channels(id) ON DELETE CASCADE,
+		server_channel_id TEXT REFERENCES server_channels(id) ON DELETE CASCADE,
+		text TEXT NOT NULL,
+		message_type TEXT DEFAULT 'text',
+		file_url TEXT,
+		is_read INTEGER DEFAULT 0,
+		reply_to_id TEXT,
+		client_message_id TEXT,
+		self_destruct_in INTEGER,
+		self_destruct_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME,
+		pinned_at DATETIME,
+		read_at DATETIME,
+		edited_at DATETIME,
+		deleted_at DATETIME,
+		deleted_for_sender INTEGER DEFAULT 0,
+		deleted_for_receiver INTEGER DEFAULT 0,
+		FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (receiver_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (group_id) REFERENCES groups(id) ON DELETE CASCADE
+	)`,
 
-		// Reactions table
-		`CREATE TABLE IF NOT EXISTS reactions (
-			id TEXT PRIMARY KEY,
-			message_id TEXT NOT NULL,
-			user_id TEXT NOT NULL,
-			emoji TEXT NOT NULL,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
-			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
-			UNIQUE(message_id, user_id, emoji)
-		)`,
+	// Indexes for messages
+	`CREATE INDEX IF NOT EXISTS idx_messages_sender ON messages(sender_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_messages_receiver ON messages(receiver_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_messages_created ON messages(created_at DESC)`,
 
-		// Groups table
-		`CREATE TABLE IF NOT EXISTS groups (
-			id TEXT PRIMARY KEY,
-			name TEXT NOT NULL,
-			description TEXT,
-			avatar_url TEXT,
-			owner_id TEXT NOT NULL,
-			is_public INTEGER DEFAULT 0,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
-		)`,
+	// Reactions table
+	`CREATE TABLE IF NOT EXISTS reactions (
+		id TEXT PRIMARY KEY,
+		message_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		emoji TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		UNIQUE(message_id, user_id, emoji)
+	)`,
 
-		// Group members table
-		`CREATE TABLE IF NOT EXISTS group_members (
-			id TEXT PRIMARY KEY,
-			group_id TEXT NOT NULL,
-			user_id TEXT NOT NULL,
-			role TEXT DEFAULT 'member',
-			joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (group_id) REFERENCES groups(id) ON DELETE CASCADE,
-			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
-			UNIQUE(group_id, user_id)
-		)`,
+	// Groups table
+	`CREATE TABLE IF NOT EXISTS groups (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		description TEXT,
+		avatar_url TEXT,
+		owner_id TEXT NOT NULL,
+		is_public INTEGER DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+	)`,
 
-		// Channels table
-		`CREATE TABLE IF NOT EXISTS channels (
-			id TEXT PRIMARY KEY,
-			name TEXT NOT NULL,
-			description TEXT,
-			avatar_url TEXT,
-			owner_id TEXT NOT NULL,
-			is_public INTEGER DEFAULT 1,
-			subscriber_count INTEGER DEFAULT 0,
-			invite_slug TEXT UNIQUE,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
-		)`,
+	// Group members table
+	`CREATE TABLE IF NOT EXISTS group_members (
+		id TEXT PRIMARY KEY,
+		group_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		role TEXT DEFAULT 'member',
+		joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (group_id) REFERENCES groups(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		UNIQUE(group_id, user_id)
+	)`,
 
-		// Servers table
-		`CREATE TABLE IF NOT EXISTS servers (
-			id TEXT PRIMARY KEY,
-			name TEXT NOT NULL,
-			description TEXT,
-			icon_url TEXT,
-			banner_url TEXT,
-			owner_id TEXT NOT NULL,
-			is_public INTEGER DEFAULT 1,
-			member_count INTEGER DEFAULT 0,
-			invite_slug TEXT UNIQUE,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
-		)`,
-	}
+	// Per-user "delete for me" of group messages
+	`CREATE TABLE IF NOT EXISTS message_deletions (
+		message_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		deleted_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (message_id, user_id),
+		FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`,
+
+	// Channels table
+	`CREATE TABLE IF NOT EXISTS channels (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		description TEXT,
+		avatar_url TEXT,
+		owner_id TEXT NOT NULL,
+		is_public INTEGER DEFAULT 1,
+		subscriber_count INTEGER DEFAULT 0,
+		invite_slug TEXT UNIQUE,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+	)`,
+
+	// Channel subscribers table
+	`CREATE TABLE IF NOT EXISTS channel_subscribers (
+		id TEXT PRIMARY KEY,
+		channel_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		role TEXT DEFAULT 'subscriber',
+		subscribed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		UNIQUE(channel_id, user_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_channel_subscribers_user ON channel_subscribers(user_id)`,
+
+	// Servers table
+	`CREATE TABLE IF NOT EXISTS servers (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		description TEXT,
+		icon_url TEXT,
+		banner_url TEXT,
+		owner_id TEXT NOT NULL,
+		is_public INTEGER DEFAULT 1,
+		member_count INTEGER DEFAULT 0,
+		invite_slug TEXT UNIQUE,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+	)`,
+
+	// Server members table
+	`CREATE TABLE IF NOT EXISTS server_members (
+		id TEXT PRIMARY KEY,
+		server_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		role TEXT DEFAULT 'member',
+		nickname TEXT,
+		joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (server_id) REFERENCES servers(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		UNIQUE(server_id, user_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_server_members_user ON server_members(user_id)`,
+
+	// Server categories table
+	`CREATE TABLE IF NOT EXISTS server_categories (
+		id TEXT PRIMARY KEY,
+		server_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		position INTEGER DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (server_id) REFERENCES servers(id) ON DELETE CASCADE
+	)`,
 
-	for _, migration := range migrations {
-		if _, err := db.Exec(migration); err != nil {
-			log.Printf("Migration error: %v", err)
+	// Server text channels table
+	`CREATE TABLE IF NOT EXISTS server_channels (
+		id TEXT PRIMARY KEY,
+		server_id TEXT NOT NULL,
+		category_id TEXT,
+		name TEXT NOT NULL,
+		topic TEXT,
+		position INTEGER DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (server_id) REFERENCES servers(id) ON DELETE CASCADE,
+		FOREIGN KEY (category_id) REFERENCES server_categories(id) ON DELETE SET NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_server_channels_server ON server_channels(server_id, position)`,
+
+	// Per-user event log for resuming WebSocket sessions
+	`CREATE TABLE IF NOT EXISTS user_event_seqs (
+		user_id TEXT PRIMARY KEY,
+		last_seq INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`,
+	`CREATE TABLE IF NOT EXISTS user_events (
+		user_id TEXT NOT NULL,
+		seq INTEGER NOT NULL,
+		payload TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, seq),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_user_events_created ON user_events(created_at)`,
+
+	// Roles of groups and servers (scope_type is 'group' or 'server')
+	`CREATE TABLE IF NOT EXISTS roles (
+		id TEXT PRIMARY KEY,
+		scope_type TEXT NOT NULL,
+		scope_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		permissions INTEGER NOT NULL DEFAULT 0,
+		position INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(scope_type, scope_id, name)
+	)`,
+
+	// Messages queued to be sent later (status: pending, sending, failed)
+	`CREATE TABLE IF NOT EXISTS scheduled_messages (
+		id TEXT PRIMARY KEY,
+		sender_id TEXT NOT NULL,
+		receiver_id TEXT,
+		group_id TEXT,
+		server_channel_id TEXT,
+		text TEXT NOT NULL,
+		reply_to_id TEXT,
+		self_destruct_in INTEGER,
+		self_destruct_after_read INTEGER NOT NULL DEFAULT 0,
+		send_at DATETIME NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		error TEXT,
+		claimed_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME,
+		FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (receiver_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (group_id) REFERENCES groups(id) ON DELETE CASCADE,
+		FOREIGN KEY (server_channel_id) REFERENCES server_channels(id) ON DELETE CASCADE,
+		FOREIGN KEY (reply_to_id) REFERENCES messages(id) ON DELETE SET NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_scheduled_messages_due ON scheduled_messages(status, send_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_scheduled_messages_sender ON scheduled_messages(sender_id, send_at)`,
+}
+
+// upgradeLegacyMessages adds the message columns that databases created by
+// early releases lack, in the order those releases added them
+func upgradeLegacyMessages(ctx context.Context, db execer) error {
+	columns := []struct{ name, definition string }{
+		{"read_at", "DATETIME"},
+		{"edited_at", "DATETIME"},
+		{"deleted_at", "DATETIME"},
+		{"deleted_for_sender", "INTEGER DEFAULT 0"},
+		{"deleted_for_receiver", "INTEGER DEFAULT 0"},
+		{"pinned_at", "DATETIME"},
+	}
+	for _, column := range columns {
+		if err := addMissingColumn(ctx, db, "messages", column.name, column.definition); err != nil {
 			return err
 		}
 	}
 
-	// Add read_at column to messages if not exists (safe migration)
-	var columnExists bool
-	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('messages') WHERE name='read_at'`).Scan(&columnExists)
-	if err == nil && !columnExists {
-		if _, err := db.Exec(`ALTER TABLE messages ADD COLUMN read_at DATETIME`); err != nil {
-			log.Printf("Warning: Could not add read_at column: %v", err)
-		}
+	// Group messages: receiver_id must become nullable and group_id must exist.
+	// SQLite cannot alter column constraints, so old tables are rebuilt.
+	if err := rebuildMessagesForGroups(ctx, db); err != nil {
+		return err
 	}
 
-	// Add edited_at column to messages if not exists (safe migration)
-	err = db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('messages') WHERE name='edited_at'`).Scan(&columnExists)
-	if err == nil && !columnExists {
-		if _, err := db.Exec(`ALTER TABLE messages ADD COLUMN edited_at DATETIME`); err != nil {
-			log.Printf("Warning: Could not add edited_at column: %v", err)
+	columns = []struct{ name, definition string }{
+		{"channel_id", "TEXT REFERENCES channels(id) ON DELETE CASCADE"},
+		{"server_channel_id", "TEXT REFERENCES server_channels(id) ON DELETE CASCADE"},
+		{"client_message_id", "TEXT"},
+		{"self_destruct_in", "INTEGER"},
+	}
+	for _, column := range columns {
+		if err := addMissingColumn(ctx, db, "messages", column.name, column.definition); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	// Add deleted_at column to messages if not exists
-	err = db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('messages') WHERE name='deleted_at'`).Scan(&columnExists)
-	if err == nil && !columnExists {
-		if _, err := db.Exec(`ALTER TABLE messages ADD COLUMN deleted_at DATETIME`); err != nil {
-			log.Printf("Warning: Could not add deleted_at column: %v", err)
-		}
+// addMissingColumn adds a column to a table unless it already has it
+func addMissingColumn(ctx context.Context, db execer, table, column, definition string) error {
+	var exists int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&exists)
+	if err != nil || exists > 0 {
+		return err
 	}
+	_, err = db.ExecContext(ctx, `ALTER TABLE `+table+` ADD COLUMN `+column+` `+definition)
+	return err
+}
 
-	// Add deleted_for_sender column to messages if not exists
-	err = db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('messages') WHERE name='deleted_for_sender'`).Scan(&columnExists)
-	if err == nil && !columnExists {
-		if _, err := db.Exec(`ALTER TABLE messages ADD COLUMN deleted_for_sender INTEGER DEFAULT 0`); err != nil {
-			log.Printf("Warning: Could not add deleted_for_sender column: %v", err)
-		}
+// createMessagesFTS creates the FTS5 index of message text of the baseline
+// and the triggers keeping it in sync, and indexes existing messages the
+// first time. The index refers to messages by rowid; keyMessagesFTS
+// replaces it.
+func createMessagesFTS(ctx context.Context, db execer) error {
+	var exists int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='messages_fts'`).Scan(&exists)
+	if err != nil {
+		return err
 	}
 
-	// Add deleted_for_receiver column to messages if not exists
-	err = db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('messages') WHERE name='deleted_for_receiver'`).Scan(&columnExists)
-	if err == nil && !columnExists {
-		if _, err := db.Exec(`ALTER TABLE messages ADD COLUMN deleted_for_receiver INTEGER DEFAULT 0`); err != nil {
-			log.Printf("Warning: Could not add deleted_for_receiver column: %v", err)
-		}
+	stmts := []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+			text, content='messages', content_rowid='rowid', tokenize='unicode61 remove_diacritics 2'
+		)`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+			INSERT INTO messages_fts(rowid, text) VALUES (new.rowid, new.text);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+			INSERT INTO messages_fts(messages_fts, rowid, text) VALUES ('delete', old.rowid, old.text);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF text ON messages BEGIN
+			INSERT INTO messages_fts(messages_fts, rowid, text) VALUES ('delete', old.rowid, old.text);
+			INSERT INTO messages_fts(rowid, text) VALUES (new.rowid, new.text);
+		END`,
+	}
+	if exists == 0 {
+		stmts = append(stmts, `INSERT INTO messages_fts(messages_fts) VALUES('rebuild')`)
 	}
+	return statements(stmts...)(ctx, db)
+}
 
-	// Add pinned_at column to messages if not exists
-	err = db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('messages') WHERE name='pinned_at'`).Scan(&columnExists)
-	if err == nil && !columnExists {
-		if _, err := db.Exec(`ALTER TABLE messages ADD COLUMN pinned_at DATETIME`); err != nil {
-			log.Printf("Warning: Could not add pinned_at column: %v", err)
-		}
+// keyMessagesFTS replaces the search index with a regular FTS5 table, which
+// keeps its own copy of the text, keyed on messages_fts_keys, and indexes
+// every message into it
+func keyMessagesFTS(ctx context.Context, db execer) error {
+	return statements(
+		`DROP TRIGGER IF EXISTS messages_fts_insert`,
+		`DROP TRIGGER IF EXISTS messages_fts_delete`,
+		`DROP TRIGGER IF EXISTS messages_fts_update`,
+		`DROP TABLE IF EXISTS messages_fts`,
+		`CREATE TABLE IF NOT EXISTS messages_fts_keys (
+			id INTEGER PRIMARY KEY,
+			message_id TEXT NOT NULL UNIQUE
+		)`,
+		`CREATE VIRTUAL TABLE messages_fts USING fts5(
+			text, tokenize='unicode61 remove_diacritics 2'
+		)`,
+		`CREATE TRIGGER messages_fts_insert AFTER INSERT ON messages BEGIN
+			INSERT INTO messages_fts_keys (message_id) VALUES (new.id);
+			INSERT INTO messages_fts (rowid, text)
+			VALUES ((SELECT id FROM messages_fts_keys WHERE message_id = new.id), new.text);
+		END`,
+		`CREATE TRIGGER messages_fts_delete AFTER DELETE ON messages BEGIN
+			DELETE FROM messages_fts WHERE rowid = (SELECT id FROM messages_fts_keys WHERE message_id = old.id);
+			DELETE FROM messages_fts_keys WHERE message_id = old.id;
+		END`,
+		`CREATE TRIGGER messages_fts_update AFTER UPDATE OF text ON messages BEGIN
+			UPDATE messages_fts SET text = new.text
+			WHERE rowid = (SELECT id FROM messages_fts_keys WHERE message_id = new.id);
+		END`,
+		`DELETE FROM messages_fts_keys`,
+		`INSERT INTO messages_fts_keys (message_id) SELECT id FROM messages ORDER BY created_at, id`,
+		`INSERT INTO messages_fts (rowid, text)
+		 SELECT k.id, m.text FROM messages_fts_keys k JOIN messages m ON m.id = k.message_id`,
+	)(ctx, db)
+}
+
+// rebuildMessagesForGroups recreates the messages table without the NOT NULL
+// constraint on receiver_id and with a group_id column, keeping all rows.
+// Foreign keys must be off, or dropping the old table cascades into reactions.
+func rebuildMessagesForGroups(ctx context.Context, db execer) error {
+	var receiverNotNull, groupColumns int
+	err := db.QueryRowContext(ctx, `SELECT "notnull" FROM pragma_table_info('messages') WHERE name='receiver_id'`).Scan(&receiverNotNull)
+	if err != nil {
+		return err
+	}
+	err = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM pragma_table_info('messages') WHERE name='group_id'`).Scan(&groupColumns)
+	if err != nil {
+		return err
+	}
+	if receiverNotNull == 0 && groupColumns > 0 {
+		return nil
+	}
+
+	err = statements(
+		`CREATE TABLE messages_new (
+			id TEXT PRIMARY KEY,
+			sender_id TEXT NOT NULL,
+			receiver_id TEXT,
+			group_id TEXT,
+			text TEXT NOT NULL,
+			message_type TEXT DEFAULT 'text',
+			file_url TEXT,
+			is_read INTEGER DEFAULT 0,
+			reply_to_id TEXT,
+			self_destruct_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME,
+			pinned_at DATETIME,
+			read_at DATETIME,
+			edited_at DATETIME,
+			deleted_at DATETIME,
+			deleted_for_sender INTEGER DEFAULT 0,
+			deleted_for_receiver INTEGER DEFAULT 0,
+			FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY (receiver_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY (group_id) REFERENCES groups(id) ON DELETE CASCADE
+		)`,
+		`INSERT INTO messages_new (
+			id, sender_id, receiver_id, text, message_type, file_url, is_read, reply_to_id,
+			self_destruct_at, created_at, updated_at, pinned_at, read_at, edited_at,
+			deleted_at, deleted_for_sender, deleted_for_receiver
+		)
+		SELECT
+			id, sender_id, receiver_id, text, message_type, file_url, is_read, reply_to_id,
+			self_destruct_at, created_at, updated_at, pinned_at, read_at, edited_at,
+			deleted_at, deleted_for_sender, deleted_for_receiver
+		FROM messages`,
+		`DROP TABLE messages`,
+		`ALTER TABLE messages_new RENAME TO messages`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_sender ON messages(sender_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_receiver ON messages(receiver_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_created ON messages(created_at DESC)`,
+	)(ctx, db)
+	if err != nil {
+		return err
 	}
 
-	log.Println("✅ SQLite database migrations completed")
+	log.Println("✅ Rebuilt messages table for group messages")
 	return nil
 }
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/kvant/messenger/internal/middleware"
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// DeleteAccount schedules the deletion of the account of the user at the end
+// of the grace period and logs it out everywhere. Logging in before then
+// cancels it; after, the reaper purges the account.
+func (h *AuthHandler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+
+	var req models.DeleteAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	if _, ok := h.checkPassword(w, r, userID, req.Password); !ok {
+		return
+	}
+
+	// With two-factor authentication a stolen password is not enough either
+	twoFactor, err := h.twoFactor.Get(r.Context(), userID)
+	if err != nil && err != store.ErrNotFound {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to load two-factor settings")
+		return
+	}
+	if err == nil && twoFactor.EnabledAt != nil {
+		if err := h.checkSecondFactor(r.Context(), twoFactor, req.Code, req.RecoveryCode); err != nil {
+			respondCodeError(w, err)
+			return
+		}
+	}
+
+	at := time.Now().Add(h.deletionGrace).UTC().Truncate(time.Second)
+	if err := h.users.ScheduleDeletion(r.Context(), userID, at); err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete account")
+		return
+	}
+
+	revoked, err := h.sessions.RevokeOthers(r.Context(), userID, "")
+	for _, sessionID := range revoked {
+		h.hub.RevokeSession(userID, sessionID)
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to end sessions")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"success":               true,
+		"deletion_scheduled_at": at,
+	})
+}
@@ -3,19 +3,103 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"log"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/gorilla/mux"
+	"github.com/kvant/messenger/internal/middleware"
 	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/notify"
+	"github.com/kvant/messenger/internal/ratelimit"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/internal/websocket"
 	"github.com/kvant/messenger/pkg/utils"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// accountLoginLimit limits logins to one account, whatever address they
+// come from
+var accountLoginLimit = ratelimit.Limit{Burst: 10, Every: time.Minute}
+
+// An account whose password is guessed wrong loginFreeFailures times in a
+// row is locked out, for loginLockout at first and twice as long after every
+// further wrong guess, up to loginMaxLockout
+const (
+	loginFreeFailures = 5
+	loginLockout      = time.Minute
+	loginMaxLockout   = time.Hour
+)
+
+// dummyHash is compared with the password given for an unknown username, so
+// that the answer takes as long as for a wrong password
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("kvant-dummy-password"), bcrypt.DefaultCost)
+
 type AuthHandler struct {
-	db *sql.DB
+	users     store.UserStore
+	sessions  store.SessionStore
+	twoFactor store.TwoFactorStore
+	resets    store.PasswordResetStore
+	hub       *websocket.Hub
+	notifier  notify.Notifier
+	// accountLogins and failedLogins limit logins per username
+	accountLogins *ratelimit.Limiter
+	failedLogins  *ratelimit.Lockout
+	// resetRequests limits reset links per account
+	resetRequests *ratelimit.Limiter
+	// resetURL is the page of the client reset links open, PASSWORD_RESET_URL
+	resetURL string
+	// resetTTL is how long a reset link works, PASSWORD_RESET_TTL
+	resetTTL time.Duration
+	// accessTTL is the lifetime of access tokens, ACCESS_TOKEN_TTL
+	accessTTL time.Duration
+	// refreshTTL is how long a session lasts unused, REFRESH_TOKEN_TTL
+	refreshTTL time.Duration
+	// deletionGrace is how long a deleted account can still be restored by
+	// logging in, ACCOUNT_DELETION_GRACE
+	deletionGrace time.Duration
 }
 
-func NewAuthHandler(db *sql.DB) *AuthHandler {
-	return &AuthHandler{db: db}
+func NewAuthHandler(db *sql.DB, hub *websocket.Hub, limits ratelimit.Store, notifier notify.Notifier) *AuthHandler {
+	accessTTL := 15 * time.Minute
+	if d, err := time.ParseDuration(os.Getenv("ACCESS_TOKEN_TTL")); err == nil && d > 0 {
+		accessTTL = d
+	}
+	refreshTTL := 30 * 24 * time.Hour
+	if d, err := time.ParseDuration(os.Getenv("REFRESH_TOKEN_TTL")); err == nil && d > 0 {
+		refreshTTL = d
+	}
+	resetTTL := time.Hour
+	if d, err := time.ParseDuration(os.Getenv("PASSWORD_RESET_TTL")); err == nil && d > 0 {
+		resetTTL = d
+	}
+	deletionGrace := 14 * 24 * time.Hour
+	if d, err := time.ParseDuration(os.Getenv("ACCOUNT_DELETION_GRACE")); err == nil && d > 0 {
+		deletionGrace = d
+	}
+	resetURL := os.Getenv("PASSWORD_RESET_URL")
+	if resetURL == "" {
+		resetURL = "http://localhost:5173/reset-password"
+	}
+	stores := store.New(db)
+	return &AuthHandler{
+		users:         stores.Users,
+		sessions:      stores.Sessions,
+		twoFactor:     stores.TwoFactor,
+		resets:        stores.Resets,
+		hub:           hub,
+		notifier:      notifier,
+		accountLogins: ratelimit.NewLimiter(limits, "login-account", accountLoginLimit),
+		failedLogins:  ratelimit.NewLockout(limits, "login-failures", loginFreeFailures, loginLockout, loginMaxLockout),
+		resetRequests: ratelimit.NewLimiter(limits, "password-reset-account", resetRequestLimit),
+		resetURL:      resetURL,
+		resetTTL:      resetTTL,
+		accessTTL:     accessTTL,
+		refreshTTL:    refreshTTL,
+		deletionGrace: deletionGrace,
+	}
 }
 
 func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
@@ -34,12 +118,7 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(req.Password) < 6 {
-		utils.RespondJSON(w, http.StatusBadRequest, map[string]interface{}{
-			"success": false,
-			"error":   "INVALID_PASSWORD_LENGTH",
-			"message": "Пароль должен быть не менее 6 символов",
-		})
+	if !validPassword(w, req.Password) {
 		return
 	}
 
@@ -49,20 +128,9 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID := utils.GenerateUUID()
-	var user models.User
-
-	err = h.db.QueryRow(`
-		INSERT INTO users (id, username, password_hash)
-		VALUES ($1, $2, $3)
-		RETURNING id, username, role, is_premium, profile_theme, bubble_style, hide_online, status, created_at, updated_at
-	`, userID, req.Username, string(hashedPassword)).Scan(
-		&user.ID, &user.Username, &user.Role, &user.IsPremium,
-		&user.ProfileTheme, &user.BubbleStyle, &user.HideOnline, &user.Status,
-		&user.CreatedAt, &user.UpdatedAt,
-	)
+	user, err := h.users.Create(r.Context(), req.Username, string(hashedPassword))
 
-	if err != nil {
+	if err == store.ErrConflict {
 		utils.RespondJSON(w, http.StatusConflict, map[string]interface{}{
 			"success": false,
 			"error":   "USERNAME_EXISTS",
@@ -71,6 +139,11 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create user")
+		return
+	}
+
 	utils.RespondJSON(w, http.StatusCreated, map[string]interface{}{
 		"success": true,
 		"user":    user,
@@ -84,53 +157,242 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var user models.User
-	var passwordHash string
+	// Store failures let the login through rather than lock everyone out
+	ok, wait, err := h.accountLogins.Allow(r.Context(), req.Username)
+	if err != nil {
+		log.Printf("Login rate limit check failed: %v", err)
+	} else if !ok {
+		middleware.RespondTooManyRequests(w, wait, "RATE_LIMITED", "Слишком много попыток входа. Попробуйте позже")
+		return
+	}
+	wait, err = h.failedLogins.Check(r.Context(), req.Username)
+	if err != nil {
+		log.Printf("Login lockout check failed: %v", err)
+	} else if wait > 0 {
+		middleware.RespondTooManyRequests(w, wait, "TOO_MANY_ATTEMPTS", "Слишком много неудачных попыток входа. Попробуйте позже")
+		return
+	}
 
-	err := h.db.QueryRow(utils.AdaptQuery(`
-		SELECT id, username, password_hash, display_name, bio, avatar_url, banner_url,
-		       role, is_premium, premium_until, name_color, profile_theme,
-		       bubble_style, hide_online, status, created_at, updated_at
-		FROM users WHERE username = $1
-	`), req.Username).Scan(
-		&user.ID, &user.Username, &passwordHash, &user.DisplayName, &user.Bio,
-		&user.AvatarURL, &user.BannerURL, &user.Role, &user.IsPremium,
-		&user.PremiumUntil, &user.NameColor, &user.ProfileTheme, &user.BubbleStyle,
-		&user.HideOnline, &user.Status, &user.CreatedAt, &user.UpdatedAt,
-	)
+	user, err := h.users.GetByUsername(r.Context(), req.Username)
+	if err != nil && err != store.ErrNotFound {
+		utils.RespondError(w, http.StatusInternalServerError, "Ошибка при поиске пользователя")
+		return
+	}
 
-	if err == sql.ErrNoRows {
+	// Unknown usernames and wrong passwords get the same answer in the same
+	// time, so that it does not tell which usernames exist
+	hash := dummyHash
+	if user != nil {
+		hash = []byte(user.PasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(req.Password)) != nil || user == nil {
+		if _, err := h.failedLogins.Fail(r.Context(), req.Username); err != nil {
+			log.Printf("Failed to count failed login: %v", err)
+		}
 		utils.RespondJSON(w, http.StatusUnauthorized, map[string]interface{}{
 			"success": false,
-			"error":   "USER_NOT_FOUND",
-			"message": "Пользователь с таким именем не найден",
+			"error":   "INVALID_CREDENTIALS",
+			"message": "Неверное имя пользователя или пароль",
+		})
+		return
+	}
+	if err := h.failedLogins.Reset(r.Context(), req.Username); err != nil {
+		log.Printf("Failed to reset failed logins: %v", err)
+	}
+
+	// With two-factor authentication the password only earns a challenge
+	twoFactor, err := h.twoFactor.Get(r.Context(), user.ID)
+	if err != nil && err != store.ErrNotFound {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to load two-factor settings")
+		return
+	}
+	if err == nil && twoFactor.EnabledAt != nil {
+		challenge, err := utils.GenerateChallengeJWT(user.ID, challengeTTL)
+		if err != nil {
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to generate token")
+			return
+		}
+		utils.RespondJSON(w, http.StatusOK, models.TwoFactorChallenge{
+			Success:           true,
+			TwoFactorRequired: true,
+			ChallengeToken:    challenge,
+			ExpiresIn:         int(challengeTTL.Seconds()),
 		})
 		return
 	}
 
+	h.startSession(w, r, user)
+}
+
+// startSession logs a user in on the device of the request, answering with
+// the tokens of a new session. Logging in cancels a scheduled deletion.
+func (h *AuthHandler) startSession(w http.ResponseWriter, r *http.Request, user *models.User) {
+	restored, err := h.users.CancelDeletion(r.Context(), user.ID)
 	if err != nil {
-		utils.RespondError(w, http.StatusInternalServerError, "Ошибка при поиске пользователя")
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to restore account")
 		return
 	}
+	user.DeletionScheduledAt = nil
 
-	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.Password)); err != nil {
+	refreshToken, refreshHash, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to generate token")
+		return
+	}
+	session := &models.Session{
+		UserID:    user.ID,
+		Device:    deviceName(r),
+		IP:        utils.ClientIP(r),
+		ExpiresAt: time.Now().Add(h.refreshTTL),
+	}
+	if err := h.sessions.Create(r.Context(), session, refreshHash); err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create session")
+		return
+	}
+
+	token, err := utils.GenerateJWT(user.ID, session.ID, h.accessTTL)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to generate token")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, models.LoginResponse{
+		Success:         true,
+		Token:           token,
+		RefreshToken:    refreshToken,
+		ExpiresIn:       int(h.accessTTL.Seconds()),
+		User:            *user,
+		AccountRestored: restored,
+	})
+}
+
+// Refresh exchanges a refresh token for a new access token and refresh
+// token. Each refresh token works once; using one again ends its session.
+func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	var req models.RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	refreshToken, refreshHash, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to generate token")
+		return
+	}
+	session, err := h.sessions.Rotate(r.Context(), utils.HashOpaqueToken(req.RefreshToken), refreshHash, time.Now().Add(h.refreshTTL))
+	if err == store.ErrTokenReused {
+		h.hub.RevokeSession(session.UserID, session.ID)
+		utils.RespondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"error":   "REFRESH_TOKEN_REUSED",
+			"message": "Сессия завершена: токен обновления уже был использован",
+		})
+		return
+	}
+	if err == store.ErrNotFound {
 		utils.RespondJSON(w, http.StatusUnauthorized, map[string]interface{}{
 			"success": false,
-			"error":   "INVALID_PASSWORD",
-			"message": "Неверный пароль",
+			"error":   "INVALID_REFRESH_TOKEN",
+			"message": "Сессия истекла или была завершена",
 		})
 		return
 	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to refresh session")
+		return
+	}
+	if ip := utils.ClientIP(r); ip != session.IP {
+		h.sessions.Touch(r.Context(), session.ID, ip)
+	}
 
-	token, err := utils.GenerateJWT(user.ID)
+	token, err := utils.GenerateJWT(session.UserID, session.ID, h.accessTTL)
 	if err != nil {
 		utils.RespondError(w, http.StatusInternalServerError, "Failed to generate token")
 		return
 	}
 
-	utils.RespondJSON(w, http.StatusOK, models.LoginResponse{
-		Success: true,
-		Token:   token,
-		User:    user,
+	utils.RespondJSON(w, http.StatusOK, models.RefreshResponse{
+		Success:      true,
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(h.accessTTL.Seconds()),
+	})
+}
+
+// Logout ends the session of the request
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+	sessionID := middleware.GetSessionID(r)
+
+	if err := h.sessions.Revoke(r.Context(), userID, sessionID); err != nil && err != store.ErrNotFound {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to end session")
+		return
+	}
+	h.hub.RevokeSession(userID, sessionID)
+
+	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+// GetSessions lists the active sessions of the user, marking the one of the request
+func (h *AuthHandler) GetSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := h.sessions.ListActive(r.Context(), middleware.GetUserID(r))
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to load sessions")
+		return
+	}
+	current := middleware.GetSessionID(r)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+
+	utils.RespondJSON(w, http.StatusOK, sessions)
+}
+
+// RevokeSession ends a session of the user, disconnecting it
+func (h *AuthHandler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+	sessionID := mux.Vars(r)["id"]
+
+	err := h.sessions.Revoke(r.Context(), userID, sessionID)
+	if err == store.ErrNotFound {
+		utils.RespondError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to end session")
+		return
+	}
+	h.hub.RevokeSession(userID, sessionID)
+
+	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+// RevokeOtherSessions ends every session of the user but the one of the request
+func (h *AuthHandler) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+
+	revoked, err := h.sessions.RevokeOthers(r.Context(), userID, middleware.GetSessionID(r))
+	// Those revoked before a failure are disconnected all the same
+	for _, sessionID := range revoked {
+		h.hub.RevokeSession(userID, sessionID)
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to end sessions")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"revoked": len(revoked),
 	})
 }
+
+// deviceName describes the device a request comes from by its User-Agent
+func deviceName(r *http.Request) string {
+	device := r.UserAgent()
+	if len(device) > 255 {
+		device = strings.ToValidUTF8(device[:255], "")
+	}
+	return device
+}
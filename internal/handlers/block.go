@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/kvant/messenger/internal/middleware"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/internal/websocket"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// BlockHandler manages the block list of a user. The blocked user is not
+// told; they stop reaching the blocker, as the blocker stops reaching them.
+type BlockHandler struct {
+	users  store.UserStore
+	blocks store.BlockStore
+	hub    *websocket.Hub
+}
+
+func NewBlockHandler(db *sql.DB, hub *websocket.Hub) *BlockHandler {
+	stores := store.New(db)
+	return &BlockHandler{users: stores.Users, blocks: stores.Blocks, hub: hub}
+}
+
+// GetBlocked returns the users the current user blocked
+func (h *BlockHandler) GetBlocked(w http.ResponseWriter, r *http.Request) {
+	blocked, err := h.blocks.List(r.Context(), middleware.GetUserID(r))
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get blocked users")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, blocked)
+}
+
+func (h *BlockHandler) BlockUser(w http.ResponseWriter, r *http.Request) {
+	currentUserID := middleware.GetUserID(r)
+	userID := mux.Vars(r)["userId"]
+
+	if userID == currentUserID {
+		utils.RespondError(w, http.StatusBadRequest, "Cannot block yourself")
+		return
+	}
+	if !utils.IsUUID(userID) {
+		utils.RespondError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	_, err := h.users.Get(r.Context(), userID)
+	if err == store.ErrNotFound {
+		utils.RespondError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err == nil {
+		err = h.blocks.Block(r.Context(), currentUserID, userID)
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to block user")
+		return
+	}
+
+	h.blocksChanged(currentUserID, userID, "user_blocked")
+	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+func (h *BlockHandler) UnblockUser(w http.ResponseWriter, r *http.Request) {
+	currentUserID := middleware.GetUserID(r)
+	userID := mux.Vars(r)["userId"]
+
+	if !utils.IsUUID(userID) {
+		utils.RespondError(w, http.StatusNotFound, "User is not blocked")
+		return
+	}
+	err := h.blocks.Unblock(r.Context(), currentUserID, userID)
+	if err == store.ErrNotFound {
+		utils.RespondError(w, http.StatusNotFound, "User is not blocked")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to unblock user")
+		return
+	}
+
+	h.blocksChanged(currentUserID, userID, "user_unblocked")
+	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+// blocksChanged updates the presence both users see and tells the other
+// devices of the blocker
+func (h *BlockHandler) blocksChanged(blockerID, blockedID, event string) {
+	h.hub.BlocksChanged(blockerID, blockedID)
+	h.hub.SendToUser(blockerID, map[string]interface{}{
+		"type": event,
+		"data": map[string]interface{}{
+			"user_id": blockedID,
+		},
+	})
+}
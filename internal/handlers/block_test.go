@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/websocket"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+func TestBlockUser(t *testing.T) {
+	db := newTestDB(t)
+	h := NewBlockHandler(db, websocket.NewHub(nil, nil, nil))
+	users := NewUserHandler(db, nil)
+	me := newTestUser(t, db, "me")
+	pest := newTestUser(t, db, "pest")
+	stranger := newTestUser(t, db, "stranger")
+
+	block := func(handler http.HandlerFunc, userID string) int {
+		return serve(handler, "POST", "/api/users/"+url.PathEscape(userID)+"/block", me.ID, map[string]string{"userId": userID}, nil).Code
+	}
+	tests := []struct {
+		userID string
+		status int
+	}{
+		{"not-a-user", http.StatusNotFound},
+		{"1' OR '1'='1", http.StatusNotFound},
+		{utils.GenerateUUID(), http.StatusNotFound},
+		{me.ID, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if status := block(h.BlockUser, tt.userID); status != tt.status {
+			t.Errorf("blocking %q: status %d, want %d", tt.userID, status, tt.status)
+		}
+		if status := block(h.UnblockUser, tt.userID); status != http.StatusNotFound && tt.userID != me.ID {
+			t.Errorf("unblocking %q: status %d, want 404", tt.userID, status)
+		}
+	}
+
+	// finds reports whether searching for a user as another shows them
+	finds := func(searcherID string, user *models.User) bool {
+		t.Helper()
+		var found []models.User
+		decode(t, serve(users.SearchUsers, "GET", "/api/users/search?q="+url.QueryEscape(user.Username), searcherID, nil, nil), http.StatusOK, &found)
+		for _, u := range found {
+			if u.ID == user.ID {
+				return true
+			}
+		}
+		return false
+	}
+	if !finds(me.ID, pest) {
+		t.Fatal("search does not find a user")
+	}
+
+	if status := block(h.BlockUser, pest.ID); status != http.StatusOK {
+		t.Fatalf("blocking: status %d", status)
+	}
+	var blocked []models.BlockedUser
+	decode(t, serve(h.GetBlocked, "GET", "/api/users/blocked", me.ID, nil, nil), http.StatusOK, &blocked)
+	if len(blocked) != 1 || blocked[0].ID != pest.ID {
+		t.Errorf("blocked users are %+v", blocked)
+	}
+
+	// Neither side finds the other; everyone else still does
+	if finds(me.ID, pest) || finds(pest.ID, me) {
+		t.Error("search shows a user blocked either way")
+	}
+	if !finds(stranger.ID, pest) || !finds(stranger.ID, me) {
+		t.Error("search hides users from someone outside the block")
+	}
+
+	if status := block(h.UnblockUser, pest.ID); status != http.StatusOK {
+		t.Fatalf("unblocking: status %d", status)
+	}
+	if !finds(me.ID, pest) || !finds(pest.ID, me) {
+		t.Error("search hides users after an unblock")
+	}
+}
@@ -0,0 +1,494 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/kvant/messenger/internal/conversation"
+	"github.com/kvant/messenger/internal/middleware"
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/internal/websocket"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+type ChannelHandler struct {
+	db          *sql.DB
+	channels    store.ChannelStore
+	messages    store.MessageStore
+	attachments store.AttachmentStore
+	hub         *websocket.Hub
+}
+
+func NewChannelHandler(db *sql.DB, hub *websocket.Hub) *ChannelHandler {
+	stores := store.New(db)
+	return &ChannelHandler{
+		db:          db,
+		channels:    stores.Channels,
+		messages:    stores.Messages,
+		attachments: stores.Attachments,
+		hub:         hub,
+	}
+}
+
+// withoutPrivateSlug hides the invite slug of private channels from non-admins
+func withoutPrivateSlug(channel *models.Channel) *models.Channel {
+	if !channel.IsPublic && channel.MyRole != models.ChannelRoleOwner && channel.MyRole != models.ChannelRoleAdmin {
+		channel.InviteSlug = nil
+	}
+	return channel
+}
+
+func isChannelAdmin(role string) bool {
+	return role == models.ChannelRoleOwner || role == models.ChannelRoleAdmin
+}
+
+func (h *ChannelHandler) subscriberIDs(channelID string) []string {
+	ids, err := conversation.ChannelSubscriberIDs(h.db, channelID)
+	if err != nil {
+		log.Printf("Failed to get subscribers of channel %s: %v", channelID, err)
+	}
+	return ids
+}
+
+func (h *ChannelHandler) CreateChannel(w http.ResponseWriter, r *http.Request) {
+	currentUserID := middleware.GetUserID(r)
+
+	var req models.CreateChannelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		utils.RespondError(w, http.StatusBadRequest, "Channel name must be between 1 and 100 characters")
+		return
+	}
+
+	slug := strings.ToLower(strings.TrimSpace(req.InviteSlug))
+	if slug == "" {
+		slug = utils.GenerateSlug()
+	} else if !utils.ValidSlug(slug) {
+		utils.RespondError(w, http.StatusBadRequest, "Invite slug must be 3-50 characters of a-z, 0-9, _ and -")
+		return
+	}
+
+	isPublic := true
+	if req.IsPublic != nil {
+		isPublic = *req.IsPublic
+	}
+
+	channel := &models.Channel{
+		Name:        req.Name,
+		Description: req.Description,
+		AvatarURL:   req.AvatarURL,
+		OwnerID:     currentUserID,
+		IsPublic:    isPublic,
+		InviteSlug:  &slug,
+	}
+	err := h.channels.Create(r.Context(), channel)
+	if err == store.ErrConflict {
+		utils.RespondError(w, http.StatusConflict, "Invite slug is already taken")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create channel")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusCreated, channel)
+}
+
+func (h *ChannelHandler) GetMyChannels(w http.ResponseWriter, r *http.Request) {
+	currentUserID := middleware.GetUserID(r)
+
+	channels, err := h.channels.ForUser(r.Context(), currentUserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get channels")
+		return
+	}
+	for i := range channels {
+		withoutPrivateSlug(&channels[i])
+	}
+
+	utils.RespondJSON(w, http.StatusOK, channels)
+}
+
+func (h *ChannelHandler) GetChannel(w http.ResponseWriter, r *http.Request) {
+	channelID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	channel, err := h.channels.Get(r.Context(), channelID, currentUserID)
+	if err == store.ErrNotFound || (err == nil && !channel.IsPublic && channel.MyRole == "") {
+		utils.RespondError(w, http.StatusNotFound, "Channel not found")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get channel")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, withoutPrivateSlug(channel))
+}
+
+// GetChannelBySlug resolves an invite link. Private channels are visible to anyone who knows the slug.
+func (h *ChannelHandler) GetChannelBySlug(w http.ResponseWriter, r *http.Request) {
+	slug := strings.ToLower(mux.Vars(r)["slug"])
+	currentUserID := middleware.GetUserID(r)
+
+	channel, err := h.channels.GetBySlug(r.Context(), slug, currentUserID)
+	if err == store.ErrNotFound {
+		utils.RespondError(w, http.StatusNotFound, "Channel not found")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get channel")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, channel)
+}
+
+func (h *ChannelHandler) UpdateChannel(w http.ResponseWriter, r *http.Request) {
+	channelID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	role, err := conversation.ChannelRole(h.db, channelID, currentUserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to check subscription")
+		return
+	}
+	if !isChannelAdmin(role) {
+		utils.RespondError(w, http.StatusForbidden, "Only channel owner or admins can edit the channel")
+		return
+	}
+
+	var req models.UpdateChannelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" || len(name) > 100 {
+			utils.RespondError(w, http.StatusBadRequest, "Channel name must be between 1 and 100 characters")
+			return
+		}
+		req.Name = &name
+	}
+	if req.InviteSlug != nil {
+		slug := strings.ToLower(strings.TrimSpace(*req.InviteSlug))
+		if !utils.ValidSlug(slug) {
+			utils.RespondError(w, http.StatusBadRequest, "Invite slug must be 3-50 characters of a-z, 0-9, _ and -")
+			return
+		}
+		req.InviteSlug = &slug
+	}
+
+	err = h.channels.Update(r.Context(), channelID, req)
+	if err == store.ErrConflict {
+		utils.RespondError(w, http.StatusConflict, "Invite slug is already taken")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update channel")
+		return
+	}
+
+	channel, err := h.channels.Get(r.Context(), channelID, currentUserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get updated channel")
+		return
+	}
+
+	h.hub.SendToUsers(h.subscriberIDs(channelID), map[string]interface{}{
+		"type": "channel_updated",
+		"data": map[string]interface{}{
+			"id":          channel.ID,
+			"name":        channel.Name,
+			"description": channel.Description,
+			"avatar_url":  channel.AvatarURL,
+			"is_public":   channel.IsPublic,
+		},
+	})
+
+	utils.RespondJSON(w, http.StatusOK, channel)
+}
+
+func (h *ChannelHandler) DeleteChannel(w http.ResponseWriter, r *http.Request) {
+	channelID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	role, err := conversation.ChannelRole(h.db, channelID, currentUserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to check subscription")
+		return
+	}
+	if role != models.ChannelRoleOwner {
+		utils.RespondError(w, http.StatusForbidden, "Only channel owner can delete the channel")
+		return
+	}
+
+	subscriberIDs := h.subscriberIDs(channelID)
+
+	if err := h.channels.Delete(r.Context(), channelID); err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete channel")
+		return
+	}
+
+	h.hub.SendToUsers(subscriberIDs, map[string]interface{}{
+		"type": "channel_deleted",
+		"data": map[string]interface{}{
+			"channel_id": channelID,
+		},
+	})
+
+	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+// Subscribe subscribes the current user to a public channel by its ID
+func (h *ChannelHandler) Subscribe(w http.ResponseWriter, r *http.Request) {
+	channelID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	channel, err := h.channels.Get(r.Context(), channelID, currentUserID)
+	if err == store.ErrNotFound || (err == nil && !channel.IsPublic) {
+		utils.RespondError(w, http.StatusNotFound, "Channel not found")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get channel")
+		return
+	}
+
+	h.subscribe(w, r, channelID, currentUserID)
+}
+
+// SubscribeBySlug subscribes the current user via an invite link; works for private channels too
+func (h *ChannelHandler) SubscribeBySlug(w http.ResponseWriter, r *http.Request) {
+	slug := strings.ToLower(mux.Vars(r)["slug"])
+	currentUserID := middleware.GetUserID(r)
+
+	channel, err := h.channels.GetBySlug(r.Context(), slug, currentUserID)
+	if err == store.ErrNotFound {
+		utils.RespondError(w, http.StatusNotFound, "Channel not found")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get channel")
+		return
+	}
+
+	h.subscribe(w, r, channel.ID, currentUserID)
+}
+
+// subscribe adds the subscription and responds with the channel
+func (h *ChannelHandler) subscribe(w http.ResponseWriter, r *http.Request, channelID, userID string) {
+	if err := h.channels.Subscribe(r.Context(), channelID, userID); err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to subscribe")
+		return
+	}
+
+	channel, err := h.channels.Get(r.Context(), channelID, userID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get channel")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, withoutPrivateSlug(channel))
+}
+
+func (h *ChannelHandler) Unsubscribe(w http.ResponseWriter, r *http.Request) {
+	channelID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	role, err := conversation.ChannelRole(h.db, channelID, currentUserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to check subscription")
+		return
+	}
+	if role == "" {
+		utils.RespondError(w, http.StatusNotFound, "Not subscribed to this channel")
+		return
+	}
+	if role == models.ChannelRoleOwner {
+		utils.RespondError(w, http.StatusForbidden, "Channel owner cannot unsubscribe; delete the channel instead")
+		return
+	}
+
+	err = h.channels.Unsubscribe(r.Context(), channelID, currentUserID)
+	if err != nil && err != store.ErrNotFound {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to unsubscribe")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+func (h *ChannelHandler) GetSubscribers(w http.ResponseWriter, r *http.Request) {
+	channelID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	role, err := conversation.ChannelRole(h.db, channelID, currentUserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to check subscription")
+		return
+	}
+	if !isChannelAdmin(role) {
+		utils.RespondError(w, http.StatusForbidden, "Only channel owner or admins can see subscribers")
+		return
+	}
+
+	subscribers, err := h.channels.Subscribers(r.Context(), channelID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get subscribers")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, subscribers)
+}
+
+// SetSubscriberRole promotes a subscriber to admin or demotes an admin. Owner only.
+func (h *ChannelHandler) SetSubscriberRole(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channelID := vars["id"]
+	targetUserID := vars["userId"]
+	currentUserID := middleware.GetUserID(r)
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	if req.Role != models.ChannelRoleAdmin && req.Role != models.ChannelRoleSubscriber {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid role")
+		return
+	}
+
+	role, err := conversation.ChannelRole(h.db, channelID, currentUserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to check subscription")
+		return
+	}
+	if role != models.ChannelRoleOwner {
+		utils.RespondError(w, http.StatusForbidden, "Only channel owner can change roles")
+		return
+	}
+
+	targetRole, err := conversation.ChannelRole(h.db, channelID, targetUserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to check subscription")
+		return
+	}
+	if targetRole == "" {
+		utils.RespondError(w, http.StatusNotFound, "Subscriber not found")
+		return
+	}
+	if targetRole == models.ChannelRoleOwner {
+		utils.RespondError(w, http.StatusForbidden, "Cannot change the owner's role")
+		return
+	}
+
+	if err := h.channels.SetRole(r.Context(), channelID, targetUserID, req.Role); err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update role")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+// CreatePost publishes a post to the channel. Only owner and admins can post.
+// It is sent like any other message, so every device of the author gets it
+// too. Files are uploads of the author, by attachment_ids or by the file_url
+// of one.
+func (h *ChannelHandler) CreatePost(w http.ResponseWriter, r *http.Request) {
+	channelID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	var req models.CreatePostRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	if strings.TrimSpace(req.Text) == "" && req.FileURL == nil && len(req.AttachmentIDs) == 0 {
+		utils.RespondError(w, http.StatusBadRequest, "Post cannot be empty")
+		return
+	}
+	// The stored type follows the files of the post
+	hasFile := req.FileURL != nil || len(req.AttachmentIDs) > 0
+	switch req.MessageType {
+	case "", "text":
+	case "image", "file":
+		if !hasFile {
+			utils.RespondError(w, http.StatusBadRequest, "A file post needs a file")
+			return
+		}
+	default:
+		utils.RespondError(w, http.StatusBadRequest, "Invalid message type")
+		return
+	}
+
+	role, err := conversation.ChannelRole(h.db, channelID, currentUserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to check subscription")
+		return
+	}
+	if !isChannelAdmin(role) {
+		utils.RespondError(w, http.StatusForbidden, "Only channel owner or admins can post")
+		return
+	}
+
+	attachmentIDs := req.AttachmentIDs
+	if req.FileURL != nil {
+		attachment, err := h.attachments.FindUnsent(r.Context(), currentUserID, *req.FileURL)
+		if err == store.ErrNotFound {
+			utils.RespondError(w, http.StatusBadRequest, "File not found")
+			return
+		}
+		if err != nil {
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to create post")
+			return
+		}
+		attachmentIDs = append([]string{attachment.ID}, attachmentIDs...)
+	}
+
+	sent, err := websocket.SendMessage(h.db, h.hub, websocket.Outgoing{
+		SenderID:      currentUserID,
+		Target:        conversation.Target{ChannelID: channelID},
+		Text:          req.Text,
+		AttachmentIDs: attachmentIDs,
+	}, nil)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch err.(*websocket.SendError).Code {
+		case "invalid_request":
+			status = http.StatusBadRequest
+		case "forbidden":
+			status = http.StatusForbidden
+		}
+		utils.RespondError(w, status, err.Error())
+		return
+	}
+
+	post, err := h.messages.Get(r.Context(), sent.ID)
+	if err == nil {
+		var attachments map[string][]models.Attachment
+		attachments, err = h.attachments.ForMessages(r.Context(), []string{post.ID})
+		post.Attachments = attachments[post.ID]
+	}
+	if err != nil {
+		log.Printf("Failed to load post %s: %v", sent.ID, err)
+		utils.RespondJSON(w, http.StatusCreated, map[string]interface{}{"id": sent.ID, "created_at": sent.CreatedAt})
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusCreated, post)
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/kvant/messenger/internal/middleware"
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// exportProfile is profile.json of an export
+type exportProfile struct {
+	User             *models.User `json:"user"`
+	Email            *string      `json:"email"`
+	TwoFactorEnabled bool         `json:"two_factor_enabled"`
+	ExportedAt       time.Time    `json:"exported_at"`
+}
+
+// exportFile is an entry of media.json: an uploaded file and where the
+// archive has it, or Missing if it could not be read back
+type exportFile struct {
+	URL     string `json:"url"`
+	Path    string `json:"path,omitempty"`
+	Missing bool   `json:"missing,omitempty"`
+}
+
+// ExportData answers with a zip archive of the personal data of the user:
+// profile.json, messages.json with the messages they sent and the direct
+// messages they received, reactions.json, uploads.json, blocks.json with
+// their block list, and the files they uploaded under media/, listed in
+// media.json
+func (h *UserHandler) ExportData(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := middleware.GetUserID(r)
+
+	profile := exportProfile{ExportedAt: time.Now().UTC()}
+	user, err := h.users.Get(ctx, userID)
+	if err == nil {
+		profile.User = user
+		profile.Email, err = h.users.Email(ctx, userID)
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to export data")
+		return
+	}
+	twoFactor, err := h.twoFactor.Get(ctx, userID)
+	if err != nil && err != store.ErrNotFound {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to export data")
+		return
+	}
+	profile.TwoFactorEnabled = err == nil && twoFactor.EnabledAt != nil
+	reactions, err := h.reactions.ByUser(ctx, userID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to export data")
+		return
+	}
+	uploads, err := h.attachments.ByUploader(ctx, userID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to export data")
+		return
+	}
+	blocked, err := h.blocks.List(ctx, userID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to export data")
+		return
+	}
+
+	// Only files of the user go in; those of the direct messages they
+	// received belong to the senders
+	var files []string
+	seen := make(map[string]bool)
+	addFile := func(url *string) {
+		if url != nil && *url != "" && !seen[*url] {
+			seen[*url] = true
+			files = append(files, *url)
+		}
+	}
+	addFile(user.AvatarURL)
+	addFile(user.BannerURL)
+	for _, upload := range uploads {
+		addFile(&upload.URL)
+		addFile(upload.ThumbnailURL)
+	}
+
+	// From here on the answer is streamed, so a failure can only cut it short
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="persona-%s-%s.zip"`,
+		user.Username, profile.ExportedAt.Format("2006-01-02")))
+	archive := zip.NewWriter(w)
+
+	if err := writeExportJSON(archive, "profile.json", profile); err != nil {
+		log.Printf("Failed to export data of user %s: %v", userID, err)
+		return
+	}
+
+	messages, err := archive.Create("messages.json")
+	if err == nil {
+		first := true
+		io.WriteString(messages, "[\n")
+		err = h.messages.ForUser(ctx, userID, func(msg *models.Message) error {
+			if msg.SenderID == userID {
+				addFile(msg.FileURL)
+			}
+			data, err := json.Marshal(msg)
+			if err != nil {
+				return err
+			}
+			if !first {
+				io.WriteString(messages, ",\n")
+			}
+			first = false
+			_, err = messages.Write(data)
+			return err
+		})
+	}
+	if err == nil {
+		_, err = io.WriteString(messages, "\n]\n")
+	}
+	if err == nil {
+		err = writeExportJSON(archive, "reactions.json", reactions)
+	}
+	if err == nil {
+		err = writeExportJSON(archive, "uploads.json", uploads)
+	}
+	if err == nil {
+		err = writeExportJSON(archive, "blocks.json", blocked)
+	}
+	if err != nil {
+		log.Printf("Failed to export data of user %s: %v", userID, err)
+		return
+	}
+
+	index := make([]exportFile, 0, len(files))
+	names := make(map[string]bool)
+	for _, url := range files {
+		file := exportFile{URL: url, Path: exportPath(url, names)}
+		if err := h.exportMedia(ctx, archive, url, file.Path); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// A file the store lost or can't reach leaves a gap, not a failed export
+			log.Printf("Failed to export file %s of user %s: %v", url, userID, err)
+			file.Path = ""
+			file.Missing = true
+		}
+		index = append(index, file)
+	}
+	if err := writeExportJSON(archive, "media.json", index); err != nil {
+		log.Printf("Failed to export data of user %s: %v", userID, err)
+		return
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("Failed to export data of user %s: %v", userID, err)
+	}
+}
+
+// exportMedia copies the file behind url into the archive. An entry is only
+// created once the file opened, so a missing one leaves none behind.
+func (h *UserHandler) exportMedia(ctx context.Context, archive *zip.Writer, url, name string) error {
+	r, err := h.blobs.Open(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Media are compressed already
+	entry, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, r)
+	return err
+}
+
+// exportPath names the file of url under media/, after the last part of its
+// path, numbering names that are taken
+func exportPath(url string, taken map[string]bool) string {
+	base := path.Base(strings.SplitN(url, "?", 2)[0])
+	if base == "." || base == "/" {
+		base = "file"
+	}
+	name := "media/" + base
+	ext := path.Ext(base)
+	for i := 2; taken[name]; i++ {
+		name = fmt.Sprintf("media/%s-%d%s", strings.TrimSuffix(base, ext), i, ext)
+	}
+	taken[name] = true
+	return name
+}
+
+func writeExportJSON(archive *zip.Writer, name string, v interface{}) error {
+	entry, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(entry)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
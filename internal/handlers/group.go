@@ -0,0 +1,417 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/kvant/messenger/internal/conversation"
+	"github.com/kvant/messenger/internal/middleware"
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/permissions"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/internal/websocket"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+type GroupHandler struct {
+	db     *sql.DB
+	groups store.GroupStore
+	hub    *websocket.Hub
+}
+
+func NewGroupHandler(db *sql.DB, hub *websocket.Hub) *GroupHandler {
+	return &GroupHandler{db: db, groups: store.New(db).Groups, hub: hub}
+}
+
+// memberIDs returns the IDs of all members of the group
+func (h *GroupHandler) memberIDs(groupID string) []string {
+	ids, err := conversation.GroupMemberIDs(h.db, groupID)
+	if err != nil {
+		log.Printf("Failed to get members of group %s: %v", groupID, err)
+	}
+	return ids
+}
+
+func (h *GroupHandler) notifyMembers(userIDs []string, event map[string]interface{}) {
+	for _, id := range userIDs {
+		h.hub.SendToUser(id, event)
+	}
+}
+
+func (h *GroupHandler) CreateGroup(w http.ResponseWriter, r *http.Request) {
+	currentUserID := middleware.GetUserID(r)
+
+	var req models.CreateGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		utils.RespondError(w, http.StatusBadRequest, "Group name must be between 1 and 100 characters")
+		return
+	}
+
+	group := &models.Group{
+		Name:        req.Name,
+		Description: req.Description,
+		AvatarURL:   req.AvatarURL,
+		OwnerID:     currentUserID,
+		IsPublic:    req.IsPublic,
+	}
+	if err := h.groups.Create(r.Context(), group, req.MemberIDs); err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create group")
+		return
+	}
+
+	h.notifyMembers(h.memberIDs(group.ID), map[string]interface{}{
+		"type": "group_created",
+		"data": group,
+	})
+
+	utils.RespondJSON(w, http.StatusCreated, group)
+}
+
+func (h *GroupHandler) GetMyGroups(w http.ResponseWriter, r *http.Request) {
+	currentUserID := middleware.GetUserID(r)
+
+	groups, err := h.groups.ForUser(r.Context(), currentUserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get groups")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, groups)
+}
+
+func (h *GroupHandler) GetGroup(w http.ResponseWriter, r *http.Request) {
+	groupID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	group, err := h.groups.Get(r.Context(), groupID, currentUserID)
+	if err == store.ErrNotFound {
+		utils.RespondError(w, http.StatusNotFound, "Group not found")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get group")
+		return
+	}
+
+	if group.MyRole == "" && !group.IsPublic {
+		utils.RespondError(w, http.StatusNotFound, "Group not found")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, group)
+}
+
+func (h *GroupHandler) UpdateGroup(w http.ResponseWriter, r *http.Request) {
+	groupID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	if _, ok := requirePermission(h.db, w, permissions.ScopeGroup, groupID, currentUserID, permissions.ManageSettings); !ok {
+		return
+	}
+
+	var req models.UpdateGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" || len(name) > 100 {
+			utils.RespondError(w, http.StatusBadRequest, "Group name must be between 1 and 100 characters")
+			return
+		}
+		req.Name = &name
+	}
+
+	if err := h.groups.Update(r.Context(), groupID, req); err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update group")
+		return
+	}
+
+	group, err := h.groups.Get(r.Context(), groupID, currentUserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get updated group")
+		return
+	}
+
+	h.notifyMembers(h.memberIDs(groupID), map[string]interface{}{
+		"type": "group_updated",
+		"data": group,
+	})
+
+	utils.RespondJSON(w, http.StatusOK, group)
+}
+
+func (h *GroupHandler) DeleteGroup(w http.ResponseWriter, r *http.Request) {
+	groupID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	member, ok := requirePermission(h.db, w, permissions.ScopeGroup, groupID, currentUserID, 0)
+	if !ok {
+		return
+	}
+	if !member.IsOwner() {
+		utils.RespondError(w, http.StatusForbidden, "Only group owner can delete the group")
+		return
+	}
+
+	// Collect members before the cascade removes them
+	memberIDs := h.memberIDs(groupID)
+
+	if err := h.groups.Delete(r.Context(), groupID); err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete group")
+		return
+	}
+
+	h.notifyMembers(memberIDs, map[string]interface{}{
+		"type": "group_deleted",
+		"data": map[string]interface{}{
+			"group_id": groupID,
+		},
+	})
+
+	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+func (h *GroupHandler) GetMembers(w http.ResponseWriter, r *http.Request) {
+	groupID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	group, err := h.groups.Get(r.Context(), groupID, currentUserID)
+	if err == store.ErrNotFound || (err == nil && group.MyRole == "" && !group.IsPublic) {
+		utils.RespondError(w, http.StatusNotFound, "Group not found")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get group")
+		return
+	}
+
+	members, err := h.groups.Members(r.Context(), groupID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get members")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, members)
+}
+
+func (h *GroupHandler) AddMember(w http.ResponseWriter, r *http.Request) {
+	groupID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	var req struct {
+		UserID string `json:"user_id"`
+		Role   string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == "" {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	if req.Role == "" {
+		req.Role = models.GroupRoleMember
+	}
+
+	actor, ok := requirePermission(h.db, w, permissions.ScopeGroup, groupID, currentUserID, permissions.ManageMembers)
+	if !ok {
+		return
+	}
+	if assignableRole(h.db, w, actor, permissions.ScopeGroup, groupID, req.Role) == nil {
+		return
+	}
+
+	existing, err := permissions.Resolve(h.db, permissions.ScopeGroup, groupID, req.UserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to check membership")
+		return
+	}
+	if existing != nil {
+		utils.RespondError(w, http.StatusConflict, "User is already a member")
+		return
+	}
+
+	err = h.groups.AddMember(r.Context(), groupID, req.UserID, req.Role)
+	switch err {
+	case nil:
+	case store.ErrNotFound:
+		utils.RespondError(w, http.StatusNotFound, "User not found")
+		return
+	case store.ErrConflict:
+		utils.RespondError(w, http.StatusConflict, "User is already a member")
+		return
+	default:
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to add member")
+		return
+	}
+
+	h.notifyMembers(h.memberIDs(groupID), map[string]interface{}{
+		"type": "group_member_added",
+		"data": map[string]interface{}{
+			"group_id": groupID,
+			"user_id":  req.UserID,
+			"role":     req.Role,
+			"added_by": currentUserID,
+		},
+	})
+
+	utils.RespondJSON(w, http.StatusCreated, map[string]bool{"success": true})
+}
+
+func (h *GroupHandler) UpdateMemberRole(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	groupID := vars["id"]
+	targetUserID := vars["userId"]
+	currentUserID := middleware.GetUserID(r)
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	actor, ok := requirePermission(h.db, w, permissions.ScopeGroup, groupID, currentUserID, permissions.ManageRoles)
+	if !ok {
+		return
+	}
+
+	target, err := permissions.Resolve(h.db, permissions.ScopeGroup, groupID, targetUserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to check membership")
+		return
+	}
+	if target == nil {
+		utils.RespondError(w, http.StatusNotFound, "Member not found")
+		return
+	}
+	if target.IsOwner() || !actor.Outranks(target.Role.Position) {
+		utils.RespondError(w, http.StatusForbidden, "You cannot change this member's role")
+		return
+	}
+	if assignableRole(h.db, w, actor, permissions.ScopeGroup, groupID, req.Role) == nil {
+		return
+	}
+
+	if err := h.groups.SetRole(r.Context(), groupID, targetUserID, req.Role); err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update member role")
+		return
+	}
+
+	h.notifyMembers(h.memberIDs(groupID), map[string]interface{}{
+		"type": "group_member_updated",
+		"data": map[string]interface{}{
+			"group_id": groupID,
+			"user_id":  targetUserID,
+			"role":     req.Role,
+		},
+	})
+
+	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+func (h *GroupHandler) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	groupID := vars["id"]
+	targetUserID := vars["userId"]
+	currentUserID := middleware.GetUserID(r)
+
+	if targetUserID == currentUserID {
+		h.LeaveGroup(w, r)
+		return
+	}
+
+	actor, ok := requirePermission(h.db, w, permissions.ScopeGroup, groupID, currentUserID, permissions.ManageMembers)
+	if !ok {
+		return
+	}
+
+	target, err := permissions.Resolve(h.db, permissions.ScopeGroup, groupID, targetUserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to check membership")
+		return
+	}
+	if target == nil {
+		utils.RespondError(w, http.StatusNotFound, "Member not found")
+		return
+	}
+	// Members can only remove members ranked below them; nobody can remove the owner
+	if target.IsOwner() || !actor.Outranks(target.Role.Position) {
+		utils.RespondError(w, http.StatusForbidden, "You cannot remove this member")
+		return
+	}
+
+	memberIDs := h.memberIDs(groupID)
+
+	if err := h.groups.RemoveMember(r.Context(), groupID, targetUserID); err != nil && err != store.ErrNotFound {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to remove member")
+		return
+	}
+
+	h.notifyMembers(memberIDs, map[string]interface{}{
+		"type": "group_member_removed",
+		"data": map[string]interface{}{
+			"group_id":   groupID,
+			"user_id":    targetUserID,
+			"removed_by": currentUserID,
+		},
+	})
+
+	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+func (h *GroupHandler) LeaveGroup(w http.ResponseWriter, r *http.Request) {
+	groupID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	member, ok := requirePermission(h.db, w, permissions.ScopeGroup, groupID, currentUserID, 0)
+	if !ok {
+		return
+	}
+
+	memberIDs := h.memberIDs(groupID)
+
+	// When the owner leaves, the group goes to the longest-standing admin,
+	// or to the longest-standing member if there are no admins.
+	// The last member leaving deletes the group.
+	newOwnerID, groupDeleted, err := h.groups.Leave(r.Context(), groupID, currentUserID, member.IsOwner())
+	if err != nil && err != store.ErrNotFound {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to leave group")
+		return
+	}
+
+	if groupDeleted {
+		h.notifyMembers(memberIDs, map[string]interface{}{
+			"type": "group_deleted",
+			"data": map[string]interface{}{
+				"group_id": groupID,
+			},
+		})
+	} else {
+		event := map[string]interface{}{
+			"group_id": groupID,
+			"user_id":  currentUserID,
+			"left":     true,
+		}
+		if newOwnerID != "" {
+			event["new_owner_id"] = newOwnerID
+		}
+		h.notifyMembers(memberIDs, map[string]interface{}{
+			"type": "group_member_removed",
+			"data": event,
+		})
+	}
+
+	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/kvant/messenger/internal/database"
+	"github.com/kvant/messenger/internal/middleware"
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// newTestDB returns a migrated SQLite database that lives as long as the test
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	t.Setenv("USE_SQLITE", "true")
+	t.Setenv("SQLITE_DB_PATH", filepath.Join(t.TempDir(), "handlers.db"))
+
+	db, err := database.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.MigrateUp(db); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	return db
+}
+
+// newTestUser creates a user with a unique name starting with prefix
+func newTestUser(t *testing.T, db *sql.DB, prefix string) *models.User {
+	t.Helper()
+	user, err := store.New(db).Users.Create(context.Background(), prefix+utils.GenerateUUID()[:8], "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// serve calls a handler the way the router does after authenticating userID.
+// A non-nil body is sent as JSON.
+func serve(handler http.HandlerFunc, method, target, userID string, vars map[string]string, body interface{}) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	}
+	r := httptest.NewRequest(method, target, reader)
+	r = r.WithContext(context.WithValue(r.Context(), middleware.UserIDKey, userID))
+	r = mux.SetURLVars(r, vars)
+
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// decode reads a JSON response with the wanted status into v
+func decode(t *testing.T, w *httptest.ResponseRecorder, status int, v interface{}) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status %d, want %d: %s", w.Code, status, w.Body)
+	}
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("decoding %s: %v", w.Body, err)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"net/http"
 
+	"github.com/kvant/messenger/internal/ratelimit"
 	"github.com/kvant/messenger/pkg/utils"
 )
 
@@ -12,13 +13,16 @@ const (
 	VersionEra  = "Horse" // Chinese Zodiac Year
 )
 
+// HealthCheck reports the version, and how often rate limits could not be
+// checked: requests are let through then, so a rising count needs a look
 func HealthCheck(w http.ResponseWriter, r *http.Request) {
-	utils.RespondJSON(w, http.StatusOK, map[string]string{
-		"status":  "ok",
-		"service": "persona-messenger",
-		"version": Version,
-		"release": ReleaseDate,
-		"era":     VersionEra,
+	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"status":                  "ok",
+		"service":                 "persona-messenger",
+		"version":                 Version,
+		"release":                 ReleaseDate,
+		"era":                     VersionEra,
+		"rate_limit_store_errors": ratelimit.StoreErrors(),
 	})
 }
 
@@ -4,83 +4,204 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
-	"fmt"
-	"mime/multipart"
 	"net/http"
-	"path/filepath"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/kvant/messenger/internal/conversation"
+	"github.com/kvant/messenger/internal/media"
 	"github.com/kvant/messenger/internal/middleware"
 	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/permissions"
+	"github.com/kvant/messenger/internal/storage"
+	"github.com/kvant/messenger/internal/store"
 	"github.com/kvant/messenger/internal/websocket"
 	"github.com/kvant/messenger/pkg/utils"
 )
 
 type MessageHandler struct {
-	db  *sql.DB
-	hub *websocket.Hub
+	db          *sql.DB
+	hub         *websocket.Hub
+	messages    store.MessageStore
+	reactions   store.ReactionStore
+	attachments store.AttachmentStore
+	blocks      store.BlockStore
+	search      store.SearchStore
+	blobs       storage.BlobStore
 }
 
-func NewMessageHandler(db *sql.DB, hub *websocket.Hub) *MessageHandler {
-	return &MessageHandler{db: db, hub: hub}
+func NewMessageHandler(db *sql.DB, hub *websocket.Hub, blobs storage.BlobStore) *MessageHandler {
+	stores := store.New(db)
+	return &MessageHandler{
+		db:          db,
+		hub:         hub,
+		messages:    stores.Messages,
+		reactions:   stores.Reactions,
+		attachments: stores.Attachments,
+		blocks:      stores.Blocks,
+		search:      stores.Search,
+		blobs:       blobs,
+	}
 }
 
+// GetMessages returns a page of the direct conversation with another user, paginated like GetGroupMessages
 func (h *MessageHandler) GetMessages(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	otherUserID := vars["userId"]
 	currentUserID := middleware.GetUserID(r)
 
-	rows, err := h.db.Query(utils.AdaptQuery(`
-		SELECT m.id, m.sender_id, m.receiver_id, m.text, m.message_type,
-		       m.file_url, m.is_read, m.reply_to_id, m.read_at, m.edited_at, m.created_at, m.pinned_at,
-		       u.username, u.avatar_url
-		FROM messages m
-		JOIN users u ON m.sender_id = u.id
-		WHERE ((m.sender_id = $1 AND m.receiver_id = $2)
-		   OR (m.sender_id = $2 AND m.receiver_id = $1))
-		   AND m.deleted_at IS NULL
-		   AND (
-		     (m.sender_id = $1 AND m.deleted_for_sender = 0)
-		     OR (m.receiver_id = $1 AND m.deleted_for_receiver = 0)
-		   )
-		ORDER BY m.created_at ASC
-		LIMIT 100
-	`), currentUserID, otherUserID)
+	h.respondPage(w, r, store.Chat{UserID: currentUserID, OtherUserID: otherUserID})
+}
+
+// GetGroupMessages returns a page of group history, the newest messages by default.
+// See respondPage for the pagination parameters.
+func (h *MessageHandler) GetGroupMessages(w http.ResponseWriter, r *http.Request) {
+	groupID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
 
+	isMember, err := conversation.IsGroupMember(h.db, groupID, currentUserID)
 	if err != nil {
-		utils.RespondError(w, http.StatusInternalServerError, "Failed to get messages")
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to check membership")
+		return
+	}
+	if !isMember {
+		utils.RespondError(w, http.StatusNotFound, "Group not found")
+		return
+	}
+
+	h.respondPage(w, r, store.Chat{UserID: currentUserID, GroupID: groupID})
+}
+
+// GetChannelPosts returns a page of channel posts, paginated like GetGroupMessages
+func (h *MessageHandler) GetChannelPosts(w http.ResponseWriter, r *http.Request) {
+	channelID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	canRead, err := conversation.CanReadChannel(h.db, channelID, currentUserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to check subscription")
+		return
+	}
+	if !canRead {
+		utils.RespondError(w, http.StatusNotFound, "Channel not found")
+		return
+	}
+
+	h.respondPage(w, r, store.Chat{UserID: currentUserID, ChannelID: channelID})
+}
+
+// GetServerChannelMessages returns a page of a server text channel, paginated like GetGroupMessages
+func (h *MessageHandler) GetServerChannelMessages(w http.ResponseWriter, r *http.Request) {
+	channelID := mux.Vars(r)["channelId"]
+	currentUserID := middleware.GetUserID(r)
+
+	isMember, err := conversation.IsServerChannelMember(h.db, channelID, currentUserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to check membership")
+		return
+	}
+	if !isMember {
+		utils.RespondError(w, http.StatusNotFound, "Channel not found")
+		return
+	}
+
+	h.respondPage(w, r, store.Chat{UserID: currentUserID, ServerChannelID: channelID})
+}
+
+// respondPage writes one page of a chat. Query parameters:
+//
+//	before=<cursor>  messages older than the cursor; the newest ones by default
+//	after=<cursor>   messages newer than the cursor
+//	around=<id>      the message with up to limit-1 messages around it, to jump to it
+//	limit=<n>        page size, 1 to 100, 50 by default
+//
+// A cursor is a message id or an RFC 3339 timestamp.
+func (h *MessageHandler) respondPage(w http.ResponseWriter, r *http.Request, chat store.Chat) {
+	q := r.URL.Query()
+	limit := 50
+	if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 && l <= 100 {
+		limit = l
+	}
+
+	raw, newer := q.Get("before"), q.Get("after") != ""
+	if newer {
+		raw = q.Get("after")
+	}
+	cursor := parseCursor(raw)
+	if raw != "" && cursor == (store.Cursor{}) {
+		utils.RespondError(w, http.StatusBadRequest, "Cursor must be a message ID or an RFC 3339 timestamp")
+		return
+	}
+	anchorID := q.Get("around")
+	if anchorID != "" && !utils.IsUUID(anchorID) {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid message ID")
 		return
 	}
-	defer rows.Close()
 
-	var messages []models.Message
-	messageMap := make(map[string]*models.Message)
-	var messageIDs []interface{} // for reaction query placeholders
-	
-	for rows.Next() {
-		var msg models.Message
-		err := rows.Scan(
-			&msg.ID, &msg.SenderID, &msg.ReceiverID, &msg.Text,
-			&msg.MessageType, &msg.FileURL, &msg.IsRead, &msg.ReplyToID,
-			&msg.ReadAt, &msg.EditedAt, &msg.CreatedAt, &msg.PinnedAt, &msg.SenderName, &msg.SenderAvatarURL,
-		)
+	page := models.MessagePage{}
+	var err error
+	switch {
+	case anchorID != "":
+		var anchor *models.Message
+		anchor, err = h.messages.InChat(r.Context(), chat, anchorID)
+		if err == store.ErrNotFound {
+			utils.RespondError(w, http.StatusNotFound, "Message not found")
+			return
+		}
+		if err != nil {
+			break
+		}
+
+		older := (limit - 1) / 2
+		var before, after []models.Message
+		before, page.HasMore, err = h.messages.Page(r.Context(), chat, store.Cursor{ID: anchorID}, false, older)
 		if err != nil {
-			continue
+			break
 		}
-		msg.Reactions = []models.Reaction{} // Initialize empty slice
-		messages = append(messages, msg)
-		messageMap[msg.ID] = &messages[len(messages)-1]
-		messageIDs = append(messageIDs, msg.ID)
+		after, page.HasMoreAfter, err = h.messages.Page(r.Context(), chat, store.Cursor{ID: anchorID}, true, limit-1-older)
+		page.Messages = append(append(before, *anchor), after...)
+
+	default:
+		page.Messages, page.HasMore, err = h.messages.Page(r.Context(), chat, cursor, newer, limit)
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get messages")
+		return
+	}
+
+	h.addDetails(r.Context(), page.Messages)
+	utils.RespondJSON(w, http.StatusOK, page)
+}
+
+// parseCursor reads a cursor, a message id or an RFC 3339 timestamp. It
+// returns the zero Cursor for anything else.
+func parseCursor(cursor string) store.Cursor {
+	if t, err := time.Parse(time.RFC3339Nano, cursor); err == nil {
+		return store.Cursor{At: t}
+	}
+	if utils.IsUUID(cursor) {
+		return store.Cursor{ID: cursor}
+	}
+	return store.Cursor{}
+}
+
+// addDetails fills in the replied messages, reactions and attachments of messages.
+// A reply shows the message it quotes if that is among messages too.
+func (h *MessageHandler) addDetails(ctx context.Context, messages []models.Message) {
+	messageMap := make(map[string]*models.Message, len(messages))
+	ids := make([]string, len(messages))
+	for i := range messages {
+		messages[i].Reactions = []models.Reaction{}
+		messageMap[messages[i].ID] = &messages[i]
+		ids[i] = messages[i].ID
 	}
 
-	// Populate replied messages
 	for i := range messages {
 		if messages[i].ReplyToID != nil {
 			if repliedMsg, ok := messageMap[*messages[i].ReplyToID]; ok {
 				// Create a copy to avoid circular references
-				replied := &models.Message{
+				messages[i].RepliedMessage = &models.Message{
 					ID:          repliedMsg.ID,
 					SenderID:    repliedMsg.SenderID,
 					Text:        repliedMsg.Text,
@@ -88,46 +209,108 @@ func (h *MessageHandler) GetMessages(w http.ResponseWriter, r *http.Request) {
 					FileURL:     repliedMsg.FileURL,
 					CreatedAt:   repliedMsg.CreatedAt,
 				}
-				messages[i].RepliedMessage = replied
 			}
 		}
 	}
 
-	// Fetch reactions if any messages found
-	if len(messages) > 0 {
-		placeholders := make([]string, len(messageIDs))
-		for i := range placeholders {
-			placeholders[i] = fmt.Sprintf("$%d", i+1)
+	// Reactions and attachments of all messages in one query each
+	if reactions, err := h.reactions.ForMessages(ctx, ids); err == nil {
+		for id, list := range reactions {
+			messageMap[id].Reactions = list
 		}
-		
-		query := fmt.Sprintf(`
-			SELECT id, message_id, user_id, emoji, created_at
-			FROM reactions
-			WHERE message_id IN (%s)
-		`, strings.Join(placeholders, ","))
-
-		// Use AdaptQuery but carefully as IN clause is dynamic
-		// Actually AdaptQuery handles $1, $2... so we should construct the string with $1, $2... then adapt
-		
-		// Re-generating placeholders to match $1, $2...
-		// But AdaptQuery replaces $N with ?N.
-		// So if we generate $1, $2... AdaptQuery will handle it.
-		
-		reactionRows, err := h.db.Query(utils.AdaptQuery(query), messageIDs...)
-		if err == nil {
-			defer reactionRows.Close()
-			for reactionRows.Next() {
-				var r models.Reaction
-				if err := reactionRows.Scan(&r.ID, &r.MessageID, &r.UserID, &r.Emoji, &r.CreatedAt); err == nil {
-					if msg, ok := messageMap[r.MessageID]; ok {
-						msg.Reactions = append(msg.Reactions, r)
-					}
-				}
-			}
+	}
+	if attachments, err := h.attachments.ForMessages(ctx, ids); err == nil {
+		for id, list := range attachments {
+			messageMap[id].Attachments = list
 		}
 	}
+}
+
+// authorizeMessage loads the message and checks that the user takes part in its conversation.
+// On failure it writes the error response and returns ok == false.
+// On success it also returns the IDs of the users that receive events about the message.
+func (h *MessageHandler) authorizeMessage(w http.ResponseWriter, messageID, userID string) (msg *conversation.Message, participants []string, ok bool) {
+	msg, err := conversation.Load(h.db, messageID)
+	if err == sql.ErrNoRows {
+		utils.RespondError(w, http.StatusNotFound, "Message not found")
+		return nil, nil, false
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get message")
+		return nil, nil, false
+	}
+
+	canAccess, err := conversation.CanAccess(h.db, msg, userID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get message")
+		return nil, nil, false
+	}
+	if !canAccess {
+		utils.RespondError(w, http.StatusForbidden, "You don't have access to this message")
+		return nil, nil, false
+	}
+
+	participants, err = conversation.Participants(h.db, msg)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get message")
+		return nil, nil, false
+	}
 
-	utils.RespondJSON(w, http.StatusOK, messages)
+	return msg, participants, true
+}
+
+// SendMessage sends a message like the WebSocket send_message frame does and
+// responds with its id. Resending the same client_message_id returns the
+// stored message with duplicate set instead of sending it again.
+func (h *MessageHandler) SendMessage(w http.ResponseWriter, r *http.Request) {
+	currentUserID := middleware.GetUserID(r)
+
+	var req models.SendMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	out := websocket.Outgoing{
+		SenderID: currentUserID,
+		Target: conversation.Target{
+			ReceiverID:      req.ReceiverID,
+			GroupID:         req.GroupID,
+			ServerChannelID: req.ServerChannelID,
+		},
+		Text:                  req.Text,
+		ReplyToID:             req.ReplyToID,
+		ClientMessageID:       req.ClientMessageID,
+		AttachmentIDs:         req.AttachmentIDs,
+		SelfDestructAfterRead: req.SelfDestructAfterRead,
+	}
+	if req.SelfDestructIn != nil {
+		out.SelfDestructIn = *req.SelfDestructIn
+	}
+
+	sent, err := websocket.SendMessage(h.db, h.hub, out, nil)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch err.(*websocket.SendError).Code {
+		case "invalid_request":
+			status = http.StatusBadRequest
+		case "forbidden", "blocked":
+			status = http.StatusForbidden
+		}
+		utils.RespondError(w, status, err.Error())
+		return
+	}
+
+	status := http.StatusCreated
+	if sent.Duplicate {
+		status = http.StatusOK
+	}
+	utils.RespondJSON(w, status, map[string]interface{}{
+		"id":                sent.ID,
+		"client_message_id": req.ClientMessageID,
+		"created_at":        sent.CreatedAt,
+		"duplicate":         sent.Duplicate,
+	})
 }
 
 func (h *MessageHandler) MarkAsRead(w http.ResponseWriter, r *http.Request) {
@@ -135,12 +318,18 @@ func (h *MessageHandler) MarkAsRead(w http.ResponseWriter, r *http.Request) {
 	otherUserID := vars["userId"]
 	currentUserID := middleware.GetUserID(r)
 
-	_, err := h.db.Exec(`
-		UPDATE messages
-		SET is_read = true
-		WHERE sender_id = $1 AND receiver_id = $2 AND is_read = false
-	`, otherUserID, currentUserID)
+	// Between a blocked pair nothing is marked read
+	blocked, err := h.blocks.Between(r.Context(), currentUserID, otherUserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to mark as read")
+		return
+	}
+	if blocked {
+		utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+		return
+	}
 
+	_, err = h.messages.MarkRead(r.Context(), otherUserID, currentUserID)
 	if err != nil {
 		utils.RespondError(w, http.StatusInternalServerError, "Failed to mark as read")
 		return
@@ -152,69 +341,29 @@ func (h *MessageHandler) MarkAsRead(w http.ResponseWriter, r *http.Request) {
 func (h *MessageHandler) GetRecentChats(w http.ResponseWriter, r *http.Request) {
 	currentUserID := middleware.GetUserID(r)
 
-	// Get list of users with recent messages
-	rows, err := h.db.Query(utils.AdaptQuery(`
-		SELECT DISTINCT
-			CASE 
-				WHEN m.sender_id = $1 THEN m.receiver_id
-				ELSE m.sender_id
-			END as user_id,
-			u.username,
-			u.display_name,
-			u.avatar_url,
-			MAX(m.created_at) as last_message_time
-		FROM messages m
-		JOIN users u ON (
-			CASE 
-				WHEN m.sender_id = $1 THEN m.receiver_id
-				ELSE m.sender_id
-			END = u.id
-		)
-		WHERE m.sender_id = $1 OR m.receiver_id = $1
-		GROUP BY user_id, u.username, u.display_name, u.avatar_url
-		ORDER BY last_message_time DESC
-		LIMIT 50
-	`), currentUserID)
-
+	chats, err := h.messages.Recent(r.Context(), currentUserID, 50)
 	if err != nil {
 		utils.RespondError(w, http.StatusInternalServerError, "Failed to get recent chats")
 		return
 	}
-	defer rows.Close()
-
-	type RecentChat struct {
-		ID              string  `json:"id"`
-		Username        string  `json:"username"`
-		DisplayName     *string `json:"display_name,omitempty"`
-		AvatarURL       *string `json:"avatar_url,omitempty"`
-		LastMessageTime string  `json:"last_message_time"`
-	}
-
-	var chats []RecentChat
-	for rows.Next() {
-		var chat RecentChat
-		err := rows.Scan(
-			&chat.ID, &chat.Username, &chat.DisplayName,
-			&chat.AvatarURL, &chat.LastMessageTime,
-		)
-		if err != nil {
-			continue
-		}
-		chats = append(chats, chat)
-	}
 
 	utils.RespondJSON(w, http.StatusOK, chats)
 }
 
+// UploadFile stores a file to send with a message and responds with its
+// attachment. Its id goes in attachment_ids of a message; its url still works
+// in the text as [image]url or [file]url.
 func (h *MessageHandler) UploadFile(w http.ResponseWriter, r *http.Request) {
 	currentUserID := middleware.GetUserID(r)
 
-	// Parse multipart form (10MB max)
+	// Up to 10MB is kept in memory, the rest of the form in temporary files
+	r.Body = http.MaxBytesReader(w, r.Body, media.MaxSize()+1<<20)
 	err := r.ParseMultipartForm(10 << 20)
 	if err != nil {
 		utils.RespondError(w, http.StatusBadRequest, "File too large")
 		return
 	}
+	defer r.MultipartForm.RemoveAll()
 
 	file, header, err := r.FormFile("file")
 	if err != nil {
@@ -223,40 +372,13 @@ func (h *MessageHandler) UploadFile(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Validate file
-	if err := utils.ValidateImageFile(file, header); err != nil {
-		utils.RespondError(w, http.StatusBadRequest, err.Error())
-		return
-	}
-
-	// Upload to Cloudinary
-	uploader, err := utils.NewCloudinaryUploader()
-	if err != nil {
-		utils.RespondError(w, http.StatusInternalServerError, "Upload service unavailable")
-		return
-	}
-
-	// Upload to messages folder
-	fileURL, err := h.uploadMessageFile(r.Context(), uploader, file, header.Filename, currentUserID)
+	attachment, err := storeAttachment(r.Context(), h.blobs, h.attachments, currentUserID, file, header.Size, header.Filename)
 	if err != nil {
-		utils.RespondError(w, http.StatusInternalServerError, "Failed to upload file")
+		respondUploadError(w, err)
 		return
 	}
 
-	utils.RespondJSON(w, http.StatusOK, map[string]string{
-		"url": fileURL,
-	})
-}
-
-func (h *MessageHandler) uploadMessageFile(ctx context.Context, uploader *utils.CloudinaryUploader, file multipart.File, filename, userID string) (string, error) {
-	// Use the existing Cloudinary uploader structure
-	// For now, we'll use a simple approach - upload as image to messages folder
-	ext := strings.ToLower(filepath.Ext(filename))
-	uniqueName := fmt.Sprintf("%d_%s%s", time.Now().Unix(), userID[:8], ext)
-	
-	// For simplicity, reuse the uploadImage method with a custom folder
-	// In production, you might want to add a dedicated method for message files
-	return uploader.UploadAvatar(ctx, file, uniqueName, userID)
+	utils.RespondJSON(w, http.StatusCreated, attachment)
 }
 
 func (h *MessageHandler) EditMessage(w http.ResponseWriter, r *http.Request) {
@@ -278,67 +400,31 @@ func (h *MessageHandler) EditMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if message exists and belongs to current user
-	var senderID, receiverID string
-	err := h.db.QueryRow(`
-		SELECT sender_id, receiver_id FROM messages WHERE id = $1
-	`, messageID).Scan(&senderID, &receiverID)
-
-	if err == sql.ErrNoRows {
-		utils.RespondError(w, http.StatusNotFound, "Message not found")
-		return
-	}
-	if err != nil {
-		utils.RespondError(w, http.StatusInternalServerError, "Failed to get message")
+	// Check if message exists and current user takes part in the chat
+	target, participants, ok := h.authorizeMessage(w, messageID, currentUserID)
+	if !ok {
 		return
 	}
 
 	// Only sender can edit their message
-	if senderID != currentUserID {
+	if target.SenderID != currentUserID {
 		utils.RespondError(w, http.StatusForbidden, "You can only edit your own messages")
 		return
 	}
 
-	// Update message
-	now := time.Now()
-	_, err = h.db.Exec(`
-		UPDATE messages
-		SET text = $1, edited_at = $2
-		WHERE id = $3
-	`, req.Text, now, messageID)
+	msg, err := h.messages.Edit(r.Context(), messageID, req.Text)
 
 	if err != nil {
 		utils.RespondError(w, http.StatusInternalServerError, "Failed to edit message")
 		return
 	}
 
-	// Get updated message
-	var msg models.Message
-	err = h.db.QueryRow(`
-		SELECT m.id, m.sender_id, m.receiver_id, m.text, m.message_type,
-		       m.file_url, m.is_read, m.reply_to_id, m.read_at, m.edited_at, m.created_at,
-		       u.username, u.avatar_url
-		FROM messages m
-		JOIN users u ON m.sender_id = u.id
-		WHERE m.id = $1
-	`, messageID).Scan(
-		&msg.ID, &msg.SenderID, &msg.ReceiverID, &msg.Text,
-		&msg.MessageType, &msg.FileURL, &msg.IsRead, &msg.ReplyToID,
-		&msg.ReadAt, &msg.EditedAt, &msg.CreatedAt, &msg.SenderName, &msg.SenderAvatarURL,
-	)
-
-	if err != nil {
-		utils.RespondError(w, http.StatusInternalServerError, "Failed to get updated message")
-		return
-	}
-
-	// Broadcast edit to both users via WebSocket
+	// Broadcast edit to everyone in the chat via WebSocket
 	editMessage := map[string]interface{}{
 		"type": "message_edited",
 		"data": msg,
 	}
-	h.hub.SendToUser(senderID, editMessage)
-	h.hub.SendToUser(receiverID, editMessage)
+	h.hub.SendToUsers(participants, editMessage)
 
 	utils.RespondJSON(w, http.StatusOK, msg)
 }
@@ -357,80 +443,59 @@ func (h *MessageHandler) DeleteMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get message details
-	var senderID, receiverID string
-	var createdAt time.Time
-	err := h.db.QueryRow(`
-		SELECT sender_id, receiver_id, created_at FROM messages WHERE id = ?
-	`, messageID).Scan(&senderID, &receiverID, &createdAt)
-
-	if err == sql.ErrNoRows {
-		utils.RespondError(w, http.StatusNotFound, "Message not found")
-		return
-	}
-	if err != nil {
-		utils.RespondError(w, http.StatusInternalServerError, "Failed to get message")
+	// Get message details and check access
+	msg, participants, ok := h.authorizeMessage(w, messageID, currentUserID)
+	if !ok {
 		return
 	}
 
-	// Determine if user is sender or receiver
-	isSender := senderID == currentUserID
-	isReceiver := receiverID == currentUserID
+	isSender := msg.SenderID == currentUserID
 
-	if !isSender && !isReceiver {
-		utils.RespondError(w, http.StatusForbidden, "You don't have access to this message")
-		return
-	}
+	var err error
 
 	// Check if trying to delete for everyone
 	if req.DeleteForEveryone {
-		// Only sender can delete for everyone
+		// Only the sender, or in groups and servers a member allowed to delete
+		// messages of others, can delete for everyone
 		if !isSender {
-			utils.RespondError(w, http.StatusForbidden, "Only sender can delete message for everyone")
-			return
+			member, err := permissions.ForMessage(h.db, msg, currentUserID)
+			if err != nil {
+				utils.RespondError(w, http.StatusInternalServerError, "Failed to check permissions")
+				return
+			}
+			if member == nil || !member.Can(permissions.DeleteMessages) {
+				utils.RespondError(w, http.StatusForbidden, "Only sender can delete message for everyone")
+				return
+			}
 		}
 
 		// Delete for everyone (soft delete)
-		now := time.Now()
-		_, err = h.db.Exec(`
-			UPDATE messages
-			SET deleted_at = ?, text = '[deleted]'
-			WHERE id = ?
-		`, now, messageID)
+		err = h.messages.DeleteForEveryone(r.Context(), messageID)
 
 		if err != nil {
 			utils.RespondError(w, http.StatusInternalServerError, "Failed to delete message")
 			return
 		}
 
-		// Broadcast deletion to both users
+		// Broadcast deletion to everyone in the chat
 		deleteMessage := map[string]interface{}{
 			"type": "message_deleted",
 			"data": map[string]interface{}{
-				"id":                messageID,
+				"id":                   messageID,
 				"deleted_for_everyone": true,
 			},
 		}
-		h.hub.SendToUser(senderID, deleteMessage)
-		h.hub.SendToUser(receiverID, deleteMessage)
+		h.hub.SendToUsers(participants, deleteMessage)
 
 		utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
-			"success": true,
+			"success":              true,
 			"deleted_for_everyone": true,
 		})
 		return
 	}
 
 	// Delete only for current user
-	if isSender {
-		_, err = h.db.Exec(`
-			UPDATE messages SET deleted_for_sender = 1 WHERE id = ?
-		`, messageID)
-	} else {
-		_, err = h.db.Exec(`
-			UPDATE messages SET deleted_for_receiver = 1 WHERE id = ?
-		`, messageID)
-	}
+	err = h.messages.DeleteForUser(r.Context(), messageID, currentUserID)
 
 	if err != nil {
 		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete message")
@@ -441,15 +506,15 @@ func (h *MessageHandler) DeleteMessage(w http.ResponseWriter, r *http.Request) {
 	deleteMessage := map[string]interface{}{
 		"type": "message_deleted",
 		"data": map[string]interface{}{
-			"id":                messageID,
+			"id":                   messageID,
 			"deleted_for_everyone": false,
-			"deleted_for":       currentUserID,
+			"deleted_for":          currentUserID,
 		},
 	}
 	h.hub.SendToUser(currentUserID, deleteMessage)
 
 	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
-		"success": true,
+		"success":              true,
 		"deleted_for_everyone": false,
 	})
 }
@@ -473,30 +538,18 @@ func (h *MessageHandler) AddReaction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if message exists
-	var senderID, receiverID string
-	err := h.db.QueryRow("SELECT sender_id, receiver_id FROM messages WHERE id = ?", messageID).Scan(&senderID, &receiverID)
-	if err == sql.ErrNoRows {
-		utils.RespondError(w, http.StatusNotFound, "Message not found")
-		return
-	}
-	if err != nil {
-		utils.RespondError(w, http.StatusInternalServerError, "Failed to get message")
+	// Check if message exists and user has access
+	msg, participants, ok := h.authorizeMessage(w, messageID, currentUserID)
+	if !ok {
 		return
 	}
 
-	// Check access (user must be sender or receiver)
-	if currentUserID != senderID && currentUserID != receiverID {
-		utils.RespondError(w, http.StatusForbidden, "You don't have access to this message")
+	if !h.requireMessagePermission(w, msg, currentUserID, permissions.AddReactions) {
 		return
 	}
 
 	// Add reaction
-	_, err = h.db.Exec(utils.AdaptQuery(`
-		INSERT INTO reactions (message_id, user_id, emoji)
-		VALUES ($1, $2, $3)
-		ON CONFLICT (message_id, user_id, emoji) DO NOTHING
-	`), messageID, currentUserID, req.Emoji)
+	err := h.reactions.Add(r.Context(), messageID, currentUserID, req.Emoji)
 
 	if err != nil {
 		utils.RespondError(w, http.StatusInternalServerError, "Failed to add reaction")
@@ -512,8 +565,7 @@ func (h *MessageHandler) AddReaction(w http.ResponseWriter, r *http.Request) {
 			"emoji":      req.Emoji,
 		},
 	}
-	h.hub.SendToUser(senderID, reactionEvent)
-	h.hub.SendToUser(receiverID, reactionEvent)
+	h.hub.SendToUsers(participants, reactionEvent)
 
 	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
 }
@@ -530,22 +582,13 @@ func (h *MessageHandler) RemoveReaction(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Check if message exists to get participants for broadcasting
-	var senderID, receiverID string
-	err := h.db.QueryRow("SELECT sender_id, receiver_id FROM messages WHERE id = ?", messageID).Scan(&senderID, &receiverID)
-	if err == sql.ErrNoRows {
-		utils.RespondError(w, http.StatusNotFound, "Message not found")
-		return
-	}
-	if err != nil {
-		utils.RespondError(w, http.StatusInternalServerError, "Failed to get message")
+	_, participants, ok := h.authorizeMessage(w, messageID, currentUserID)
+	if !ok {
 		return
 	}
 
 	// Remove reaction
-	_, err = h.db.Exec(utils.AdaptQuery(`
-		DELETE FROM reactions
-		WHERE message_id = $1 AND user_id = $2 AND emoji = $3
-	`), messageID, currentUserID, emoji)
+	err := h.reactions.Remove(r.Context(), messageID, currentUserID, emoji)
 
 	if err != nil {
 		utils.RespondError(w, http.StatusInternalServerError, "Failed to remove reaction")
@@ -561,8 +604,7 @@ func (h *MessageHandler) RemoveReaction(w http.ResponseWriter, r *http.Request)
 			"emoji":      emoji,
 		},
 	}
-	h.hub.SendToUser(senderID, reactionEvent)
-	h.hub.SendToUser(receiverID, reactionEvent)
+	h.hub.SendToUsers(participants, reactionEvent)
 
 	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
 }
@@ -573,42 +615,17 @@ func (h *MessageHandler) PinMessage(w http.ResponseWriter, r *http.Request) {
 	currentUserID := middleware.GetUserID(r)
 
 	// Check if message exists and user has access
-	var senderID, receiverID string
-	err := h.db.QueryRow("SELECT sender_id, receiver_id FROM messages WHERE id = ?", messageID).Scan(&senderID, &receiverID)
-	if err == sql.ErrNoRows {
-		utils.RespondError(w, http.StatusNotFound, "Message not found")
-		return
-	}
-	if err != nil {
-		utils.RespondError(w, http.StatusInternalServerError, "Failed to get message")
+	msg, participants, ok := h.authorizeMessage(w, messageID, currentUserID)
+	if !ok {
 		return
 	}
 
-	if currentUserID != senderID && currentUserID != receiverID {
-		utils.RespondError(w, http.StatusForbidden, "You don't have access to this message")
+	if !h.canPin(w, msg, currentUserID) {
 		return
 	}
 
-	// Unpin any existing pinned message in this chat
-	_, err = h.db.Exec(utils.AdaptQuery(`
-		UPDATE messages
-		SET pinned_at = NULL
-		WHERE ((sender_id = $1 AND receiver_id = $2) OR (sender_id = $2 AND receiver_id = $1))
-		  AND pinned_at IS NOT NULL
-	`), senderID, receiverID)
-	
-	if err != nil {
-		utils.RespondError(w, http.StatusInternalServerError, "Failed to unpin previous messages")
-		return
-	}
-
-	// Pin the new message
-	now := time.Now()
-	_, err = h.db.Exec(utils.AdaptQuery(`
-		UPDATE messages
-		SET pinned_at = $1
-		WHERE id = $2
-	`), now, messageID)
+	// Pin the message, unpinning any other one in this chat
+	now, err := h.messages.Pin(r.Context(), messageID)
 
 	if err != nil {
 		utils.RespondError(w, http.StatusInternalServerError, "Failed to pin message")
@@ -624,8 +641,7 @@ func (h *MessageHandler) PinMessage(w http.ResponseWriter, r *http.Request) {
 			"pinner_id":  currentUserID,
 		},
 	}
-	h.hub.SendToUser(senderID, pinEvent)
-	h.hub.SendToUser(receiverID, pinEvent)
+	h.hub.SendToUsers(participants, pinEvent)
 
 	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
 }
@@ -635,29 +651,18 @@ func (h *MessageHandler) UnpinMessage(w http.ResponseWriter, r *http.Request) {
 	messageID := vars["messageId"]
 	currentUserID := middleware.GetUserID(r)
 
-	// Check if message exists
-	var senderID, receiverID string
-	err := h.db.QueryRow("SELECT sender_id, receiver_id FROM messages WHERE id = ?", messageID).Scan(&senderID, &receiverID)
-	if err == sql.ErrNoRows {
-		utils.RespondError(w, http.StatusNotFound, "Message not found")
-		return
-	}
-	if err != nil {
-		utils.RespondError(w, http.StatusInternalServerError, "Failed to get message")
+	// Check if message exists and user has access
+	msg, participants, ok := h.authorizeMessage(w, messageID, currentUserID)
+	if !ok {
 		return
 	}
 
-	if currentUserID != senderID && currentUserID != receiverID {
-		utils.RespondError(w, http.StatusForbidden, "You don't have access to this message")
+	if !h.canPin(w, msg, currentUserID) {
 		return
 	}
 
 	// Unpin message
-	_, err = h.db.Exec(utils.AdaptQuery(`
-		UPDATE messages
-		SET pinned_at = NULL
-		WHERE id = $1
-	`), messageID)
+	err := h.messages.Unpin(r.Context(), messageID)
 
 	if err != nil {
 		utils.RespondError(w, http.StatusInternalServerError, "Failed to unpin message")
@@ -671,8 +676,43 @@ func (h *MessageHandler) UnpinMessage(w http.ResponseWriter, r *http.Request) {
 			"message_id": messageID,
 		},
 	}
-	h.hub.SendToUser(senderID, unpinEvent)
-	h.hub.SendToUser(receiverID, unpinEvent)
+	h.hub.SendToUsers(participants, unpinEvent)
 
 	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
 }
+
+// requireMessagePermission checks that the user holds perm in the group or server
+// the message belongs to. Direct chats and broadcast channels have no roles and
+// always pass. On failure it writes the error response.
+func (h *MessageHandler) requireMessagePermission(w http.ResponseWriter, msg *conversation.Message, userID string, perm permissions.Permission) bool {
+	member, err := permissions.ForMessage(h.db, msg, userID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to check permissions")
+		return false
+	}
+	if member != nil && !member.Can(perm) {
+		utils.RespondError(w, http.StatusForbidden, "You don't have permission to do this")
+		return false
+	}
+	return true
+}
+
+// canPin checks that the user may pin and unpin the message: only channel owner
+// and admins pin channel posts, groups and servers require the pin permission.
+// On failure it writes the error response.
+func (h *MessageHandler) canPin(w http.ResponseWriter, msg *conversation.Message, userID string) bool {
+	if msg.ChannelID == nil {
+		return h.requireMessagePermission(w, msg, userID, permissions.PinMessages)
+	}
+
+	role, err := conversation.ChannelRole(h.db, *msg.ChannelID, userID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to check channel role")
+		return false
+	}
+	if role != models.ChannelRoleOwner && role != models.ChannelRoleAdmin {
+		utils.RespondError(w, http.StatusForbidden, "Only channel owner or admins can pin posts")
+		return false
+	}
+	return true
+}
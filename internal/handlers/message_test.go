@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// pageIDs returns the IDs of the messages of a page in order
+func pageIDs(page models.MessagePage) []string {
+	ids := make([]string, len(page.Messages))
+	for i, msg := range page.Messages {
+		ids[i] = msg.ID
+	}
+	return ids
+}
+
+func TestGetMessagesPagination(t *testing.T) {
+	db := newTestDB(t)
+	h := NewMessageHandler(db, nil, nil)
+	me := newTestUser(t, db, "me")
+	other := newTestUser(t, db, "other")
+
+	// Messages sent within the same microsecond share created_at and are
+	// ordered by ID, so every one of these is a tie
+	var ids []string
+	for i := 0; i < 5; i++ {
+		msg := &models.Message{SenderID: other.ID, ReceiverID: &me.ID, Text: fmt.Sprintf("message %d", i)}
+		if err := store.New(db).Messages.Create(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+	sentAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	if _, err := db.Exec(utils.AdaptQuery(`UPDATE messages SET created_at = $1 WHERE sender_id = $2`), utils.DBTime(sentAt), other.ID); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ids)
+
+	tests := []struct {
+		name         string
+		query        string
+		want         []string
+		hasMore      bool
+		hasMoreAfter bool
+	}{
+		{"newest", "limit=2", ids[3:], true, false},
+		{"whole chat", "", ids, false, false},
+		{"before an ID", "before=" + ids[3] + "&limit=2", ids[1:3], true, false},
+		{"before the oldest page", "before=" + ids[1] + "&limit=2", ids[:1], false, false},
+		{"after an ID", "after=" + ids[0] + "&limit=3", ids[1:4], true, false},
+		{"after the newest page", "after=" + ids[2] + "&limit=3", ids[3:], false, false},
+		{"before a time", "before=" + url.QueryEscape(sentAt.Format(time.RFC3339)), nil, false, false},
+		{"after a time", "after=" + url.QueryEscape(sentAt.Add(-time.Second).Format(time.RFC3339Nano)) + "&limit=2", ids[:2], true, false},
+		{"around the middle", "around=" + ids[2] + "&limit=3", ids[1:4], true, true},
+		{"around the oldest", "around=" + ids[0] + "&limit=3", ids[:2], false, true},
+		{"around the newest", "around=" + ids[4] + "&limit=5", ids[2:], true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(h.GetMessages, "GET", "/api/messages/"+other.ID+"?"+tt.query, me.ID, map[string]string{"userId": other.ID}, nil)
+			var page models.MessagePage
+			decode(t, w, http.StatusOK, &page)
+
+			got := pageIDs(page)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("messages %v, want %v", got, tt.want)
+			}
+			if page.HasMore != tt.hasMore || page.HasMoreAfter != tt.hasMoreAfter {
+				t.Errorf("has_more %v, has_more_after %v; want %v, %v", page.HasMore, page.HasMoreAfter, tt.hasMore, tt.hasMoreAfter)
+			}
+		})
+	}
+}
+
+func TestGetMessagesInvalidCursor(t *testing.T) {
+	db := newTestDB(t)
+	h := NewMessageHandler(db, nil, nil)
+	me := newTestUser(t, db, "me")
+	other := newTestUser(t, db, "other")
+	stranger := newTestUser(t, db, "stranger")
+
+	msg := &models.Message{SenderID: other.ID, ReceiverID: &stranger.ID, Text: "elsewhere"}
+	if err := store.New(db).Messages.Create(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"before=yesterday", http.StatusBadRequest},
+		{"after=2026-01-02", http.StatusBadRequest},
+		{"before=1%27%20OR%201=1", http.StatusBadRequest},
+		{"around=42", http.StatusBadRequest},
+		{"around=" + utils.GenerateUUID(), http.StatusNotFound},
+		// A message of another chat is not in this one
+		{"around=" + msg.ID, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := serve(h.GetMessages, "GET", "/api/messages/"+other.ID+"?"+tt.query, me.ID, map[string]string{"userId": other.ID}, nil)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.query, w.Code, tt.status, w.Body)
+		}
+	}
+}
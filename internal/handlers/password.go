@@ -0,0 +1,372 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kvant/messenger/internal/middleware"
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/notify"
+	"github.com/kvant/messenger/internal/ratelimit"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/pkg/utils"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// resetRequestLimit limits the reset links sent for one account, so that
+// nobody can flood its mailbox
+var resetRequestLimit = ratelimit.Limit{Burst: 3, Every: 20 * time.Minute}
+
+// sendTimeout bounds the delivery of a reset link, which runs after the
+// request is answered
+const sendTimeout = time.Minute
+
+// ChangePassword sets a new password for the user after checking the old
+// one, and ends their other sessions
+func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+
+	var req models.ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	if !validPassword(w, req.NewPassword) {
+		return
+	}
+	user, ok := h.checkPassword(w, r, userID, req.OldPassword)
+	if !ok {
+		return
+	}
+
+	revoked, err := h.setPassword(r.Context(), user, req.NewPassword, middleware.GetSessionID(r))
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to change password")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"revoked": revoked,
+	})
+}
+
+// GetEmail returns the address password resets of the user are sent to
+func (h *AuthHandler) GetEmail(w http.ResponseWriter, r *http.Request) {
+	email, err := h.users.Email(r.Context(), middleware.GetUserID(r))
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to load email")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"email": email,
+	})
+}
+
+// SetEmail changes the address password resets are sent to. It takes the
+// password, since whoever controls the address can take over the account.
+func (h *AuthHandler) SetEmail(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+
+	var req models.EmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	var email *string
+	if req.Email != "" {
+		normalized, ok := normalizeEmail(req.Email)
+		if !ok {
+			utils.RespondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"success": false,
+				"error":   "INVALID_EMAIL",
+				"message": "Неверный адрес электронной почты",
+			})
+			return
+		}
+		email = &normalized
+	}
+	if _, ok := h.checkPassword(w, r, userID, req.Password); !ok {
+		return
+	}
+
+	err := h.users.SetEmail(r.Context(), userID, email)
+	if err == store.ErrConflict {
+		utils.RespondJSON(w, http.StatusConflict, map[string]interface{}{
+			"success": false,
+			"error":   "EMAIL_TAKEN",
+			"message": "Этот адрес уже используется",
+		})
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to change email")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"email":   email,
+	})
+}
+
+// ForgotPassword sends a reset link to the address of an account, found by
+// username or address. The answer is the same whether or not there is such
+// an account, so that it does not tell which ones exist.
+func (h *AuthHandler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req models.ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Login == "" {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	if err := h.sendResetLink(r.Context(), req.Login); err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to send reset link")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": "Если у аккаунта есть адрес электронной почты, мы отправили на него ссылку для сброса пароля",
+	})
+}
+
+// sendResetLink mails a reset link if login names an account with an
+// address. Nothing to send is not an error.
+func (h *AuthHandler) sendResetLink(ctx context.Context, login string) error {
+	var user *models.User
+	var err error
+	if strings.Contains(login, "@") {
+		email, ok := normalizeEmail(login)
+		if !ok {
+			return nil
+		}
+		user, err = h.users.GetByEmail(ctx, email)
+	} else {
+		user, err = h.users.GetByUsername(ctx, login)
+	}
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	email, err := h.users.Email(ctx, user.ID)
+	if err != nil || email == nil {
+		return err
+	}
+
+	ok, _, err := h.resetRequests.Allow(ctx, user.ID)
+	if err != nil {
+		log.Printf("Password reset rate limit check failed: %v", err)
+	} else if !ok {
+		return nil
+	}
+
+	token, tokenHash, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return err
+	}
+	if err := h.resets.Create(ctx, user.ID, tokenHash, time.Now().Add(h.resetTTL)); err != nil {
+		return err
+	}
+
+	link, err := url.Parse(h.resetURL)
+	if err != nil {
+		return err
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	msg := notify.Message{
+		To:      *email,
+		Subject: "Сброс пароля Persona",
+		Body: fmt.Sprintf("Здравствуйте, %s!\n\n"+
+			"Чтобы задать новый пароль, перейдите по ссылке:\n%s\n\n"+
+			"Ссылка действует %d мин. и только один раз. Если вы не запрашивали сброс пароля, "+
+			"просто проигнорируйте это письмо.\n", user.Username, link, int(h.resetTTL.Minutes())),
+	}
+	// Sent in the background: how long it takes would tell that the account exists
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		defer cancel()
+		if err := h.notifier.Send(ctx, msg); err != nil {
+			log.Printf("Failed to send password reset to user %s: %v", user.ID, err)
+		}
+	}()
+	return nil
+}
+
+// ResetPassword sets a new password with the token of a reset link, or with
+// a username and a recovery code for accounts without an address. Every
+// session of the account ends, and two-factor authentication stays on.
+func (h *AuthHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req models.ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	if req.Token == "" && (req.Username == "" || req.RecoveryCode == "") {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	if !validPassword(w, req.NewPassword) {
+		return
+	}
+
+	var user *models.User
+	if req.Token != "" {
+		userID, err := h.resets.Use(r.Context(), utils.HashOpaqueToken(req.Token))
+		if err == store.ErrNotFound {
+			utils.RespondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"success": false,
+				"error":   "INVALID_RESET_TOKEN",
+				"message": "Ссылка для сброса пароля недействительна или устарела",
+			})
+			return
+		}
+		if err == nil {
+			user, err = h.users.Get(r.Context(), userID)
+		}
+		if err != nil {
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to reset password")
+			return
+		}
+	} else {
+		var err error
+		user, err = h.useRecoveryCode(r.Context(), req.Username, req.RecoveryCode)
+		if err != nil {
+			respondCodeError(w, err)
+			return
+		}
+	}
+
+	if _, err := h.setPassword(r.Context(), user, req.NewPassword, ""); err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+// useRecoveryCode spends a recovery code of the user with a username. An
+// unknown username or one without recovery codes is a wrong code all the
+// same, so that the answer does not tell them apart.
+func (h *AuthHandler) useRecoveryCode(ctx context.Context, username, recoveryCode string) (*models.User, error) {
+	user, err := h.users.GetByUsername(ctx, username)
+	if err == store.ErrNotFound {
+		return nil, errWrongCode
+	}
+	if err != nil {
+		return nil, err
+	}
+	twoFactor, err := h.twoFactor.Get(ctx, user.ID)
+	if err == store.ErrNotFound || err == nil && twoFactor.EnabledAt == nil {
+		return nil, errWrongCode
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := h.checkSecondFactor(ctx, twoFactor, "", recoveryCode); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// setPassword replaces the password of a user, voids their reset links and
+// ends their sessions but keepSessionID. It returns how many it ended.
+func (h *AuthHandler) setPassword(ctx context.Context, user *models.User, password, keepSessionID string) (int, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, err
+	}
+	if err := h.users.SetPassword(ctx, user.ID, string(hash)); err != nil {
+		return 0, err
+	}
+	if err := h.resets.DeleteForUser(ctx, user.ID); err != nil {
+		return 0, err
+	}
+	// A wrong guess of the old password no longer counts against the new one
+	if err := h.failedLogins.Reset(ctx, user.Username); err != nil {
+		log.Printf("Failed to reset failed logins: %v", err)
+	}
+
+	revoked, err := h.sessions.RevokeOthers(ctx, user.ID, keepSessionID)
+	for _, sessionID := range revoked {
+		h.hub.RevokeSession(user.ID, sessionID)
+	}
+	return len(revoked), err
+}
+
+// checkPassword checks the password of the user of a request, answering it
+// if it is wrong. Wrong guesses count towards the same lockout as failed
+// logins, so a stolen session cannot be used to guess the password. It
+// returns the user with the password hash.
+func (h *AuthHandler) checkPassword(w http.ResponseWriter, r *http.Request, userID, password string) (*models.User, bool) {
+	user, err := h.users.Get(r.Context(), userID)
+	if err == nil {
+		// Get leaves out the password hash
+		user, err = h.users.GetByUsername(r.Context(), user.Username)
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to load user")
+		return nil, false
+	}
+
+	wait, err := h.failedLogins.Check(r.Context(), user.Username)
+	if err != nil {
+		log.Printf("Password lockout check failed: %v", err)
+	} else if wait > 0 {
+		middleware.RespondTooManyRequests(w, wait, "TOO_MANY_ATTEMPTS", "Слишком много неудачных попыток ввода пароля. Попробуйте позже")
+		return nil, false
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		if _, err := h.failedLogins.Fail(r.Context(), user.Username); err != nil {
+			log.Printf("Failed to count failed password check: %v", err)
+		}
+		utils.RespondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"error":   "INVALID_PASSWORD",
+			"message": "Неверный пароль",
+		})
+		return nil, false
+	}
+	if err := h.failedLogins.Reset(r.Context(), user.Username); err != nil {
+		log.Printf("Failed to reset failed logins: %v", err)
+	}
+	return user, true
+}
+
+// validPassword checks a new password, answering the request if it is too short
+func validPassword(w http.ResponseWriter, password string) bool {
+	if len(password) < 6 {
+		utils.RespondJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"error":   "INVALID_PASSWORD_LENGTH",
+			"message": "Пароль должен быть не менее 6 символов",
+		})
+		return false
+	}
+	return true
+}
+
+// normalizeEmail returns a bare address in lower case, so that each address
+// is stored one way
+func normalizeEmail(email string) (string, bool) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || len(email) > 255 {
+		return "", false
+	}
+	return email, true
+}
@@ -0,0 +1,480 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kvant/messenger/internal/media"
+	"github.com/kvant/messenger/internal/middleware"
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/storage"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// tusVersion is the version of the tus protocol spoken
+const tusVersion = "1.0.0"
+
+// statusChecksumMismatch is the status tus gives a chunk or file whose checksum does not match
+const statusChecksumMismatch = 460
+
+// checksumAlgorithms are the hashes a chunk may be checked with
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"md5":    md5.New,
+}
+
+var sha256Hex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// UploadHandler takes files in chunks over the tus protocol (https://tus.io)
+// with its creation, termination, checksum and expiration extensions. After a
+// disconnect a client asks for the offset of the upload with HEAD and sends the
+// rest from there with PATCH. The complete file becomes an attachment, whose id
+// the last PATCH returns in the Attachment-Id header.
+type UploadHandler struct {
+	uploads     store.UploadStore
+	attachments store.AttachmentStore
+	blobs       storage.BlobStore
+	spool       *storage.Spool
+	// maxSize is the largest resumable upload, MAX_UPLOAD_SIZE bytes
+	maxSize int64
+	// ttl is how long an upload is kept after its last chunk, UPLOAD_EXPIRY
+	ttl time.Duration
+	// locks serializes the chunks of each upload
+	locks uploadLocks
+}
+
+func NewUploadHandler(db *sql.DB, blobs storage.BlobStore, spool *storage.Spool) *UploadHandler {
+	maxSize := media.MaxSize()
+	if n, err := strconv.ParseInt(os.Getenv("MAX_UPLOAD_SIZE"), 10, 64); err == nil && n > 0 {
+		maxSize = n
+	}
+	ttl := 24 * time.Hour
+	if d, err := time.ParseDuration(os.Getenv("UPLOAD_EXPIRY")); err == nil && d > 0 {
+		ttl = d
+	}
+	stores := store.New(db)
+	return &UploadHandler{
+		uploads:     stores.Uploads,
+		attachments: stores.Attachments,
+		blobs:       blobs,
+		spool:       spool,
+		maxSize:     maxSize,
+		ttl:         ttl,
+	}
+}
+
+// getUpload returns an upload of the user, or nil if there is none
+func (h *UploadHandler) getUpload(ctx context.Context, id, userID string) (*models.Upload, error) {
+	if !utils.IsUUID(id) {
+		return nil, nil
+	}
+	upload, err := h.uploads.Get(ctx, id)
+	if err == store.ErrNotFound || (err == nil && upload.UserID != userID) {
+		return nil, nil
+	}
+	return upload, err
+}
+
+// uploadLocks serializes the chunks of each upload. An entry lives only while
+// requests hold or wait for it, so completed, expired and abandoned uploads
+// leave nothing behind.
+type uploadLocks struct {
+	mu    sync.Mutex
+	locks map[string]*uploadLock
+}
+
+type uploadLock struct {
+	sync.Mutex
+	// refs counts the requests holding or waiting for the lock
+	refs int
+}
+
+// lock keeps other chunks of an upload out until the returned func is called
+func (l *uploadLocks) lock(id string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*uploadLock)
+	}
+	lock, ok := l.locks[id]
+	if !ok {
+		lock = &uploadLock{}
+		l.locks[id] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.mu.Lock()
+		if lock.refs--; lock.refs == 0 {
+			delete(l.locks, id)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// tusRequest checks that a request speaks our version of tus
+func tusRequest(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		utils.RespondError(w, http.StatusPreconditionFailed, "Unsupported tus version")
+		return false
+	}
+	return true
+}
+
+// loadUpload returns the upload of the request, responding if it cannot
+func (h *UploadHandler) loadUpload(w http.ResponseWriter, r *http.Request) (*models.Upload, bool) {
+	upload, err := h.getUpload(r.Context(), mux.Vars(r)["id"], middleware.GetUserID(r))
+	if err != nil {
+		log.Printf("Failed to load upload: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to load upload")
+		return nil, false
+	}
+	if upload == nil {
+		utils.RespondError(w, http.StatusNotFound, "Upload not found")
+		return nil, false
+	}
+	return upload, true
+}
+
+// setUploadHeaders tells a client how far an upload got
+func setUploadHeaders(w http.ResponseWriter, upload *models.Upload) {
+	header := w.Header()
+	header.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	header.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	header.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	header.Set("Cache-Control", "no-store")
+	if upload.AttachmentID != nil {
+		header.Set("Attachment-Id", *upload.AttachmentID)
+	}
+}
+
+// Options describes what the server supports
+func (h *UploadHandler) Options(w http.ResponseWriter, r *http.Request) {
+	header := w.Header()
+	header.Set("Tus-Resumable", tusVersion)
+	header.Set("Tus-Version", tusVersion)
+	header.Set("Tus-Extension", "creation,termination,checksum,expiration")
+	header.Set("Tus-Max-Size", strconv.FormatInt(h.maxSize, 10))
+	header.Set("Tus-Checksum-Algorithm", "sha1,sha256,md5")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateUpload starts an upload of Upload-Length bytes. Upload-Metadata may
+// carry the filename and the hex sha256 of the whole file, which is checked
+// when it is complete.
+func (h *UploadHandler) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	currentUserID := middleware.GetUserID(r)
+	if !tusRequest(w, r) {
+		return
+	}
+
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		utils.RespondError(w, http.StatusBadRequest, "Upload-Length is required")
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid Upload-Length")
+		return
+	}
+	if length == 0 {
+		utils.RespondError(w, http.StatusBadRequest, "File is empty")
+		return
+	}
+	if length > h.maxSize {
+		utils.RespondError(w, http.StatusRequestEntityTooLarge, "File too large")
+		return
+	}
+
+	metadata, ok := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if !ok {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid Upload-Metadata")
+		return
+	}
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+	var checksum *string
+	if sum, ok := metadata["sha256"]; ok {
+		sum = strings.ToLower(sum)
+		if !sha256Hex.MatchString(sum) {
+			utils.RespondError(w, http.StatusBadRequest, "sha256 must be a hex SHA-256 digest")
+			return
+		}
+		checksum = &sum
+	}
+
+	upload := &models.Upload{
+		ID:        utils.GenerateUUID(),
+		UserID:    currentUserID,
+		Filename:  cleanFilename(filename, ""),
+		Length:    length,
+		Checksum:  checksum,
+		ExpiresAt: time.Now().Add(h.ttl),
+	}
+	if err := h.spool.Create(upload.ID); err != nil {
+		log.Printf("Failed to create upload file: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create upload")
+		return
+	}
+	if err := h.uploads.Create(r.Context(), upload); err != nil {
+		h.spool.Remove(upload.ID)
+		log.Printf("Failed to create upload: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create upload")
+		return
+	}
+
+	w.Header().Set("Location", "/api/uploads/"+upload.ID)
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HeadUpload returns the offset to resume an upload from
+func (h *UploadHandler) HeadUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusRequest(w, r) {
+		return
+	}
+	upload, ok := h.loadUpload(w, r)
+	if !ok {
+		return
+	}
+	setUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetUpload returns an upload as JSON, with its attachment once it is complete
+func (h *UploadHandler) GetUpload(w http.ResponseWriter, r *http.Request) {
+	upload, ok := h.loadUpload(w, r)
+	if !ok {
+		return
+	}
+	if upload.AttachmentID != nil {
+		attachment, err := h.attachments.Get(r.Context(), *upload.AttachmentID)
+		if err != nil && err != store.ErrNotFound {
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to load upload")
+			return
+		}
+		upload.Attachment = attachment
+	}
+	utils.RespondJSON(w, http.StatusOK, upload)
+}
+
+// PatchUpload writes a chunk at Upload-Offset, which must be the offset of
+// the upload. The bytes that arrive are kept even if the connection drops.
+// An Upload-Checksum ("sha1 <base64>") makes the chunk count only if it matches.
+func (h *UploadHandler) PatchUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusRequest(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		utils.RespondError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid Upload-Offset")
+		return
+	}
+	var chunkHash hash.Hash
+	var expected []byte
+	if checksum := r.Header.Get("Upload-Checksum"); checksum != "" {
+		algorithm, sum, _ := strings.Cut(checksum, " ")
+		newHash, ok := checksumAlgorithms[algorithm]
+		expected, err = base64.StdEncoding.DecodeString(sum)
+		if !ok || err != nil {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid Upload-Checksum")
+			return
+		}
+		chunkHash = newHash()
+	}
+
+	// Only uploads of the user get a lock
+	upload, ok := h.loadUpload(w, r)
+	if !ok {
+		return
+	}
+	unlock := h.locks.lock(upload.ID)
+	defer unlock()
+
+	// Another chunk may have moved the upload on while this one waited
+	if upload, ok = h.loadUpload(w, r); !ok {
+		return
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		if err := h.remove(r.Context(), upload.ID); err != nil {
+			log.Printf("Failed to delete expired upload %s: %v", upload.ID, err)
+		}
+		utils.RespondError(w, http.StatusGone, "Upload expired")
+		return
+	}
+	if offset != upload.Offset {
+		setUploadHeaders(w, upload)
+		utils.RespondError(w, http.StatusConflict, "Upload-Offset does not match the offset of the upload")
+		return
+	}
+	remaining := upload.Length - upload.Offset
+	if r.ContentLength > remaining {
+		utils.RespondError(w, http.StatusRequestEntityTooLarge, "Chunk goes past Upload-Length")
+		return
+	}
+
+	if remaining > 0 {
+		var body io.Reader = r.Body
+		if chunkHash != nil {
+			body = io.TeeReader(body, chunkHash)
+		}
+		written, readErr := h.spool.Append(upload.ID, offset, body, remaining)
+
+		// A chunk that fails its checksum is dropped as a whole
+		if chunkHash != nil && (readErr != nil || !bytes.Equal(chunkHash.Sum(nil), expected)) {
+			setUploadHeaders(w, upload)
+			utils.RespondError(w, statusChecksumMismatch, "Checksum mismatch")
+			return
+		}
+		if written > 0 {
+			// The bytes are recorded even if the client went away meanwhile
+			if err := h.advance(context.WithoutCancel(r.Context()), upload, written); err != nil {
+				log.Printf("Failed to advance upload %s: %v", upload.ID, err)
+				utils.RespondError(w, http.StatusInternalServerError, "Failed to store chunk")
+				return
+			}
+		}
+		if readErr != nil {
+			setUploadHeaders(w, upload)
+			utils.RespondError(w, http.StatusBadRequest, "Failed to read chunk")
+			return
+		}
+	}
+
+	// The last chunk completes the upload. Completing is retried by a PATCH
+	// at the end if it failed for a reason other than the file.
+	if upload.Offset == upload.Length && upload.AttachmentID == nil {
+		attachment, err := h.complete(r.Context(), upload)
+		if err != nil {
+			if _, rejected := err.(*uploadError); rejected {
+				h.remove(r.Context(), upload.ID)
+			}
+			respondUploadError(w, err)
+			return
+		}
+		upload.AttachmentID = &attachment.ID
+	}
+
+	setUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteUpload cancels an upload. An attachment it completed stays.
+func (h *UploadHandler) DeleteUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusRequest(w, r) {
+		return
+	}
+	upload, ok := h.loadUpload(w, r)
+	if !ok {
+		return
+	}
+	unlock := h.locks.lock(upload.ID)
+	defer unlock()
+
+	if err := h.remove(r.Context(), upload.ID); err != nil {
+		log.Printf("Failed to delete upload %s: %v", upload.ID, err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete upload")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// advance moves the offset of an upload past n written bytes and postpones its expiry
+func (h *UploadHandler) advance(ctx context.Context, upload *models.Upload, n int64) error {
+	expiresAt := time.Now().Add(h.ttl)
+	if err := h.uploads.Advance(ctx, upload.ID, upload.Offset, upload.Offset+n, expiresAt); err != nil {
+		return err
+	}
+	upload.Offset += n
+	upload.ExpiresAt = expiresAt
+	return nil
+}
+
+// complete checks a fully uploaded file and stores it as an attachment
+func (h *UploadHandler) complete(ctx context.Context, upload *models.Upload) (*models.Attachment, error) {
+	file, err := h.spool.Open(upload.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if upload.Checksum != nil {
+		sum := sha256.New()
+		if _, err := io.Copy(sum, io.NewSectionReader(file, 0, upload.Length)); err != nil {
+			return nil, err
+		}
+		if hex.EncodeToString(sum.Sum(nil)) != *upload.Checksum {
+			return nil, &uploadError{statusChecksumMismatch, "Checksum of the file does not match"}
+		}
+	}
+
+	attachment, err := storeAttachment(ctx, h.blobs, h.attachments, upload.UserID, file, upload.Length, upload.Filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.uploads.Complete(ctx, upload.ID, attachment.ID); err != nil {
+		return nil, err
+	}
+	if err := h.spool.Remove(upload.ID); err != nil {
+		log.Printf("Failed to remove upload file %s: %v", upload.ID, err)
+	}
+	return attachment, nil
+}
+
+// remove deletes an upload with its partial file
+func (h *UploadHandler) remove(ctx context.Context, id string) error {
+	if err := h.uploads.Delete(ctx, id); err != nil && err != store.ErrNotFound {
+		return err
+	}
+	return h.spool.Remove(id)
+}
+
+// parseUploadMetadata parses tus Upload-Metadata: comma-separated keys, each
+// with an optional base64 value
+func parseUploadMetadata(header string) (map[string]string, bool) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, true
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, false
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, false
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata, true
+}
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kvant/messenger/internal/middleware"
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/storage"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// newTestUploadHandler returns an upload handler keeping its files in temporary directories
+func newTestUploadHandler(t *testing.T, db *sql.DB) *UploadHandler {
+	t.Helper()
+	blobs, err := storage.NewLocalStore(t.TempDir(), "/uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool, err := storage.NewSpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewUploadHandler(db, blobs, spool)
+}
+
+// tus sends a tus request for an upload as userID
+func tus(handler http.HandlerFunc, method, id, userID string, headers map[string]string, body io.Reader) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/api/uploads/"+id, body)
+	r.Header.Set("Tus-Resumable", tusVersion)
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), middleware.UserIDKey, userID))
+	r = mux.SetURLVars(r, map[string]string{"id": id})
+
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// createUpload starts an upload of length bytes and returns its id
+func createUpload(t *testing.T, h *UploadHandler, userID string, length int, metadata string) string {
+	t.Helper()
+	w := tus(h.CreateUpload, "POST", "", userID, map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": metadata,
+	}, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating upload: status %d: %s", w.Code, w.Body)
+	}
+	return path.Base(w.Header().Get("Location"))
+}
+
+// patch sends a chunk at offset
+func patch(h *UploadHandler, id, userID string, offset int, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+	all := map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	}
+	for key, value := range headers {
+		all[key] = value
+	}
+	return tus(h.PatchUpload, "PATCH", id, userID, all, body)
+}
+
+func wantOffset(t *testing.T, w *httptest.ResponseRecorder, status int, offset string) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status %d, want %d: %s", w.Code, status, w.Body)
+	}
+	if got := w.Header().Get("Upload-Offset"); got != offset {
+		t.Fatalf("Upload-Offset %q, want %q", got, offset)
+	}
+}
+
+// failingReader returns its data, then fails like a dropped connection
+type failingReader struct{ data io.Reader }
+
+func (r failingReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestUploadResume(t *testing.T) {
+	db := newTestDB(t)
+	h := newTestUploadHandler(t, db)
+	user := newTestUser(t, db, "uploader")
+
+	content := "hello, resumable world"
+	sum := sha256.Sum256([]byte(content))
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("notes.txt")) +
+		",sha256 " + base64.StdEncoding.EncodeToString([]byte(hex.EncodeToString(sum[:])))
+	id := createUpload(t, h, user.ID, len(content), metadata)
+
+	// The connection drops after 5 bytes; they are kept
+	w := patch(h, id, user.ID, 0, failingReader{strings.NewReader(content[:5])}, nil)
+	wantOffset(t, w, http.StatusBadRequest, "5")
+	wantOffset(t, tus(h.HeadUpload, "HEAD", id, user.ID, nil, nil), http.StatusOK, "5")
+
+	// A chunk from a stale offset is refused
+	w = patch(h, id, user.ID, 0, strings.NewReader(content), nil)
+	wantOffset(t, w, http.StatusConflict, "5")
+
+	// A chunk failing its checksum is dropped as a whole
+	bad := sha1.Sum([]byte("something else"))
+	w = patch(h, id, user.ID, 5, strings.NewReader(content[5:10]), map[string]string{
+		"Upload-Checksum": "sha1 " + base64.StdEncoding.EncodeToString(bad[:]),
+	})
+	wantOffset(t, w, statusChecksumMismatch, "5")
+	wantOffset(t, tus(h.HeadUpload, "HEAD", id, user.ID, nil, nil), http.StatusOK, "5")
+
+	good := sha1.Sum([]byte(content[5:10]))
+	w = patch(h, id, user.ID, 5, strings.NewReader(content[5:10]), map[string]string{
+		"Upload-Checksum": "sha1 " + base64.StdEncoding.EncodeToString(good[:]),
+	})
+	wantOffset(t, w, http.StatusNoContent, "10")
+	if w.Header().Get("Attachment-Id") != "" {
+		t.Fatal("an incomplete upload has an attachment")
+	}
+
+	// The last chunk completes it
+	w = patch(h, id, user.ID, 10, strings.NewReader(content[10:]), nil)
+	wantOffset(t, w, http.StatusNoContent, strconv.Itoa(len(content)))
+	attachmentID := w.Header().Get("Attachment-Id")
+	if attachmentID == "" {
+		t.Fatal("a complete upload has no attachment")
+	}
+
+	var upload models.Upload
+	decode(t, tus(h.GetUpload, "GET", id, user.ID, nil, nil), http.StatusOK, &upload)
+	if upload.Attachment == nil || upload.Attachment.ID != attachmentID || upload.Attachment.Size != int64(len(content)) ||
+		upload.Attachment.Filename != "notes.txt" || upload.Attachment.MimeType != "text/plain" {
+		t.Fatalf("attachment of the upload is %+v", upload.Attachment)
+	}
+	if len(h.locks.locks) != 0 {
+		t.Errorf("%d upload locks are left", len(h.locks.locks))
+	}
+}
+
+func TestUploadWholeFileChecksum(t *testing.T) {
+	db := newTestDB(t)
+	h := newTestUploadHandler(t, db)
+	user := newTestUser(t, db, "uploader")
+
+	sum := sha256.Sum256([]byte("the file the client meant"))
+	id := createUpload(t, h, user.ID, 7, "sha256 "+base64.StdEncoding.EncodeToString([]byte(hex.EncodeToString(sum[:]))))
+
+	// A file that does not match is rejected and deleted
+	w := patch(h, id, user.ID, 0, strings.NewReader("corrupt"), nil)
+	if w.Code != statusChecksumMismatch {
+		t.Fatalf("status %d, want %d: %s", w.Code, statusChecksumMismatch, w.Body)
+	}
+	if w := tus(h.HeadUpload, "HEAD", id, user.ID, nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD of a rejected upload: status %d, want 404", w.Code)
+	}
+
+	w = tus(h.CreateUpload, "POST", "", user.ID, map[string]string{
+		"Upload-Length":   "7",
+		"Upload-Metadata": "sha256 " + base64.StdEncoding.EncodeToString([]byte("not-hex")),
+	}, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("creating an upload with an invalid sha256: status %d, want 400", w.Code)
+	}
+}
+
+func TestUploadExpiry(t *testing.T) {
+	db := newTestDB(t)
+	h := newTestUploadHandler(t, db)
+	user := newTestUser(t, db, "uploader")
+
+	id := createUpload(t, h, user.ID, 8, "")
+	wantOffset(t, patch(h, id, user.ID, 0, strings.NewReader("half"), nil), http.StatusNoContent, "4")
+
+	past := time.Now().Add(-time.Minute)
+	if _, err := db.Exec(utils.AdaptQuery(`UPDATE uploads SET expires_at = $1 WHERE id = $2`), utils.DBTime(past), id); err != nil {
+		t.Fatal(err)
+	}
+	if w := patch(h, id, user.ID, 4, strings.NewReader("more"), nil); w.Code != http.StatusGone {
+		t.Fatalf("status %d, want 410: %s", w.Code, w.Body)
+	}
+
+	// An expired upload is gone with its partial file
+	if w := tus(h.HeadUpload, "HEAD", id, user.ID, nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD of an expired upload: status %d, want 404", w.Code)
+	}
+	if file, err := h.spool.Open(id); err == nil {
+		file.Close()
+		t.Error("the partial file of an expired upload is kept")
+	}
+	if len(h.locks.locks) != 0 {
+		t.Errorf("%d upload locks are left", len(h.locks.locks))
+	}
+}
+
+func TestUploadOwnership(t *testing.T) {
+	db := newTestDB(t)
+	h := newTestUploadHandler(t, db)
+	owner := newTestUser(t, db, "owner")
+	other := newTestUser(t, db, "other")
+
+	id := createUpload(t, h, owner.ID, 4, "")
+	for _, tt := range []struct{ id, userID string }{
+		{id, other.ID},
+		{"not-an-id", owner.ID},
+		{utils.GenerateUUID(), owner.ID},
+	} {
+		if w := patch(h, tt.id, tt.userID, 0, strings.NewReader("data"), nil); w.Code != http.StatusNotFound {
+			t.Errorf("PATCH %s as %s: status %d, want 404", tt.id, tt.userID, w.Code)
+		}
+		if w := tus(h.DeleteUpload, "DELETE", tt.id, tt.userID, nil, nil); w.Code != http.StatusNotFound {
+			t.Errorf("DELETE %s as %s: status %d, want 404", tt.id, tt.userID, w.Code)
+		}
+	}
+	if len(h.locks.locks) != 0 {
+		t.Errorf("requests for uploads of others left %d locks", len(h.locks.locks))
+	}
+
+	if w := tus(h.DeleteUpload, "DELETE", id, owner.ID, nil, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: status %d, want 204: %s", w.Code, w.Body)
+	}
+	if w := tus(h.HeadUpload, "HEAD", id, owner.ID, nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD of a deleted upload: status %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,313 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/kvant/messenger/internal/conversation"
+	"github.com/kvant/messenger/internal/middleware"
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/permissions"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/internal/websocket"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// requirePermission resolves the membership of the user in the group or server and
+// writes an error response unless the user is a member holding perm.
+// Pass perm == 0 to only require membership.
+func requirePermission(db *sql.DB, w http.ResponseWriter, scope permissions.Scope, scopeID, userID string, perm permissions.Permission) (*permissions.Member, bool) {
+	member, err := permissions.Resolve(db, scope, scopeID, userID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to check membership")
+		return nil, false
+	}
+	if member == nil {
+		if scope == permissions.ScopeGroup {
+			utils.RespondError(w, http.StatusNotFound, "Group not found")
+		} else {
+			utils.RespondError(w, http.StatusNotFound, "Server not found")
+		}
+		return nil, false
+	}
+	if perm != 0 && !member.Can(perm) {
+		utils.RespondError(w, http.StatusForbidden, "You don't have permission to do this")
+		return nil, false
+	}
+	return member, true
+}
+
+// assignableRole looks up a role that actor may give to a member. It writes an
+// error response and returns nil if the role does not exist or ranks too high.
+func assignableRole(db *sql.DB, w http.ResponseWriter, actor *permissions.Member, scope permissions.Scope, scopeID, name string) *permissions.Role {
+	if name == permissions.RoleOwner {
+		utils.RespondError(w, http.StatusBadRequest, "Ownership cannot be assigned")
+		return nil
+	}
+	role, err := permissions.GetRole(db, scope, scopeID, name)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get role")
+		return nil
+	}
+	if role == nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid role")
+		return nil
+	}
+	if name != permissions.RoleMember && !(actor.Can(permissions.ManageRoles) && actor.Outranks(role.Position)) {
+		utils.RespondError(w, http.StatusForbidden, "You cannot assign this role")
+		return nil
+	}
+	return role
+}
+
+// RoleHandler manages the roles of groups and servers. Each method takes the
+// scope it serves and returns the handler for it.
+type RoleHandler struct {
+	db    *sql.DB
+	roles store.RoleStore
+	hub   *websocket.Hub
+}
+
+func NewRoleHandler(db *sql.DB, hub *websocket.Hub) *RoleHandler {
+	return &RoleHandler{db: db, roles: store.New(db).Roles, hub: hub}
+}
+
+func (h *RoleHandler) notifyMembers(scope permissions.Scope, scopeID string, event map[string]interface{}) {
+	var ids []string
+	var err error
+	if scope == permissions.ScopeGroup {
+		ids, err = conversation.GroupMemberIDs(h.db, scopeID)
+	} else {
+		ids, err = conversation.ServerMemberIDs(h.db, scopeID)
+	}
+	if err != nil {
+		log.Printf("Failed to get members of %s %s: %v", scope, scopeID, err)
+		return
+	}
+	h.hub.SendToUsers(ids, event)
+}
+
+func (h *RoleHandler) ListRoles(scope permissions.Scope) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scopeID := mux.Vars(r)["id"]
+		currentUserID := middleware.GetUserID(r)
+
+		if _, ok := requirePermission(h.db, w, scope, scopeID, currentUserID, 0); !ok {
+			return
+		}
+
+		roles, err := permissions.ListRoles(h.db, scope, scopeID)
+		if err != nil {
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to get roles")
+			return
+		}
+
+		utils.RespondJSON(w, http.StatusOK, roles)
+	}
+}
+
+// validateRole checks that actor may give a role the requested permissions and position
+func validateRole(w http.ResponseWriter, actor *permissions.Member, perms permissions.Permission, position int) bool {
+	if perms&^permissions.All != 0 {
+		utils.RespondError(w, http.StatusBadRequest, "Unknown permission bits")
+		return false
+	}
+	// Nobody can grant what they don't have or create a role at or above their own
+	if !actor.Role.Permissions.Has(perms) {
+		utils.RespondError(w, http.StatusForbidden, "You cannot grant permissions you don't have")
+		return false
+	}
+	if position < 0 || position >= permissions.OwnerPosition || !actor.Outranks(position) {
+		utils.RespondError(w, http.StatusForbidden, "Role position must be below your own")
+		return false
+	}
+	return true
+}
+
+func (h *RoleHandler) CreateRole(scope permissions.Scope) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scopeID := mux.Vars(r)["id"]
+		currentUserID := middleware.GetUserID(r)
+
+		actor, ok := requirePermission(h.db, w, scope, scopeID, currentUserID, permissions.ManageRoles)
+		if !ok {
+			return
+		}
+
+		var req models.RoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == nil {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+			return
+		}
+
+		role := permissions.Role{
+			Name:        strings.ToLower(strings.TrimSpace(*req.Name)),
+			Permissions: permissions.SendMessages | permissions.AttachFiles | permissions.AddReactions,
+			Position:    1,
+		}
+		if role.Name == "" || len(role.Name) > 20 {
+			utils.RespondError(w, http.StatusBadRequest, "Role name must be between 1 and 20 characters")
+			return
+		}
+		if permissions.IsBuiltIn(role.Name) {
+			utils.RespondError(w, http.StatusConflict, "Role already exists")
+			return
+		}
+		if req.Permissions != nil {
+			role.Permissions = permissions.Permission(*req.Permissions)
+		}
+		if req.Position != nil {
+			role.Position = *req.Position
+		}
+		if !validateRole(w, actor, role.Permissions, role.Position) {
+			return
+		}
+
+		err := h.roles.Create(r.Context(), string(scope), scopeID, models.StoredRole{Name: role.Name, Permissions: int64(role.Permissions), Position: role.Position})
+		if err == store.ErrConflict {
+			utils.RespondError(w, http.StatusConflict, "Role already exists")
+			return
+		}
+		if err != nil {
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to create role")
+			return
+		}
+
+		h.notifyMembers(scope, scopeID, map[string]interface{}{
+			"type": "role_created",
+			"data": map[string]interface{}{
+				"scope":    scope,
+				"scope_id": scopeID,
+				"role":     role,
+			},
+		})
+
+		utils.RespondJSON(w, http.StatusCreated, role)
+	}
+}
+
+// UpdateRole changes the permissions or position of a role. The built-in admin
+// and member roles can be changed too; the owner role cannot.
+func (h *RoleHandler) UpdateRole(scope permissions.Scope) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		scopeID := vars["id"]
+		name := vars["role"]
+		currentUserID := middleware.GetUserID(r)
+
+		actor, ok := requirePermission(h.db, w, scope, scopeID, currentUserID, permissions.ManageRoles)
+		if !ok {
+			return
+		}
+
+		var req models.RoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+			return
+		}
+
+		if name == permissions.RoleOwner {
+			utils.RespondError(w, http.StatusForbidden, "The owner role cannot be changed")
+			return
+		}
+		role, err := permissions.GetRole(h.db, scope, scopeID, name)
+		if err != nil {
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to get role")
+			return
+		}
+		if role == nil {
+			utils.RespondError(w, http.StatusNotFound, "Role not found")
+			return
+		}
+		if !actor.Outranks(role.Position) {
+			utils.RespondError(w, http.StatusForbidden, "You cannot change a role at or above your own")
+			return
+		}
+
+		if req.Permissions != nil {
+			role.Permissions = permissions.Permission(*req.Permissions)
+		}
+		if req.Position != nil {
+			role.Position = *req.Position
+		}
+		if !validateRole(w, actor, role.Permissions, role.Position) {
+			return
+		}
+
+		// Built-in roles have no row until their defaults are first changed
+		err = h.roles.Save(r.Context(), string(scope), scopeID, models.StoredRole{Name: role.Name, Permissions: int64(role.Permissions), Position: role.Position})
+		if err != nil {
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to update role")
+			return
+		}
+
+		h.notifyMembers(scope, scopeID, map[string]interface{}{
+			"type": "role_updated",
+			"data": map[string]interface{}{
+				"scope":    scope,
+				"scope_id": scopeID,
+				"role":     role,
+			},
+		})
+
+		utils.RespondJSON(w, http.StatusOK, role)
+	}
+}
+
+// DeleteRole removes a custom role; members holding it fall back to member
+func (h *RoleHandler) DeleteRole(scope permissions.Scope) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		scopeID := vars["id"]
+		name := vars["role"]
+		currentUserID := middleware.GetUserID(r)
+
+		actor, ok := requirePermission(h.db, w, scope, scopeID, currentUserID, permissions.ManageRoles)
+		if !ok {
+			return
+		}
+
+		if permissions.IsBuiltIn(name) {
+			utils.RespondError(w, http.StatusForbidden, "Built-in roles cannot be deleted")
+			return
+		}
+		role, err := permissions.GetRole(h.db, scope, scopeID, name)
+		if err != nil {
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to get role")
+			return
+		}
+		if role == nil {
+			utils.RespondError(w, http.StatusNotFound, "Role not found")
+			return
+		}
+		if !actor.Outranks(role.Position) {
+			utils.RespondError(w, http.StatusForbidden, "You cannot delete a role at or above your own")
+			return
+		}
+
+		err = h.roles.Delete(r.Context(), string(scope), scopeID, name, permissions.RoleMember)
+		if err == store.ErrNotFound {
+			utils.RespondError(w, http.StatusNotFound, "Role not found")
+			return
+		}
+		if err != nil {
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to delete role")
+			return
+		}
+
+		h.notifyMembers(scope, scopeID, map[string]interface{}{
+			"type": "role_deleted",
+			"data": map[string]interface{}{
+				"scope":    scope,
+				"scope_id": scopeID,
+				"name":     name,
+			},
+		})
+
+		utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+	}
+}
@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kvant/messenger/internal/conversation"
+	"github.com/kvant/messenger/internal/middleware"
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/internal/websocket"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// maxScheduleAhead is how far in the future a message can be scheduled
+const maxScheduleAhead = 365 * 24 * time.Hour
+
+// ScheduledMessageHandler manages the send-later queue of the current user.
+// The scheduler in package scheduler sends the messages when they are due.
+type ScheduledMessageHandler struct {
+	db        *sql.DB
+	scheduled store.ScheduledMessageStore
+	hub       *websocket.Hub
+}
+
+func NewScheduledMessageHandler(db *sql.DB, hub *websocket.Hub) *ScheduledMessageHandler {
+	return &ScheduledMessageHandler{db: db, scheduled: store.New(db).Scheduled, hub: hub}
+}
+
+// getScheduled returns a queued message of the user, or nil if there is none
+func (h *ScheduledMessageHandler) getScheduled(ctx context.Context, id, userID string) (*models.ScheduledMessage, error) {
+	msg, err := h.scheduled.Get(ctx, id)
+	if err == store.ErrNotFound || (err == nil && msg.SenderID != userID) {
+		return nil, nil
+	}
+	return msg, err
+}
+
+// validSendAt checks that a send time is in the future and not too far ahead
+func validSendAt(w http.ResponseWriter, sendAt time.Time) bool {
+	now := time.Now()
+	if !sendAt.After(now) || sendAt.After(now.Add(maxScheduleAhead)) {
+		utils.RespondError(w, http.StatusBadRequest, "send_at must be in the future and within a year")
+		return false
+	}
+	return true
+}
+
+// notifySender keeps the queue in sync across the sender's devices
+func (h *ScheduledMessageHandler) notifySender(userID, eventType string, data interface{}) {
+	h.hub.SendToUser(userID, map[string]interface{}{
+		"type": eventType,
+		"data": data,
+	})
+}
+
+// ScheduleMessage queues a message to be sent at send_at
+func (h *ScheduledMessageHandler) ScheduleMessage(w http.ResponseWriter, r *http.Request) {
+	currentUserID := middleware.GetUserID(r)
+
+	var req models.ScheduleMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	target := conversation.Target{
+		ReceiverID:      req.ReceiverID,
+		GroupID:         req.GroupID,
+		ServerChannelID: req.ServerChannelID,
+	}
+	if !target.Valid() {
+		utils.RespondError(w, http.StatusBadRequest, "Exactly one of receiver_id, group_id or server_channel_id is required")
+		return
+	}
+	if req.Text == "" {
+		utils.RespondError(w, http.StatusBadRequest, "Message text cannot be empty")
+		return
+	}
+	if req.SelfDestructIn != nil && (*req.SelfDestructIn <= 0 || *req.SelfDestructIn > websocket.MaxSelfDestructIn) {
+		utils.RespondError(w, http.StatusBadRequest, "self_destruct_in must be between 1 second and 7 days")
+		return
+	}
+	if req.SelfDestructAfterRead && (req.SelfDestructIn == nil || req.ReceiverID == "") {
+		utils.RespondError(w, http.StatusBadRequest, "self_destruct_after_read needs self_destruct_in and a direct chat")
+		return
+	}
+	if !validSendAt(w, req.SendAt) {
+		return
+	}
+
+	// Permissions are checked again when the message is sent
+	_, ok, err := conversation.Recipients(h.db, target, currentUserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to schedule message")
+		return
+	}
+	if !ok {
+		utils.RespondError(w, http.StatusForbidden, "You are not a member of this chat")
+		return
+	}
+
+	msg := &models.ScheduledMessage{
+		SenderID:              currentUserID,
+		ReceiverID:            nullString(req.ReceiverID),
+		GroupID:               nullString(req.GroupID),
+		ServerChannelID:       nullString(req.ServerChannelID),
+		Text:                  req.Text,
+		ReplyToID:             req.ReplyToID,
+		SelfDestructIn:        req.SelfDestructIn,
+		SelfDestructAfterRead: req.SelfDestructAfterRead,
+		SendAt:                req.SendAt,
+	}
+	if err := h.scheduled.Create(r.Context(), msg); err != nil {
+		log.Printf("Failed to schedule message: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to schedule message")
+		return
+	}
+
+	msg, err = h.getScheduled(r.Context(), msg.ID, currentUserID)
+	if err != nil || msg == nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to schedule message")
+		return
+	}
+
+	h.notifySender(currentUserID, "scheduled_message_created", msg)
+	utils.RespondJSON(w, http.StatusCreated, msg)
+}
+
+// GetScheduledMessages lists the queued messages of the user, soonest first.
+// Pass receiver_id, group_id or server_channel_id to list those of one chat.
+func (h *ScheduledMessageHandler) GetScheduledMessages(w http.ResponseWriter, r *http.Request) {
+	currentUserID := middleware.GetUserID(r)
+	q := r.URL.Query()
+
+	messages, err := h.scheduled.ForSender(r.Context(), currentUserID, q.Get("receiver_id"), q.Get("group_id"), q.Get("server_channel_id"))
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get scheduled messages")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, messages)
+}
+
+// UpdateScheduledMessage edits the text or send time of a queued message.
+// Rescheduling a failed message queues it again.
+func (h *ScheduledMessageHandler) UpdateScheduledMessage(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	var req models.UpdateScheduledMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	msg, err := h.getScheduled(r.Context(), id, currentUserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get scheduled message")
+		return
+	}
+	if msg == nil {
+		utils.RespondError(w, http.StatusNotFound, "Scheduled message not found")
+		return
+	}
+
+	if req.Text != nil {
+		if *req.Text == "" {
+			utils.RespondError(w, http.StatusBadRequest, "Message text cannot be empty")
+			return
+		}
+		msg.Text = *req.Text
+	}
+	if req.SendAt != nil {
+		if !validSendAt(w, *req.SendAt) {
+			return
+		}
+		msg.SendAt = *req.SendAt
+	}
+
+	// A message the scheduler is sending right now can no longer be changed
+	err = h.scheduled.Update(r.Context(), id, msg.Text, msg.SendAt)
+	if err == store.ErrConflict {
+		utils.RespondError(w, http.StatusConflict, "The message is already being sent")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update scheduled message")
+		return
+	}
+
+	msg, err = h.getScheduled(r.Context(), id, currentUserID)
+	if err != nil || msg == nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get scheduled message")
+		return
+	}
+
+	h.notifySender(currentUserID, "scheduled_message_updated", msg)
+	utils.RespondJSON(w, http.StatusOK, msg)
+}
+
+// CancelScheduledMessage removes a message from the queue
+func (h *ScheduledMessageHandler) CancelScheduledMessage(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	msg, err := h.getScheduled(r.Context(), id, currentUserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get scheduled message")
+		return
+	}
+	if msg == nil {
+		utils.RespondError(w, http.StatusNotFound, "Scheduled message not found")
+		return
+	}
+
+	err = h.scheduled.Cancel(r.Context(), id)
+	if err == store.ErrConflict {
+		utils.RespondError(w, http.StatusConflict, "The message is already being sent")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to cancel scheduled message")
+		return
+	}
+
+	h.notifySender(currentUserID, "scheduled_message_deleted", map[string]interface{}{"id": id})
+	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
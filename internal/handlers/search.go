@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/kvant/messenger/internal/conversation"
+	"github.com/kvant/messenger/internal/middleware"
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// maxSearchTerms bounds the words of a search query
+const maxSearchTerms = 10
+
+// searchTerms splits a query into lowercase words of letters and digits, the
+// way both full-text engines tokenize text. Punctuation never reaches the
+// engines, so no query can be a syntax error.
+func searchTerms(q string) []string {
+	terms := strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(terms) > maxSearchTerms {
+		terms = terms[:maxSearchTerms]
+	}
+	return terms
+}
+
+// SearchMessages searches the text of messages in every chat of the user,
+// newest first. Query parameters:
+//
+//	q=<text>         words that must all appear in the message
+//	before=<id>      only hits older than this message, for the next page
+//	limit=<n>        hits per page, 1 to 50, 20 by default
+//	context=<n>      messages to include before and after each hit, 0 to 5, 1 by default
+func (h *MessageHandler) SearchMessages(w http.ResponseWriter, r *http.Request) {
+	currentUserID := middleware.GetUserID(r)
+	q := r.URL.Query()
+
+	terms := searchTerms(q.Get("q"))
+	if len(terms) == 0 {
+		utils.RespondError(w, http.StatusBadRequest, "Search query is required")
+		return
+	}
+
+	limit := 20
+	if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 && l <= 50 {
+		limit = l
+	}
+	contextSize := 1
+	if c, err := strconv.Atoi(q.Get("context")); err == nil && c >= 0 && c <= 5 {
+		contextSize = c
+	}
+	before := q.Get("before")
+	if before != "" && !utils.IsUUID(before) {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	matches, hasMore, err := h.search.Messages(r.Context(), currentUserID, terms, before, limit)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to search messages")
+		return
+	}
+
+	results := models.SearchResults{Conversations: []models.SearchConversation{}, HasMore: hasMore}
+	if len(matches) == 0 {
+		utils.RespondJSON(w, http.StatusOK, results)
+		return
+	}
+
+	// Load the full hit messages with reactions and replies at once
+	ids := make([]string, len(matches))
+	for i, match := range matches {
+		ids[i] = match.MessageID
+	}
+	messages, err := h.messages.List(r.Context(), ids)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to search messages")
+		return
+	}
+	h.addDetails(r.Context(), messages)
+	byID := make(map[string]models.Message, len(messages))
+	for _, msg := range messages {
+		byID[msg.ID] = msg
+	}
+
+	index := make(map[string]int)
+	for _, match := range matches {
+		msg, ok := byID[match.MessageID]
+		if !ok {
+			continue
+		}
+
+		result := models.SearchHit{Message: msg, Snippet: match.Snippet, Before: []models.Message{}, After: []models.Message{}}
+		if contextSize > 0 {
+			around := store.Cursor{ID: match.MessageID}
+			result.Before, _, err = h.messages.Page(r.Context(), match.Chat, around, false, contextSize)
+			if err == nil {
+				result.After, _, err = h.messages.Page(r.Context(), match.Chat, around, true, contextSize)
+			}
+			if err != nil {
+				utils.RespondError(w, http.StatusInternalServerError, "Failed to search messages")
+				return
+			}
+			h.addDetails(r.Context(), result.Before)
+			h.addDetails(r.Context(), result.After)
+		}
+
+		conv := chatConversation(match.Chat)
+		key := conv.Type + ":" + conv.ID
+		i, ok := index[key]
+		if !ok {
+			i = len(results.Conversations)
+			index[key] = i
+			conv.Name = match.ChatName
+			conv.Hits = []models.SearchHit{}
+			results.Conversations = append(results.Conversations, conv)
+		}
+		results.Conversations[i].Hits = append(results.Conversations[i].Hits, result)
+	}
+
+	utils.RespondJSON(w, http.StatusOK, results)
+}
+
+// chatConversation returns the type and id of a chat as search results name them
+func chatConversation(chat store.Chat) models.SearchConversation {
+	switch {
+	case chat.GroupID != "":
+		return models.SearchConversation{Type: conversation.TypeGroup, ID: chat.GroupID}
+	case chat.ChannelID != "":
+		return models.SearchConversation{Type: conversation.TypeChannel, ID: chat.ChannelID}
+	case chat.ServerChannelID != "":
+		return models.SearchConversation{Type: conversation.TypeServerChannel, ID: chat.ServerChannelID}
+	}
+	return models.SearchConversation{Type: conversation.TypeDirect, ID: chat.OtherUserID}
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/kvant/messenger/internal/conversation"
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+func TestSearchTerms(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"Hello World", []string{"hello", "world"}},
+		// Query syntax of either engine is just punctuation
+		{`"tea" OR coffee*`, []string{"tea", "or", "coffee"}},
+		{"NEAR(a b) -c col:d", []string{"near", "a", "b", "c", "col", "d"}},
+		{"it's 2am", []string{"it", "s", "2am"}},
+		{"  ...  ", []string{}},
+		{"a b c d e f g h i j k l", []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}},
+	}
+	for _, tt := range tests {
+		if got := searchTerms(tt.in); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("searchTerms(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSearchMessages(t *testing.T) {
+	db := newTestDB(t)
+	h := NewMessageHandler(db, nil, nil)
+	stores := store.New(db)
+	ctx := context.Background()
+	me := newTestUser(t, db, "me")
+	friend := newTestUser(t, db, "friend")
+	stranger := newTestUser(t, db, "stranger")
+
+	send := func(msg *models.Message) string {
+		t.Helper()
+		if err := stores.Messages.Create(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg.ID
+	}
+	direct := send(&models.Message{SenderID: friend.ID, ReceiverID: &me.ID, Text: "tea or coffee tomorrow?"})
+	send(&models.Message{SenderID: me.ID, ReceiverID: &friend.ID, Text: "sure"})
+
+	group := &models.Group{Name: "Cafe", OwnerID: friend.ID}
+	if err := stores.Groups.Create(ctx, group, []string{me.ID}); err != nil {
+		t.Fatal(err)
+	}
+	inGroup := send(&models.Message{SenderID: friend.ID, GroupID: &group.ID, Text: "coffeehouse at noon"})
+
+	// Chats the caller does not belong to never match
+	send(&models.Message{SenderID: friend.ID, ReceiverID: &stranger.ID, Text: "coffee without me"})
+	closed := &models.Group{Name: "Closed", OwnerID: stranger.ID}
+	if err := stores.Groups.Create(ctx, closed, []string{friend.ID}); err != nil {
+		t.Fatal(err)
+	}
+	send(&models.Message{SenderID: friend.ID, GroupID: &closed.ID, Text: "coffee behind closed doors"})
+
+	search := func(query string) models.SearchResults {
+		t.Helper()
+		var results models.SearchResults
+		decode(t, serve(h.SearchMessages, "GET", "/api/messages/search?"+query, me.ID, nil, nil), http.StatusOK, &results)
+		return results
+	}
+	hits := func(results models.SearchResults) []string {
+		var ids []string
+		for _, conv := range results.Conversations {
+			for _, hit := range conv.Hits {
+				ids = append(ids, conv.Type+":"+hit.Message.ID)
+			}
+		}
+		return ids
+	}
+
+	// The last word is a prefix; newest first
+	results := search("q=coffee")
+	want := []string{conversation.TypeGroup + ":" + inGroup, conversation.TypeDirect + ":" + direct}
+	if fmt.Sprint(hits(results)) != fmt.Sprint(want) {
+		t.Fatalf("hits %v, want %v", hits(results), want)
+	}
+	if conv := results.Conversations[1]; conv.ID != friend.ID || conv.Name != friend.Username {
+		t.Errorf("direct chat is %s %q, want %s %q", conv.ID, conv.Name, friend.ID, friend.Username)
+	}
+	if hit := results.Conversations[1].Hits[0]; len(hit.After) != 1 || hit.After[0].Text != "sure" || len(hit.Before) != 0 {
+		t.Errorf("context of the direct hit is %+v / %+v", hit.Before, hit.After)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		// Operator words and query syntax are searched as words
+		{`"tea" OR coffee`, []string{conversation.TypeDirect + ":" + direct}},
+		{"tea NEAR coffee", nil},
+		{"coffee*)", []string{conversation.TypeGroup + ":" + inGroup, conversation.TypeDirect + ":" + direct}},
+		// Only the last word is a prefix
+		{"coff tomorrow", nil},
+		{"closed doors", nil},
+		{"without", nil},
+	}
+	for _, tt := range tests {
+		if got := hits(search("q=" + url.QueryEscape(tt.query))); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: hits %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	// Paging
+	results = search("q=coffee&limit=1")
+	if !results.HasMore || fmt.Sprint(hits(results)) != fmt.Sprint(want[:1]) {
+		t.Errorf("first page is %v (more %v)", hits(results), results.HasMore)
+	}
+	results = search("q=coffee&limit=1&before=" + inGroup)
+	if results.HasMore || fmt.Sprint(hits(results)) != fmt.Sprint(want[1:]) {
+		t.Errorf("second page is %v (more %v)", hits(results), results.HasMore)
+	}
+
+	for _, query := range []string{"q=", "q=%22%2A%22", "q=coffee&before=1%27", "q=coffee&before=" + utils.GenerateUUID()[:8]} {
+		if w := serve(h.SearchMessages, "GET", "/api/messages/search?"+query, me.ID, nil, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, w.Code)
+		}
+	}
+}
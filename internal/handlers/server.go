@@ -0,0 +1,771 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/kvant/messenger/internal/conversation"
+	"github.com/kvant/messenger/internal/middleware"
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/permissions"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/internal/websocket"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+type ServerHandler struct {
+	db      *sql.DB
+	servers store.ServerStore
+	blocks  store.BlockStore
+	hub     *websocket.Hub
+}
+
+func NewServerHandler(db *sql.DB, hub *websocket.Hub) *ServerHandler {
+	stores := store.New(db)
+	return &ServerHandler{db: db, servers: stores.Servers, blocks: stores.Blocks, hub: hub}
+}
+
+// requirePermission resolves the membership of the user in the server, see the package-level requirePermission
+func (h *ServerHandler) requirePermission(w http.ResponseWriter, serverID, userID string, perm permissions.Permission) (*permissions.Member, bool) {
+	return requirePermission(h.db, w, permissions.ScopeServer, serverID, userID, perm)
+}
+
+// resolveTarget returns the membership of the user being acted on, writing an error response if there is none
+func (h *ServerHandler) resolveTarget(w http.ResponseWriter, serverID, userID string) (*permissions.Member, bool) {
+	target, err := permissions.Resolve(h.db, permissions.ScopeServer, serverID, userID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to check membership")
+		return nil, false
+	}
+	if target == nil {
+		utils.RespondError(w, http.StatusNotFound, "Member not found")
+		return nil, false
+	}
+	return target, true
+}
+
+func (h *ServerHandler) notifyMembers(serverID string, event map[string]interface{}) {
+	ids, err := conversation.ServerMemberIDs(h.db, serverID)
+	if err != nil {
+		log.Printf("Failed to get members of server %s: %v", serverID, err)
+		return
+	}
+	h.hub.SendToUsers(ids, event)
+}
+
+func (h *ServerHandler) CreateServer(w http.ResponseWriter, r *http.Request) {
+	currentUserID := middleware.GetUserID(r)
+
+	var req models.CreateServerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		utils.RespondError(w, http.StatusBadRequest, "Server name must be between 1 and 100 characters")
+		return
+	}
+
+	slug := strings.ToLower(strings.TrimSpace(req.InviteSlug))
+	if slug == "" {
+		slug = utils.GenerateSlug()
+	} else if !utils.ValidSlug(slug) {
+		utils.RespondError(w, http.StatusBadRequest, "Invite slug must be 3-50 characters of a-z, 0-9, _ and -")
+		return
+	}
+
+	isPublic := true
+	if req.IsPublic != nil {
+		isPublic = *req.IsPublic
+	}
+
+	// Every new server starts with a "Text Channels" category holding #general
+	server := &models.Server{
+		Name:        req.Name,
+		Description: req.Description,
+		IconURL:     req.IconURL,
+		BannerURL:   req.BannerURL,
+		OwnerID:     currentUserID,
+		IsPublic:    isPublic,
+		InviteSlug:  &slug,
+	}
+	err := h.servers.Create(r.Context(), server)
+	if err == store.ErrConflict {
+		utils.RespondError(w, http.StatusConflict, "Invite slug is already taken")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create server")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusCreated, server)
+}
+
+func (h *ServerHandler) GetMyServers(w http.ResponseWriter, r *http.Request) {
+	currentUserID := middleware.GetUserID(r)
+
+	servers, err := h.servers.ForUser(r.Context(), currentUserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get servers")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, servers)
+}
+
+func (h *ServerHandler) GetServer(w http.ResponseWriter, r *http.Request) {
+	serverID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	server, err := h.servers.Get(r.Context(), serverID, currentUserID)
+	if err == store.ErrNotFound || (err == nil && !server.IsPublic && server.MyRole == "") {
+		utils.RespondError(w, http.StatusNotFound, "Server not found")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get server")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, server)
+}
+
+// GetServerBySlug resolves an invite link
+func (h *ServerHandler) GetServerBySlug(w http.ResponseWriter, r *http.Request) {
+	slug := strings.ToLower(mux.Vars(r)["slug"])
+	currentUserID := middleware.GetUserID(r)
+
+	server, err := h.servers.GetBySlug(r.Context(), slug, currentUserID)
+	if err == store.ErrNotFound {
+		utils.RespondError(w, http.StatusNotFound, "Server not found")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get server")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, server)
+}
+
+func (h *ServerHandler) UpdateServer(w http.ResponseWriter, r *http.Request) {
+	serverID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	if _, ok := h.requirePermission(w, serverID, currentUserID, permissions.ManageSettings); !ok {
+		return
+	}
+
+	var req models.UpdateServerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" || len(name) > 100 {
+			utils.RespondError(w, http.StatusBadRequest, "Server name must be between 1 and 100 characters")
+			return
+		}
+		req.Name = &name
+	}
+	if req.InviteSlug != nil {
+		slug := strings.ToLower(strings.TrimSpace(*req.InviteSlug))
+		if !utils.ValidSlug(slug) {
+			utils.RespondError(w, http.StatusBadRequest, "Invite slug must be 3-50 characters of a-z, 0-9, _ and -")
+			return
+		}
+		req.InviteSlug = &slug
+	}
+
+	err := h.servers.Update(r.Context(), serverID, req)
+	if err == store.ErrConflict {
+		utils.RespondError(w, http.StatusConflict, "Invite slug is already taken")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update server")
+		return
+	}
+
+	server, err := h.servers.Get(r.Context(), serverID, currentUserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get updated server")
+		return
+	}
+
+	h.notifyMembers(serverID, map[string]interface{}{
+		"type": "server_updated",
+		"data": map[string]interface{}{
+			"id":          server.ID,
+			"name":        server.Name,
+			"description": server.Description,
+			"icon_url":    server.IconURL,
+			"banner_url":  server.BannerURL,
+			"is_public":   server.IsPublic,
+		},
+	})
+
+	utils.RespondJSON(w, http.StatusOK, server)
+}
+
+func (h *ServerHandler) DeleteServer(w http.ResponseWriter, r *http.Request) {
+	serverID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	member, ok := h.requirePermission(w, serverID, currentUserID, 0)
+	if !ok {
+		return
+	}
+	if !member.IsOwner() {
+		utils.RespondError(w, http.StatusForbidden, "Only server owner can delete the server")
+		return
+	}
+
+	memberIDs, err := conversation.ServerMemberIDs(h.db, serverID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get members")
+		return
+	}
+
+	if err := h.servers.Delete(r.Context(), serverID); err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete server")
+		return
+	}
+
+	h.hub.SendToUsers(memberIDs, map[string]interface{}{
+		"type": "server_deleted",
+		"data": map[string]interface{}{
+			"server_id": serverID,
+		},
+	})
+
+	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+// JoinServer joins a public server by its ID
+func (h *ServerHandler) JoinServer(w http.ResponseWriter, r *http.Request) {
+	serverID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	server, err := h.servers.Get(r.Context(), serverID, currentUserID)
+	if err == store.ErrNotFound || (err == nil && !server.IsPublic) {
+		utils.RespondError(w, http.StatusNotFound, "Server not found")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get server")
+		return
+	}
+
+	h.join(w, r, serverID, currentUserID)
+}
+
+// JoinServerBySlug joins a server via an invite link; works for private servers too
+func (h *ServerHandler) JoinServerBySlug(w http.ResponseWriter, r *http.Request) {
+	slug := strings.ToLower(mux.Vars(r)["slug"])
+	currentUserID := middleware.GetUserID(r)
+
+	server, err := h.servers.GetBySlug(r.Context(), slug, currentUserID)
+	if err == store.ErrNotFound {
+		utils.RespondError(w, http.StatusNotFound, "Server not found")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get server")
+		return
+	}
+
+	h.join(w, r, server.ID, currentUserID)
+}
+
+// join adds the membership and responds with the server
+func (h *ServerHandler) join(w http.ResponseWriter, r *http.Request, serverID, userID string) {
+	joined, err := h.servers.Join(r.Context(), serverID, userID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to join server")
+		return
+	}
+
+	if joined {
+		h.notifyMembers(serverID, map[string]interface{}{
+			"type": "server_member_joined",
+			"data": map[string]interface{}{
+				"server_id": serverID,
+				"user_id":   userID,
+			},
+		})
+	}
+
+	server, err := h.servers.Get(r.Context(), serverID, userID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get server")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, server)
+}
+
+func (h *ServerHandler) LeaveServer(w http.ResponseWriter, r *http.Request) {
+	serverID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	member, ok := h.requirePermission(w, serverID, currentUserID, 0)
+	if !ok {
+		return
+	}
+	if member.IsOwner() {
+		utils.RespondError(w, http.StatusForbidden, "Server owner cannot leave; delete the server instead")
+		return
+	}
+
+	if err := h.servers.RemoveMember(r.Context(), serverID, currentUserID); err != nil && err != store.ErrNotFound {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to leave server")
+		return
+	}
+
+	event := map[string]interface{}{
+		"type": "server_member_left",
+		"data": map[string]interface{}{
+			"server_id": serverID,
+			"user_id":   currentUserID,
+		},
+	}
+	h.notifyMembers(serverID, event)
+	h.hub.SendToUser(currentUserID, event)
+
+	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+func (h *ServerHandler) GetMembers(w http.ResponseWriter, r *http.Request) {
+	serverID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	if _, ok := h.requirePermission(w, serverID, currentUserID, 0); !ok {
+		return
+	}
+
+	// Members blocked either way are never shown online
+	related, err := h.blocks.Related(r.Context(), currentUserID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get members")
+		return
+	}
+	hidden := make(map[string]bool, len(related))
+	for _, id := range related {
+		hidden[id] = true
+	}
+
+	members, err := h.servers.Members(r.Context(), serverID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get members")
+		return
+	}
+	for i := range members {
+		members[i].IsOnline = !hidden[members[i].UserID] && h.hub.IsOnline(members[i].UserID)
+	}
+
+	utils.RespondJSON(w, http.StatusOK, members)
+}
+
+// UpdateMember changes a member's role or nickname. Members can always change their own nickname.
+func (h *ServerHandler) UpdateMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	serverID := vars["id"]
+	targetUserID := vars["userId"]
+	currentUserID := middleware.GetUserID(r)
+
+	var req struct {
+		Role     *string `json:"role"`
+		Nickname *string `json:"nickname"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	actor, ok := h.requirePermission(w, serverID, currentUserID, 0)
+	if !ok {
+		return
+	}
+	target, ok := h.resolveTarget(w, serverID, targetUserID)
+	if !ok {
+		return
+	}
+
+	if req.Role != nil {
+		if target.IsOwner() || !actor.Outranks(target.Role.Position) {
+			utils.RespondError(w, http.StatusForbidden, "You cannot change this member's role")
+			return
+		}
+		if assignableRole(h.db, w, actor, permissions.ScopeServer, serverID, *req.Role) == nil {
+			return
+		}
+	}
+	if req.Nickname != nil && targetUserID != currentUserID &&
+		!(actor.Can(permissions.ManageMembers) && actor.Outranks(target.Role.Position)) {
+		utils.RespondError(w, http.StatusForbidden, "You cannot change this member's nickname")
+		return
+	}
+
+	if err := h.servers.UpdateMember(r.Context(), serverID, targetUserID, req.Role, req.Nickname); err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update member")
+		return
+	}
+
+	h.notifyMembers(serverID, map[string]interface{}{
+		"type": "server_member_updated",
+		"data": map[string]interface{}{
+			"server_id": serverID,
+			"user_id":   targetUserID,
+			"role":      req.Role,
+			"nickname":  req.Nickname,
+		},
+	})
+
+	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+// KickMember removes a member from the server. Only members ranked below the caller can be kicked.
+func (h *ServerHandler) KickMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	serverID := vars["id"]
+	targetUserID := vars["userId"]
+	currentUserID := middleware.GetUserID(r)
+
+	if targetUserID == currentUserID {
+		h.LeaveServer(w, r)
+		return
+	}
+
+	actor, ok := h.requirePermission(w, serverID, currentUserID, permissions.ManageMembers)
+	if !ok {
+		return
+	}
+	target, ok := h.resolveTarget(w, serverID, targetUserID)
+	if !ok {
+		return
+	}
+	if target.IsOwner() || !actor.Outranks(target.Role.Position) {
+		utils.RespondError(w, http.StatusForbidden, "You cannot kick this member")
+		return
+	}
+
+	if err := h.servers.RemoveMember(r.Context(), serverID, targetUserID); err != nil && err != store.ErrNotFound {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to kick member")
+		return
+	}
+
+	event := map[string]interface{}{
+		"type": "server_member_left",
+		"data": map[string]interface{}{
+			"server_id": serverID,
+			"user_id":   targetUserID,
+			"kicked_by": currentUserID,
+		},
+	}
+	h.notifyMembers(serverID, event)
+	h.hub.SendToUser(targetUserID, event)
+
+	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+// GetChannelTree returns the ordered categories of a server with their ordered text channels
+func (h *ServerHandler) GetChannelTree(w http.ResponseWriter, r *http.Request) {
+	serverID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	if _, ok := h.requirePermission(w, serverID, currentUserID, 0); !ok {
+		return
+	}
+
+	tree, err := h.servers.ChannelTree(r.Context(), serverID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get channels")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, tree)
+}
+
+func (h *ServerHandler) CreateCategory(w http.ResponseWriter, r *http.Request) {
+	serverID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	if _, ok := h.requirePermission(w, serverID, currentUserID, permissions.ManageChannels); !ok {
+		return
+	}
+
+	var req models.ServerCategoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	category := &models.ServerCategory{
+		ServerID: serverID,
+		Name:     strings.TrimSpace(*req.Name),
+		Channels: []models.ServerChannel{},
+	}
+	if category.Name == "" || len(category.Name) > 100 {
+		utils.RespondError(w, http.StatusBadRequest, "Category name must be between 1 and 100 characters")
+		return
+	}
+
+	// New categories go to the bottom unless a position is given
+	if err := h.servers.CreateCategory(r.Context(), category, req.Position); err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create category")
+		return
+	}
+
+	h.notifyMembers(serverID, map[string]interface{}{
+		"type": "server_category_created",
+		"data": category,
+	})
+
+	utils.RespondJSON(w, http.StatusCreated, category)
+}
+
+func (h *ServerHandler) UpdateCategory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	serverID := vars["id"]
+	categoryID := vars["categoryId"]
+	currentUserID := middleware.GetUserID(r)
+
+	if _, ok := h.requirePermission(w, serverID, currentUserID, permissions.ManageChannels); !ok {
+		return
+	}
+
+	var req models.ServerCategoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" || len(name) > 100 {
+			utils.RespondError(w, http.StatusBadRequest, "Category name must be between 1 and 100 characters")
+			return
+		}
+		req.Name = &name
+	}
+
+	err := h.servers.UpdateCategory(r.Context(), serverID, categoryID, req.Name, req.Position)
+	if err == store.ErrNotFound {
+		utils.RespondError(w, http.StatusNotFound, "Category not found")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update category")
+		return
+	}
+
+	h.notifyMembers(serverID, map[string]interface{}{
+		"type": "server_category_updated",
+		"data": map[string]interface{}{
+			"server_id":   serverID,
+			"category_id": categoryID,
+			"name":        req.Name,
+			"position":    req.Position,
+		},
+	})
+
+	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+// DeleteCategory removes a category; its channels become uncategorized
+func (h *ServerHandler) DeleteCategory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	serverID := vars["id"]
+	categoryID := vars["categoryId"]
+	currentUserID := middleware.GetUserID(r)
+
+	if _, ok := h.requirePermission(w, serverID, currentUserID, permissions.ManageChannels); !ok {
+		return
+	}
+
+	err := h.servers.DeleteCategory(r.Context(), serverID, categoryID)
+	if err == store.ErrNotFound {
+		utils.RespondError(w, http.StatusNotFound, "Category not found")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete category")
+		return
+	}
+
+	h.notifyMembers(serverID, map[string]interface{}{
+		"type": "server_category_deleted",
+		"data": map[string]interface{}{
+			"server_id":   serverID,
+			"category_id": categoryID,
+		},
+	})
+
+	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+func (h *ServerHandler) CreateChannel(w http.ResponseWriter, r *http.Request) {
+	serverID := mux.Vars(r)["id"]
+	currentUserID := middleware.GetUserID(r)
+
+	if _, ok := h.requirePermission(w, serverID, currentUserID, permissions.ManageChannels); !ok {
+		return
+	}
+
+	var req models.ServerChannelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	name := strings.TrimSpace(*req.Name)
+	if name == "" || len(name) > 100 {
+		utils.RespondError(w, http.StatusBadRequest, "Channel name must be between 1 and 100 characters")
+		return
+	}
+
+	var categoryID *string
+	if req.CategoryID != nil && *req.CategoryID != "" {
+		ok, err := h.servers.HasCategory(r.Context(), serverID, *req.CategoryID)
+		if err != nil {
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to check category")
+			return
+		}
+		if !ok {
+			utils.RespondError(w, http.StatusBadRequest, "Category not found in this server")
+			return
+		}
+		categoryID = req.CategoryID
+	}
+
+	// New channels go to the bottom of their category unless a position is given
+	channel := &models.ServerChannel{
+		ServerID:   serverID,
+		CategoryID: categoryID,
+		Name:       name,
+		Topic:      req.Topic,
+	}
+	if err := h.servers.CreateChannel(r.Context(), channel, req.Position); err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create channel")
+		return
+	}
+
+	h.notifyMembers(serverID, map[string]interface{}{
+		"type": "server_channel_created",
+		"data": channel,
+	})
+
+	utils.RespondJSON(w, http.StatusCreated, channel)
+}
+
+// UpdateChannel renames, re-topics, reorders or moves a channel between categories.
+// Pass "category_id": "" to move the channel out of any category.
+func (h *ServerHandler) UpdateChannel(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	serverID := vars["id"]
+	channelID := vars["channelId"]
+	currentUserID := middleware.GetUserID(r)
+
+	if _, ok := h.requirePermission(w, serverID, currentUserID, permissions.ManageChannels); !ok {
+		return
+	}
+
+	var req models.ServerChannelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	channel, err := h.servers.GetChannel(r.Context(), serverID, channelID)
+	if err == store.ErrNotFound {
+		utils.RespondError(w, http.StatusNotFound, "Channel not found")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to get channel")
+		return
+	}
+
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" || len(name) > 100 {
+			utils.RespondError(w, http.StatusBadRequest, "Channel name must be between 1 and 100 characters")
+			return
+		}
+		channel.Name = name
+	}
+	if req.Topic != nil {
+		channel.Topic = req.Topic
+	}
+	if req.Position != nil {
+		channel.Position = *req.Position
+	}
+	if req.CategoryID != nil {
+		if *req.CategoryID == "" {
+			channel.CategoryID = nil
+		} else {
+			ok, err := h.servers.HasCategory(r.Context(), serverID, *req.CategoryID)
+			if err != nil {
+				utils.RespondError(w, http.StatusInternalServerError, "Failed to check category")
+				return
+			}
+			if !ok {
+				utils.RespondError(w, http.StatusBadRequest, "Category not found in this server")
+				return
+			}
+			channel.CategoryID = req.CategoryID
+		}
+	}
+
+	if err := h.servers.UpdateChannel(r.Context(), channel); err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update channel")
+		return
+	}
+
+	h.notifyMembers(serverID, map[string]interface{}{
+		"type": "server_channel_updated",
+		"data": channel,
+	})
+
+	utils.RespondJSON(w, http.StatusOK, channel)
+}
+
+func (h *ServerHandler) DeleteChannel(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	serverID := vars["id"]
+	channelID := vars["channelId"]
+	currentUserID := middleware.GetUserID(r)
+
+	if _, ok := h.requirePermission(w, serverID, currentUserID, permissions.ManageChannels); !ok {
+		return
+	}
+
+	err := h.servers.DeleteChannel(r.Context(), serverID, channelID)
+	if err == store.ErrNotFound {
+		utils.RespondError(w, http.StatusNotFound, "Channel not found")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete channel")
+		return
+	}
+
+	h.notifyMembers(serverID, map[string]interface{}{
+		"type": "server_channel_deleted",
+		"data": map[string]interface{}{
+			"server_id":  serverID,
+			"channel_id": channelID,
+		},
+	})
+
+	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
@@ -0,0 +1,370 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/kvant/messenger/internal/middleware"
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/internal/totp"
+	"github.com/kvant/messenger/pkg/utils"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	// challengeTTL is how long the second step of a login may wait
+	challengeTTL = 5 * time.Minute
+	// maxCodeAttempts wrong codes in a row lock codes out for codeLockout,
+	// since six digits fall to guessing otherwise
+	maxCodeAttempts = 5
+	codeLockout     = 15 * time.Minute
+)
+
+var (
+	errWrongCode   = errors.New("wrong two-factor code")
+	errCodesLocked = errors.New("two-factor codes locked")
+)
+
+// GetTwoFactor tells whether the user has two-factor authentication and how
+// many recovery codes they have left
+func (h *AuthHandler) GetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+
+	twoFactor, err := h.twoFactor.Get(r.Context(), userID)
+	if err != nil && err != store.ErrNotFound {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to load two-factor settings")
+		return
+	}
+	enabled := err == nil && twoFactor.EnabledAt != nil
+
+	left := 0
+	if enabled {
+		if left, err = h.twoFactor.RecoveryCodesLeft(r.Context(), userID); err != nil {
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to load two-factor settings")
+			return
+		}
+	}
+
+	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"enabled":             enabled,
+		"recovery_codes_left": left,
+	})
+}
+
+// SetupTwoFactor starts enrolling an authenticator app: it returns a new
+// secret as text, as an otpauth:// URI and as a QR code of that URI. 2FA is
+// enabled once ConfirmTwoFactor gets a code of it.
+func (h *AuthHandler) SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+
+	user, err := h.users.Get(r.Context(), userID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to load user")
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to generate secret")
+		return
+	}
+	sealed, err := totp.Seal(secret)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to generate secret")
+		return
+	}
+	err = h.twoFactor.Begin(r.Context(), userID, sealed)
+	if err == store.ErrConflict {
+		utils.RespondJSON(w, http.StatusConflict, map[string]interface{}{
+			"success": false,
+			"error":   "TWO_FACTOR_ENABLED",
+			"message": "Двухфакторная аутентификация уже включена",
+		})
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to start two-factor setup")
+		return
+	}
+
+	issuer := os.Getenv("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = "Persona"
+	}
+	uri := totp.ProvisioningURI(secret, issuer, user.Username)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to render QR code")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"success":          true,
+		"secret":           secret,
+		"provisioning_uri": uri,
+		"qr_code":          "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+// ConfirmTwoFactor enables two-factor authentication with a code from the
+// app being enrolled and returns the recovery codes, which are only shown once
+func (h *AuthHandler) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+
+	var req models.TwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	twoFactor, err := h.twoFactor.Get(r.Context(), userID)
+	if err == store.ErrNotFound {
+		utils.RespondError(w, http.StatusBadRequest, "Two-factor setup was not started")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to load two-factor settings")
+		return
+	}
+	if twoFactor.EnabledAt != nil {
+		utils.RespondJSON(w, http.StatusConflict, map[string]interface{}{
+			"success": false,
+			"error":   "TWO_FACTOR_ENABLED",
+			"message": "Двухфакторная аутентификация уже включена",
+		})
+		return
+	}
+
+	step, err := h.checkCode(r.Context(), twoFactor, req.Code)
+	if err != nil {
+		respondCodeError(w, err)
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to generate recovery codes")
+		return
+	}
+	if err := h.twoFactor.Enable(r.Context(), userID, step, hashes); err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to enable two-factor authentication")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"success":        true,
+		"recovery_codes": codes,
+	})
+}
+
+// DisableTwoFactor turns two-factor authentication off. The user proves who
+// they are again with their password and a code, so that a stolen session
+// alone can't do it.
+func (h *AuthHandler) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+
+	var req models.TwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	if !h.reauthenticate(w, r, userID, req) {
+		return
+	}
+
+	if err := h.twoFactor.Disable(r.Context(), userID); err != nil && err != store.ErrNotFound {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to disable two-factor authentication")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user, after
+// the same proof as DisableTwoFactor
+func (h *AuthHandler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetUserID(r)
+
+	var req models.TwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	if !h.reauthenticate(w, r, userID, req) {
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to generate recovery codes")
+		return
+	}
+	if err := h.twoFactor.ReplaceRecoveryCodes(r.Context(), userID, hashes); err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to replace recovery codes")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"success":        true,
+		"recovery_codes": codes,
+	})
+}
+
+// LoginTwoFactor is the second step of a login with two-factor
+// authentication: the challenge from Login and a code or a recovery code
+func (h *AuthHandler) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req models.TwoFactorLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	claims, err := utils.ValidateJWT(req.ChallengeToken)
+	if err != nil || claims.Purpose != utils.ChallengePurpose {
+		utils.RespondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"error":   "INVALID_CHALLENGE",
+			"message": "Время на ввод кода истекло, войдите заново",
+		})
+		return
+	}
+
+	user, err := h.users.Get(r.Context(), claims.UserID)
+	if err == store.ErrNotFound {
+		utils.RespondError(w, http.StatusUnauthorized, "User not found")
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to load user")
+		return
+	}
+	twoFactor, err := h.twoFactor.Get(r.Context(), user.ID)
+	if err == store.ErrNotFound || err == nil && twoFactor.EnabledAt == nil {
+		// Disabled since the password step
+		h.startSession(w, r, user)
+		return
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to load two-factor settings")
+		return
+	}
+
+	if err := h.checkSecondFactor(r.Context(), twoFactor, req.Code, req.RecoveryCode); err != nil {
+		respondCodeError(w, err)
+		return
+	}
+	h.startSession(w, r, user)
+}
+
+// reauthenticate checks the password and the second factor of the user of a
+// request, answering it if they are wrong
+func (h *AuthHandler) reauthenticate(w http.ResponseWriter, r *http.Request, userID string, req models.TwoFactorRequest) bool {
+	if _, ok := h.checkPassword(w, r, userID, req.Password); !ok {
+		return false
+	}
+
+	twoFactor, err := h.twoFactor.Get(r.Context(), userID)
+	if err == store.ErrNotFound || err == nil && twoFactor.EnabledAt == nil {
+		utils.RespondError(w, http.StatusBadRequest, "Two-factor authentication is not enabled")
+		return false
+	}
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to load two-factor settings")
+		return false
+	}
+	if err := h.checkSecondFactor(r.Context(), twoFactor, req.Code, req.RecoveryCode); err != nil {
+		respondCodeError(w, err)
+		return false
+	}
+	return true
+}
+
+// checkSecondFactor accepts a code of the authenticator app or, instead, an
+// unused recovery code, which it spends
+func (h *AuthHandler) checkSecondFactor(ctx context.Context, twoFactor *models.TwoFactor, code, recoveryCode string) error {
+	if recoveryCode == "" {
+		step, err := h.checkCode(ctx, twoFactor, code)
+		if err != nil {
+			return err
+		}
+		err = h.twoFactor.UseStep(ctx, twoFactor.UserID, step)
+		if err == store.ErrNotFound {
+			// The code was used already, which is no guess
+			return errWrongCode
+		}
+		return err
+	}
+
+	if locked(twoFactor) {
+		return errCodesLocked
+	}
+	err := h.twoFactor.UseRecoveryCode(ctx, twoFactor.UserID, totp.HashRecoveryCode(recoveryCode))
+	if err == store.ErrNotFound {
+		if err := h.twoFactor.Fail(ctx, twoFactor.UserID, maxCodeAttempts, time.Now().Add(codeLockout)); err != nil {
+			return err
+		}
+		return errWrongCode
+	}
+	return err
+}
+
+// checkCode validates a code of the authenticator app and returns its time
+// step, counting wrong codes towards a lockout
+func (h *AuthHandler) checkCode(ctx context.Context, twoFactor *models.TwoFactor, code string) (int64, error) {
+	if locked(twoFactor) {
+		return 0, errCodesLocked
+	}
+	secret, err := totp.Open(twoFactor.Secret)
+	if err != nil {
+		return 0, err
+	}
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		if err := h.twoFactor.Fail(ctx, twoFactor.UserID, maxCodeAttempts, time.Now().Add(codeLockout)); err != nil {
+			return 0, err
+		}
+		return 0, errWrongCode
+	}
+	return step, nil
+}
+
+func locked(twoFactor *models.TwoFactor) bool {
+	return twoFactor.LockedUntil != nil && time.Now().Before(*twoFactor.LockedUntil)
+}
+
+func respondCodeError(w http.ResponseWriter, err error) {
+	switch err {
+	case errWrongCode:
+		utils.RespondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"error":   "INVALID_TWO_FACTOR_CODE",
+			"message": "Неверный код",
+		})
+	case errCodesLocked:
+		utils.RespondJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+			"success": false,
+			"error":   "TWO_FACTOR_LOCKED",
+			"message": "Слишком много неверных кодов, попробуйте позже",
+		})
+	default:
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to check code")
+	}
+}
+
+// newRecoveryCodes returns recovery codes to show and the hashes to store
+func newRecoveryCodes() ([]string, []string, error) {
+	codes, err := totp.GenerateRecoveryCodes()
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = totp.HashRecoveryCode(code)
+	}
+	return codes, hashes, nil
+}
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/kvant/messenger/internal/media"
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/storage"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// uploadError is an upload rejected for its content, with the status to respond with
+type uploadError struct {
+	status  int
+	message string
+}
+
+func (e *uploadError) Error() string {
+	return e.message
+}
+
+// respondUploadError responds to a failed upload
+func respondUploadError(w http.ResponseWriter, err error) {
+	if rejected, ok := err.(*uploadError); ok {
+		utils.RespondError(w, rejected.status, rejected.message)
+		return
+	}
+	log.Printf("Failed to store upload: %v", err)
+	utils.RespondError(w, http.StatusInternalServerError, "Failed to upload file")
+}
+
+// detectUpload tells the type of an uploaded file from its content and
+// checks it against the size limit of its kind
+func detectUpload(file io.ReaderAt, size int64, filename string) (string, media.Kind, error) {
+	if size == 0 {
+		return "", "", &uploadError{http.StatusBadRequest, "File is empty"}
+	}
+	head := make([]byte, media.SniffLen)
+	n, err := file.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", "", err
+	}
+
+	mimeType, kind, ok := media.Detect(head[:n], filename)
+	if !ok {
+		return "", "", &uploadError{http.StatusUnsupportedMediaType, "This type of file cannot be uploaded"}
+	}
+	if size > media.Limits[kind] {
+		return "", "", &uploadError{http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("File too large: max size for %s files is %dMB", kind, media.Limits[kind]>>20)}
+	}
+	return mimeType, kind, nil
+}
+
+// readUpload reads a whole uploaded file into memory
+func readUpload(file io.ReaderAt, size int64) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := file.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// imageError turns an image that failed to decode into an uploadError
+func imageError(err error) error {
+	switch err {
+	case media.ErrUndecodable:
+		return &uploadError{http.StatusUnsupportedMediaType, "This type of image cannot be used here"}
+	case media.ErrTooManyPixels:
+		return &uploadError{http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Image too large: max %d megapixels", media.MaxPixels/1_000_000)}
+	}
+	return &uploadError{http.StatusBadRequest, "Invalid image"}
+}
+
+// putImage scales an image a user uploaded to a variant and stores it into
+// folder. It returns its URL and blurhash.
+func putImage(ctx context.Context, blobs storage.BlobStore, folder, userID string, file io.ReaderAt, size int64, filename string, variant media.Variant) (string, string, error) {
+	mimeType, kind, err := detectUpload(file, size, filename)
+	if err != nil {
+		return "", "", err
+	}
+	if kind != media.KindImage {
+		return "", "", &uploadError{http.StatusBadRequest, "invalid file type: only JPG, PNG, GIF, and WebP are allowed"}
+	}
+	data, err := readUpload(file, size)
+	if err != nil {
+		return "", "", err
+	}
+	photo, err := media.DecodeImage(data, mimeType)
+	if err != nil {
+		return "", "", imageError(err)
+	}
+	image, err := photo.Render(variant)
+	if err != nil {
+		return "", "", err
+	}
+
+	key := storage.NewKey(folder, userID, media.Extension(image.MimeType))
+	url, err := blobs.Put(ctx, key, bytes.NewReader(image.Data), int64(len(image.Data)), image.MimeType)
+	if err != nil {
+		return "", "", err
+	}
+	return url, photo.Blurhash(), nil
+}
+
+// storeAttachment stores a file a user uploaded to send with a message.
+// Images are stored scaled and without their metadata, with a thumbnail.
+func storeAttachment(ctx context.Context, blobs storage.BlobStore, attachments store.AttachmentStore, uploaderID string, file io.ReaderAt, size int64, filename string) (*models.Attachment, error) {
+	mimeType, kind, err := detectUpload(file, size, filename)
+	if err != nil {
+		return nil, err
+	}
+	attachment := &models.Attachment{
+		UploaderID: uploaderID,
+		Filename:   cleanFilename(filename, media.Extension(mimeType)),
+		MimeType:   mimeType,
+		Kind:       string(kind),
+		Size:       size,
+	}
+	content := io.ReadSeeker(io.NewSectionReader(file, 0, size))
+
+	if kind == media.KindImage {
+		data, err := readUpload(file, size)
+		if err != nil {
+			return nil, err
+		}
+		processed, err := media.ProcessImage(data, mimeType)
+		if err != nil {
+			return nil, imageError(err)
+		}
+
+		image := processed.Image
+		if image.MimeType != mimeType {
+			// Name the file for what it became
+			attachment.Filename = strings.TrimSuffix(attachment.Filename, path.Ext(attachment.Filename)) + media.Extension(image.MimeType)
+		}
+		attachment.MimeType = image.MimeType
+		attachment.Size = int64(len(image.Data))
+		if image.Width > 0 && image.Height > 0 {
+			attachment.Width, attachment.Height = &image.Width, &image.Height
+		}
+		attachment.Blurhash = processed.Blurhash
+		content = bytes.NewReader(image.Data)
+
+		if thumbnail := processed.Thumbnail; thumbnail != nil {
+			key := storage.NewKey(storage.FolderAttachments, uploaderID, media.Extension(thumbnail.MimeType))
+			url, err := blobs.Put(ctx, key, bytes.NewReader(thumbnail.Data), int64(len(thumbnail.Data)), thumbnail.MimeType)
+			if err != nil {
+				return nil, err
+			}
+			attachment.ThumbnailURL = &url
+		}
+	} else {
+		info := media.Probe(file, size, mimeType)
+		attachment.Width, attachment.Height, attachment.DurationMS = info.Width, info.Height, info.DurationMS
+	}
+
+	// The checksum is taken of what is stored
+	hash := sha256.New()
+	key := storage.NewKey(storage.FolderAttachments, uploaderID, media.Extension(attachment.MimeType))
+	url, err := blobs.Put(ctx, key, io.TeeReader(content, hash), attachment.Size, attachment.MimeType)
+	if err != nil {
+		deleteUpload(ctx, blobs, attachment.ThumbnailURL)
+		return nil, err
+	}
+	attachment.URL = url
+	attachment.Checksum = hex.EncodeToString(hash.Sum(nil))
+
+	if err := attachments.Create(ctx, attachment); err != nil {
+		deleteUpload(ctx, blobs, &url)
+		deleteUpload(ctx, blobs, attachment.ThumbnailURL)
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// maxFilename is the longest filename kept, in characters
+const maxFilename = 255
+
+// cleanFilename returns the base of an uploaded file's name without control
+// characters, or a name with ext if nothing is left of it
+func cleanFilename(filename, ext string) string {
+	name := path.Base(strings.ReplaceAll(filename, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == "/" {
+		return "file" + ext
+	}
+	if runes := []rune(name); len(runes) > maxFilename {
+		name = string(runes[:maxFilename])
+	}
+	return name
+}
+
+// deleteUpload deletes an uploaded file that is no longer used, such as a
+// previous avatar. A failure only leaves the file behind, so it is logged.
+func deleteUpload(ctx context.Context, blobs storage.BlobStore, url *string) {
+	if url == nil || *url == "" {
+		return
+	}
+	if err := blobs.Delete(ctx, *url); err != nil && err != storage.ErrForeignURL {
+		log.Printf("Failed to delete upload %s: %v", *url, err)
+	}
+}
+
+// deletePicture deletes a picture that was replaced, like deleteUpload, but
+// only if ownerID uploaded it and nothing else uses it: the URL may have come
+// from elsewhere, or also be a file sent in a message or another picture.
+func deletePicture(ctx context.Context, blobs storage.BlobStore, attachments store.AttachmentStore, url *string, ownerID string) {
+	if url == nil || *url == "" {
+		return
+	}
+	if owner, ok := blobs.Owner(*url); !ok || owner != ownerID {
+		return
+	}
+	uses, err := attachments.FileUses(ctx, *url)
+	if err != nil {
+		log.Printf("Failed to count uses of %s: %v", *url, err)
+		return
+	}
+	if uses == 0 {
+		deleteUpload(ctx, blobs, url)
+	}
+}
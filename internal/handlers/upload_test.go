@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/storage"
+	"github.com/kvant/messenger/internal/store"
+)
+
+func TestDeletePicture(t *testing.T) {
+	db := newTestDB(t)
+	stores := store.New(db)
+	ctx := context.Background()
+	blobs, err := storage.NewLocalStore(t.TempDir(), "/uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	me := newTestUser(t, db, "me")
+	other := newTestUser(t, db, "other")
+
+	put := func(userID string) string {
+		t.Helper()
+		url, err := blobs.Put(ctx, storage.NewKey(storage.FolderAvatars, userID, ".png"), strings.NewReader("png"), 3, "image/png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return url
+	}
+	exists := func(url string) bool {
+		f, err := blobs.Open(ctx, url)
+		if err != nil {
+			return false
+		}
+		f.Close()
+		return true
+	}
+
+	unused := put(me.ID)
+	alsoBanner := put(me.ID)
+	if err := stores.Users.SetBanner(ctx, me.ID, alsoBanner, nil); err != nil {
+		t.Fatal(err)
+	}
+	sent := put(me.ID)
+	msg := &models.Message{SenderID: me.ID, ReceiverID: &other.ID, MessageType: "image", FileURL: &sent}
+	if err := stores.Messages.Create(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	theirs := put(other.ID)
+
+	tests := []struct {
+		name string
+		url  string
+		kept bool
+	}{
+		{"unused", unused, false},
+		{"still the banner", alsoBanner, true},
+		{"sent in a message", sent, true},
+		{"uploaded by another user", theirs, true},
+	}
+	for _, tt := range tests {
+		url := tt.url
+		deletePicture(ctx, blobs, stores.Attachments, &url, me.ID)
+		if exists(tt.url) != tt.kept {
+			t.Errorf("%s: kept %v, want %v", tt.name, !tt.kept, tt.kept)
+		}
+	}
+	deletePicture(ctx, blobs, stores.Attachments, nil, me.ID)
+}
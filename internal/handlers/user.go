@@ -6,31 +6,35 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/kvant/messenger/internal/media"
 	"github.com/kvant/messenger/internal/middleware"
 	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/storage"
+	"github.com/kvant/messenger/internal/store"
 	"github.com/kvant/messenger/pkg/utils"
 )
 
 type UserHandler struct {
-	db                *sql.DB
-	cloudinaryEnabled bool
-	cloudinary        *utils.CloudinaryUploader
+	users       store.UserStore
+	messages    store.MessageStore
+	reactions   store.ReactionStore
+	attachments store.AttachmentStore
+	twoFactor   store.TwoFactorStore
+	blocks      store.BlockStore
+	blobs       storage.BlobStore
 }
 
-func NewUserHandler(db *sql.DB) *UserHandler {
-	handler := &UserHandler{
-		db:                db,
-		cloudinaryEnabled: false,
+func NewUserHandler(db *sql.DB, blobs storage.BlobStore) *UserHandler {
+	stores := store.New(db)
+	return &UserHandler{
+		users:       stores.Users,
+		messages:    stores.Messages,
+		reactions:   stores.Reactions,
+		attachments: stores.Attachments,
+		twoFactor:   stores.TwoFactor,
+		blocks:      stores.Blocks,
+		blobs:       blobs,
 	}
-
-	// Try to initialize Cloudinary
-	cld, err := utils.NewCloudinaryUploader()
-	if err == nil {
-		handler.cloudinary = cld
-		handler.cloudinaryEnabled = true
-	}
-
-	return handler
 }
 
 func (h *UserHandler) SearchUsers(w http.ResponseWriter, r *http.Request) {
@@ -42,32 +46,11 @@ func (h *UserHandler) SearchUsers(w http.ResponseWriter, r *http.Request) {
 
 	userID := middleware.GetUserID(r)
 
-	rows, err := h.db.Query(utils.AdaptQuery(`
-		SELECT id, username, display_name, avatar_url, role, is_premium
-		FROM users
-		WHERE (username LIKE $1 OR display_name LIKE $1)
-		AND id != $2
-		LIMIT 20
-	`), "%"+query+"%", userID)
-
+	users, err := h.users.Search(r.Context(), query, userID, 20)
 	if err != nil {
 		utils.RespondError(w, http.StatusInternalServerError, "Search failed")
 		return
 	}
-	defer rows.Close()
-
-	var users []models.User
-	for rows.Next() {
-		var user models.User
-		err := rows.Scan(
-			&user.ID, &user.Username, &user.DisplayName, &user.AvatarURL,
-			&user.Role, &user.IsPremium,
-		)
-		if err != nil {
-			continue
-		}
-		users = append(users, user)
-	}
 
 	utils.RespondJSON(w, http.StatusOK, users)
 }
@@ -76,21 +59,9 @@ func (h *UserHandler) GetUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userID := vars["id"]
 
-	var user models.User
-	err := h.db.QueryRow(utils.AdaptQuery(`
-		SELECT id, username, display_name, bio, avatar_url, banner_url,
-		       role, is_premium, premium_until, name_color, profile_theme,
-		       bubble_style, hide_online, status, created_at, updated_at
-		FROM users WHERE id = $1
-	`), userID).Scan(
-		&user.ID, &user.Username, &user.DisplayName, &user.Bio,
-		&user.AvatarURL, &user.BannerURL, &user.Role,
-		&user.IsPremium, &user.PremiumUntil, &user.NameColor,
-		&user.ProfileTheme, &user.BubbleStyle, &user.HideOnline,
-		&user.Status, &user.CreatedAt, &user.UpdatedAt,
-	)
-
-	if err == sql.ErrNoRows {
+	user, err := h.users.Get(r.Context(), userID)
+
+	if err == store.ErrNotFound {
 		utils.RespondError(w, http.StatusNotFound, "User not found")
 		return
 	}
@@ -124,40 +95,17 @@ func (h *UserHandler) UpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := h.db.Exec(`
-		UPDATE users
-		SET display_name = COALESCE($1, display_name),
-		    bio = COALESCE($2, bio),
-		    name_color = COALESCE($3, name_color),
-		    updated_at = CURRENT_TIMESTAMP
-		WHERE id = $4
-	`, req.DisplayName, req.Bio, req.NameColor, userID)
+	user, err := h.users.UpdateProfile(r.Context(), userID, store.ProfileUpdate{
+		DisplayName: req.DisplayName,
+		Bio:         req.Bio,
+		NameColor:   req.NameColor,
+	})
 
 	if err != nil {
 		utils.RespondError(w, http.StatusInternalServerError, "Failed to update user")
 		return
 	}
 
-	// Return updated user
-	var user models.User
-	err = h.db.QueryRow(`
-		SELECT id, username, display_name, bio, avatar_url, banner_url,
-		       role, is_premium, premium_until, name_color, profile_theme,
-		       bubble_style, hide_online, status, created_at, updated_at
-		FROM users WHERE id = $1
-	`, userID).Scan(
-		&user.ID, &user.Username, &user.DisplayName, &user.Bio,
-		&user.AvatarURL, &user.BannerURL, &user.Role,
-		&user.IsPremium, &user.PremiumUntil, &user.NameColor,
-		&user.ProfileTheme, &user.BubbleStyle, &user.HideOnline,
-		&user.Status, &user.CreatedAt, &user.UpdatedAt,
-	)
-
-	if err != nil {
-		utils.RespondError(w, http.StatusInternalServerError, "Failed to get updated user")
-		return
-	}
-
 	utils.RespondJSON(w, http.StatusOK, user)
 }
 
@@ -184,40 +132,28 @@ func (h *UserHandler) UploadAvatar(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Validate file
-	if err := utils.ValidateImageFile(file, header); err != nil {
-		utils.RespondError(w, http.StatusBadRequest, err.Error())
+	user, err := h.users.Get(r.Context(), userID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update avatar")
 		return
 	}
 
-	var avatarURL string
-
-	// Upload to Cloudinary if enabled
-	if h.cloudinaryEnabled {
-		url, err := h.cloudinary.UploadAvatar(r.Context(), file, header.Filename, userID)
-		if err != nil {
-			utils.RespondError(w, http.StatusInternalServerError, "Failed to upload image")
-			return
-		}
-		avatarURL = url
-	} else {
-		// Fallback to placeholder
-		avatarURL = "/uploads/avatars/" + userID + ".jpg"
+	avatarURL, blurhash, err := putImage(r.Context(), h.blobs, storage.FolderAvatars, userID, file, header.Size, header.Filename, media.AvatarVariant)
+	if err != nil {
+		respondUploadError(w, err)
+		return
 	}
 
 	// Update database
-	_, err = h.db.Exec(`
-		UPDATE users
-		SET avatar_url = $1, updated_at = CURRENT_TIMESTAMP
-		WHERE id = $2
-	`, avatarURL, userID)
+	err = h.users.SetAvatar(r.Context(), userID, avatarURL, &blurhash)
 
 	if err != nil {
 		utils.RespondError(w, http.StatusInternalServerError, "Failed to update avatar")
 		return
 	}
+	deletePicture(r.Context(), h.blobs, h.attachments, user.AvatarURL, userID)
 
-	utils.RespondJSON(w, http.StatusOK, map[string]string{"avatar_url": avatarURL})
+	utils.RespondJSON(w, http.StatusOK, map[string]string{"avatar_url": avatarURL, "avatar_blurhash": blurhash})
 }
 
 func (h *UserHandler) UploadBanner(w http.ResponseWriter, r *http.Request) {
@@ -243,38 +179,26 @@ func (h *UserHandler) UploadBanner(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Validate file
-	if err := utils.ValidateImageFile(file, header); err != nil {
-		utils.RespondError(w, http.StatusBadRequest, err.Error())
+	user, err := h.users.Get(r.Context(), userID)
+	if err != nil {
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update banner")
 		return
 	}
 
-	var bannerURL string
-
-	// Upload to Cloudinary if enabled
-	if h.cloudinaryEnabled {
-		url, err := h.cloudinary.UploadBanner(r.Context(), file, header.Filename, userID)
-		if err != nil {
-			utils.RespondError(w, http.StatusInternalServerError, "Failed to upload image")
-			return
-		}
-		bannerURL = url
-	} else {
-		// Fallback to placeholder
-		bannerURL = "/uploads/banners/" + userID + ".jpg"
+	bannerURL, blurhash, err := putImage(r.Context(), h.blobs, storage.FolderBanners, userID, file, header.Size, header.Filename, media.BannerVariant)
+	if err != nil {
+		respondUploadError(w, err)
+		return
 	}
 
 	// Update database
-	_, err = h.db.Exec(`
-		UPDATE users
-		SET banner_url = $1, updated_at = CURRENT_TIMESTAMP
-		WHERE id = $2
-	`, bannerURL, userID)
+	err = h.users.SetBanner(r.Context(), userID, bannerURL, &blurhash)
 
 	if err != nil {
 		utils.RespondError(w, http.StatusInternalServerError, "Failed to update banner")
 		return
 	}
+	deletePicture(r.Context(), h.blobs, h.attachments, user.BannerURL, userID)
 
-	utils.RespondJSON(w, http.StatusOK, map[string]string{"banner_url": bannerURL})
+	utils.RespondJSON(w, http.StatusOK, map[string]string{"banner_url": bannerURL, "banner_blurhash": blurhash})
 }
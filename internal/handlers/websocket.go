@@ -4,9 +4,11 @@ import (
 	"database/sql"
 	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/websocket"
 	"github.com/kvant/messenger/internal/middleware"
+	"github.com/kvant/messenger/internal/store"
 	ws "github.com/kvant/messenger/internal/websocket"
 	"github.com/kvant/messenger/pkg/utils"
 )
@@ -20,17 +22,19 @@ var upgrader = websocket.Upgrader{
 }
 
 type WebSocketHandler struct {
-	hub *ws.Hub
-	db  *sql.DB
+	hub      *ws.Hub
+	db       *sql.DB
+	sessions store.SessionStore
 }
 
 func NewWebSocketHandler(hub *ws.Hub, db *sql.DB) *WebSocketHandler {
-	return &WebSocketHandler{hub: hub, db: db}
+	return &WebSocketHandler{hub: hub, db: db, sessions: store.New(db).Sessions}
 }
 
 func (h *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	// Try to get user ID from context (if middleware was used)
 	userID := middleware.GetUserID(r)
+	sessionID := middleware.GetSessionID(r)
 	
 	// If not in context, try to get token from query parameter
 	if userID == "" {
@@ -40,14 +44,14 @@ func (h *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Reques
 			return
 		}
 
-		// Validate token
-		claims, err := utils.ValidateJWT(token)
+		// Validate token and its session
+		claims, err := middleware.Authenticate(r, h.sessions, token)
 		if err != nil {
 			log.Printf("Invalid WebSocket token: %v", err)
 			http.Error(w, "Unauthorized: invalid token", http.StatusUnauthorized)
 			return
 		}
-		userID = claims.UserID
+		userID, sessionID = claims.UserID, claims.SessionID
 	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -56,7 +60,22 @@ func (h *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	client := ws.NewClient(h.hub, conn, userID, h.db)
+	// Clients pass a stable device_id so a reconnect replaces their previous
+	// connection instead of adding a new device
+	deviceID := r.URL.Query().Get("device_id")
+	if deviceID == "" || len(deviceID) > 64 {
+		deviceID = utils.GenerateUUID()
+	}
+
+	// A reconnecting client passes the last event seq it saw to get what it missed
+	since := int64(-1)
+	if v := r.URL.Query().Get("since"); v != "" {
+		if seq, err := strconv.ParseInt(v, 10, 64); err == nil && seq >= 0 {
+			since = seq
+		}
+	}
+
+	client := ws.NewClient(h.hub, conn, userID, sessionID, deviceID, since, h.db)
 	h.hub.RegisterClient(client)
 
 	go client.WritePump()
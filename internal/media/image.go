@@ -0,0 +1,271 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+// MaxPixels is the largest image that is decoded, so that a small file
+// cannot claim gigabytes of memory
+const MaxPixels = 40_000_000
+
+var (
+	// ErrUndecodable is returned by DecodeImage for an image type it cannot
+	// decode, such as HEIC or an animated WebP
+	ErrUndecodable = errors.New("media: image cannot be decoded")
+	// ErrTooManyPixels is returned by DecodeImage for an image over MaxPixels
+	ErrTooManyPixels = errors.New("media: image has too many pixels")
+)
+
+// Variant is a size images are stored in
+type Variant struct {
+	Width  int
+	Height int
+	// Crop fills exactly Width x Height, cutting off the edges of the image.
+	// Otherwise the image fits within them. Images are never enlarged.
+	Crop bool
+}
+
+var (
+	AvatarVariant    = Variant{Width: 512, Height: 512, Crop: true}
+	BannerVariant    = Variant{Width: 1500, Height: 500, Crop: true}
+	ThumbnailVariant = Variant{Width: 480, Height: 480}
+	// FullVariant bounds images sent with messages
+	FullVariant = Variant{Width: 2560, Height: 2560}
+)
+
+// Encoded is an image ready to be stored
+type Encoded struct {
+	Data     []byte
+	MimeType string
+	Width    int
+	Height   int
+}
+
+// Photo is a decoded image. It is rendered upright, as its EXIF orientation
+// asks, and without any of the metadata of the file it came from.
+type Photo struct {
+	img         image.Image
+	orientation int
+	mimeType    string
+}
+
+// DecodeImage decodes a JPEG, PNG, GIF (its first frame) or WebP image
+func DecodeImage(data []byte, mimeType string) (*Photo, error) {
+	var decodeConfig func([]byte) (image.Config, error)
+	var decode func([]byte) (image.Image, error)
+	switch mimeType {
+	case "image/jpeg":
+		decodeConfig = func(b []byte) (image.Config, error) { return jpeg.DecodeConfig(bytes.NewReader(b)) }
+		decode = func(b []byte) (image.Image, error) { return jpeg.Decode(bytes.NewReader(b)) }
+	case "image/png":
+		decodeConfig = func(b []byte) (image.Config, error) { return png.DecodeConfig(bytes.NewReader(b)) }
+		decode = func(b []byte) (image.Image, error) { return png.Decode(bytes.NewReader(b)) }
+	case "image/gif":
+		decodeConfig = func(b []byte) (image.Config, error) { return gif.DecodeConfig(bytes.NewReader(b)) }
+		decode = func(b []byte) (image.Image, error) { return gif.Decode(bytes.NewReader(b)) }
+	case "image/webp":
+		// The WebP decoder knows neither animation nor the extended format's
+		// metadata, so only still images are decoded
+		if webpAnimated(data) {
+			return nil, ErrUndecodable
+		}
+		decodeConfig = func(b []byte) (image.Config, error) { return webp.DecodeConfig(bytes.NewReader(b)) }
+		decode = func(b []byte) (image.Image, error) { return webp.Decode(bytes.NewReader(b)) }
+	default:
+		return nil, ErrUndecodable
+	}
+
+	cfg, err := decodeConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, errors.New("media: image has no pixels")
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > MaxPixels {
+		return nil, ErrTooManyPixels
+	}
+	img, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	photo := &Photo{img: img, orientation: 1, mimeType: mimeType}
+	if mimeType == "image/jpeg" {
+		photo.orientation = jpegOrientation(data)
+	}
+	return photo, nil
+}
+
+// Size returns the width and height of the upright image
+func (p *Photo) Size() (int, int) {
+	b := p.img.Bounds()
+	if p.orientation >= 5 {
+		return b.Dy(), b.Dx()
+	}
+	return b.Dx(), b.Dy()
+}
+
+// Render scales the image to a variant and encodes it: as PNG if it came
+// from a PNG or has transparency, as JPEG otherwise
+func (p *Photo) Render(v Variant) (*Encoded, error) {
+	img := p.scale(v)
+
+	var buf bytes.Buffer
+	encoded := &Encoded{Width: img.Bounds().Dx(), Height: img.Bounds().Dy()}
+	if p.mimeType == "image/png" || !img.Opaque() {
+		encoded.MimeType = "image/png"
+		if err := (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img); err != nil {
+			return nil, err
+		}
+	} else {
+		encoded.MimeType = "image/jpeg"
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
+			return nil, err
+		}
+	}
+	encoded.Data = buf.Bytes()
+	return encoded, nil
+}
+
+// Blurhash returns a placeholder of the image for clients to show while it loads
+func (p *Photo) Blurhash() string {
+	img := p.scale(Variant{Width: 32, Height: 32})
+	x, y := 4, 3
+	if b := img.Bounds(); b.Dy() > b.Dx() {
+		x, y = 3, 4
+	}
+	return blurhash(img, x, y)
+}
+
+// scale resizes the image to a variant and turns it upright
+func (p *Photo) scale(v Variant) *image.RGBA {
+	// The image is scaled before it is turned, so a turned one takes a turned variant
+	if p.orientation >= 5 {
+		v.Width, v.Height = v.Height, v.Width
+	}
+
+	src := p.img.Bounds()
+	crop := src
+	w, h := src.Dx(), src.Dy()
+	if v.Crop {
+		// Cut the widest centered part with the aspect of the variant
+		if w*v.Height > h*v.Width {
+			cw := h * v.Width / v.Height
+			crop.Min.X += (w - cw) / 2
+			crop.Max.X = crop.Min.X + cw
+		} else {
+			ch := w * v.Height / v.Width
+			crop.Min.Y += (h - ch) / 2
+			crop.Max.Y = crop.Min.Y + ch
+		}
+		w, h = crop.Dx(), crop.Dy()
+	}
+	if w > v.Width || h > v.Height {
+		if w*v.Height > h*v.Width {
+			w, h = v.Width, max(1, h*v.Width/w)
+		} else {
+			w, h = max(1, w*v.Height/h), v.Height
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if w == crop.Dx() && h == crop.Dy() {
+		draw.Draw(dst, dst.Bounds(), p.img, crop.Min, draw.Src)
+	} else {
+		xdraw.CatmullRom.Scale(dst, dst.Bounds(), p.img, crop, xdraw.Src, nil)
+	}
+	return orient(dst, p.orientation)
+}
+
+// orient turns an image as an EXIF orientation (1 to 8) asks
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // upside down and mirrored
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // turned left, so turn right
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // turned right, so turn left
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
+
+// ProcessedImage is an image uploaded with a message, ready to be stored
+type ProcessedImage struct {
+	// Image is the image to serve: scaled to FullVariant and re-encoded, or
+	// for an image that cannot be decoded, the file without its metadata
+	Image *Encoded
+	// Thumbnail is missing for an image no larger than a thumbnail, and
+	// with Blurhash for an image that cannot be decoded
+	Thumbnail *Encoded
+	Blurhash  *string
+}
+
+// ProcessImage prepares an image uploaded with a message. GIFs are kept as
+// they are, since re-encoding would lose their animation; they carry no EXIF.
+func ProcessImage(data []byte, mimeType string) (*ProcessedImage, error) {
+	photo, err := DecodeImage(data, mimeType)
+	if err == ErrUndecodable {
+		stripped := StripMetadata(data, mimeType)
+		info := Probe(bytes.NewReader(stripped), int64(len(stripped)), mimeType)
+		encoded := &Encoded{Data: stripped, MimeType: mimeType}
+		if info.Width != nil && info.Height != nil {
+			encoded.Width, encoded.Height = *info.Width, *info.Height
+		}
+		return &ProcessedImage{Image: encoded}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	processed := &ProcessedImage{}
+	if mimeType == "image/gif" {
+		w, h := photo.Size()
+		processed.Image = &Encoded{Data: data, MimeType: mimeType, Width: w, Height: h}
+	} else if processed.Image, err = photo.Render(FullVariant); err != nil {
+		return nil, err
+	}
+	if w, h := photo.Size(); w > ThumbnailVariant.Width || h > ThumbnailVariant.Height || mimeType == "image/gif" {
+		// An animated GIF is not shown in full until it is opened
+		if processed.Thumbnail, err = photo.Render(ThumbnailVariant); err != nil {
+			return nil, err
+		}
+	}
+	hash := photo.Blurhash()
+	processed.Blurhash = &hash
+	return processed, nil
+}
@@ -0,0 +1,154 @@
+// Package media tells what an uploaded file is from its content: its MIME
+// type, its kind with the size limit of that kind, and the dimensions and
+// duration of images, audio and video. It also prepares uploaded images to
+// be served: scaled, without their metadata, and with a blurhash.
+package media
+
+import (
+	"bytes"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Kind is a class of files with a common size limit
+type Kind string
+
+const (
+	KindImage    Kind = "image"
+	KindVideo    Kind = "video"
+	KindAudio    Kind = "audio"
+	KindDocument Kind = "document"
+	KindArchive  Kind = "archive"
+)
+
+// Limits are the largest files of each kind, in bytes
+var Limits = map[Kind]int64{
+	KindImage:    10 << 20,
+	KindVideo:    200 << 20,
+	KindAudio:    50 << 20,
+	KindDocument: 50 << 20,
+	KindArchive:  100 << 20,
+}
+
+// MaxSize is the largest file of any kind
+func MaxSize() int64 {
+	var max int64
+	for _, limit := range Limits {
+		if limit > max {
+			max = limit
+		}
+	}
+	return max
+}
+
+// SniffLen is how much of the start of a file Detect looks at
+const SniffLen = 512
+
+// allowed are the accepted MIME types with their kind and the extension
+// files of the type are stored with
+var allowed = map[string]struct {
+	kind Kind
+	ext  string
+}{
+	"image/jpeg": {KindImage, ".jpg"},
+	"image/png":  {KindImage, ".png"},
+	"image/gif":  {KindImage, ".gif"},
+	"image/webp": {KindImage, ".webp"},
+	"image/heic": {KindImage, ".heic"},
+
+	"video/mp4":       {KindVideo, ".mp4"},
+	"video/quicktime": {KindVideo, ".mov"},
+	"video/webm":      {KindVideo, ".webm"},
+
+	"audio/mpeg": {KindAudio, ".mp3"},
+	"audio/mp4":  {KindAudio, ".m4a"},
+	"audio/aac":  {KindAudio, ".aac"},
+	"audio/ogg":  {KindAudio, ".ogg"},
+	"audio/wav":  {KindAudio, ".wav"},
+	"audio/flac": {KindAudio, ".flac"},
+
+	"application/pdf": {KindDocument, ".pdf"},
+	"text/plain":      {KindDocument, ".txt"},
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   {KindDocument, ".docx"},
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         {KindDocument, ".xlsx"},
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": {KindDocument, ".pptx"},
+	"application/vnd.oasis.opendocument.text":                                   {KindDocument, ".odt"},
+
+	"application/zip":             {KindArchive, ".zip"},
+	"application/gzip":            {KindArchive, ".gz"},
+	"application/vnd.rar":         {KindArchive, ".rar"},
+	"application/x-7z-compressed": {KindArchive, ".7z"},
+}
+
+// zipDocuments are the document formats that are ZIP files, by extension
+var zipDocuments = map[string]string{
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":  "application/vnd.oasis.opendocument.text",
+}
+
+// Detect returns the MIME type and kind of a file from its first SniffLen
+// bytes, or false if it is not a type that may be uploaded. The name only
+// tells apart formats with the same content, such as a .docx from a .zip;
+// it never makes a file pass for another type.
+func Detect(head []byte, filename string) (string, Kind, bool) {
+	mimeType := sniff(head)
+	ext := strings.ToLower(filepath.Ext(filename))
+	if t, ok := zipDocuments[ext]; ok && mimeType == "application/zip" {
+		mimeType = t
+	}
+
+	a, ok := allowed[mimeType]
+	return mimeType, a.kind, ok
+}
+
+// Extension returns the extension files of an allowed MIME type are stored with
+func Extension(mimeType string) string {
+	return allowed[mimeType].ext
+}
+
+// sniff returns the MIME type of content without parameters. It knows the
+// formats of http.DetectContentType and a few more that phones and desktops
+// commonly send.
+func sniff(head []byte) string {
+	// ISO base media files (MP4, MOV, M4A, HEIC) tell their brand in the ftyp box
+	if len(head) >= 12 && string(head[4:8]) == "ftyp" {
+		switch string(head[8:12]) {
+		case "M4A ", "M4B ":
+			return "audio/mp4"
+		case "qt  ":
+			return "video/quicktime"
+		case "heic", "heix", "mif1", "msf1":
+			return "image/heic"
+		default:
+			return "video/mp4"
+		}
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return "audio/flac"
+	case bytes.HasPrefix(head, []byte("7z\xbc\xaf\x27\x1c")):
+		return "application/x-7z-compressed"
+	case len(head) >= 2 && head[0] == 0xff && head[1]&0xf6 == 0xf0:
+		// ADTS frame sync of raw AAC
+		return "audio/aac"
+	case len(head) >= 2 && head[0] == 0xff && head[1]&0xe0 == 0xe0:
+		// MPEG audio frame sync of an MP3 without an ID3 tag
+		return "audio/mpeg"
+	}
+
+	mimeType, _, _ := strings.Cut(http.DetectContentType(head), ";")
+	switch mimeType {
+	case "application/x-gzip":
+		return "application/gzip"
+	case "application/x-rar-compressed":
+		return "application/vnd.rar"
+	case "application/ogg":
+		return "audio/ogg"
+	case "audio/wave":
+		return "audio/wav"
+	}
+	return mimeType
+}
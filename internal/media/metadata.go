@@ -0,0 +1,361 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// jpegOrientation returns the EXIF orientation of a JPEG file, 1 to 8, or 1
+// (upright) if it has none
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return 1
+		}
+		marker := data[i+1]
+		switch marker {
+		case 0xff:
+			// Fill byte before a marker
+			i++
+			continue
+		case 0xda, 0xd9:
+			// EXIF comes before the image data
+			return 1
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if size < 2 || i+2+size > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+size]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation tag from the first IFD of EXIF data
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int64(order.Uint32(tiff[4:8]))
+	if ifd+2 > int64(len(tiff)) {
+		return 1
+	}
+	entries := int64(order.Uint16(tiff[ifd:]))
+	for k := int64(0); k < entries; k++ {
+		entry := ifd + 2 + 12*k
+		if entry+12 > int64(len(tiff)) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// webpAnimated reports whether a WebP file is an animation
+func webpAnimated(data []byte) bool {
+	// The extended format flags animation in its first chunk
+	return len(data) >= 21 && string(data[12:16]) == "VP8X" && data[20]&0x02 != 0
+}
+
+// StripMetadata removes EXIF and XMP metadata, which may tell where a photo
+// was taken, from an image that is stored without being re-encoded. Types
+// that carry no metadata, and files it cannot make out, are returned as they are.
+func StripMetadata(data []byte, mimeType string) []byte {
+	switch mimeType {
+	case "image/webp":
+		return stripWebP(data)
+	case "image/heic":
+		return stripHEIF(data)
+	}
+	return data
+}
+
+// stripWebP drops the EXIF and XMP chunks of a WebP file
+func stripWebP(data []byte) []byte {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return data
+	}
+
+	out := make([]byte, 12, len(data))
+	copy(out, data[:12])
+	for offset := 12; offset < len(data); {
+		if offset+8 > len(data) {
+			return data
+		}
+		size := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		// Chunks are padded to an even size
+		end := offset + 8 + size + size%2
+		if size < 0 || end > len(data) {
+			if offset+8+size != len(data) {
+				return data
+			}
+			end = len(data)
+		}
+
+		chunk := data[offset:end]
+		switch string(chunk[:4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			out = append(out, chunk...)
+			// Clear the flags of the dropped chunks
+			if len(chunk) > 8 {
+				out[len(out)-len(chunk)+8] &^= 0x08 | 0x04
+			}
+		default:
+			out = append(out, chunk...)
+		}
+		offset = end
+	}
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+	return out
+}
+
+// stripHEIF blanks the EXIF and XMP items of a HEIF file. They are zeroed
+// in place, since removing them would move the offsets of every other item.
+func stripHEIF(data []byte) []byte {
+	metaStart, metaEnd, ok := sliceBox(data, 0, len(data), "meta")
+	if !ok || metaStart+4 > metaEnd {
+		return data
+	}
+	// meta is a full box: its children follow a version and flags
+	metaStart += 4
+
+	iinfStart, iinfEnd, ok := sliceBox(data, metaStart, metaEnd, "iinf")
+	if !ok {
+		return data
+	}
+	metadataItems := heifMetadataItems(data[iinfStart:iinfEnd])
+	if len(metadataItems) == 0 {
+		return data
+	}
+	ilocStart, ilocEnd, ok := sliceBox(data, metaStart, metaEnd, "iloc")
+	if !ok {
+		return data
+	}
+	idatStart, _, hasIdat := sliceBox(data, metaStart, metaEnd, "idat")
+
+	out := make([]byte, len(data))
+	copy(out, data)
+	for _, extent := range heifExtents(data[ilocStart:ilocEnd], metadataItems) {
+		start := extent.offset
+		if extent.inIdat {
+			if !hasIdat {
+				continue
+			}
+			start += uint64(idatStart)
+		}
+		end := start + extent.length
+		if end < start || end > uint64(len(out)) {
+			return data
+		}
+		for i := start; i < end; i++ {
+			out[i] = 0
+		}
+	}
+	return out
+}
+
+// heifMetadataItems returns the IDs of the EXIF and XMP items listed by the
+// content of an iinf box
+func heifMetadataItems(iinf []byte) map[uint32]bool {
+	items := make(map[uint32]bool)
+	if len(iinf) < 6 {
+		return items
+	}
+	offset := 6
+	if iinf[0] != 0 {
+		// Version 1 counts the entries in 32 bits
+		offset = 8
+	}
+
+	for offset < len(iinf) {
+		start, end, ok := sliceBox(iinf, offset, len(iinf), "infe")
+		if !ok {
+			return items
+		}
+		infe := iinf[start:end]
+		offset = end
+
+		// Versions 2 and 3 have a type for each item
+		if len(infe) < 12 || infe[0] < 2 {
+			continue
+		}
+		var id uint32
+		var rest []byte
+		if infe[0] == 2 {
+			id = uint32(binary.BigEndian.Uint16(infe[4:6]))
+			rest = infe[8:]
+		} else {
+			if len(infe) < 14 {
+				continue
+			}
+			id = binary.BigEndian.Uint32(infe[4:8])
+			rest = infe[10:]
+		}
+		itemType, rest := string(rest[:4]), rest[4:]
+
+		switch itemType {
+		case "Exif":
+			items[id] = true
+		case "mime":
+			// XMP is an item of MIME type application/rdf+xml, after a name
+			if _, rest, ok := bytes.Cut(rest, []byte{0}); ok && bytes.HasPrefix(rest, []byte("application/rdf+xml\x00")) {
+				items[id] = true
+			}
+		}
+	}
+	return items
+}
+
+// heifExtent is where a part of an item is stored
+type heifExtent struct {
+	offset uint64
+	length uint64
+	// inIdat places the offset in the idat box rather than the file
+	inIdat bool
+}
+
+// heifExtents returns the extents of some items from the content of an iloc box
+func heifExtents(iloc []byte, items map[uint32]bool) []heifExtent {
+	r := &fieldReader{data: iloc}
+	version := r.uint(1)
+	r.uint(3)
+	sizes := r.uint(1)
+	offsetSize, lengthSize := int(sizes>>4), int(sizes&0x0f)
+	sizes = r.uint(1)
+	baseOffsetSize, indexSize := int(sizes>>4), int(sizes&0x0f)
+	if version == 0 {
+		indexSize = 0
+	}
+	var count uint64
+	if version < 2 {
+		count = r.uint(2)
+	} else {
+		count = r.uint(4)
+	}
+
+	var extents []heifExtent
+	for i := uint64(0); i < count && r.ok(); i++ {
+		var id uint64
+		if version < 2 {
+			id = r.uint(2)
+		} else {
+			id = r.uint(4)
+		}
+		var method uint64
+		if version > 0 {
+			method = r.uint(2) & 0x0f
+		}
+		r.uint(2) // data reference index
+		base := r.uint(baseOffsetSize)
+		extentCount := r.uint(2)
+		for e := uint64(0); e < extentCount && r.ok(); e++ {
+			r.uint(indexSize)
+			offset := r.uint(offsetSize)
+			length := r.uint(lengthSize)
+			if items[uint32(id)] && method < 2 {
+				extents = append(extents, heifExtent{offset: base + offset, length: length, inIdat: method == 1})
+			}
+		}
+	}
+	if !r.ok() {
+		return nil
+	}
+	return extents
+}
+
+// fieldReader reads big-endian integers of 0 to 8 bytes, remembering if it ran out
+type fieldReader struct {
+	data   []byte
+	offset int
+	short  bool
+}
+
+func (r *fieldReader) uint(n int) uint64 {
+	if n < 0 || n > 8 || r.offset+n > len(r.data) {
+		r.short = true
+		return 0
+	}
+	var v uint64
+	for _, b := range r.data[r.offset : r.offset+n] {
+		v = v<<8 | uint64(b)
+	}
+	r.offset += n
+	return v
+}
+
+func (r *fieldReader) ok() bool {
+	return !r.short
+}
+
+// sliceBox returns where the content of the first box of a type among those
+// in data[start:end] starts and ends
+func sliceBox(data []byte, start, end int, boxType string) (int, int, bool) {
+	box, next, ok := nextBox(io.NewSectionReader(bytes.NewReader(data[:end]), 0, int64(end)), int64(start), boxType)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(next - box.Size()), int(next), true
+}
+
+// heifSize returns the largest image size among the item properties of a
+// HEIF file, which is that of the primary image rather than of its tiles or
+// thumbnails
+func heifSize(r *io.SectionReader) (*int, *int) {
+	meta, ok := findBox(r, "meta")
+	if !ok || meta.Size() < 4 {
+		return nil, nil
+	}
+	iprp, ok := findBox(io.NewSectionReader(meta, 4, meta.Size()-4), "iprp")
+	if !ok {
+		return nil, nil
+	}
+	ipco, ok := findBox(iprp, "ipco")
+	if !ok {
+		return nil, nil
+	}
+
+	var width, height int
+	for offset := int64(0); ; {
+		ispe, next, ok := nextBox(ipco, offset, "ispe")
+		if !ok {
+			break
+		}
+		offset = next
+		var buf [12]byte
+		if _, err := ispe.ReadAt(buf[:], 0); err != nil {
+			continue
+		}
+		w, h := int(binary.BigEndian.Uint32(buf[4:8])), int(binary.BigEndian.Uint32(buf[8:12]))
+		if w*h > width*height {
+			width, height = w, h
+		}
+	}
+	if width == 0 || height == 0 {
+		return nil, nil
+	}
+	return &width, &height
+}
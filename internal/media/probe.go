@@ -0,0 +1,200 @@
+package media
+
+import (
+	"encoding/binary"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+)
+
+// Info is what Probe finds out about a file. Fields it cannot tell are nil.
+type Info struct {
+	Width      *int
+	Height     *int
+	DurationMS *int
+}
+
+// Probe reads the dimensions of images and video and the duration of audio
+// and video from their headers. It never fails: a file it cannot make out
+// has an empty Info.
+func Probe(r io.ReaderAt, size int64, mimeType string) Info {
+	var info Info
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif":
+		if cfg, _, err := image.DecodeConfig(io.NewSectionReader(r, 0, size)); err == nil {
+			info.Width, info.Height = &cfg.Width, &cfg.Height
+		}
+	case "image/webp":
+		info.Width, info.Height = webpSize(r)
+	case "image/heic":
+		info.Width, info.Height = heifSize(io.NewSectionReader(r, 0, size))
+	case "video/mp4", "video/quicktime", "audio/mp4":
+		probeISOBMFF(io.NewSectionReader(r, 0, size), &info)
+	case "audio/wav":
+		info.DurationMS = wavDuration(io.NewSectionReader(r, 0, size))
+	}
+	return info
+}
+
+// webpSize reads the canvas size from the first chunk of a WebP file
+func webpSize(r io.ReaderAt) (*int, *int) {
+	var head [30]byte
+	if _, err := r.ReadAt(head[:], 0); err != nil {
+		return nil, nil
+	}
+	var w, h int
+	switch string(head[12:16]) {
+	case "VP8 ":
+		// Lossy: 14-bit sizes after the frame tag and start code
+		w = int(binary.LittleEndian.Uint16(head[26:28]) & 0x3fff)
+		h = int(binary.LittleEndian.Uint16(head[28:30]) & 0x3fff)
+	case "VP8L":
+		// Lossless: 14-bit sizes minus one after the signature byte
+		bits := binary.LittleEndian.Uint32(head[21:25])
+		w = int(bits&0x3fff) + 1
+		h = int(bits>>14&0x3fff) + 1
+	case "VP8X":
+		// Extended: 24-bit canvas sizes minus one
+		w = int(uint32(head[24])|uint32(head[25])<<8|uint32(head[26])<<16) + 1
+		h = int(uint32(head[27])|uint32(head[28])<<8|uint32(head[29])<<16) + 1
+	default:
+		return nil, nil
+	}
+	return &w, &h
+}
+
+// probeISOBMFF reads the duration from the movie header (mvhd) of an MP4,
+// MOV or M4A file, and the size from the header (tkhd) of its first track
+// that has one
+func probeISOBMFF(r *io.SectionReader, info *Info) {
+	moov, ok := findBox(r, "moov")
+	if !ok {
+		return
+	}
+	if mvhd, ok := findBox(moov, "mvhd"); ok {
+		info.DurationMS = mvhdDuration(mvhd)
+	}
+
+	for offset := int64(0); ; {
+		trak, next, ok := nextBox(moov, offset, "trak")
+		if !ok {
+			return
+		}
+		offset = next
+		if tkhd, ok := findBox(trak, "tkhd"); ok {
+			if w, h := tkhdSize(tkhd); w > 0 && h > 0 {
+				info.Width, info.Height = &w, &h
+				return
+			}
+		}
+	}
+}
+
+// findBox returns the content of the first box of a type among those in r
+func findBox(r *io.SectionReader, boxType string) (*io.SectionReader, bool) {
+	box, _, ok := nextBox(r, 0, boxType)
+	return box, ok
+}
+
+// nextBox returns the content of the first box of a type at or after offset,
+// and the offset past it
+func nextBox(r *io.SectionReader, offset int64, boxType string) (*io.SectionReader, int64, bool) {
+	var header [16]byte
+	for offset+8 <= r.Size() {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return nil, 0, false
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		headerLen := int64(8)
+		switch size {
+		case 0:
+			// The box extends to the end of the file
+			size = r.Size() - offset
+		case 1:
+			// A 64-bit size follows the type
+			if _, err := r.ReadAt(header[8:16], offset); err != nil {
+				return nil, 0, false
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerLen = 16
+		}
+		if size < headerLen || offset+size > r.Size() {
+			return nil, 0, false
+		}
+		if string(header[4:8]) == boxType {
+			return io.NewSectionReader(r, offset+headerLen, size-headerLen), offset + size, true
+		}
+		offset += size
+	}
+	return nil, 0, false
+}
+
+func mvhdDuration(mvhd *io.SectionReader) *int {
+	var buf [32]byte
+	if _, err := mvhd.ReadAt(buf[:], 0); err != nil {
+		return nil
+	}
+	// Version 1 has 64-bit times and duration
+	var timescale, duration uint64
+	if buf[0] == 1 {
+		timescale = uint64(binary.BigEndian.Uint32(buf[20:24]))
+		duration = binary.BigEndian.Uint64(buf[24:32])
+	} else {
+		timescale = uint64(binary.BigEndian.Uint32(buf[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(buf[16:20]))
+	}
+	if timescale == 0 {
+		return nil
+	}
+	ms := int(duration * 1000 / timescale)
+	return &ms
+}
+
+// tkhdSize reads the 16.16 fixed-point width and height that end a track header
+func tkhdSize(tkhd *io.SectionReader) (int, int) {
+	var buf [8]byte
+	if _, err := tkhd.ReadAt(buf[:], tkhd.Size()-8); err != nil {
+		return 0, 0
+	}
+	return int(binary.BigEndian.Uint32(buf[:4]) >> 16), int(binary.BigEndian.Uint32(buf[4:]) >> 16)
+}
+
+// wavDuration divides the size of the data chunk of a WAV file by its byte rate
+func wavDuration(r *io.SectionReader) *int {
+	var header [12]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil || string(header[:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
+		return nil
+	}
+
+	var byteRate uint32
+	var chunk [8]byte
+	for offset := int64(12); offset+8 <= r.Size(); {
+		if _, err := r.ReadAt(chunk[:], offset); err != nil {
+			return nil
+		}
+		size := int64(binary.LittleEndian.Uint32(chunk[4:]))
+		switch string(chunk[:4]) {
+		case "fmt ":
+			var rate [4]byte
+			if _, err := r.ReadAt(rate[:], offset+16); err != nil {
+				return nil
+			}
+			byteRate = binary.LittleEndian.Uint32(rate[:])
+		case "data":
+			if byteRate == 0 {
+				return nil
+			}
+			// A stream may not know the size of its data yet
+			if offset+8+size > r.Size() {
+				size = r.Size() - offset - 8
+			}
+			ms := int(size * 1000 / int64(byteRate))
+			return &ms
+		}
+		// Chunks are padded to an even size
+		offset += 8 + size + size%2
+	}
+	return nil
+}
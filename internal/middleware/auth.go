@@ -2,42 +2,110 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/kvant/messenger/internal/store"
 	"github.com/kvant/messenger/pkg/utils"
 )
 
 type contextKey string
 
-const UserIDKey contextKey = "user_id"
-
-func AuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			utils.RespondError(w, http.StatusUnauthorized, "Missing authorization header")
-			return
-		}
-
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			utils.RespondError(w, http.StatusUnauthorized, "Invalid authorization header")
-			return
-		}
-
-		claims, err := utils.ValidateJWT(parts[1])
-		if err != nil {
-			utils.RespondError(w, http.StatusUnauthorized, "Invalid token")
-			return
-		}
-
-		ctx := context.WithValue(r.Context(), UserIDKey, claims.UserID)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+const (
+	UserIDKey    contextKey = "user_id"
+	SessionIDKey contextKey = "session_id"
+)
+
+// touchInterval is how stale the last use of a session gets before it is
+// recorded again, to spare a write on every request
+const touchInterval = time.Minute
+
+var (
+	// ErrInvalidToken is returned by Authenticate for a token that is malformed,
+	// forged or expired
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrSessionEnded is returned by Authenticate for a valid token of a session
+	// that was revoked or has expired
+	ErrSessionEnded = errors.New("session ended")
+)
+
+// NewAuthMiddleware accepts requests with a Bearer access token of an active session
+func NewAuthMiddleware(sessions store.SessionStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authHeader := r.Header.Get("Authorization")
+			if authHeader == "" {
+				utils.RespondError(w, http.StatusUnauthorized, "Missing authorization header")
+				return
+			}
+
+			parts := strings.Split(authHeader, " ")
+			if len(parts) != 2 || parts[0] != "Bearer" {
+				utils.RespondError(w, http.StatusUnauthorized, "Invalid authorization header")
+				return
+			}
+
+			claims, err := Authenticate(r, sessions, parts[1])
+			switch err {
+			case nil:
+			case ErrInvalidToken:
+				utils.RespondError(w, http.StatusUnauthorized, "Invalid token")
+				return
+			case ErrSessionEnded:
+				utils.RespondError(w, http.StatusUnauthorized, "Session ended")
+				return
+			default:
+				utils.RespondError(w, http.StatusInternalServerError, "Failed to check session")
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), UserIDKey, claims.UserID)
+			ctx = context.WithValue(ctx, SessionIDKey, claims.SessionID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// Authenticate validates an access token and checks that its session is
+// still active, recording that it is in use
+func Authenticate(r *http.Request, sessions store.SessionStore, token string) (*utils.Claims, error) {
+	claims, err := utils.ValidateJWT(token)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if claims.Purpose != "" {
+		return nil, ErrInvalidToken
+	}
+	// Tokens from before sessions can't be revoked, so they are not accepted
+	if claims.SessionID == "" {
+		return nil, ErrSessionEnded
+	}
+
+	session, err := sessions.Active(r.Context(), claims.SessionID)
+	if err == store.ErrNotFound || err == nil && session.UserID != claims.UserID {
+		return nil, ErrSessionEnded
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ip := utils.ClientIP(r)
+	if time.Since(session.LastSeenAt) > touchInterval || session.IP != ip {
+		// Failing to record it is no reason to refuse the request
+		sessions.Touch(r.Context(), session.ID, ip)
+	}
+	return claims, nil
 }
 
 func GetUserID(r *http.Request) string {
 	userID, _ := r.Context().Value(UserIDKey).(string)
 	return userID
 }
+
+// GetSessionID returns the session of an authenticated request
+func GetSessionID(r *http.Request) string {
+	sessionID, _ := r.Context().Value(SessionIDKey).(string)
+	return sessionID
+}
@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kvant/messenger/internal/ratelimit"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// NewRateLimitMiddleware answers 429 Too Many Requests to clients that have
+// used up their requests under limiter. key tells clients apart, such as
+// utils.ClientIP for a limit per IP address.
+func NewRateLimitMiddleware(limiter *ratelimit.Limiter, key func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ok, wait, err := limiter.Allow(r.Context(), key(r))
+			if err != nil {
+				// A broken limit store should not take the endpoint down with
+				// it. The failures are counted in ratelimit.StoreErrors.
+				log.Printf("Rate limit check failed, letting %s %s through: %v", r.Method, r.URL.Path, err)
+			} else if !ok {
+				RespondTooManyRequests(w, wait, "RATE_LIMITED", "Слишком много запросов. Попробуйте позже")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RespondTooManyRequests answers 429 with a Retry-After of wait, rounded up
+// to whole seconds
+func RespondTooManyRequests(w http.ResponseWriter, wait time.Duration, code, message string) {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	utils.RespondJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+		"success":     false,
+		"error":       code,
+		"message":     message,
+		"retry_after": seconds,
+	})
+}
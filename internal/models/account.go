@@ -0,0 +1,10 @@
+package models
+
+// DeleteAccountRequest schedules the deletion of the account of the user,
+// who proves who they are with their password and, with two-factor
+// authentication, a code or a recovery code
+type DeleteAccountRequest struct {
+	Password     string `json:"password"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// BlockedUser is a user on the block list of another
+type BlockedUser struct {
+	ID          string    `json:"id"`
+	Username    string    `json:"username"`
+	DisplayName *string   `json:"display_name,omitempty"`
+	AvatarURL   *string   `json:"avatar_url,omitempty"`
+	BlockedAt   time.Time `json:"blocked_at"`
+}
@@ -0,0 +1,56 @@
+package models
+
+import "time"
+
+// Channel subscriber roles stored in channel_subscribers.role
+const (
+	ChannelRoleOwner      = "owner"
+	ChannelRoleAdmin      = "admin"
+	ChannelRoleSubscriber = "subscriber"
+)
+
+type Channel struct {
+	ID              string    `json:"id"`
+	Name            string    `json:"name"`
+	Description     *string   `json:"description,omitempty"`
+	AvatarURL       *string   `json:"avatar_url,omitempty"`
+	OwnerID         string    `json:"owner_id"`
+	IsPublic        bool      `json:"is_public"`
+	SubscriberCount int       `json:"subscriber_count"`
+	InviteSlug      *string   `json:"invite_slug,omitempty"`
+	MyRole          string    `json:"my_role,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+type ChannelSubscriber struct {
+	UserID       string    `json:"user_id"`
+	Username     string    `json:"username"`
+	DisplayName  *string   `json:"display_name,omitempty"`
+	AvatarURL    *string   `json:"avatar_url,omitempty"`
+	Role         string    `json:"role"`
+	SubscribedAt time.Time `json:"subscribed_at"`
+}
+
+type CreateChannelRequest struct {
+	Name        string  `json:"name"`
+	Description *string `json:"description,omitempty"`
+	AvatarURL   *string `json:"avatar_url,omitempty"`
+	IsPublic    *bool   `json:"is_public,omitempty"`
+	InviteSlug  string  `json:"invite_slug,omitempty"`
+}
+
+type UpdateChannelRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	AvatarURL   *string `json:"avatar_url"`
+	IsPublic    *bool   `json:"is_public"`
+	InviteSlug  *string `json:"invite_slug"`
+}
+
+type CreatePostRequest struct {
+	Text        string `json:"text"`
+	MessageType string `json:"message_type,omitempty"`
+	// FileURL is an unsent upload of the author, sent before AttachmentIDs
+	FileURL       *string  `json:"file_url,omitempty"`
+	AttachmentIDs []string `json:"attachment_ids,omitempty"`
+}
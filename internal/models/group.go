@@ -0,0 +1,46 @@
+package models
+
+import "time"
+
+// Group member roles stored in group_members.role
+const (
+	GroupRoleOwner  = "owner"
+	GroupRoleAdmin  = "admin"
+	GroupRoleMember = "member"
+)
+
+type Group struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description *string   `json:"description,omitempty"`
+	AvatarURL   *string   `json:"avatar_url,omitempty"`
+	OwnerID     string    `json:"owner_id"`
+	IsPublic    bool      `json:"is_public"`
+	MemberCount int       `json:"member_count"`
+	MyRole      string    `json:"my_role,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type GroupMember struct {
+	UserID      string    `json:"user_id"`
+	Username    string    `json:"username"`
+	DisplayName *string   `json:"display_name,omitempty"`
+	AvatarURL   *string   `json:"avatar_url,omitempty"`
+	Role        string    `json:"role"`
+	JoinedAt    time.Time `json:"joined_at"`
+}
+
+type CreateGroupRequest struct {
+	Name        string   `json:"name"`
+	Description *string  `json:"description,omitempty"`
+	AvatarURL   *string  `json:"avatar_url,omitempty"`
+	IsPublic    bool     `json:"is_public"`
+	MemberIDs   []string `json:"member_ids,omitempty"`
+}
+
+type UpdateGroupRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	AvatarURL   *string `json:"avatar_url"`
+	IsPublic    *bool   `json:"is_public"`
+}
@@ -5,7 +5,11 @@ import "time"
 type Message struct {
 	ID              string     `json:"id"`
 	SenderID        string     `json:"sender_id"`
-	ReceiverID      string     `json:"receiver_id"`
+	ReceiverID      *string    `json:"receiver_id,omitempty"`
+	GroupID         *string    `json:"group_id,omitempty"`
+	ChannelID       *string    `json:"channel_id,omitempty"`
+	ServerChannelID *string    `json:"server_channel_id,omitempty"`
+	ClientMessageID *string    `json:"client_message_id,omitempty"`
 	Text            string     `json:"text"`
 	MessageType     string     `json:"message_type"`
 	FileURL         *string    `json:"file_url,omitempty"`
@@ -13,6 +17,9 @@ type Message struct {
 	ReadAt          *time.Time `json:"read_at,omitempty"`
 	ReplyToID       *string    `json:"reply_to_id,omitempty"`
 	RepliedMessage  *Message   `json:"replied_message,omitempty"`
+	// SelfDestructIn is the self-destruct timer in seconds. SelfDestructAt is
+	// when the message is deleted; it is unset until a timer that starts on read starts.
+	SelfDestructIn  *int       `json:"self_destruct_in,omitempty"`
 	SelfDestructAt  *time.Time `json:"self_destruct_at,omitempty"`
 	EditedAt        *time.Time `json:"edited_at,omitempty"`
 	DeletedAt       *time.Time `json:"deleted_at,omitempty"`
@@ -24,6 +31,47 @@ type Message struct {
 	SenderAvatarURL *string    `json:"sender_avatar_url,omitempty"`
 	PinnedAt        *time.Time `json:"pinned_at,omitempty"`
 	Reactions       []Reaction `json:"reactions,omitempty"`
+	Attachments     []Attachment `json:"attachments,omitempty"`
+}
+
+// MessagePage is a slice of conversation history, oldest message first
+type MessagePage struct {
+	Messages []Message `json:"messages"`
+	// HasMore reports whether there are more messages past the page in the
+	// direction it was loaded: older ones, or newer ones for an after= page.
+	// Around a message it covers the older side.
+	HasMore bool `json:"has_more"`
+	// HasMoreAfter reports whether there are newer messages past a page around a message
+	HasMoreAfter bool `json:"has_more_after,omitempty"`
+}
+
+// SearchResults are messages matching a search, grouped by conversation.
+// Conversations are ordered by their newest hit.
+type SearchResults struct {
+	Conversations []SearchConversation `json:"conversations"`
+	// HasMore reports whether there are older hits; pass the id of the
+	// oldest hit as before= to get them
+	HasMore bool `json:"has_more"`
+}
+
+// SearchConversation is a chat with messages matching a search
+type SearchConversation struct {
+	// Type is direct, group, channel or server_channel
+	Type string `json:"type"`
+	// ID is the group or channel, or the other user of a direct chat
+	ID   string      `json:"id"`
+	Name string      `json:"name"`
+	Hits []SearchHit `json:"hits"`
+}
+
+// SearchHit is a matching message with the messages next to it
+type SearchHit struct {
+	Message Message `json:"message"`
+	// Snippet is an excerpt of the text with the matches wrapped in <mark></mark>.
+	// The rest of the text is not escaped.
+	Snippet string    `json:"snippet"`
+	Before  []Message `json:"before"`
+	After   []Message `json:"after"`
 }
 
 type Reaction struct {
@@ -34,10 +82,54 @@ type Reaction struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// Attachment is an uploaded file. It belongs to its uploader until it is sent
+// with a message, after which it belongs to that message.
+type Attachment struct {
+	ID         string  `json:"id"`
+	UploaderID string  `json:"uploader_id"`
+	MessageID  *string `json:"message_id,omitempty"`
+	URL        string  `json:"url"`
+	Filename   string  `json:"filename"`
+	MimeType   string  `json:"mime_type"`
+	// Kind is image, video, audio, document or archive
+	Kind string `json:"kind"`
+	Size int64  `json:"size"`
+	// Width and Height are set for images and video, DurationMS for audio
+	// and video, when the file tells them
+	Width      *int `json:"width,omitempty"`
+	Height     *int `json:"height,omitempty"`
+	DurationMS *int `json:"duration_ms,omitempty"`
+	// ThumbnailURL is a smaller copy of an image, when it is large; Blurhash
+	// is a placeholder to show while an image loads
+	ThumbnailURL *string `json:"thumbnail_url,omitempty"`
+	Blurhash     *string `json:"blurhash,omitempty"`
+	// Checksum is the hex SHA-256 of the content
+	Checksum  string    `json:"checksum"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SendMessageRequest sends a message to exactly one of a user, group or server channel
 type SendMessageRequest struct {
-	ReceiverID     string  `json:"receiver_id"`
-	Text           string  `json:"text"`
-	MessageType    string  `json:"message_type"`
-	ReplyToID      *string `json:"reply_to_id,omitempty"`
-	SelfDestructIn *int    `json:"self_destruct_in,omitempty"`
+	ReceiverID      string  `json:"receiver_id,omitempty"`
+	GroupID         string  `json:"group_id,omitempty"`
+	ServerChannelID string  `json:"server_channel_id,omitempty"`
+	Text            string  `json:"text"`
+	MessageType     string  `json:"message_type"`
+	ReplyToID       *string `json:"reply_to_id,omitempty"`
+	ClientMessageID string  `json:"client_message_id,omitempty"`
+	// AttachmentIDs are uploaded attachments to send with the message, in order
+	AttachmentIDs []string `json:"attachment_ids,omitempty"`
+	// SelfDestructIn deletes the message after that many seconds, counted from
+	// sending or, with SelfDestructAfterRead, from reading (direct chats only)
+	SelfDestructIn        *int `json:"self_destruct_in,omitempty"`
+	SelfDestructAfterRead bool `json:"self_destruct_after_read,omitempty"`
+}
+
+// RecentChat is a user someone had a direct chat with
+type RecentChat struct {
+	ID              string  `json:"id"`
+	Username        string  `json:"username"`
+	DisplayName     *string `json:"display_name,omitempty"`
+	AvatarURL       *string `json:"avatar_url,omitempty"`
+	LastMessageTime string  `json:"last_message_time"`
 }
@@ -0,0 +1,28 @@
+package models
+
+type ChangePasswordRequest struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+// EmailRequest sets the address password resets are sent to; an empty
+// Email removes it
+type EmailRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// ForgotPasswordRequest asks for a reset link for a username or an email
+// address
+type ForgotPasswordRequest struct {
+	Login string `json:"login"`
+}
+
+// ResetPasswordRequest sets a new password with the token of a reset link,
+// or with a username and one of its recovery codes
+type ResetPasswordRequest struct {
+	Token        string `json:"token,omitempty"`
+	Username     string `json:"username,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+	NewPassword  string `json:"new_password"`
+}
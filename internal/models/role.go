@@ -0,0 +1,17 @@
+package models
+
+// RoleRequest creates or updates a role of a group or server.
+// Permissions is a bitset, see package permissions for the bits.
+type RoleRequest struct {
+	Name        *string `json:"name"`
+	Permissions *int64  `json:"permissions"`
+	Position    *int    `json:"position"`
+}
+
+// StoredRole is a row of the roles table: a custom role of a group or
+// server, or the changed defaults of a built-in one
+type StoredRole struct {
+	Name        string
+	Permissions int64
+	Position    int
+}
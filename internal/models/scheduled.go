@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+// Scheduled message states. Sent messages are removed from the queue.
+const (
+	ScheduledPending = "pending"
+	ScheduledSending = "sending"
+	ScheduledFailed  = "failed"
+)
+
+// ScheduledMessage is a message queued to be sent at SendAt
+type ScheduledMessage struct {
+	ID                    string    `json:"id"`
+	SenderID              string    `json:"sender_id"`
+	ReceiverID            *string   `json:"receiver_id,omitempty"`
+	GroupID               *string   `json:"group_id,omitempty"`
+	ServerChannelID       *string   `json:"server_channel_id,omitempty"`
+	Text                  string    `json:"text"`
+	ReplyToID             *string   `json:"reply_to_id,omitempty"`
+	SelfDestructIn        *int      `json:"self_destruct_in,omitempty"`
+	SelfDestructAfterRead bool      `json:"self_destruct_after_read"`
+	SendAt                time.Time `json:"send_at"`
+	Status                string    `json:"status"`
+	// Error says why a failed message could not be sent
+	Error     *string    `json:"error,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// ScheduleMessageRequest queues a message to be sent at SendAt
+type ScheduleMessageRequest struct {
+	SendMessageRequest
+	SendAt time.Time `json:"send_at"`
+}
+
+// UpdateScheduledMessageRequest edits or reschedules a queued message
+type UpdateScheduledMessageRequest struct {
+	Text   *string    `json:"text"`
+	SendAt *time.Time `json:"send_at"`
+}
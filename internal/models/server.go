@@ -0,0 +1,91 @@
+package models
+
+import "time"
+
+// Server member roles stored in server_members.role
+const (
+	ServerRoleOwner  = "owner"
+	ServerRoleAdmin  = "admin"
+	ServerRoleMember = "member"
+)
+
+type Server struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description *string   `json:"description,omitempty"`
+	IconURL     *string   `json:"icon_url,omitempty"`
+	BannerURL   *string   `json:"banner_url,omitempty"`
+	OwnerID     string    `json:"owner_id"`
+	IsPublic    bool      `json:"is_public"`
+	MemberCount int       `json:"member_count"`
+	InviteSlug  *string   `json:"invite_slug,omitempty"`
+	MyRole      string    `json:"my_role,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type ServerMember struct {
+	UserID      string    `json:"user_id"`
+	Username    string    `json:"username"`
+	DisplayName *string   `json:"display_name,omitempty"`
+	AvatarURL   *string   `json:"avatar_url,omitempty"`
+	Nickname    *string   `json:"nickname,omitempty"`
+	Role        string    `json:"role"`
+	IsOnline    bool      `json:"is_online"`
+	JoinedAt    time.Time `json:"joined_at"`
+}
+
+type ServerCategory struct {
+	ID        string          `json:"id"`
+	ServerID  string          `json:"server_id"`
+	Name      string          `json:"name"`
+	Position  int             `json:"position"`
+	Channels  []ServerChannel `json:"channels"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+type ServerChannel struct {
+	ID         string    `json:"id"`
+	ServerID   string    `json:"server_id"`
+	CategoryID *string   `json:"category_id,omitempty"`
+	Name       string    `json:"name"`
+	Topic      *string   `json:"topic,omitempty"`
+	Position   int       `json:"position"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ServerChannelTree is the sidebar of a server: ordered categories with their
+// ordered channels, plus channels that are not in any category
+type ServerChannelTree struct {
+	Categories    []ServerCategory `json:"categories"`
+	Uncategorized []ServerChannel  `json:"uncategorized"`
+}
+
+type CreateServerRequest struct {
+	Name        string  `json:"name"`
+	Description *string `json:"description,omitempty"`
+	IconURL     *string `json:"icon_url,omitempty"`
+	BannerURL   *string `json:"banner_url,omitempty"`
+	IsPublic    *bool   `json:"is_public,omitempty"`
+	InviteSlug  string  `json:"invite_slug,omitempty"`
+}
+
+type UpdateServerRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	IconURL     *string `json:"icon_url"`
+	BannerURL   *string `json:"banner_url"`
+	IsPublic    *bool   `json:"is_public"`
+	InviteSlug  *string `json:"invite_slug"`
+}
+
+type ServerCategoryRequest struct {
+	Name     *string `json:"name"`
+	Position *int    `json:"position"`
+}
+
+type ServerChannelRequest struct {
+	Name       *string `json:"name"`
+	Topic      *string `json:"topic"`
+	CategoryID *string `json:"category_id"`
+	Position   *int    `json:"position"`
+}
@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+// Session is a login of a user on one device. It lasts as long as its
+// refresh token keeps being used before ExpiresAt.
+type Session struct {
+	ID     string `json:"id"`
+	UserID string `json:"-"`
+	// Device is the User-Agent the session was started from
+	Device string `json:"device"`
+	// IP is the address the session was last used from
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// Current marks the session of the request that lists them
+	Current bool `json:"current"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshResponse is a new token pair; the refresh token sent is spent
+type RefreshResponse struct {
+	Success      bool   `json:"success"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
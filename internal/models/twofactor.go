@@ -0,0 +1,42 @@
+package models
+
+import "time"
+
+// TwoFactor is the TOTP enrollment of a user. It is pending until the user
+// confirms a code, which sets EnabledAt.
+type TwoFactor struct {
+	UserID string
+	// Secret is sealed, see totp.Seal
+	Secret    string
+	EnabledAt *time.Time
+	// LastStep is the time step of the last code accepted, which can't be used again
+	LastStep       int64
+	FailedAttempts int
+	// LockedUntil refuses codes after too many wrong ones
+	LockedUntil *time.Time
+	CreatedAt   time.Time
+}
+
+// TwoFactorChallenge is the answer to a correct password of a user with
+// two-factor authentication: the second step posts ChallengeToken with a code
+type TwoFactorChallenge struct {
+	Success           bool   `json:"success"`
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+	ExpiresIn         int    `json:"expires_in"`
+}
+
+// TwoFactorLoginRequest completes a login with a TOTP code or a recovery code
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+// TwoFactorRequest confirms an enrollment with Code, or proves who the user
+// is again before 2FA is disabled or its recovery codes replaced
+type TwoFactorRequest struct {
+	Password     string `json:"password"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
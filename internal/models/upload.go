@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// Upload is a file being uploaded in chunks. Once Offset reaches Length the
+// file becomes the attachment AttachmentID.
+type Upload struct {
+	ID       string `json:"id"`
+	UserID   string `json:"user_id"`
+	Filename string `json:"filename"`
+	Length   int64  `json:"length"`
+	Offset   int64  `json:"offset"`
+	// Checksum is the hex SHA-256 the complete file must have, if the client gave one
+	Checksum     *string `json:"checksum,omitempty"`
+	AttachmentID *string `json:"attachment_id,omitempty"`
+	// ExpiresAt is when the upload is deleted; every chunk postpones it
+	ExpiresAt  time.Time   `json:"expires_at"`
+	CreatedAt  time.Time   `json:"created_at"`
+	Attachment *Attachment `json:"attachment,omitempty"`
+}
@@ -10,6 +10,9 @@ type User struct {
 	Bio           *string    `json:"bio,omitempty"`
 	AvatarURL     *string    `json:"avatar_url,omitempty"`
 	BannerURL     *string    `json:"banner_url,omitempty"`
+	// Blurhash placeholders of the avatar and banner, shown while they load
+	AvatarBlurhash *string `json:"avatar_blurhash,omitempty"`
+	BannerBlurhash *string `json:"banner_blurhash,omitempty"`
 	Role          string     `json:"role"`
 	IsPremium     bool       `json:"is_premium"`
 	PremiumUntil  *time.Time `json:"premium_until,omitempty"`
@@ -21,6 +24,10 @@ type User struct {
 	IsOnline      bool       `json:"is_online"`
 	CreatedAt     time.Time  `json:"created_at"`
 	UpdatedAt     time.Time  `json:"updated_at"`
+	// DeletionScheduledAt is when an account its user deleted is purged,
+	// unless they log in before; DeletedAt is when it was
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+	DeletedAt           *time.Time `json:"deleted_at,omitempty"`
 }
 
 type RegisterRequest struct {
@@ -34,7 +41,12 @@ type LoginRequest struct {
 }
 
 type LoginResponse struct {
-	Success bool   `json:"success"`
-	Token   string `json:"token"`
-	User    User   `json:"user"`
+	Success      bool   `json:"success"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	// ExpiresIn is the lifetime of Token in seconds
+	ExpiresIn int  `json:"expires_in"`
+	User      User `json:"user"`
+	// AccountRestored tells that the login cancelled a scheduled deletion
+	AccountRestored bool `json:"account_restored,omitempty"`
 }
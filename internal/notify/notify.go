@@ -0,0 +1,71 @@
+// Package notify delivers messages to users outside the app, such as
+// password reset links. The driver is chosen by NOTIFIER: smtp sends email,
+// log writes messages to the server log for development.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+// Message is a plain-text message to one address
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Notifier sends messages
+type Notifier interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// FromEnv returns the notifier configured by NOTIFIER, smtp when SMTP_HOST is
+// set and log otherwise
+func FromEnv() (Notifier, error) {
+	driver := os.Getenv("NOTIFIER")
+	if driver == "" {
+		driver = "log"
+		if os.Getenv("SMTP_HOST") != "" {
+			driver = "smtp"
+		}
+	}
+
+	switch driver {
+	case "log":
+		return LogNotifier{}, nil
+	case "smtp":
+		port, err := strconv.Atoi(getEnv("SMTP_PORT", "587"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SMTP_PORT: %w", err)
+		}
+		return NewSMTPNotifier(SMTPConfig{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("SMTP_FROM"),
+		})
+	default:
+		return nil, fmt.Errorf("unknown NOTIFIER %q", driver)
+	}
+}
+
+// LogNotifier writes messages to the log instead of sending them. Anyone
+// who can read the log can use what is in them, so it is for development.
+type LogNotifier struct{}
+
+func (LogNotifier) Send(ctx context.Context, msg Message) error {
+	log.Printf("📧 To %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
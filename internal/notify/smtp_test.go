@@ -0,0 +1,184 @@
+package notify
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// smtpSession is what a fakeSMTP server was told in one conversation
+type smtpSession struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTP serves one SMTP conversation on a local port. rejectRcpt makes
+// it refuse every recipient. The session is sent on the returned channel
+// when the client hangs up.
+func fakeSMTP(t *testing.T, rejectRcpt bool) (int, <-chan smtpSession) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	sessions := make(chan smtpSession, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		c := textproto.NewConn(conn)
+
+		var s smtpSession
+		defer func() { sessions <- s }()
+		c.PrintfLine("220 fake ESMTP")
+		for {
+			line, err := c.ReadLine()
+			if err != nil {
+				return
+			}
+			verb, arg, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(verb) {
+			case "EHLO":
+				c.PrintfLine("250-fake")
+				c.PrintfLine("250 AUTH PLAIN")
+			case "AUTH":
+				s.auth = strings.TrimPrefix(arg, "PLAIN ")
+				c.PrintfLine("235 accepted")
+			case "MAIL":
+				s.from = arg
+				c.PrintfLine("250 ok")
+			case "RCPT":
+				if rejectRcpt {
+					c.PrintfLine("550 no such user")
+					continue
+				}
+				s.to = append(s.to, arg)
+				c.PrintfLine("250 ok")
+			case "DATA":
+				c.PrintfLine("354 go ahead")
+				data, err := io.ReadAll(c.DotReader())
+				if err != nil {
+					return
+				}
+				s.data = string(data)
+				c.PrintfLine("250 queued")
+			case "QUIT":
+				c.PrintfLine("221 bye")
+				return
+			default:
+				c.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, sessions
+}
+
+func TestSMTPNotifierSend(t *testing.T) {
+	port, sessions := fakeSMTP(t, false)
+	n, err := NewSMTPNotifier(SMTPConfig{
+		Host:     "127.0.0.1",
+		Port:     port,
+		Username: "mailer",
+		Password: "secret",
+		From:     "Messenger <noreply@example.com>",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = n.Send(context.Background(), Message{
+		To:      "alice@example.com",
+		Subject: "Сброс пароля",
+		Body:    "Ссылка:\nhttps://example.com/reset?token=abc",
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	s := <-sessions
+
+	if want := base64.StdEncoding.EncodeToString([]byte("\x00mailer\x00secret")); s.auth != want {
+		t.Errorf("AUTH PLAIN %q, want %q", s.auth, want)
+	}
+	if s.from != "FROM:<noreply@example.com>" {
+		t.Errorf("MAIL %q", s.from)
+	}
+	if len(s.to) != 1 || s.to[0] != "TO:<alice@example.com>" {
+		t.Errorf("RCPT %q", s.to)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(s.data))
+	if err != nil {
+		t.Fatalf("reading the sent message: %v", err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Сброс пароля" {
+		t.Errorf("Subject %q (%v)", subject, err)
+	}
+	for header, want := range map[string]string{
+		"From":         `"Messenger" <noreply@example.com>`,
+		"To":           "<alice@example.com>",
+		"Content-Type": "text/plain; charset=utf-8",
+	} {
+		if got := msg.Header.Get(header); got != want {
+			t.Errorf("%s %q, want %q", header, got, want)
+		}
+	}
+	if id := msg.Header.Get("Message-ID"); !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("Message-ID %q", id)
+	}
+	body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The dot reader turns line ends back into \n
+	if want := "Ссылка:\nhttps://example.com/reset?token=abc\n"; string(body) != want {
+		t.Errorf("body %q, want %q", body, want)
+	}
+}
+
+func TestSMTPNotifierRejectedRecipient(t *testing.T) {
+	port, sessions := fakeSMTP(t, true)
+	n, err := NewSMTPNotifier(SMTPConfig{Host: "127.0.0.1", Port: port, From: "noreply@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = n.Send(context.Background(), Message{To: "nobody@example.com", Subject: "s", Body: "b"})
+	if err == nil || !strings.Contains(err.Error(), "550") {
+		t.Fatalf("Send to a rejected recipient: %v, want the 550", err)
+	}
+	if s := <-sessions; s.auth != "" || s.data != "" {
+		t.Errorf("session without credentials, to a rejected recipient: %+v", s)
+	}
+}
+
+func TestNewSMTPNotifierConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  SMTPConfig
+	}{
+		{"no host", SMTPConfig{Port: 587, From: "noreply@example.com"}},
+		{"no port", SMTPConfig{Host: "smtp.example.com", From: "noreply@example.com"}},
+		{"bad from", SMTPConfig{Host: "smtp.example.com", Port: 587, From: "not an address"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewSMTPNotifier(tt.cfg); err == nil {
+				t.Errorf("NewSMTPNotifier(%+v) succeeded", tt.cfg)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+// Package permissions resolves what a member may do inside a group or a
+// server. Every member holds one named role; a role carries a bitset of
+// permissions and a position that ranks it against other roles of the same
+// group or server. The owner, admin and member roles are built in. Groups and
+// servers can override the permissions of admin and member and define
+// custom roles in the roles table.
+package permissions
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+
+	"github.com/kvant/messenger/internal/conversation"
+	"github.com/kvant/messenger/internal/store"
+)
+
+// Permission is a bitset of actions a role allows
+type Permission int64
+
+const (
+	SendMessages Permission = 1 << iota
+	AttachFiles
+	AddReactions
+	PinMessages
+	// DeleteMessages allows deleting messages of other members for everyone
+	DeleteMessages
+	// ManageMembers allows adding and removing members and changing their nicknames
+	ManageMembers
+	// ManageRoles allows creating roles and assigning them to members
+	ManageRoles
+	// ManageSettings allows editing the name, description and images
+	ManageSettings
+	// ManageChannels allows creating, editing and deleting server categories and channels
+	ManageChannels
+	// Administrator implies every other permission
+	Administrator
+)
+
+// All is every permission defined above
+const All = Administrator<<1 - 1
+
+// Names maps permission names used in the API to their bits
+var Names = map[string]Permission{
+	"send_messages":   SendMessages,
+	"attach_files":    AttachFiles,
+	"add_reactions":   AddReactions,
+	"pin_messages":    PinMessages,
+	"delete_messages": DeleteMessages,
+	"manage_members":  ManageMembers,
+	"manage_roles":    ManageRoles,
+	"manage_settings": ManageSettings,
+	"manage_channels": ManageChannels,
+	"administrator":   Administrator,
+}
+
+// Has reports whether p grants q. Administrator grants everything.
+func (p Permission) Has(q Permission) bool {
+	return p&Administrator != 0 || p&q == q
+}
+
+// Scope is the kind of container a role belongs to
+type Scope string
+
+const (
+	ScopeGroup  Scope = "group"
+	ScopeServer Scope = "server"
+)
+
+// Built-in role names, shared by groups and servers
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// Role is a named permission set within a group or server
+type Role struct {
+	Name        string     `json:"name"`
+	Permissions Permission `json:"permissions"`
+	// Position ranks roles: members can only manage members and roles below their own
+	Position int  `json:"position"`
+	BuiltIn  bool `json:"built_in"`
+}
+
+// OwnerPosition ranks the owner above any role
+const OwnerPosition = 1 << 30
+
+var builtIn = map[string]Role{
+	RoleOwner: {Name: RoleOwner, Permissions: All, Position: OwnerPosition, BuiltIn: true},
+	RoleAdmin: {Name: RoleAdmin, Position: 100, BuiltIn: true, Permissions: SendMessages | AttachFiles | AddReactions |
+		PinMessages | DeleteMessages | ManageMembers | ManageSettings | ManageChannels},
+	RoleMember: {Name: RoleMember, Position: 0, BuiltIn: true, Permissions: SendMessages | AttachFiles | AddReactions},
+}
+
+// IsBuiltIn reports whether name is one of the built-in roles
+func IsBuiltIn(name string) bool {
+	_, ok := builtIn[name]
+	return ok
+}
+
+// GetRole returns the role named name in the group or server, or nil if there is none.
+// A stored row overrides the defaults of a built-in role; the owner role cannot be overridden.
+func GetRole(db *sql.DB, scope Scope, scopeID, name string) (*Role, error) {
+	role, isBuiltIn := builtIn[name]
+	if name == RoleOwner {
+		return &role, nil
+	}
+
+	stored, err := store.New(db).Roles.Get(context.Background(), string(scope), scopeID, name)
+	if err == store.ErrNotFound {
+		if isBuiltIn {
+			return &role, nil
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Role{Name: name, Permissions: Permission(stored.Permissions), Position: stored.Position, BuiltIn: isBuiltIn}, nil
+}
+
+// ListRoles returns every role of the group or server, highest position first
+func ListRoles(db *sql.DB, scope Scope, scopeID string) ([]Role, error) {
+	rows, err := store.New(db).Roles.List(context.Background(), string(scope), scopeID)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := make(map[string]Role, len(rows))
+	for _, row := range rows {
+		stored[row.Name] = Role{Name: row.Name, Permissions: Permission(row.Permissions), Position: row.Position, BuiltIn: IsBuiltIn(row.Name)}
+	}
+
+	roles := []Role{builtIn[RoleOwner]}
+	for _, name := range []string{RoleAdmin, RoleMember} {
+		if role, ok := stored[name]; ok {
+			roles = append(roles, role)
+			delete(stored, name)
+		} else {
+			roles = append(roles, builtIn[name])
+		}
+	}
+	for _, role := range stored {
+		roles = append(roles, role)
+	}
+
+	sort.SliceStable(roles, func(i, j int) bool {
+		if roles[i].Position != roles[j].Position {
+			return roles[i].Position > roles[j].Position
+		}
+		return roles[i].Name < roles[j].Name
+	})
+	return roles, nil
+}
+
+// Member is a resolved membership: the role a user holds and what it allows
+type Member struct {
+	UserID string
+	Role   Role
+}
+
+// Can reports whether the member has the permission
+func (m *Member) Can(p Permission) bool {
+	return m.Role.Permissions.Has(p)
+}
+
+// IsOwner reports whether the member owns the group or server
+func (m *Member) IsOwner() bool {
+	return m.Role.Name == RoleOwner
+}
+
+// Outranks reports whether the member may manage a member or role at the given position
+func (m *Member) Outranks(position int) bool {
+	return m.IsOwner() || m.Role.Position > position
+}
+
+// Resolve returns the membership of the user in the group or server, or nil if
+// the user is not a member. A role that no longer exists resolves to member.
+func Resolve(db *sql.DB, scope Scope, scopeID, userID string) (*Member, error) {
+	stores := store.New(db)
+	var roleName string
+	var err error
+	if scope == ScopeGroup {
+		roleName, err = stores.Groups.Role(context.Background(), scopeID, userID)
+	} else {
+		roleName, err = stores.Servers.Role(context.Background(), scopeID, userID)
+	}
+	if err == store.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	role, err := GetRole(db, scope, scopeID, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		role, err = GetRole(db, scope, scopeID, RoleMember)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Member{UserID: userID, Role: *role}, nil
+}
+
+// ForMessage returns the membership of the user in the group or server the
+// message was posted in. It returns nil for direct messages and broadcast channel
+// posts, which have no roles, and for users that are not members.
+func ForMessage(db *sql.DB, msg *conversation.Message, userID string) (*Member, error) {
+	switch msg.Type() {
+	case conversation.TypeGroup:
+		return Resolve(db, ScopeGroup, *msg.GroupID, userID)
+	case conversation.TypeServerChannel:
+		return forServerChannel(db, *msg.ServerChannelID, userID)
+	}
+	return nil, nil
+}
+
+// ForTarget returns the membership of the user in the group or server a new
+// message is sent to. It returns nil for direct messages, channel posts and
+// users that are not members.
+func ForTarget(db *sql.DB, target conversation.Target, userID string) (*Member, error) {
+	if target.GroupID != "" {
+		return Resolve(db, ScopeGroup, target.GroupID, userID)
+	}
+	if target.ServerChannelID != "" {
+		return forServerChannel(db, target.ServerChannelID, userID)
+	}
+	return nil, nil
+}
+
+func forServerChannel(db *sql.DB, serverChannelID, userID string) (*Member, error) {
+	serverID, err := store.New(db).Servers.ChannelServer(context.Background(), serverChannelID)
+	if err == store.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return Resolve(db, ScopeServer, serverID, userID)
+}
@@ -0,0 +1,194 @@
+// Package ratelimit throttles requests with token buckets and locks out keys,
+// such as accounts, that keep failing, for longer after every failure. The
+// state lives in a Store; MemoryStore keeps it in the process, so replicas
+// of the server each count on their own.
+package ratelimit
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// storeErrors counts the calls to a Store that failed. Callers let requests
+// through when the store fails, so a rising count means limits are not
+// being applied. It is published as the expvar ratelimit_store_errors.
+var storeErrors = expvar.NewInt("ratelimit_store_errors")
+
+// StoreErrors returns how many calls to a Store have failed since the start
+func StoreErrors() int64 {
+	return storeErrors.Value()
+}
+
+// storeFailed counts err if it is one and names the limiter it came from
+func storeFailed(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	storeErrors.Add(1)
+	return fmt.Errorf("ratelimit %s: %w", name, err)
+}
+
+// Limit is a token bucket: Burst requests at once, then one every Every. The
+// zero Limit lets everything through.
+type Limit struct {
+	Burst int
+	Every time.Duration
+}
+
+// Unlimited reports whether the limit lets everything through
+func (l Limit) Unlimited() bool {
+	return l.Burst <= 0 || l.Every <= 0
+}
+
+// ParseLimit reads a limit written as "N/period", such as "10/1m": N requests
+// at once and N every period after that. "off" turns limiting off.
+func ParseLimit(s string) (Limit, error) {
+	if s == "off" {
+		return Limit{}, nil
+	}
+	count, period, ok := strings.Cut(s, "/")
+	n, err := strconv.Atoi(count)
+	if !ok || err != nil || n <= 0 {
+		return Limit{}, fmt.Errorf("ratelimit: invalid limit %q", s)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("ratelimit: invalid limit %q", s)
+	}
+	return Limit{Burst: n, Every: d / time.Duration(n)}, nil
+}
+
+// LimitFromEnv reads a limit from the environment variable env, falling back
+// to fallback when it is not set
+func LimitFromEnv(env, fallback string) (Limit, error) {
+	s := os.Getenv(env)
+	if s == "" {
+		s = fallback
+	}
+	limit, err := ParseLimit(s)
+	if err != nil {
+		return Limit{}, fmt.Errorf("%s: %w", env, err)
+	}
+	return limit, nil
+}
+
+// Failures counts the failures of a key in a row
+type Failures struct {
+	Count int
+	Last  time.Time
+}
+
+// Store keeps token buckets and failure counts under opaque keys. Each
+// method must be atomic, as requests for the same key race.
+type Store interface {
+	// Take spends a token of the bucket at key. When the bucket is empty it
+	// spends nothing and returns how long until the next token.
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (time.Duration, error)
+	// Fail counts a failure at key. Failures older than forget are dropped
+	// first, so that a key starts over after a quiet spell.
+	Fail(ctx context.Context, key string, now time.Time, forget time.Duration) (Failures, error)
+	// Failures returns the failures counted at key, none once they are older than forget
+	Failures(ctx context.Context, key string, now time.Time, forget time.Duration) (Failures, error)
+	// Reset drops the failures at key
+	Reset(ctx context.Context, key string) error
+}
+
+// Limiter applies a Limit to the keys of one kind of request
+type Limiter struct {
+	store Store
+	name  string
+	limit Limit
+}
+
+// NewLimiter returns a limiter whose keys are kept in store under name, which
+// must differ between limiters sharing a store
+func NewLimiter(store Store, name string, limit Limit) *Limiter {
+	return &Limiter{store: store, name: name, limit: limit}
+}
+
+// Allow spends a request of key. When key has none left it returns how long
+// to wait for the next one.
+func (l *Limiter) Allow(ctx context.Context, key string) (bool, time.Duration, error) {
+	if l.limit.Unlimited() {
+		return true, 0, nil
+	}
+	wait, err := l.store.Take(ctx, l.name+":"+key, l.limit, time.Now())
+	if err != nil {
+		return false, 0, storeFailed(l.name, err)
+	}
+	return wait == 0, wait, nil
+}
+
+// Lockout locks out a key after a number of failures in a row, at first for
+// a base time and twice as long with each further failure, up to a maximum.
+// Failing while locked out is not possible: callers check first.
+type Lockout struct {
+	store Store
+	name  string
+	free  int
+	base  time.Duration
+	max   time.Duration
+}
+
+// NewLockout returns a lockout that lets a key fail free times in a row
+// before locking it out for base, and doubles that up to max. Its keys are
+// kept in store under name.
+func NewLockout(store Store, name string, free int, base, max time.Duration) *Lockout {
+	return &Lockout{store: store, name: name, free: free, base: base, max: max}
+}
+
+// Check returns how much longer key is locked out
+func (l *Lockout) Check(ctx context.Context, key string) (time.Duration, error) {
+	now := time.Now()
+	failures, err := l.store.Failures(ctx, l.name+":"+key, now, l.forget())
+	if err != nil {
+		return 0, storeFailed(l.name, err)
+	}
+	return l.remaining(failures, now), nil
+}
+
+// Fail counts a failure of key and returns how long it is locked out for
+func (l *Lockout) Fail(ctx context.Context, key string) (time.Duration, error) {
+	now := time.Now()
+	failures, err := l.store.Fail(ctx, l.name+":"+key, now, l.forget())
+	if err != nil {
+		return 0, storeFailed(l.name, err)
+	}
+	return l.remaining(failures, now), nil
+}
+
+// Reset forgets the failures of key, after it succeeds
+func (l *Lockout) Reset(ctx context.Context, key string) error {
+	return storeFailed(l.name, l.store.Reset(ctx, l.name+":"+key))
+}
+
+func (l *Lockout) remaining(failures Failures, now time.Time) time.Duration {
+	if failures.Count <= l.free {
+		return 0
+	}
+	delay := l.base
+	for i := l.free + 1; i < failures.Count && delay < l.max; i++ {
+		delay *= 2
+	}
+	if delay > l.max {
+		delay = l.max
+	}
+	if remaining := failures.Last.Add(delay).Sub(now); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// forget is how long failures are remembered: a day, or the longest lockout
+// when that is longer
+func (l *Lockout) forget() time.Duration {
+	if l.max > 24*time.Hour {
+		return l.max
+	}
+	return 24 * time.Hour
+}
@@ -0,0 +1,181 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Limit
+		wantErr bool
+	}{
+		{"10/1m", Limit{Burst: 10, Every: 6 * time.Second}, false},
+		{"5/1h", Limit{Burst: 5, Every: 12 * time.Minute}, false},
+		{"1/1s", Limit{Burst: 1, Every: time.Second}, false},
+		{"off", Limit{}, false},
+		{"", Limit{}, true},
+		{"10", Limit{}, true},
+		{"0/1m", Limit{}, true},
+		{"-1/1m", Limit{}, true},
+		{"10/0s", Limit{}, true},
+		{"10/soon", Limit{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLimit(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseLimit(%q) = %+v, %v; want %+v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestMemoryStoreTake(t *testing.T) {
+	limit := Limit{Burst: 2, Every: 10 * time.Second}
+	start := time.Now()
+
+	// Each step takes a token at start+at and expects to wait that long
+	tests := []struct {
+		name string
+		at   time.Duration
+		wait time.Duration
+	}{
+		{"first of the burst", 0, 0},
+		{"second of the burst", 0, 0},
+		{"bucket empty", 0, 10 * time.Second},
+		{"half a token in", 5 * time.Second, 5 * time.Second},
+		{"refilled one", 10 * time.Second, 0},
+		{"empty again", 10 * time.Second, 10 * time.Second},
+		{"refilled to the burst", time.Hour, 0},
+		{"burst, not more", time.Hour, 0},
+		{"empty after the burst", time.Hour, 10 * time.Second},
+	}
+	s := NewMemoryStore()
+	for _, tt := range tests {
+		wait, err := s.Take(context.Background(), "key", limit, start.Add(tt.at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait != tt.wait {
+			t.Errorf("%s: waited %v, want %v", tt.name, wait, tt.wait)
+		}
+	}
+
+	// Keys do not share buckets
+	if wait, _ := s.Take(context.Background(), "other", limit, start.Add(time.Hour)); wait != 0 {
+		t.Errorf("another key waited %v", wait)
+	}
+}
+
+func TestLockoutRemaining(t *testing.T) {
+	l := NewLockout(nil, "test", 3, time.Minute, 10*time.Minute)
+	now := time.Now()
+
+	tests := []struct {
+		failures int
+		ago      time.Duration
+		want     time.Duration
+	}{
+		{0, 0, 0},
+		{3, 0, 0},
+		{4, 0, time.Minute},
+		{5, 0, 2 * time.Minute},
+		{6, 0, 4 * time.Minute},
+		{7, 0, 8 * time.Minute},
+		// Doubling stops at the maximum
+		{8, 0, 10 * time.Minute},
+		{50, 0, 10 * time.Minute},
+		// Time served counts
+		{5, 30 * time.Second, 90 * time.Second},
+		{5, 2 * time.Minute, 0},
+		{50, time.Hour, 0},
+	}
+	for _, tt := range tests {
+		got := l.remaining(Failures{Count: tt.failures, Last: now.Add(-tt.ago)}, now)
+		if got != tt.want {
+			t.Errorf("%d failures %v ago: locked out for %v, want %v", tt.failures, tt.ago, got, tt.want)
+		}
+	}
+}
+
+func TestLockout(t *testing.T) {
+	ctx := context.Background()
+	l := NewLockout(NewMemoryStore(), "test", 2, time.Minute, time.Hour)
+
+	for i, want := range []bool{false, false, true, true} {
+		wait, err := l.Fail(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locked := wait > 0; locked != want {
+			t.Errorf("failure %d: locked out %v, want %v", i+1, locked, want)
+		}
+	}
+	if wait, err := l.Check(ctx, "alice"); err != nil || wait <= time.Minute {
+		t.Errorf("after 4 failures locked out for %v (%v), want more than a minute", wait, err)
+	}
+	if wait, err := l.Check(ctx, "bob"); err != nil || wait != 0 {
+		t.Errorf("another key locked out for %v (%v)", wait, err)
+	}
+
+	if err := l.Reset(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if wait, err := l.Check(ctx, "alice"); err != nil || wait != 0 {
+		t.Errorf("after a reset locked out for %v (%v)", wait, err)
+	}
+}
+
+// brokenStore fails every call
+type brokenStore struct{}
+
+var errBroken = errors.New("store is down")
+
+func (brokenStore) Take(context.Context, string, Limit, time.Time) (time.Duration, error) {
+	return 0, errBroken
+}
+
+func (brokenStore) Fail(context.Context, string, time.Time, time.Duration) (Failures, error) {
+	return Failures{}, errBroken
+}
+
+func (brokenStore) Failures(context.Context, string, time.Time, time.Duration) (Failures, error) {
+	return Failures{}, errBroken
+}
+
+func (brokenStore) Reset(context.Context, string) error {
+	return errBroken
+}
+
+func TestStoreErrorsCounted(t *testing.T) {
+	ctx := context.Background()
+	before := StoreErrors()
+
+	limiter := NewLimiter(brokenStore{}, "test", Limit{Burst: 1, Every: time.Second})
+	if _, _, err := limiter.Allow(ctx, "key"); !errors.Is(err, errBroken) {
+		t.Errorf("Allow: %v, want the store error", err)
+	}
+	lockout := NewLockout(brokenStore{}, "test", 1, time.Minute, time.Hour)
+	if _, err := lockout.Check(ctx, "key"); !errors.Is(err, errBroken) {
+		t.Errorf("Check: %v, want the store error", err)
+	}
+	if _, err := lockout.Fail(ctx, "key"); !errors.Is(err, errBroken) {
+		t.Errorf("Fail: %v, want the store error", err)
+	}
+	if err := lockout.Reset(ctx, "key"); !errors.Is(err, errBroken) {
+		t.Errorf("Reset: %v, want the store error", err)
+	}
+	if got := StoreErrors() - before; got != 4 {
+		t.Errorf("counted %d store errors, want 4", got)
+	}
+
+	// Unlimited limiters never reach the store
+	if ok, _, err := NewLimiter(brokenStore{}, "off", Limit{}).Allow(ctx, "key"); !ok || err != nil {
+		t.Errorf("unlimited Allow = %v, %v", ok, err)
+	}
+	if got := StoreErrors() - before; got != 4 {
+		t.Errorf("counted %d store errors after an unlimited check, want 4", got)
+	}
+}
@@ -0,0 +1,283 @@
+package scheduler
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/kvant/messenger/internal/conversation"
+	"github.com/kvant/messenger/internal/permissions"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// ownedChat is a group, channel or server of a deleted account, which goes
+// with it, and the members to tell
+type ownedChat struct {
+	table   string
+	event   string
+	idField string
+	scope   permissions.Scope
+	id      string
+	members []string
+}
+
+// reapAccounts purges the accounts whose deletion grace period is over
+func (r *Reaper) reapAccounts() {
+	for {
+		ids, err := r.users.DeletionsDue(context.Background(), time.Now(), reapBatch)
+		if err != nil {
+			log.Printf("Failed to load accounts to delete: %v", err)
+			return
+		}
+
+		for _, id := range ids {
+			if err := r.purgeAccount(id); err != nil {
+				log.Printf("Failed to delete account %s: %v", id, err)
+				return
+			}
+			log.Printf("Deleted account %s", id)
+		}
+		if len(ids) < reapBatch {
+			return
+		}
+	}
+}
+
+// purgeAccount deletes the personal data of a user. The users row stays as
+// an anonymous tombstone, so that the messages they left in the chats of
+// others keep a sender; their files go, and with them the messages that
+// carried them. The groups, channels and servers they own are deleted with
+// their messages and the files sent in them.
+func (r *Reaper) purgeAccount(userID string) error {
+	ctx := context.Background()
+
+	// Live connections close with the sessions; logging in again is no
+	// longer possible once the password is gone
+	revoked, err := r.sessions.RevokeOthers(ctx, userID, "")
+	for _, sessionID := range revoked {
+		r.hub.RevokeSession(userID, sessionID)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Only their own uploads are deleted: the file_url of a message may be
+	// any URL typed in as [image]url, or the file of a forward. files maps
+	// each URL to the user it may be deleted for.
+	files := make(map[string]string)
+	var avatarURL, bannerURL *string
+	err = r.db.QueryRow(utils.AdaptQuery(`
+		SELECT avatar_url, banner_url FROM users WHERE id = $1
+	`), userID).Scan(&avatarURL, &bannerURL)
+	if err != nil {
+		return err
+	}
+	for _, url := range []*string{avatarURL, bannerURL} {
+		if url != nil && *url != "" {
+			files[*url] = userID
+		}
+	}
+	uploads, err := r.attachments.ByUploader(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, upload := range uploads {
+		files[upload.URL] = userID
+		if upload.ThumbnailURL != nil {
+			files[*upload.ThumbnailURL] = userID
+		}
+	}
+	spooled, err := r.queryStrings(`SELECT id FROM uploads WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	var owned []ownedChat
+	for _, kind := range []struct {
+		table, event, idField string
+		scope                 permissions.Scope
+		members               func(*sql.DB, string) ([]string, error)
+		// messages selects the messages of the chat $1
+		messages string
+	}{
+		{"groups", "group_deleted", "group_id", permissions.ScopeGroup, conversation.GroupMemberIDs,
+			`group_id = $1`},
+		{"channels", "channel_deleted", "channel_id", "", conversation.ChannelSubscriberIDs,
+			`channel_id = $1`},
+		{"servers", "server_deleted", "server_id", permissions.ScopeServer, conversation.ServerMemberIDs,
+			`server_channel_id IN (SELECT id FROM server_channels WHERE server_id = $1)`},
+	} {
+		ids, err := r.queryStrings(`SELECT id FROM `+kind.table+` WHERE owner_id = $1`, userID)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			members, err := kind.members(r.db, id)
+			if err != nil {
+				return err
+			}
+			owned = append(owned, ownedChat{kind.table, kind.event, kind.idField, kind.scope, id, members})
+
+			// The cascade takes the messages of other members with the
+			// chat, so their files are collected before it
+			if err := r.chatFiles(kind.messages, id, files); err != nil {
+				return err
+			}
+		}
+	}
+
+	tombstone, err := tombstoneName()
+	if err != nil {
+		return err
+	}
+	at := utils.DBTime(time.Now())
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, chat := range owned {
+		if _, err := tx.Exec(utils.AdaptQuery(`DELETE FROM `+chat.table+` WHERE id = $1`), chat.id); err != nil {
+			return err
+		}
+		if chat.scope != "" {
+			if _, err := tx.Exec(utils.AdaptQuery(`
+				DELETE FROM roles WHERE scope_type = $1 AND scope_id = $2
+			`), string(chat.scope), chat.id); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Messages that carried files of the user are deleted for everyone like
+	// any other, the rest of their messages stay under the tombstone
+	if _, err := tx.Exec(utils.AdaptQuery(`
+		UPDATE messages SET deleted_at = COALESCE(deleted_at, $1), text = '[deleted]', file_url = NULL
+		WHERE sender_id = $2
+		  AND (file_url IS NOT NULL OR id IN (SELECT message_id FROM attachments WHERE uploader_id = $2))
+	`), at, userID); err != nil {
+		return err
+	}
+	for _, query := range []string{
+		`DELETE FROM attachments WHERE uploader_id = $1`,
+		`DELETE FROM uploads WHERE user_id = $1`,
+		`DELETE FROM reactions WHERE user_id = $1`,
+		`DELETE FROM message_deletions WHERE user_id = $1`,
+		`DELETE FROM scheduled_messages WHERE sender_id = $1 OR receiver_id = $1`,
+		`DELETE FROM group_members WHERE user_id = $1`,
+		`DELETE FROM channel_subscribers WHERE user_id = $1`,
+		`DELETE FROM server_members WHERE user_id = $1`,
+		`DELETE FROM user_blocks WHERE blocker_id = $1 OR blocked_id = $1`,
+		`DELETE FROM sessions WHERE user_id = $1`,
+		`DELETE FROM recovery_codes WHERE user_id = $1`,
+		`DELETE FROM two_factor WHERE user_id = $1`,
+		`DELETE FROM password_resets WHERE user_id = $1`,
+		`DELETE FROM user_events WHERE user_id = $1`,
+		`DELETE FROM user_event_seqs WHERE user_id = $1`,
+	} {
+		if _, err := tx.Exec(utils.AdaptQuery(query), userID); err != nil {
+			return err
+		}
+	}
+	// An empty password hash matches no password
+	result, err := tx.Exec(utils.AdaptQuery(`
+		UPDATE users
+		SET username = $1, password_hash = '', email = NULL, display_name = NULL, bio = NULL,
+		    avatar_url = NULL, banner_url = NULL, avatar_blurhash = NULL, banner_blurhash = NULL,
+		    name_color = NULL, is_premium = $2, premium_until = NULL, hide_online = $3,
+		    deletion_scheduled_at = NULL, deleted_at = $4, updated_at = $4
+		WHERE id = $5 AND deletion_scheduled_at IS NOT NULL
+	`), tombstone, false, true, at, userID)
+	if err != nil {
+		return err
+	}
+	// The user logged in again since the deletion was loaded, cancelling it
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for url, ownerID := range files {
+		r.deleteFile(url, ownerID)
+	}
+	for _, id := range spooled {
+		if err := r.spool.Remove(id); err != nil {
+			log.Printf("Failed to remove upload file %s: %v", id, err)
+		}
+	}
+	for _, chat := range owned {
+		r.hub.SendToUsers(chat.members, map[string]interface{}{
+			"type": chat.event,
+			"data": map[string]interface{}{
+				chat.idField: chat.id,
+			},
+		})
+	}
+	return nil
+}
+
+// chatFiles adds the files sent in the messages a condition selects to files,
+// each for its sender
+func (r *Reaper) chatFiles(messages, chatID string, files map[string]string) error {
+	rows, err := r.db.Query(utils.AdaptQuery(`
+		SELECT a.url, a.thumbnail_url, a.uploader_id
+		FROM attachments a JOIN messages m ON m.id = a.message_id
+		WHERE m.`+messages+`
+		UNION ALL
+		SELECT file_url, NULL, sender_id FROM messages
+		WHERE `+messages+` AND file_url IS NOT NULL
+	`), chatID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var url, ownerID string
+		var thumbnailURL *string
+		if err := rows.Scan(&url, &thumbnailURL, &ownerID); err != nil {
+			return err
+		}
+		files[url] = ownerID
+		if thumbnailURL != nil {
+			files[*thumbnailURL] = ownerID
+		}
+	}
+	return rows.Err()
+}
+
+// tombstoneName is the username of a deleted account, which no
+// registration can take since usernames are at most 20 characters long
+func tombstoneName() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return "deleted-" + hex.EncodeToString(b[:]), nil
+}
+
+// queryStrings returns the single column of the rows of a query
+func (r *Reaper) queryStrings(query string, args ...interface{}) ([]string, error) {
+	rows, err := r.db.Query(utils.AdaptQuery(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
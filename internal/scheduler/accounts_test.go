@@ -0,0 +1,133 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kvant/messenger/internal/database"
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/storage"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/internal/websocket"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// newTestDB returns a migrated SQLite database that lives as long as the test
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	t.Setenv("USE_SQLITE", "true")
+	t.Setenv("SQLITE_DB_PATH", filepath.Join(t.TempDir(), "scheduler.db"))
+
+	db, err := database.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.MigrateUp(db); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	return db
+}
+
+func TestPurgeAccountDeletesFilesOfOwnedChats(t *testing.T) {
+	db := newTestDB(t)
+	stores := store.New(db)
+	ctx := context.Background()
+	blobs, err := storage.NewLocalStore(t.TempDir(), "/uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool, err := storage.NewSpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReaper(db, websocket.NewHub(nil, nil, nil), blobs, spool, time.Hour)
+
+	newUser := func(prefix string) *models.User {
+		t.Helper()
+		user, err := stores.Users.Create(ctx, prefix+utils.GenerateUUID()[:8], "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+	owner, member, outsider := newUser("owner"), newUser("member"), newUser("outsider")
+
+	put := func(userID string) string {
+		t.Helper()
+		url, err := blobs.Put(ctx, storage.NewKey(storage.FolderAttachments, userID, ".txt"), strings.NewReader("file"), 4, "text/plain")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return url
+	}
+	send := func(msg *models.Message) {
+		t.Helper()
+		if err := stores.Messages.Create(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(url string) bool {
+		f, err := blobs.Open(ctx, url)
+		if err != nil {
+			return false
+		}
+		f.Close()
+		return true
+	}
+
+	group := &models.Group{Name: "Owned", OwnerID: owner.ID}
+	if err := stores.Groups.Create(ctx, group, []string{member.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A member sends an attachment and a file in the group of the owner
+	attached := put(member.ID)
+	attachment := &models.Attachment{UploaderID: member.ID, URL: attached, Filename: "a.txt", MimeType: "text/plain",
+		Kind: "document", Size: 4, Checksum: "aa"}
+	if err := stores.Attachments.Create(ctx, attachment); err != nil {
+		t.Fatal(err)
+	}
+	send(&models.Message{SenderID: member.ID, GroupID: &group.ID, Attachments: []models.Attachment{{ID: attachment.ID}}})
+	sent := put(member.ID)
+	send(&models.Message{SenderID: member.ID, GroupID: &group.ID, MessageType: "file", FileURL: &sent})
+
+	// A file that is also forwarded elsewhere outlives the group
+	forwarded := put(member.ID)
+	send(&models.Message{SenderID: member.ID, GroupID: &group.ID, MessageType: "file", FileURL: &forwarded})
+	send(&models.Message{SenderID: member.ID, ReceiverID: &outsider.ID, MessageType: "file", FileURL: &forwarded})
+
+	avatar := put(owner.ID)
+	if err := stores.Users.SetAvatar(ctx, owner.ID, avatar, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stores.Users.ScheduleDeletion(ctx, owner.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.purgeAccount(owner.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := stores.Groups.Get(ctx, group.ID, member.ID); err != store.ErrNotFound {
+		t.Errorf("group of a deleted account: %v, want ErrNotFound", err)
+	}
+	for _, tt := range []struct {
+		name string
+		url  string
+		kept bool
+	}{
+		{"attachment sent in the group", attached, false},
+		{"file sent in the group", sent, false},
+		{"file forwarded out of the group", forwarded, true},
+		{"avatar of the account", avatar, false},
+	} {
+		if exists(tt.url) != tt.kept {
+			t.Errorf("%s: kept %v, want %v", tt.name, !tt.kept, tt.kept)
+		}
+	}
+}
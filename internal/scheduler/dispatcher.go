@@ -0,0 +1,156 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/kvant/messenger/internal/conversation"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/internal/websocket"
+)
+
+const (
+	// dispatchBatch is the most due messages loaded at once
+	dispatchBatch = 100
+	// claimTimeout is how long a claimed message may take to send before it
+	// is assumed its server process died and another one retries it
+	claimTimeout = time.Minute
+)
+
+// Dispatcher sends scheduled messages when they are due. The queue lives in
+// the database, so pending messages survive restarts, and every server
+// process can run a dispatcher: each message is claimed by exactly one.
+type Dispatcher struct {
+	db        *sql.DB
+	scheduled store.ScheduledMessageStore
+	hub       *websocket.Hub
+	interval  time.Duration
+}
+
+func NewDispatcher(db *sql.DB, hub *websocket.Hub, interval time.Duration) *Dispatcher {
+	return &Dispatcher{db: db, scheduled: store.New(db).Scheduled, hub: hub, interval: interval}
+}
+
+// Run sends due messages every interval
+func (d *Dispatcher) Run() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		d.dispatch()
+		<-ticker.C
+	}
+}
+
+// dispatch sends every message whose time has come
+func (d *Dispatcher) dispatch() {
+	ctx := context.Background()
+	now := time.Now()
+
+	// Messages claimed by a process that died before sending them are retried.
+	// Sending is idempotent, so a retry of a message that was stored is not sent twice.
+	if err := d.scheduled.Release(ctx, now.Add(-claimTimeout)); err != nil {
+		log.Printf("Failed to release stale scheduled messages: %v", err)
+	}
+
+	for {
+		ids, err := d.scheduled.Due(ctx, now, dispatchBatch)
+		if err != nil {
+			log.Printf("Failed to load due scheduled messages: %v", err)
+			return
+		}
+
+		for _, id := range ids {
+			d.send(ctx, id)
+		}
+		if len(ids) < dispatchBatch {
+			return
+		}
+	}
+}
+
+// send claims a scheduled message and sends it like a live send_message
+func (d *Dispatcher) send(ctx context.Context, id string) {
+	claimed, err := d.scheduled.Claim(ctx, id)
+	if err != nil {
+		log.Printf("Failed to claim scheduled message %s: %v", id, err)
+		return
+	}
+	// Cancelled, edited into the future or claimed by another process meanwhile
+	if !claimed {
+		return
+	}
+
+	msg, err := d.scheduled.Get(ctx, id)
+	if err != nil {
+		log.Printf("Failed to load scheduled message %s: %v", id, err)
+		return
+	}
+
+	out := websocket.Outgoing{
+		SenderID: msg.SenderID,
+		Target: conversation.Target{
+			ReceiverID:      deref(msg.ReceiverID),
+			GroupID:         deref(msg.GroupID),
+			ServerChannelID: deref(msg.ServerChannelID),
+		},
+		Text:      msg.Text,
+		ReplyToID: msg.ReplyToID,
+		// Makes a retry after a crash find the stored message instead of sending it again
+		ClientMessageID:       "scheduled:" + id,
+		SelfDestructAfterRead: msg.SelfDestructAfterRead,
+	}
+	if msg.SelfDestructIn != nil {
+		out.SelfDestructIn = *msg.SelfDestructIn
+	}
+
+	sent, err := websocket.SendMessage(d.db, d.hub, out, nil)
+	if err != nil {
+		d.fail(ctx, id, msg.SenderID, err.(*websocket.SendError))
+		return
+	}
+
+	if err := d.scheduled.Delete(ctx, id); err != nil {
+		log.Printf("Failed to remove sent scheduled message %s: %v", id, err)
+	}
+
+	d.hub.SendToUser(msg.SenderID, map[string]interface{}{
+		"type": "scheduled_message_sent",
+		"data": map[string]interface{}{
+			"id":         id,
+			"message_id": sent.ID,
+		},
+	})
+}
+
+// fail marks a message that cannot be sent, e.g. because the sender left the
+// group. Internal errors put it back in the queue to be retried instead.
+func (d *Dispatcher) fail(ctx context.Context, id, senderID string, sendErr *websocket.SendError) {
+	if sendErr.Code == "internal" {
+		if err := d.scheduled.Requeue(ctx, id); err != nil {
+			log.Printf("Failed to requeue scheduled message %s: %v", id, err)
+		}
+		return
+	}
+
+	if err := d.scheduled.Fail(ctx, id, sendErr.Message); err != nil {
+		log.Printf("Failed to mark scheduled message %s as failed: %v", id, err)
+	}
+
+	d.hub.SendToUser(senderID, map[string]interface{}{
+		"type": "scheduled_message_failed",
+		"data": map[string]interface{}{
+			"id":    id,
+			"error": sendErr.Message,
+		},
+	})
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,265 @@
+// Package scheduler runs the background jobs of the server
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/kvant/messenger/internal/conversation"
+	"github.com/kvant/messenger/internal/storage"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/internal/websocket"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// reapBatch is the most expired messages or unsent uploads loaded at once
+const reapBatch = 100
+
+// unsentTTL is how long an upload is kept for a message to be sent with it
+const unsentTTL = 24 * time.Hour
+
+// Reaper deletes self-destructing messages once their timer runs out,
+// uploads that were never sent, resumable uploads that were abandoned,
+// sessions that ended, password reset tokens that were used or expired and
+// accounts whose deletion is due
+type Reaper struct {
+	db          *sql.DB
+	hub         *websocket.Hub
+	users       store.UserStore
+	attachments store.AttachmentStore
+	uploads     store.UploadStore
+	sessions    store.SessionStore
+	resets      store.PasswordResetStore
+	blobs       storage.BlobStore
+	spool       *storage.Spool
+	interval    time.Duration
+}
+
+func NewReaper(db *sql.DB, hub *websocket.Hub, blobs storage.BlobStore, spool *storage.Spool, interval time.Duration) *Reaper {
+	stores := store.New(db)
+	return &Reaper{db: db, hub: hub, users: stores.Users, attachments: stores.Attachments, uploads: stores.Uploads, sessions: stores.Sessions, resets: stores.Resets, blobs: blobs, spool: spool, interval: interval}
+}
+
+// Run deletes expired messages, uploads, sessions, reset tokens and deleted
+// accounts every interval
+func (r *Reaper) Run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.reap()
+		r.reapUnsent()
+		r.reapUploads()
+		r.reapSessions()
+		r.reapResets()
+		r.reapAccounts()
+	}
+}
+
+type expiredMessage struct {
+	conversation.Message
+	fileURL *string
+}
+
+// reap deletes every message whose self-destruct time has passed
+func (r *Reaper) reap() {
+	for {
+		rows, err := r.db.Query(utils.AdaptQuery(`
+			SELECT id, sender_id, receiver_id, group_id, channel_id, server_channel_id, file_url
+			FROM messages
+			WHERE self_destruct_at IS NOT NULL AND self_destruct_at <= $1
+			LIMIT $2
+		`), utils.DBTime(time.Now()), reapBatch)
+		if err != nil {
+			log.Printf("Failed to load expired messages: %v", err)
+			return
+		}
+
+		var expired []expiredMessage
+		for rows.Next() {
+			var msg expiredMessage
+			if err := rows.Scan(&msg.ID, &msg.SenderID, &msg.ReceiverID, &msg.GroupID, &msg.ChannelID,
+				&msg.ServerChannelID, &msg.fileURL); err != nil {
+				log.Printf("Failed to scan expired message: %v", err)
+				continue
+			}
+			expired = append(expired, msg)
+		}
+		rows.Close()
+
+		for _, msg := range expired {
+			if err := r.expire(msg); err != nil {
+				log.Printf("Failed to delete expired message %s: %v", msg.ID, err)
+				return
+			}
+		}
+		if len(expired) < reapBatch {
+			return
+		}
+	}
+}
+
+// expire hard-deletes a message with its reactions and files and tells the participants
+func (r *Reaper) expire(msg expiredMessage) error {
+	participants, err := conversation.Participants(r.db, &msg.Message)
+	if err != nil {
+		return err
+	}
+
+	// The attachments go with the message; their files are deleted after it
+	attachments, err := r.attachments.ForMessages(context.Background(), []string{msg.ID})
+	if err != nil {
+		return err
+	}
+	// files maps each URL to the user it has to be stored for to be deleted
+	files := make(map[string]string)
+	if msg.fileURL != nil {
+		files[*msg.fileURL] = msg.SenderID
+	}
+	for _, attachment := range attachments[msg.ID] {
+		files[attachment.URL] = attachment.UploaderID
+		if attachment.ThumbnailURL != nil {
+			files[*attachment.ThumbnailURL] = attachment.UploaderID
+		}
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		`DELETE FROM reactions WHERE message_id = $1`,
+		`DELETE FROM message_deletions WHERE message_id = $1`,
+	} {
+		if _, err := tx.Exec(utils.AdaptQuery(query), msg.ID); err != nil {
+			return err
+		}
+	}
+	result, err := tx.Exec(utils.AdaptQuery(`DELETE FROM messages WHERE id = $1`), msg.ID)
+	if err != nil {
+		return err
+	}
+	// Another server process may have deleted it first
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for url, ownerID := range files {
+		r.deleteFile(url, ownerID)
+	}
+
+	event := map[string]interface{}{
+		"id": msg.ID,
+	}
+	switch msg.Type() {
+	case conversation.TypeGroup:
+		event["group_id"] = *msg.GroupID
+	case conversation.TypeChannel:
+		event["channel_id"] = *msg.ChannelID
+	case conversation.TypeServerChannel:
+		event["server_channel_id"] = *msg.ServerChannelID
+	default:
+		event["sender_id"] = msg.SenderID
+		event["receiver_id"] = msg.ReceiverID
+	}
+	r.hub.SendToUsers(participants, map[string]interface{}{
+		"type": "message_expired",
+		"data": event,
+	})
+	return nil
+}
+
+// reapUnsent deletes uploads that were not sent with a message in time
+func (r *Reaper) reapUnsent() {
+	for {
+		unsent, err := r.attachments.Unsent(context.Background(), time.Now().Add(-unsentTTL), reapBatch)
+		if err != nil {
+			log.Printf("Failed to load unsent uploads: %v", err)
+			return
+		}
+
+		for _, attachment := range unsent {
+			if err := r.attachments.Delete(context.Background(), attachment.ID); err != nil {
+				if err != store.ErrNotFound {
+					log.Printf("Failed to delete unsent upload %s: %v", attachment.ID, err)
+				}
+				continue
+			}
+			r.deleteFile(attachment.URL, attachment.UploaderID)
+			if attachment.ThumbnailURL != nil {
+				r.deleteFile(*attachment.ThumbnailURL, attachment.UploaderID)
+			}
+		}
+		if len(unsent) < reapBatch {
+			return
+		}
+	}
+}
+
+// reapUploads deletes resumable uploads past their expiry with their partial
+// files. The attachment of a completed one is left to reapUnsent.
+func (r *Reaper) reapUploads() {
+	ctx := context.Background()
+	for {
+		ids, err := r.uploads.Expired(ctx, time.Now(), reapBatch)
+		if err != nil {
+			log.Printf("Failed to load expired uploads: %v", err)
+			return
+		}
+
+		for _, id := range ids {
+			if err := r.uploads.Delete(ctx, id); err != nil && err != store.ErrNotFound {
+				log.Printf("Failed to delete expired upload %s: %v", id, err)
+				continue
+			}
+			if err := r.spool.Remove(id); err != nil {
+				log.Printf("Failed to remove upload file %s: %v", id, err)
+			}
+		}
+		if len(ids) < reapBatch {
+			return
+		}
+	}
+}
+
+// reapSessions deletes sessions that expired or were revoked. Their refresh
+// tokens are refused from then on like any unknown token.
+func (r *Reaper) reapSessions() {
+	if _, err := r.sessions.DeleteEnded(context.Background(), time.Now()); err != nil {
+		log.Printf("Failed to delete ended sessions: %v", err)
+	}
+}
+
+// reapResets deletes password reset tokens that were used or expired
+func (r *Reaper) reapResets() {
+	if _, err := r.resets.DeleteEnded(context.Background(), time.Now()); err != nil {
+		log.Printf("Failed to delete ended password resets: %v", err)
+	}
+}
+
+// deleteFile removes a file uploaded by ownerID unless something still uses
+// it: a forward, a message that carries its URL in the text as [image]url,
+// or the picture of a profile, group, channel or server. A URL stored for
+// anyone else is left alone, since message texts may carry any URL.
+func (r *Reaper) deleteFile(fileURL, ownerID string) {
+	if owner, ok := r.blobs.Owner(fileURL); !ok || owner != ownerID {
+		return
+	}
+
+	uses, err := r.attachments.FileUses(context.Background(), fileURL)
+	if err != nil || uses > 0 {
+		return
+	}
+
+	err = r.blobs.Delete(context.Background(), fileURL)
+	if err != nil && err != storage.ErrForeignURL {
+		log.Printf("Failed to delete file %s: %v", fileURL, err)
+	}
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudinary/cloudinary-go/v2"
+	"github.com/cloudinary/cloudinary-go/v2/api/uploader"
+)
+
+// CloudinaryStore keeps files in Cloudinary
+type CloudinaryStore struct {
+	cld *cloudinary.Cloudinary
+}
+
+// cloudinaryFolder is the folder the uploads are kept in
+const cloudinaryFolder = "kvant"
+
+func NewCloudinaryStore(cloudName, apiKey, apiSecret string) (*CloudinaryStore, error) {
+	if cloudName == "" || apiKey == "" || apiSecret == "" {
+		return nil, fmt.Errorf("cloudinary credentials not configured")
+	}
+
+	cld, err := cloudinary.NewFromParams(cloudName, apiKey, apiSecret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize cloudinary: %w", err)
+	}
+
+	return &CloudinaryStore{cld: cld}, nil
+}
+
+func (c *CloudinaryStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (string, error) {
+	if !validKey(key) {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+
+	// Cloudinary adds the extension of the format it detects
+	uploadParams := uploader.UploadParams{
+		PublicID:     strings.TrimSuffix(key, filepath.Ext(key)),
+		Folder:       cloudinaryFolder,
+		ResourceType: "auto",
+	}
+
+	result, err := c.cld.Upload.Upload(ctx, r, uploadParams)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload to cloudinary: %w", err)
+	}
+	if result.Error.Message != "" {
+		return "", fmt.Errorf("failed to upload to cloudinary: %s", result.Error.Message)
+	}
+
+	return result.SecureURL, nil
+}
+
+func (c *CloudinaryStore) Delete(ctx context.Context, url string) error {
+	resourceType, publicID, ok := parseCloudinaryURL(url)
+	if !ok {
+		return ErrForeignURL
+	}
+	_, err := c.cld.Upload.Destroy(ctx, uploader.DestroyParams{
+		PublicID:     publicID,
+		ResourceType: resourceType,
+	})
+	return err
+}
+
+// Open downloads a file from its delivery URL, which is public
+func (c *CloudinaryStore) Open(ctx context.Context, url string) (io.ReadCloser, error) {
+	if _, _, ok := parseCloudinaryURL(url); !ok {
+		return nil, ErrForeignURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download from cloudinary: %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// Owner reads the key back from the public ID, which is the key without
+// its extension under the folder of the uploads
+func (c *CloudinaryStore) Owner(url string) (string, bool) {
+	_, publicID, ok := parseCloudinaryURL(url)
+	if !ok {
+		return "", false
+	}
+	key, ok := strings.CutPrefix(publicID, cloudinaryFolder+"/")
+	if !ok {
+		return "", false
+	}
+	return keyOwner(key)
+}
+
+// parseCloudinaryURL returns the resource type and public ID of a file from
+// its Cloudinary delivery URL, or false if the URL is not a Cloudinary upload
+func parseCloudinaryURL(url string) (resourceType, publicID string, ok bool) {
+	i := strings.Index(url, "/upload/")
+	if !strings.Contains(url, "res.cloudinary.com/") || i < 0 {
+		return "", "", false
+	}
+	resourceType = url[strings.LastIndex(url[:i], "/")+1 : i]
+	path := url[i+len("/upload/"):]
+
+	// Skip the version segment (v1234567890/)
+	if j := strings.Index(path, "/"); j > 1 && path[0] == 'v' && strings.Trim(path[1:j], "0123456789") == "" {
+		path = path[j+1:]
+	}
+	path = strings.TrimSuffix(path, filepath.Ext(path))
+	return resourceType, path, path != ""
+}
@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"avatars/user/0123abcd.png", true},
+		{"attachments/user-1/a_b.tar.gz", true},
+		{"", false},
+		{"/avatars/user/x.png", false},
+		{"avatars/../../etc/passwd", false},
+		{"../x", false},
+		{"avatars/./x", false},
+		{"avatars//x", false},
+		{"avatars/user/", false},
+		{"avatars/user/.hidden", false},
+		{".upload-123", false},
+		{`avatars\..\x`, false},
+		{"avatars/user/x y.png", false},
+		{"avatars/user/x%2F..", false},
+		{"avatars/user/ü.png", false},
+	}
+	for _, tt := range tests {
+		if got := validKey(tt.key); got != tt.want {
+			t.Errorf("validKey(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestNewKey(t *testing.T) {
+	key := NewKey(FolderAvatars, "user-1", ".png")
+	if !validKey(key) || !strings.HasPrefix(key, "avatars/user-1/") || !strings.HasSuffix(key, ".png") {
+		t.Errorf("NewKey = %q", key)
+	}
+	if owner, ok := keyOwner(key); !ok || owner != "user-1" {
+		t.Errorf("keyOwner(%q) = %q, %v", key, owner, ok)
+	}
+	if other := NewKey(FolderAvatars, "user-1", ".png"); other == key {
+		t.Errorf("NewKey returned %q twice", key)
+	}
+	// An extension that is not a valid key segment is dropped
+	if key := NewKey(FolderAttachments, "user-1", "/../x"); strings.Contains(key, "..") || !validKey(key) {
+		t.Errorf("NewKey with a bad extension = %q", key)
+	}
+}
+
+func newTestLocalStore(t *testing.T) (*LocalStore, string) {
+	t.Helper()
+	dir := t.TempDir()
+	s, err := NewLocalStore(dir, "/uploads/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+func TestLocalStore(t *testing.T) {
+	s, dir := newTestLocalStore(t)
+	ctx := context.Background()
+	content := "hello, blob"
+
+	key := NewKey(FolderAttachments, "user-1", ".txt")
+	url, err := s.Put(ctx, key, strings.NewReader(content), int64(len(content)), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "/uploads/"+key {
+		t.Errorf("URL %q, want /uploads/%s", url, key)
+	}
+
+	f, err := s.Open(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(f)
+	f.Close()
+	if string(got) != content {
+		t.Errorf("Open read %q, want %q", got, content)
+	}
+
+	owners := []struct {
+		url   string
+		owner string
+		ok    bool
+	}{
+		{url, "user-1", true},
+		{"/uploads/avatars/user-2/abc.png", "user-2", true},
+		{"https://res.cloudinary.com/x/avatars/user-1/abc.png", "", false},
+		{"/uploads/user-1/abc.png", "", false},
+		{"/uploads/avatars/../user-1/abc.png", "", false},
+		{"/elsewhere/avatars/user-1/abc.png", "", false},
+	}
+	for _, tt := range owners {
+		if owner, ok := s.Owner(tt.url); owner != tt.owner || ok != tt.ok {
+			t.Errorf("Owner(%q) = %q, %v; want %q, %v", tt.url, owner, ok, tt.owner, tt.ok)
+		}
+	}
+
+	// A short write is an error and leaves nothing behind
+	short := NewKey(FolderAttachments, "user-1", ".txt")
+	if _, err := s.Put(ctx, short, strings.NewReader(content), int64(len(content))+1, "text/plain"); err == nil {
+		t.Error("Put of fewer bytes than its size succeeded")
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, "attachments", "user-1"))
+	if len(entries) != 1 {
+		t.Errorf("%d files after a failed Put, want 1", len(entries))
+	}
+
+	if err := s.Delete(ctx, url); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(key))); !os.IsNotExist(err) {
+		t.Errorf("file is kept after Delete: %v", err)
+	}
+	// Deleting it again is not an error
+	if err := s.Delete(ctx, url); err != nil {
+		t.Errorf("deleting a missing file: %v", err)
+	}
+}
+
+func TestLocalStoreTraversal(t *testing.T) {
+	s, dir := newTestLocalStore(t)
+	ctx := context.Background()
+
+	// A file next to the store that no URL may reach
+	outside := filepath.Join(filepath.Dir(dir), "secret.txt")
+	if err := os.WriteFile(outside, []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(outside) })
+	if err := os.WriteFile(filepath.Join(dir, ".hidden"), []byte("hidden"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"../secret.txt", "/etc/passwd", "a/../../secret.txt", ".hidden"} {
+		if _, err := s.Put(ctx, key, strings.NewReader("x"), 1, "text/plain"); err == nil {
+			t.Errorf("Put(%q) succeeded", key)
+		}
+	}
+	for _, url := range []string{"/uploads/../secret.txt", "/uploads/a/../../secret.txt", "/uploads/.hidden", "/secret.txt"} {
+		if err := s.Delete(ctx, url); err != ErrForeignURL {
+			t.Errorf("Delete(%q) = %v, want ErrForeignURL", url, err)
+		}
+		if _, err := s.Open(ctx, url); err != ErrForeignURL {
+			t.Errorf("Open(%q) = %v, want ErrForeignURL", url, err)
+		}
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("file outside the store: %v", err)
+	}
+
+	for _, path := range []string{"/../secret.txt", "/a/..%2F..%2Fsecret.txt", "/.hidden", "/", "/attachments"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.URL.Path = path
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want 404", path, w.Code)
+		}
+	}
+}
+
+func TestLocalStoreServeHTTP(t *testing.T) {
+	s, _ := newTestLocalStore(t)
+	content := "0123456789"
+	key := NewKey(FolderAttachments, "user-1", ".txt")
+	if _, err := s.Put(context.Background(), key, strings.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	get := func(method string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/"+key, nil)
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("GET", nil)
+	if w.Code != http.StatusOK || w.Body.String() != content {
+		t.Fatalf("GET: status %d, body %q", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type %q", ct)
+	}
+	if w.Header().Get("X-Content-Type-Options") != "nosniff" || !strings.Contains(w.Header().Get("Content-Security-Policy"), "sandbox") {
+		t.Error("an upload is served without nosniff and a sandbox")
+	}
+	etag := w.Header().Get("ETag")
+
+	w = get("GET", map[string]string{"Range": "bytes=2-5"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "2345" || w.Header().Get("Content-Range") != "bytes 2-5/10" {
+		t.Errorf("Range: status %d, body %q, Content-Range %q", w.Code, w.Body, w.Header().Get("Content-Range"))
+	}
+	w = get("GET", map[string]string{"Range": "bytes=20-"})
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("unsatisfiable Range: status %d", w.Code)
+	}
+	if w = get("GET", map[string]string{"If-None-Match": etag}); w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: status %d, want 304", w.Code)
+	}
+	if w = get("HEAD", nil); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("HEAD: status %d, %d bytes", w.Code, w.Body.Len())
+	}
+	if w = get("DELETE", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE: status %d, want 405", w.Code)
+	}
+
+	if err := s.Delete(context.Background(), "/uploads/"+key); err != nil {
+		t.Fatal(err)
+	}
+	if w = get("GET", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET of a deleted file: status %d, want 404", w.Code)
+	}
+}
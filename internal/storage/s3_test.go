@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestS3Store runs against an S3-compatible service such as MinIO given by
+// S3_TEST_ENDPOINT, S3_TEST_ACCESS_KEY_ID and S3_TEST_SECRET_ACCESS_KEY, e.g.
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//	S3_TEST_ENDPOINT=http://localhost:9000 S3_TEST_ACCESS_KEY_ID=minioadmin \
+//	S3_TEST_SECRET_ACCESS_KEY=minioadmin go test ./internal/storage
+//
+// The bucket, S3_TEST_BUCKET or messenger-test, is created if missing.
+func TestS3Store(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT not set")
+	}
+	s, err := NewS3Store(S3Config{
+		Endpoint:        endpoint,
+		Region:          getEnv("S3_TEST_REGION", "us-east-1"),
+		Bucket:          getEnv("S3_TEST_BUCKET", "messenger-test"),
+		AccessKeyID:     os.Getenv("S3_TEST_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_TEST_SECRET_ACCESS_KEY"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.bucketURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.do(req, http.StatusOK, http.StatusConflict); err != nil {
+		t.Fatalf("creating bucket: %v", err)
+	}
+
+	content := "hello, bucket"
+	key := NewKey(FolderAttachments, "user-1", ".txt")
+	url, err := s.Put(ctx, key, strings.NewReader(content), int64(len(content)), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner, ok := s.Owner(url); !ok || owner != "user-1" {
+		t.Errorf("Owner(%q) = %q, %v", url, owner, ok)
+	}
+
+	body, err := s.Open(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(body)
+	body.Close()
+	if string(got) != content {
+		t.Errorf("Open read %q, want %q", got, content)
+	}
+
+	if err := s.Delete(ctx, url); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := s.Open(ctx, url); err == nil {
+		body.Close()
+		t.Error("Open of a deleted object succeeded")
+	}
+	// Deleting it again is not an error
+	if err := s.Delete(ctx, url); err != nil {
+		t.Errorf("deleting a missing object: %v", err)
+	}
+	if err := s.Delete(ctx, "https://elsewhere.example/"+key); err != ErrForeignURL {
+		t.Errorf("Delete of a foreign URL = %v, want ErrForeignURL", err)
+	}
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Spool keeps the partial files of resumable uploads on the local disk until
+// they are complete and go to the BlobStore. A client must keep uploading to
+// the same server process, or to processes sharing the directory.
+type Spool struct {
+	dir string
+}
+
+func NewSpool(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating upload spool: %w", err)
+	}
+	return &Spool{dir: dir}, nil
+}
+
+func (s *Spool) path(id string) (string, error) {
+	if !validKey(id) || filepath.Base(id) != id {
+		return "", fmt.Errorf("invalid upload id %q", id)
+	}
+	return filepath.Join(s.dir, id), nil
+}
+
+// Create starts an empty partial file
+func (s *Spool) Create(id string) error {
+	name, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Append writes up to max bytes of r at offset, dropping anything past
+// offset that an earlier failed or rejected write left behind. It returns
+// how many bytes were written and synced to disk, which are kept even if
+// reading r fails midway.
+func (s *Spool) Append(id string, offset int64, r io.Reader, max int64) (int64, error) {
+	name, err := s.path(id)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(offset); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	written, copyErr := io.Copy(f, io.LimitReader(r, max))
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return written, copyErr
+}
+
+// Open opens a partial file for reading
+func (s *Spool) Open(id string) (*os.File, error) {
+	name, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(name)
+}
+
+// Remove deletes a partial file. Removing one that is gone is not an error.
+func (s *Spool) Remove(id string) error {
+	name, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+// Package storage keeps uploaded files (avatars, banners and message
+// attachments) in a BlobStore. The driver is chosen by STORAGE_DRIVER: the
+// local disk, an S3-compatible bucket or Cloudinary.
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// ErrForeignURL is returned by Delete for a URL the store did not hand out,
+// such as a Cloudinary URL kept from before a change of driver
+var ErrForeignURL = errors.New("storage: URL does not belong to this store")
+
+// BlobStore keeps files under keys made by NewKey
+type BlobStore interface {
+	// Put stores size bytes of r under key and returns the URL clients load it from
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (string, error)
+	// Delete removes the file behind a URL returned by Put. Deleting a
+	// file that is already gone is not an error.
+	Delete(ctx context.Context, url string) error
+	// Open reads back the file behind a URL returned by Put, for the server
+	// itself; clients load files from the URL
+	Open(ctx context.Context, url string) (io.ReadCloser, error)
+	// Owner returns the user a URL returned by Put was stored for, from the
+	// key it was made with by NewKey, or false if the store did not hand
+	// the URL out. Delete takes any such URL, so callers check it first.
+	Owner(url string) (userID string, ok bool)
+}
+
+// Folders of the keys
+const (
+	FolderAvatars     = "avatars"
+	FolderBanners     = "banners"
+	FolderAttachments = "attachments"
+)
+
+// NewKey returns a new key for a file with extension ext (such as ".png")
+// that a user uploads into folder. Keys are never reused, so whatever is
+// stored under one can be cached for good.
+func NewKey(folder, userID, ext string) string {
+	var random [16]byte
+	rand.Read(random[:])
+	key := fmt.Sprintf("%s/%s/%s", folder, userID, hex.EncodeToString(random[:]))
+
+	// The extension tells the type of the file when it is served
+	if ext != "" && validKey("x"+ext) {
+		key += ext
+	}
+	return key
+}
+
+// keyOwner returns the user segment of a key made by NewKey
+func keyOwner(key string) (string, bool) {
+	segments := strings.Split(key, "/")
+	if len(segments) != 3 || !validKey(key) {
+		return "", false
+	}
+	return segments[1], true
+}
+
+// validKey reports whether key is a relative slash-separated path of
+// letters, digits, '-', '_' and '.' without hidden or dot segments. Such a
+// key is safe as a file path and needs no escaping in a URL.
+func validKey(key string) bool {
+	if key == "" || path.Clean(key) != key || strings.HasPrefix(key, "/") {
+		return false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return false
+		}
+	}
+	for _, c := range key {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == '/':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// FromEnv returns the BlobStore configured by the environment. Without
+// STORAGE_DRIVER it is Cloudinary when its credentials are set and the local
+// disk otherwise.
+func FromEnv() (BlobStore, error) {
+	driver := os.Getenv("STORAGE_DRIVER")
+	if driver == "" {
+		driver = "local"
+		if os.Getenv("CLOUDINARY_CLOUD_NAME") != "" {
+			driver = "cloudinary"
+		}
+	}
+
+	switch driver {
+	case "local":
+		return NewLocalStore(getEnv("UPLOAD_DIR", "./uploads"), getEnv("UPLOAD_BASE_URL", "/uploads"))
+	case "s3":
+		return NewS3Store(S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          getEnv("S3_REGION", "us-east-1"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			PublicURL:       os.Getenv("S3_PUBLIC_URL"),
+		})
+	case "cloudinary":
+		return NewCloudinaryStore(os.Getenv("CLOUDINARY_CLOUD_NAME"), os.Getenv("CLOUDINARY_API_KEY"), os.Getenv("CLOUDINARY_API_SECRET"))
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_DRIVER %q", driver)
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,192 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// AttachmentStore keeps uploaded files. They are sent by MessageStore.Create.
+type AttachmentStore interface {
+	// Create stores an upload that is not sent yet, setting its ID and CreatedAt
+	Create(ctx context.Context, attachment *models.Attachment) error
+	Get(ctx context.Context, id string) (*models.Attachment, error)
+	// ForMessages returns the attachments of each of the messages in the order they were sent
+	ForMessages(ctx context.Context, messageIDs []string) (map[string][]models.Attachment, error)
+	// Unsent returns up to limit uploads created before a time that were never sent
+	Unsent(ctx context.Context, before time.Time, limit int) ([]models.Attachment, error)
+	// ByUploader returns the uploads of a user, sent or not, oldest first
+	ByUploader(ctx context.Context, userID string) ([]models.Attachment, error)
+	// FindUnsent returns the upload of a user stored at url that was not sent yet
+	FindUnsent(ctx context.Context, uploaderID, url string) (*models.Attachment, error)
+	Delete(ctx context.Context, id string) error
+	// FileUses counts what still uses the file stored at url: messages,
+	// attachments and thumbnails, and the pictures of profiles, groups,
+	// channels and servers
+	FileUses(ctx context.Context, url string) (int, error)
+}
+
+type attachmentStore struct {
+	db *sql.DB
+	d  dialect
+}
+
+const attachmentColumns = `id, uploader_id, message_id, url, filename, mime_type, kind, size,
+		       width, height, duration_ms, thumbnail_url, blurhash, checksum, created_at`
+
+func scanAttachment(row interface{ Scan(...interface{}) error }) (*models.Attachment, error) {
+	var a models.Attachment
+	err := row.Scan(
+		&a.ID, &a.UploaderID, &a.MessageID, &a.URL, &a.Filename, &a.MimeType, &a.Kind, &a.Size,
+		&a.Width, &a.Height, &a.DurationMS, &a.ThumbnailURL, &a.Blurhash, &a.Checksum, &a.CreatedAt,
+	)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &a, nil
+}
+
+// queryer is a database or a transaction
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func queryAttachments(ctx context.Context, q queryer, query string, args ...interface{}) ([]models.Attachment, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []models.Attachment
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, *a)
+	}
+	return attachments, rows.Err()
+}
+
+func (s *attachmentStore) Create(ctx context.Context, a *models.Attachment) error {
+	if a.ID == "" {
+		a.ID = utils.GenerateUUID()
+	}
+	at, createdAt := now()
+	_, err := s.db.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO attachments (id, uploader_id, url, filename, mime_type, kind, size,
+		                         width, height, duration_ms, thumbnail_url, blurhash, checksum, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+	`), a.ID, a.UploaderID, a.URL, a.Filename, a.MimeType, a.Kind, a.Size,
+		a.Width, a.Height, a.DurationMS, a.ThumbnailURL, a.Blurhash, a.Checksum, at)
+	if err != nil {
+		return err
+	}
+	a.MessageID, a.CreatedAt = nil, createdAt
+	return nil
+}
+
+func (s *attachmentStore) Get(ctx context.Context, id string) (*models.Attachment, error) {
+	return scanAttachment(s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT `+attachmentColumns+` FROM attachments WHERE id = $1
+	`), id))
+}
+
+func (s *attachmentStore) ForMessages(ctx context.Context, messageIDs []string) (map[string][]models.Attachment, error) {
+	byMessage := make(map[string][]models.Attachment)
+	if len(messageIDs) == 0 {
+		return byMessage, nil
+	}
+
+	placeholders := make([]string, len(messageIDs))
+	args := make([]interface{}, len(messageIDs))
+	for i, id := range messageIDs {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = id
+	}
+
+	attachments, err := queryAttachments(ctx, s.db, s.d.rebind(`
+		SELECT `+attachmentColumns+`
+		FROM attachments
+		WHERE message_id IN (`+strings.Join(placeholders, ",")+`)
+		ORDER BY position
+	`), args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range attachments {
+		byMessage[*a.MessageID] = append(byMessage[*a.MessageID], a)
+	}
+	return byMessage, nil
+}
+
+func (s *attachmentStore) Unsent(ctx context.Context, before time.Time, limit int) ([]models.Attachment, error) {
+	return queryAttachments(ctx, s.db, s.d.rebind(`
+		SELECT `+attachmentColumns+`
+		FROM attachments
+		WHERE message_id IS NULL AND created_at < $1
+		ORDER BY created_at
+		LIMIT $2
+	`), utils.DBTime(before), limit)
+}
+
+func (s *attachmentStore) ByUploader(ctx context.Context, userID string) ([]models.Attachment, error) {
+	return queryAttachments(ctx, s.db, s.d.rebind(`
+		SELECT `+attachmentColumns+`
+		FROM attachments
+		WHERE uploader_id = $1
+		ORDER BY created_at, id
+	`), userID)
+}
+
+func (s *attachmentStore) FindUnsent(ctx context.Context, uploaderID, url string) (*models.Attachment, error) {
+	return scanAttachment(s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT `+attachmentColumns+`
+		FROM attachments
+		WHERE uploader_id = $1 AND url = $2 AND message_id IS NULL
+		ORDER BY created_at
+		LIMIT 1
+	`), uploaderID, url))
+}
+
+func (s *attachmentStore) Delete(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`DELETE FROM attachments WHERE id = $1`), id)
+	return affected(result, err)
+}
+
+func (s *attachmentStore) FileUses(ctx context.Context, url string) (int, error) {
+	var uses int
+	err := s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT (SELECT COUNT(*) FROM messages WHERE file_url = $1) +
+		       (SELECT COUNT(*) FROM attachments WHERE url = $1 OR thumbnail_url = $1) +
+		       (SELECT COUNT(*) FROM users WHERE avatar_url = $1 OR banner_url = $1) +
+		       (SELECT COUNT(*) FROM groups WHERE avatar_url = $1) +
+		       (SELECT COUNT(*) FROM channels WHERE avatar_url = $1) +
+		       (SELECT COUNT(*) FROM servers WHERE icon_url = $1 OR banner_url = $1)
+	`), url).Scan(&uses)
+	return uses, err
+}
+
+// attach sends the attachments with ids with a message of their uploader,
+// in that order, and returns them. It returns ErrNotFound unless every one
+// is an unsent upload of the uploader.
+func attach(ctx context.Context, tx *sql.Tx, d dialect, messageID, uploaderID string, ids []string) ([]models.Attachment, error) {
+	for position, id := range ids {
+		result, err := tx.ExecContext(ctx, d.rebind(`
+			UPDATE attachments SET message_id = $1, position = $2
+			WHERE id = $3 AND uploader_id = $4 AND message_id IS NULL
+		`), messageID, position, id, uploaderID)
+		if err := affected(result, err); err != nil {
+			return nil, err
+		}
+	}
+	return queryAttachments(ctx, tx, d.rebind(`
+		SELECT `+attachmentColumns+` FROM attachments WHERE message_id = $1 ORDER BY position
+	`), messageID)
+}
@@ -0,0 +1,103 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/kvant/messenger/internal/models"
+)
+
+// BlockStore keeps the users each user blocked. A block works both ways:
+// callers treat two users as blocked when either blocked the other.
+type BlockStore interface {
+	// Block adds a user to the block list of another; blocking one twice
+	// does nothing
+	Block(ctx context.Context, blockerID, blockedID string) error
+	// Unblock removes a user from the list; ErrNotFound means they were not on it
+	Unblock(ctx context.Context, blockerID, blockedID string) error
+	// List returns the block list of a user, last blocked first
+	List(ctx context.Context, blockerID string) ([]models.BlockedUser, error)
+	// Between reports whether either of two users blocked the other
+	Between(ctx context.Context, userID, otherID string) (bool, error)
+	// Related returns the users a user blocked or was blocked by
+	Related(ctx context.Context, userID string) ([]string, error)
+}
+
+type blockStore struct {
+	db *sql.DB
+	d  dialect
+}
+
+func (s *blockStore) Block(ctx context.Context, blockerID, blockedID string) error {
+	at, _ := now()
+	_, err := s.db.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO user_blocks (blocker_id, blocked_id, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (blocker_id, blocked_id) DO NOTHING
+	`), blockerID, blockedID, at)
+	return err
+}
+
+func (s *blockStore) Unblock(ctx context.Context, blockerID, blockedID string) error {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		DELETE FROM user_blocks WHERE blocker_id = $1 AND blocked_id = $2
+	`), blockerID, blockedID)
+	return affected(result, err)
+}
+
+func (s *blockStore) List(ctx context.Context, blockerID string) ([]models.BlockedUser, error) {
+	rows, err := s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT u.id, u.username, u.display_name, u.avatar_url, b.created_at
+		FROM user_blocks b
+		JOIN users u ON u.id = b.blocked_id
+		WHERE b.blocker_id = $1
+		ORDER BY b.created_at DESC, u.username
+	`), blockerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocked := []models.BlockedUser{}
+	for rows.Next() {
+		var user models.BlockedUser
+		if err := rows.Scan(&user.ID, &user.Username, &user.DisplayName, &user.AvatarURL, &user.BlockedAt); err != nil {
+			return nil, err
+		}
+		blocked = append(blocked, user)
+	}
+	return blocked, rows.Err()
+}
+
+func (s *blockStore) Between(ctx context.Context, userID, otherID string) (bool, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT COUNT(*) FROM user_blocks
+		WHERE (blocker_id = $1 AND blocked_id = $2) OR (blocker_id = $2 AND blocked_id = $1)
+	`), userID, otherID).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (s *blockStore) Related(ctx context.Context, userID string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT blocked_id FROM user_blocks WHERE blocker_id = $1
+		UNION
+		SELECT blocker_id FROM user_blocks WHERE blocked_id = $1
+	`), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
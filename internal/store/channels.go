@@ -0,0 +1,267 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// ChannelStore keeps broadcast channels and their subscribers. A channel
+// counts its subscribers in subscriber_count, kept along with them.
+type ChannelStore interface {
+	// Create stores a new channel with its owner as the first subscriber. It
+	// sets ID, CreatedAt, SubscriberCount and MyRole, as the owner sees it.
+	// ErrConflict means the invite slug is taken.
+	Create(ctx context.Context, channel *models.Channel) error
+	// Get returns a channel as seen by a user; MyRole is "" if they are not subscribed
+	Get(ctx context.Context, id, userID string) (*models.Channel, error)
+	// GetBySlug returns the channel of an invite slug as seen by a user
+	GetBySlug(ctx context.Context, slug, userID string) (*models.Channel, error)
+	// ForUser returns the channels a user is subscribed to, last subscribed first
+	ForUser(ctx context.Context, userID string) ([]models.Channel, error)
+	// Update changes the fields of the request that are set; ErrConflict
+	// means the invite slug is taken
+	Update(ctx context.Context, id string, update models.UpdateChannelRequest) error
+	Delete(ctx context.Context, id string) error
+	// Subscribe adds a subscriber; subscribing twice does nothing
+	Subscribe(ctx context.Context, channelID, userID string) error
+	// Unsubscribe removes a subscriber; ErrNotFound means they were not subscribed
+	Unsubscribe(ctx context.Context, channelID, userID string) error
+	// Subscribers returns the subscribers of a channel, first subscribed first
+	Subscribers(ctx context.Context, channelID string) ([]models.ChannelSubscriber, error)
+	// SubscriberIDs returns the IDs of the subscribers of a channel
+	SubscriberIDs(ctx context.Context, channelID string) ([]string, error)
+	// Role returns the role of a subscriber; ErrNotFound means they are not subscribed
+	Role(ctx context.Context, channelID, userID string) (string, error)
+	// SetRole changes the role of a subscriber
+	SetRole(ctx context.Context, channelID, userID, role string) error
+	// CanRead reports whether a user may read the posts of a channel:
+	// subscribers can read any channel, everyone else only public ones
+	CanRead(ctx context.Context, channelID, userID string) (bool, error)
+}
+
+type channelStore struct {
+	db *sql.DB
+	d  dialect
+}
+
+// channelColumns select a channel as seen by the user in $1
+const channelColumns = `c.id, c.name, c.description, c.avatar_url, c.owner_id, c.is_public,
+		       c.subscriber_count, c.invite_slug, c.created_at,
+		       COALESCE((SELECT role FROM channel_subscribers WHERE channel_id = c.id AND user_id = $1), '')`
+
+func scanChannel(row interface{ Scan(...interface{}) error }) (*models.Channel, error) {
+	var c models.Channel
+	err := row.Scan(
+		&c.ID, &c.Name, &c.Description, &c.AvatarURL, &c.OwnerID,
+		&c.IsPublic, &c.SubscriberCount, &c.InviteSlug, &c.CreatedAt, &c.MyRole,
+	)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &c, nil
+}
+
+func (s *channelStore) Create(ctx context.Context, c *models.Channel) error {
+	c.ID = utils.GenerateUUID()
+	at, createdAt := now()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO channels (id, name, description, avatar_url, owner_id, is_public, subscriber_count, invite_slug, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, 1, $7, $8)
+	`), c.ID, c.Name, c.Description, c.AvatarURL, c.OwnerID, c.IsPublic, c.InviteSlug, at)
+	if s.d.isUniqueViolation(err) {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO channel_subscribers (id, channel_id, user_id, role, subscribed_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`), utils.GenerateUUID(), c.ID, c.OwnerID, models.ChannelRoleOwner, at)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	c.CreatedAt, c.SubscriberCount, c.MyRole = createdAt, 1, models.ChannelRoleOwner
+	return nil
+}
+
+func (s *channelStore) Get(ctx context.Context, id, userID string) (*models.Channel, error) {
+	return scanChannel(s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT `+channelColumns+`
+		FROM channels c
+		WHERE c.id = $2
+	`), userID, id))
+}
+
+func (s *channelStore) GetBySlug(ctx context.Context, slug, userID string) (*models.Channel, error) {
+	return scanChannel(s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT `+channelColumns+`
+		FROM channels c
+		WHERE c.invite_slug = $2
+	`), userID, slug))
+}
+
+func (s *channelStore) ForUser(ctx context.Context, userID string) ([]models.Channel, error) {
+	rows, err := s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT `+channelColumns+`
+		FROM channels c
+		JOIN channel_subscribers s ON s.channel_id = c.id
+		WHERE s.user_id = $1
+		ORDER BY s.subscribed_at DESC
+	`), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	channels := []models.Channel{}
+	for rows.Next() {
+		c, err := scanChannel(rows)
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, *c)
+	}
+	return channels, rows.Err()
+}
+
+func (s *channelStore) Update(ctx context.Context, id string, update models.UpdateChannelRequest) error {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE channels
+		SET name = COALESCE($1, name),
+		    description = COALESCE($2, description),
+		    avatar_url = COALESCE($3, avatar_url),
+		    is_public = COALESCE($4, is_public),
+		    invite_slug = COALESCE($5, invite_slug)
+		WHERE id = $6
+	`), update.Name, update.Description, update.AvatarURL, update.IsPublic, update.InviteSlug, id)
+	if s.d.isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return affected(result, err)
+}
+
+func (s *channelStore) Delete(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`DELETE FROM channels WHERE id = $1`), id)
+	return affected(result, err)
+}
+
+func (s *channelStore) Subscribe(ctx context.Context, channelID, userID string) error {
+	at, _ := now()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO channel_subscribers (id, channel_id, user_id, role, subscribed_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (channel_id, user_id) DO NOTHING
+	`), utils.GenerateUUID(), channelID, userID, models.ChannelRoleSubscriber, at)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		_, err = tx.ExecContext(ctx, s.d.rebind(`
+			UPDATE channels SET subscriber_count = subscriber_count + 1 WHERE id = $1
+		`), channelID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *channelStore) Unsubscribe(ctx context.Context, channelID, userID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, s.d.rebind(`
+		DELETE FROM channel_subscribers WHERE channel_id = $1 AND user_id = $2
+	`), channelID, userID)
+	if err := affected(result, err); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, s.d.rebind(`
+		UPDATE channels SET subscriber_count = subscriber_count - 1 WHERE id = $1 AND subscriber_count > 0
+	`), channelID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *channelStore) Subscribers(ctx context.Context, channelID string) ([]models.ChannelSubscriber, error) {
+	rows, err := s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT u.id, u.username, u.display_name, u.avatar_url, s.role, s.subscribed_at
+		FROM channel_subscribers s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.channel_id = $1
+		ORDER BY s.subscribed_at ASC
+	`), channelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscribers := []models.ChannelSubscriber{}
+	for rows.Next() {
+		var sub models.ChannelSubscriber
+		if err := rows.Scan(&sub.UserID, &sub.Username, &sub.DisplayName, &sub.AvatarURL, &sub.Role, &sub.SubscribedAt); err != nil {
+			return nil, err
+		}
+		subscribers = append(subscribers, sub)
+	}
+	return subscribers, rows.Err()
+}
+
+func (s *channelStore) SetRole(ctx context.Context, channelID, userID, role string) error {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE channel_subscribers SET role = $1 WHERE channel_id = $2 AND user_id = $3
+	`), role, channelID, userID)
+	return affected(result, err)
+}
+
+func (s *channelStore) SubscriberIDs(ctx context.Context, channelID string) ([]string, error) {
+	return scanIDs(s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT user_id FROM channel_subscribers WHERE channel_id = $1
+	`), channelID))
+}
+
+func (s *channelStore) Role(ctx context.Context, channelID, userID string) (string, error) {
+	var role string
+	err := s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT role FROM channel_subscribers WHERE channel_id = $1 AND user_id = $2
+	`), channelID, userID).Scan(&role)
+	return role, notFound(err)
+}
+
+func (s *channelStore) CanRead(ctx context.Context, channelID, userID string) (bool, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT COUNT(*) FROM channels c
+		WHERE c.id = $1
+		  AND (c.is_public = $3 OR EXISTS (
+		    SELECT 1 FROM channel_subscribers s WHERE s.channel_id = c.id AND s.user_id = $2
+		  ))
+	`), channelID, userID, true).Scan(&count)
+	return count > 0, err
+}
@@ -0,0 +1,295 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// GroupStore keeps groups and their members. Deleting a group deletes its
+// members and custom roles with it.
+type GroupStore interface {
+	// Create stores a new group with its owner as the first member and adds
+	// the listed users as members, skipping unknown users and repeats. It
+	// sets ID, CreatedAt, MemberCount and MyRole, as the owner sees it.
+	Create(ctx context.Context, group *models.Group, memberIDs []string) error
+	// Get returns a group as seen by a user; MyRole is "" if they are not a member
+	Get(ctx context.Context, id, userID string) (*models.Group, error)
+	// ForUser returns the groups of a user, newest first
+	ForUser(ctx context.Context, userID string) ([]models.Group, error)
+	// Update changes the fields of the request that are set
+	Update(ctx context.Context, id string, update models.UpdateGroupRequest) error
+	Delete(ctx context.Context, id string) error
+	// Members returns the members of a group, longest-standing first
+	Members(ctx context.Context, groupID string) ([]models.GroupMember, error)
+	// MemberIDs returns the IDs of the members of a group
+	MemberIDs(ctx context.Context, groupID string) ([]string, error)
+	// Role returns the role of a member; ErrNotFound means they are not one
+	Role(ctx context.Context, groupID, userID string) (string, error)
+	// AddMember adds a user with a role. ErrNotFound means there is no such
+	// user, ErrConflict that they are a member already.
+	AddMember(ctx context.Context, groupID, userID, role string) error
+	// SetRole changes the role of a member
+	SetRole(ctx context.Context, groupID, userID, role string) error
+	// RemoveMember removes a member; ErrNotFound means they were not one
+	RemoveMember(ctx context.Context, groupID, userID string) error
+	// Leave removes a member. When it is the owner, the group goes to the
+	// longest-standing admin, or member if there are no admins, who is
+	// returned; the last member leaving deletes the group.
+	Leave(ctx context.Context, groupID, userID string, owner bool) (newOwnerID string, deleted bool, err error)
+}
+
+type groupStore struct {
+	db *sql.DB
+	d  dialect
+}
+
+// groupColumns select a group as seen by the user in $1
+const groupColumns = `g.id, g.name, g.description, g.avatar_url, g.owner_id, g.is_public, g.created_at,
+		       (SELECT COUNT(*) FROM group_members WHERE group_id = g.id),
+		       COALESCE((SELECT role FROM group_members WHERE group_id = g.id AND user_id = $1), '')`
+
+func scanGroup(row interface{ Scan(...interface{}) error }) (*models.Group, error) {
+	var g models.Group
+	err := row.Scan(
+		&g.ID, &g.Name, &g.Description, &g.AvatarURL, &g.OwnerID,
+		&g.IsPublic, &g.CreatedAt, &g.MemberCount, &g.MyRole,
+	)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &g, nil
+}
+
+func (s *groupStore) Create(ctx context.Context, g *models.Group, memberIDs []string) error {
+	g.ID = utils.GenerateUUID()
+	at, createdAt := now()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO groups (id, name, description, avatar_url, owner_id, is_public, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`), g.ID, g.Name, g.Description, g.AvatarURL, g.OwnerID, g.IsPublic, at)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO group_members (id, group_id, user_id, role, joined_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`), utils.GenerateUUID(), g.ID, g.OwnerID, models.GroupRoleOwner, at)
+	if err != nil {
+		return err
+	}
+
+	count := 1
+	for _, memberID := range memberIDs {
+		if memberID == "" || memberID == g.OwnerID {
+			continue
+		}
+		result, err := tx.ExecContext(ctx, s.d.rebind(`
+			INSERT INTO group_members (id, group_id, user_id, role, joined_at)
+			SELECT $1, $2, id, $3, $4 FROM users WHERE id = $5
+			ON CONFLICT (group_id, user_id) DO NOTHING
+		`), utils.GenerateUUID(), g.ID, models.GroupRoleMember, at, memberID)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			count++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	g.CreatedAt, g.MemberCount, g.MyRole = createdAt, count, models.GroupRoleOwner
+	return nil
+}
+
+func (s *groupStore) Get(ctx context.Context, id, userID string) (*models.Group, error) {
+	return scanGroup(s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT `+groupColumns+`
+		FROM groups g
+		WHERE g.id = $2
+	`), userID, id))
+}
+
+func (s *groupStore) ForUser(ctx context.Context, userID string) ([]models.Group, error) {
+	rows, err := s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT `+groupColumns+`
+		FROM groups g
+		JOIN group_members gm ON gm.group_id = g.id
+		WHERE gm.user_id = $1
+		ORDER BY g.created_at DESC
+	`), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []models.Group{}
+	for rows.Next() {
+		g, err := scanGroup(rows)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, *g)
+	}
+	return groups, rows.Err()
+}
+
+func (s *groupStore) Update(ctx context.Context, id string, update models.UpdateGroupRequest) error {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE groups
+		SET name = COALESCE($1, name),
+		    description = COALESCE($2, description),
+		    avatar_url = COALESCE($3, avatar_url),
+		    is_public = COALESCE($4, is_public)
+		WHERE id = $5
+	`), update.Name, update.Description, update.AvatarURL, update.IsPublic, id)
+	return affected(result, err)
+}
+
+func (s *groupStore) Delete(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := deleteGroup(ctx, tx, s.d, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteGroup deletes a group and its roles, which have no foreign key to cascade from
+func deleteGroup(ctx context.Context, tx *sql.Tx, d dialect, id string) error {
+	result, err := tx.ExecContext(ctx, d.rebind(`DELETE FROM groups WHERE id = $1`), id)
+	if err := affected(result, err); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, d.rebind(`
+		DELETE FROM roles WHERE scope_type = 'group' AND scope_id = $1
+	`), id)
+	return err
+}
+
+func (s *groupStore) Members(ctx context.Context, groupID string) ([]models.GroupMember, error) {
+	rows, err := s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT u.id, u.username, u.display_name, u.avatar_url, gm.role, gm.joined_at
+		FROM group_members gm
+		JOIN users u ON u.id = gm.user_id
+		WHERE gm.group_id = $1
+		ORDER BY gm.joined_at ASC
+	`), groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []models.GroupMember{}
+	for rows.Next() {
+		var m models.GroupMember
+		if err := rows.Scan(&m.UserID, &m.Username, &m.DisplayName, &m.AvatarURL, &m.Role, &m.JoinedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func (s *groupStore) MemberIDs(ctx context.Context, groupID string) ([]string, error) {
+	return scanIDs(s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT user_id FROM group_members WHERE group_id = $1
+	`), groupID))
+}
+
+func (s *groupStore) Role(ctx context.Context, groupID, userID string) (string, error) {
+	var role string
+	err := s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT role FROM group_members WHERE group_id = $1 AND user_id = $2
+	`), groupID, userID).Scan(&role)
+	return role, notFound(err)
+}
+
+func (s *groupStore) AddMember(ctx context.Context, groupID, userID, role string) error {
+	at, _ := now()
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO group_members (id, group_id, user_id, role, joined_at)
+		SELECT $1, $2, id, $3, $4 FROM users WHERE id = $5
+	`), utils.GenerateUUID(), groupID, role, at, userID)
+	if s.d.isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return affected(result, err)
+}
+
+func (s *groupStore) SetRole(ctx context.Context, groupID, userID, role string) error {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE group_members SET role = $1 WHERE group_id = $2 AND user_id = $3
+	`), role, groupID, userID)
+	return affected(result, err)
+}
+
+func (s *groupStore) RemoveMember(ctx context.Context, groupID, userID string) error {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		DELETE FROM group_members WHERE group_id = $1 AND user_id = $2
+	`), groupID, userID)
+	return affected(result, err)
+}
+
+func (s *groupStore) Leave(ctx context.Context, groupID, userID string, owner bool) (string, bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, s.d.rebind(`
+		DELETE FROM group_members WHERE group_id = $1 AND user_id = $2
+	`), groupID, userID)
+	if err := affected(result, err); err != nil {
+		return "", false, err
+	}
+	if !owner {
+		return "", false, tx.Commit()
+	}
+
+	var newOwnerID string
+	err = tx.QueryRowContext(ctx, s.d.rebind(`
+		SELECT user_id FROM group_members
+		WHERE group_id = $1
+		ORDER BY CASE WHEN role = $2 THEN 0 ELSE 1 END, joined_at ASC
+		LIMIT 1
+	`), groupID, models.GroupRoleAdmin).Scan(&newOwnerID)
+	if err == sql.ErrNoRows {
+		if err := deleteGroup(ctx, tx, s.d, groupID); err != nil {
+			return "", false, err
+		}
+		return "", true, tx.Commit()
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	_, err = tx.ExecContext(ctx, s.d.rebind(`
+		UPDATE group_members SET role = $1 WHERE group_id = $2 AND user_id = $3
+	`), models.GroupRoleOwner, groupID, newOwnerID)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, s.d.rebind(`
+			UPDATE groups SET owner_id = $1 WHERE id = $2
+		`), newOwnerID, groupID)
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return newOwnerID, false, tx.Commit()
+}
@@ -0,0 +1,512 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// MessageStore keeps messages of direct chats, groups, channels and server channels
+type MessageStore interface {
+	// Create stores msg, setting its ID if empty and its CreatedAt. It
+	// returns ErrConflict if the sender already stored its ClientMessageID.
+	// The attachments of msg, of which only the IDs are read, are sent with
+	// it and loaded into msg; ErrNotFound means one is not an unsent upload
+	// of the sender.
+	Create(ctx context.Context, msg *models.Message) error
+	// Get returns a message with the name and avatar of its sender
+	Get(ctx context.Context, id string) (*models.Message, error)
+	// FindByClientID returns the message the sender stored under clientMessageID
+	FindByClientID(ctx context.Context, senderID, clientMessageID string) (*models.Message, error)
+	// Edit replaces the text of a message and marks it edited
+	Edit(ctx context.Context, id, text string) (*models.Message, error)
+	// DeleteForEveryone blanks a message and marks it deleted for all
+	DeleteForEveryone(ctx context.Context, id string) error
+	// DeleteForUser hides a message from one user only: a side of a
+	// direct chat, or a member of a group or channel
+	DeleteForUser(ctx context.Context, id, userID string) error
+	// Pin pins a message, unpinning any other pinned message of its chat
+	Pin(ctx context.Context, id string) (time.Time, error)
+	Unpin(ctx context.Context, id string) error
+	// ForUser calls fn with every message a user sent and every direct
+	// message they received, oldest first, except those deleted for
+	// everyone. fn must not use the database.
+	ForUser(ctx context.Context, userID string, fn func(*models.Message) error) error
+
+	// Page returns up to limit messages of a chat next to a cursor, newer
+	// ones or older ones, oldest first, and reports whether there are more
+	// past them. A cursor is a message ID or a time; an empty one starts
+	// from the newest message. Messages sharing a time are ordered by ID.
+	Page(ctx context.Context, chat Chat, cursor Cursor, newer bool, limit int) ([]models.Message, bool, error)
+	// InChat returns a message of a chat; ErrNotFound means the chat has no
+	// such message, or the user deleted it
+	InChat(ctx context.Context, chat Chat, id string) (*models.Message, error)
+	// List returns the messages with the given IDs that exist, in no order
+	List(ctx context.Context, ids []string) ([]models.Message, error)
+	// Recent returns up to limit users a user had direct chats with, the
+	// latest chat first
+	Recent(ctx context.Context, userID string, limit int) ([]models.RecentChat, error)
+	// MarkRead marks the direct messages from senderID to readerID as read
+	// and starts the timers of those that self-destruct after reading. It
+	// returns the number of messages that were unread.
+	MarkRead(ctx context.Context, senderID, readerID string) (int64, error)
+}
+
+// Chat is a conversation as one user sees it, without the messages they
+// deleted for themselves. Exactly one of OtherUserID, GroupID, ChannelID
+// and ServerChannelID is set.
+type Chat struct {
+	UserID string
+	// OtherUserID is the other side of a direct chat
+	OtherUserID     string
+	GroupID         string
+	ChannelID       string
+	ServerChannelID string
+}
+
+// scope returns a condition on m selecting the messages of the chat, in which
+// $1 is the user and $2 the chat, and the argument for $2
+func (c Chat) scope() (string, string) {
+	if c.OtherUserID != "" {
+		return `((m.sender_id = $1 AND m.receiver_id = $2)
+		   OR (m.sender_id = $2 AND m.receiver_id = $1))
+		   AND m.deleted_at IS NULL
+		   AND (
+		     (m.sender_id = $1 AND m.deleted_for_sender = 0)
+		     OR (m.receiver_id = $1 AND m.deleted_for_receiver = 0)
+		   )`, c.OtherUserID
+	}
+
+	column, id := "group_id", c.GroupID
+	if c.ChannelID != "" {
+		column, id = "channel_id", c.ChannelID
+	} else if c.ServerChannelID != "" {
+		column, id = "server_channel_id", c.ServerChannelID
+	}
+	return `m.` + column + ` = $2
+		  AND m.deleted_at IS NULL
+		  AND NOT EXISTS (
+		    SELECT 1 FROM message_deletions d WHERE d.message_id = m.id AND d.user_id = $1
+		  )`, id
+}
+
+// Cursor is a position in a chat: just past a message, or a time if ID is
+// empty. The zero Cursor is the newest end of the chat.
+type Cursor struct {
+	ID string
+	At time.Time
+}
+
+type messageStore struct {
+	db *sql.DB
+	d  dialect
+}
+
+const messageColumns = `m.id, m.sender_id, m.receiver_id, m.group_id, m.channel_id, m.server_channel_id, m.client_message_id,
+		       m.text, m.message_type, m.file_url, m.is_read, m.reply_to_id, m.read_at, m.edited_at, m.deleted_at,
+		       m.deleted_for_sender, m.deleted_for_receiver, m.created_at, m.pinned_at, m.self_destruct_in, m.self_destruct_at, u.username, u.avatar_url`
+
+func scanMessage(row interface{ Scan(...interface{}) error }) (*models.Message, error) {
+	var msg models.Message
+	err := row.Scan(
+		&msg.ID, &msg.SenderID, &msg.ReceiverID, &msg.GroupID, &msg.ChannelID, &msg.ServerChannelID, &msg.ClientMessageID,
+		&msg.Text, &msg.MessageType, &msg.FileURL, &msg.IsRead, &msg.ReplyToID, &msg.ReadAt, &msg.EditedAt, &msg.DeletedAt,
+		&msg.DeletedForSender, &msg.DeletedForReceiver, &msg.CreatedAt, &msg.PinnedAt, &msg.SelfDestructIn, &msg.SelfDestructAt, &msg.SenderName, &msg.SenderAvatarURL,
+	)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &msg, nil
+}
+
+func (s *messageStore) Create(ctx context.Context, msg *models.Message) error {
+	if msg.ID == "" {
+		msg.ID = utils.GenerateUUID()
+	}
+	if msg.MessageType == "" {
+		msg.MessageType = "text"
+	}
+	// Written here rather than defaulted, since CURRENT_TIMESTAMP has whole
+	// seconds on SQLite and messages are paged in created_at order
+	createdAt, _ := now()
+	// The deadline is kept as stored, to the microsecond, so that it is
+	// echoed to clients exactly as the reaper sees it
+	var selfDestructAt *string
+	if msg.SelfDestructAt != nil {
+		deadline := msg.SelfDestructAt.UTC().Truncate(time.Microsecond)
+		at := utils.DBTime(deadline)
+		msg.SelfDestructAt, selfDestructAt = &deadline, &at
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// A concurrent insert of the same client_message_id loses the race on the
+	// unique index without failing the statement
+	err = tx.QueryRowContext(ctx, s.d.rebind(`
+		INSERT INTO messages (id, sender_id, receiver_id, group_id, channel_id, server_channel_id, text, message_type,
+		                      file_url, reply_to_id, client_message_id, self_destruct_in, self_destruct_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		ON CONFLICT (sender_id, client_message_id) DO NOTHING
+		RETURNING created_at
+	`), msg.ID, msg.SenderID, msg.ReceiverID, msg.GroupID, msg.ChannelID, msg.ServerChannelID, msg.Text, msg.MessageType,
+		msg.FileURL, msg.ReplyToID, msg.ClientMessageID, msg.SelfDestructIn, selfDestructAt, createdAt).Scan(&msg.CreatedAt)
+	if err == sql.ErrNoRows || s.d.isUniqueViolation(err) {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(msg.Attachments) > 0 {
+		ids := make([]string, len(msg.Attachments))
+		for i, a := range msg.Attachments {
+			ids[i] = a.ID
+		}
+		if msg.Attachments, err = attach(ctx, tx, s.d, msg.ID, msg.SenderID, ids); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *messageStore) Get(ctx context.Context, id string) (*models.Message, error) {
+	return scanMessage(s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT `+messageColumns+`
+		FROM messages m
+		JOIN users u ON m.sender_id = u.id
+		WHERE m.id = $1
+	`), id))
+}
+
+func (s *messageStore) FindByClientID(ctx context.Context, senderID, clientMessageID string) (*models.Message, error) {
+	return scanMessage(s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT `+messageColumns+`
+		FROM messages m
+		JOIN users u ON m.sender_id = u.id
+		WHERE m.sender_id = $1 AND m.client_message_id = $2
+	`), senderID, clientMessageID))
+}
+
+func (s *messageStore) Edit(ctx context.Context, id, text string) (*models.Message, error) {
+	at, _ := now()
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE messages SET text = $1, edited_at = $2 WHERE id = $3
+	`), text, at, id)
+	if err := affected(result, err); err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, id)
+}
+
+func (s *messageStore) DeleteForEveryone(ctx context.Context, id string) error {
+	at, _ := now()
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE messages SET deleted_at = $1, text = '[deleted]' WHERE id = $2
+	`), at, id)
+	return affected(result, err)
+}
+
+func (s *messageStore) DeleteForUser(ctx context.Context, id, userID string) error {
+	var receiverID *string
+	err := s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT receiver_id FROM messages WHERE id = $1
+	`), id).Scan(&receiverID)
+	if err != nil {
+		return notFound(err)
+	}
+
+	// Members of groups and channels each have their own deletions
+	if receiverID == nil {
+		_, err = s.db.ExecContext(ctx, s.d.rebind(`
+			INSERT INTO message_deletions (message_id, user_id)
+			VALUES ($1, $2)
+			ON CONFLICT (message_id, user_id) DO NOTHING
+		`), id, userID)
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE messages
+		SET deleted_for_sender = CASE WHEN sender_id = $2 THEN 1 ELSE deleted_for_sender END,
+		    deleted_for_receiver = CASE WHEN receiver_id = $2 THEN 1 ELSE deleted_for_receiver END
+		WHERE id = $1
+	`), id, userID)
+	return err
+}
+
+func (s *messageStore) Pin(ctx context.Context, id string) (time.Time, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var senderID string
+	var receiverID, groupID, channelID, serverChannelID *string
+	err = tx.QueryRowContext(ctx, s.d.rebind(`
+		SELECT sender_id, receiver_id, group_id, channel_id, server_channel_id FROM messages WHERE id = $1
+	`), id).Scan(&senderID, &receiverID, &groupID, &channelID, &serverChannelID)
+	if err != nil {
+		return time.Time{}, notFound(err)
+	}
+
+	// A chat has at most one pinned message
+	var chat string
+	var args []interface{}
+	switch {
+	case groupID != nil:
+		chat, args = `group_id = $1`, []interface{}{*groupID}
+	case channelID != nil:
+		chat, args = `channel_id = $1`, []interface{}{*channelID}
+	case serverChannelID != nil:
+		chat, args = `server_channel_id = $1`, []interface{}{*serverChannelID}
+	default:
+		chat = `((sender_id = $1 AND receiver_id = $2) OR (sender_id = $2 AND receiver_id = $1))`
+		args = []interface{}{senderID, receiverID}
+	}
+	_, err = tx.ExecContext(ctx, s.d.rebind(`
+		UPDATE messages SET pinned_at = NULL WHERE `+chat+` AND pinned_at IS NOT NULL
+	`), args...)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	at, pinnedAt := now()
+	if _, err := tx.ExecContext(ctx, s.d.rebind(`UPDATE messages SET pinned_at = $1 WHERE id = $2`), at, id); err != nil {
+		return time.Time{}, err
+	}
+	return pinnedAt, tx.Commit()
+}
+
+func (s *messageStore) Unpin(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE messages SET pinned_at = NULL WHERE id = $1
+	`), id)
+	return affected(result, err)
+}
+
+func (s *messageStore) ForUser(ctx context.Context, userID string, fn func(*models.Message) error) error {
+	rows, err := s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT `+messageColumns+`
+		FROM messages m
+		JOIN users u ON m.sender_id = u.id
+		WHERE (m.sender_id = $1 OR m.receiver_id = $1) AND m.deleted_at IS NULL
+		ORDER BY m.created_at, m.id
+	`), userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *messageStore) Page(ctx context.Context, chat Chat, cursor Cursor, newer bool, limit int) ([]models.Message, bool, error) {
+	op, order := "<", "DESC"
+	if newer {
+		op, order = ">", "ASC"
+	}
+
+	scope, scopeArg := chat.scope()
+	query := `
+		SELECT ` + messageColumns + `
+		FROM messages m
+		JOIN users u ON m.sender_id = u.id
+		WHERE ` + scope
+	// One extra row tells whether there are more
+	args := []interface{}{chat.UserID, scopeArg, limit + 1}
+
+	switch {
+	case cursor.ID != "":
+		query += `
+		  AND EXISTS (
+		    SELECT 1 FROM messages c
+		    WHERE c.id = $4
+		      AND (m.created_at ` + op + ` c.created_at OR (m.created_at = c.created_at AND m.id ` + op + ` c.id))
+		  )`
+		args = append(args, cursor.ID)
+	case !cursor.At.IsZero():
+		query += `
+		  AND m.created_at ` + op + ` $4`
+		args = append(args, utils.DBTime(cursor.At))
+	}
+
+	query += `
+		ORDER BY m.created_at ` + order + `, m.id ` + order + `
+		LIMIT $3`
+
+	messages, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	if !newer {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+	return messages, hasMore, nil
+}
+
+func (s *messageStore) InChat(ctx context.Context, chat Chat, id string) (*models.Message, error) {
+	scope, scopeArg := chat.scope()
+	return scanMessage(s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT `+messageColumns+`
+		FROM messages m
+		JOIN users u ON m.sender_id = u.id
+		WHERE `+scope+` AND m.id = $3
+	`), chat.UserID, scopeArg, id))
+}
+
+func (s *messageStore) List(ctx context.Context, ids []string) ([]models.Message, error) {
+	if len(ids) == 0 {
+		return []models.Message{}, nil
+	}
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = id
+	}
+	return s.query(ctx, `
+		SELECT `+messageColumns+`
+		FROM messages m
+		JOIN users u ON m.sender_id = u.id
+		WHERE m.id IN (`+strings.Join(placeholders, ", ")+`)`, args...)
+}
+
+// query runs a query selecting messageColumns
+func (s *messageStore) query(ctx context.Context, query string, args ...interface{}) ([]models.Message, error) {
+	rows, err := s.db.QueryContext(ctx, s.d.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []models.Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, *msg)
+	}
+	return messages, rows.Err()
+}
+
+func (s *messageStore) Recent(ctx context.Context, userID string, limit int) ([]models.RecentChat, error) {
+	rows, err := s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT DISTINCT
+			CASE
+				WHEN m.sender_id = $1 THEN m.receiver_id
+				ELSE m.sender_id
+			END as user_id,
+			u.username,
+			u.display_name,
+			u.avatar_url,
+			MAX(m.created_at) as last_message_time
+		FROM messages m
+		JOIN users u ON (
+			CASE
+				WHEN m.sender_id = $1 THEN m.receiver_id
+				ELSE m.sender_id
+			END = u.id
+		)
+		WHERE (m.sender_id = $1 OR m.receiver_id = $1) AND m.receiver_id IS NOT NULL
+		GROUP BY user_id, u.username, u.display_name, u.avatar_url
+		ORDER BY last_message_time DESC
+		LIMIT $2
+	`), userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chats := []models.RecentChat{}
+	for rows.Next() {
+		var chat models.RecentChat
+		if err := rows.Scan(&chat.ID, &chat.Username, &chat.DisplayName, &chat.AvatarURL, &chat.LastMessageTime); err != nil {
+			return nil, err
+		}
+		chats = append(chats, chat)
+	}
+	return chats, rows.Err()
+}
+
+func (s *messageStore) MarkRead(ctx context.Context, senderID, readerID string) (int64, error) {
+	at, readAt := now()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// A timer set to start on read runs from now. Deadlines are computed
+	// here, in UTC like the reaper's, rather than by the database, whose
+	// CURRENT_TIMESTAMP is in the session's time zone.
+	rows, err := tx.QueryContext(ctx, s.d.rebind(`
+		SELECT id, self_destruct_in FROM messages
+		WHERE sender_id = $1 AND receiver_id = $2 AND is_read = false
+		  AND self_destruct_in IS NOT NULL AND self_destruct_at IS NULL
+	`), senderID, readerID)
+	if err != nil {
+		return 0, err
+	}
+	deadlines := make(map[string]string)
+	for rows.Next() {
+		var id string
+		var seconds int
+		if err := rows.Scan(&id, &seconds); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		deadlines[id] = utils.DBTime(readAt.Add(time.Duration(seconds) * time.Second))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for id, deadline := range deadlines {
+		if _, err := tx.ExecContext(ctx, s.d.rebind(`
+			UPDATE messages SET self_destruct_at = $1 WHERE id = $2
+		`), deadline, id); err != nil {
+			return 0, err
+		}
+	}
+
+	result, err := tx.ExecContext(ctx, s.d.rebind(`
+		UPDATE messages SET is_read = true, read_at = $1
+		WHERE sender_id = $2 AND receiver_id = $3 AND is_read = false
+	`), at, senderID, readerID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
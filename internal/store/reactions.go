@@ -0,0 +1,102 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// ReactionStore keeps the emoji reactions of users to messages
+type ReactionStore interface {
+	// Add adds a reaction; adding one that exists does nothing
+	Add(ctx context.Context, messageID, userID, emoji string) error
+	Remove(ctx context.Context, messageID, userID, emoji string) error
+	// ForMessages returns the reactions to each of the messages, oldest first
+	ForMessages(ctx context.Context, messageIDs []string) (map[string][]models.Reaction, error)
+	// ByUser returns the reactions of a user, oldest first
+	ByUser(ctx context.Context, userID string) ([]models.Reaction, error)
+}
+
+type reactionStore struct {
+	db *sql.DB
+	d  dialect
+}
+
+func (s *reactionStore) Add(ctx context.Context, messageID, userID, emoji string) error {
+	// An explicit time keeps the order of reactions added within a second
+	at, _ := now()
+	_, err := s.db.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO reactions (id, message_id, user_id, emoji, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (message_id, user_id, emoji) DO NOTHING
+	`), utils.GenerateUUID(), messageID, userID, emoji, at)
+	return err
+}
+
+func (s *reactionStore) Remove(ctx context.Context, messageID, userID, emoji string) error {
+	_, err := s.db.ExecContext(ctx, s.d.rebind(`
+		DELETE FROM reactions WHERE message_id = $1 AND user_id = $2 AND emoji = $3
+	`), messageID, userID, emoji)
+	return err
+}
+
+func (s *reactionStore) ForMessages(ctx context.Context, messageIDs []string) (map[string][]models.Reaction, error) {
+	reactions := make(map[string][]models.Reaction)
+	if len(messageIDs) == 0 {
+		return reactions, nil
+	}
+
+	placeholders := make([]string, len(messageIDs))
+	args := make([]interface{}, len(messageIDs))
+	for i, id := range messageIDs {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = id
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT id, message_id, user_id, emoji, created_at
+		FROM reactions
+		WHERE message_id IN (`+strings.Join(placeholders, ",")+`)
+		ORDER BY created_at, id
+	`), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r models.Reaction
+		if err := rows.Scan(&r.ID, &r.MessageID, &r.UserID, &r.Emoji, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		reactions[r.MessageID] = append(reactions[r.MessageID], r)
+	}
+	return reactions, rows.Err()
+}
+
+func (s *reactionStore) ByUser(ctx context.Context, userID string) ([]models.Reaction, error) {
+	rows, err := s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT id, message_id, user_id, emoji, created_at
+		FROM reactions
+		WHERE user_id = $1
+		ORDER BY created_at, id
+	`), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reactions := []models.Reaction{}
+	for rows.Next() {
+		var r models.Reaction
+		if err := rows.Scan(&r.ID, &r.MessageID, &r.UserID, &r.Emoji, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		reactions = append(reactions, r)
+	}
+	return reactions, rows.Err()
+}
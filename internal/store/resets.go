@@ -0,0 +1,77 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// PasswordResetStore keeps the tokens that let a user who forgot their
+// password set a new one. Only the hashes of the tokens are stored.
+type PasswordResetStore interface {
+	// Create saves a token of a user that can be used until expiresAt
+	Create(ctx context.Context, userID, tokenHash string, expiresAt time.Time) error
+	// Use spends a token and returns its user; ErrNotFound means the token
+	// does not exist, was used or has expired
+	Use(ctx context.Context, tokenHash string) (string, error)
+	// DeleteForUser deletes the tokens of a user, once the password changed
+	DeleteForUser(ctx context.Context, userID string) error
+	// DeleteEnded deletes the tokens that expired or were used before a time
+	DeleteEnded(ctx context.Context, before time.Time) (int64, error)
+}
+
+type passwordResetStore struct {
+	db *sql.DB
+	d  dialect
+}
+
+func (s *passwordResetStore) Create(ctx context.Context, userID, tokenHash string, expiresAt time.Time) error {
+	at, _ := now()
+	_, err := s.db.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO password_resets (token_hash, user_id, expires_at, created_at) VALUES ($1, $2, $3, $4)
+	`), tokenHash, userID, utils.DBTime(expiresAt), at)
+	return err
+}
+
+func (s *passwordResetStore) Use(ctx context.Context, tokenHash string) (string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	at, _ := now()
+	var userID string
+	err = tx.QueryRowContext(ctx, s.d.rebind(`
+		SELECT user_id FROM password_resets
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2
+	`), tokenHash, at).Scan(&userID)
+	if err != nil {
+		return "", notFound(err)
+	}
+	// Only one of two requests racing with the same token gets to spend it
+	result, err := tx.ExecContext(ctx, s.d.rebind(`
+		UPDATE password_resets SET used_at = $1 WHERE token_hash = $2 AND used_at IS NULL
+	`), at, tokenHash)
+	if err := affected(result, err); err != nil {
+		return "", err
+	}
+	return userID, tx.Commit()
+}
+
+func (s *passwordResetStore) DeleteForUser(ctx context.Context, userID string) error {
+	_, err := s.db.ExecContext(ctx, s.d.rebind(`DELETE FROM password_resets WHERE user_id = $1`), userID)
+	return err
+}
+
+func (s *passwordResetStore) DeleteEnded(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		DELETE FROM password_resets WHERE expires_at < $1 OR used_at < $1
+	`), utils.DBTime(before))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
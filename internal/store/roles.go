@@ -0,0 +1,114 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// RoleStore keeps the custom roles of groups and servers and the changed
+// defaults of their built-in roles. A scope is "group" or "server"; roles
+// have no foreign key, so deleting a group or server deletes its roles by
+// scope.
+type RoleStore interface {
+	// Get returns a stored role; ErrNotFound means there is no row for it
+	Get(ctx context.Context, scope, scopeID, name string) (*models.StoredRole, error)
+	// List returns the stored roles of a group or server
+	List(ctx context.Context, scope, scopeID string) ([]models.StoredRole, error)
+	// Create stores a new role; ErrConflict means the name is taken
+	Create(ctx context.Context, scope, scopeID string, role models.StoredRole) error
+	// Save stores the permissions and position of a role, adding its row if
+	// there is none
+	Save(ctx context.Context, scope, scopeID string, role models.StoredRole) error
+	// Delete deletes a role and gives the members that held it the fallback
+	// role. ErrNotFound means there is no row for it.
+	Delete(ctx context.Context, scope, scopeID, name, fallback string) error
+}
+
+type roleStore struct {
+	db *sql.DB
+	d  dialect
+}
+
+func (s *roleStore) Get(ctx context.Context, scope, scopeID, name string) (*models.StoredRole, error) {
+	role := models.StoredRole{Name: name}
+	err := s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT permissions, position FROM roles
+		WHERE scope_type = $1 AND scope_id = $2 AND name = $3
+	`), scope, scopeID, name).Scan(&role.Permissions, &role.Position)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &role, nil
+}
+
+func (s *roleStore) List(ctx context.Context, scope, scopeID string) ([]models.StoredRole, error) {
+	rows, err := s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT name, permissions, position FROM roles
+		WHERE scope_type = $1 AND scope_id = $2
+	`), scope, scopeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []models.StoredRole{}
+	for rows.Next() {
+		var role models.StoredRole
+		if err := rows.Scan(&role.Name, &role.Permissions, &role.Position); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func (s *roleStore) Create(ctx context.Context, scope, scopeID string, role models.StoredRole) error {
+	_, err := s.db.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO roles (id, scope_type, scope_id, name, permissions, position)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`), utils.GenerateUUID(), scope, scopeID, role.Name, role.Permissions, role.Position)
+	if s.d.isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func (s *roleStore) Save(ctx context.Context, scope, scopeID string, role models.StoredRole) error {
+	_, err := s.db.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO roles (id, scope_type, scope_id, name, permissions, position)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (scope_type, scope_id, name)
+		DO UPDATE SET permissions = excluded.permissions, position = excluded.position
+	`), utils.GenerateUUID(), scope, scopeID, role.Name, role.Permissions, role.Position)
+	return err
+}
+
+func (s *roleStore) Delete(ctx context.Context, scope, scopeID, name, fallback string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, s.d.rebind(`
+		DELETE FROM roles WHERE scope_type = $1 AND scope_id = $2 AND name = $3
+	`), scope, scopeID, name)
+	if err := affected(result, err); err != nil {
+		return err
+	}
+
+	membersTable, scopeColumn := "group_members", "group_id"
+	if scope == "server" {
+		membersTable, scopeColumn = "server_members", "server_id"
+	}
+	_, err = tx.ExecContext(ctx, s.d.rebind(`
+		UPDATE `+membersTable+` SET role = $1 WHERE `+scopeColumn+` = $2 AND role = $3
+	`), fallback, scopeID, name)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
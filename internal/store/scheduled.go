@@ -0,0 +1,199 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// ScheduledMessageStore keeps the send-later queue. A queued message is
+// pending until a dispatcher claims it to send it, and is deleted once sent.
+// The queue lives in the database so that every server process can claim
+// from it and pending messages survive restarts.
+type ScheduledMessageStore interface {
+	// Create queues a message, setting its ID, Status and CreatedAt
+	Create(ctx context.Context, msg *models.ScheduledMessage) error
+	Get(ctx context.Context, id string) (*models.ScheduledMessage, error)
+	// ForSender returns the queued messages of a user, soonest first. The
+	// set one of receiverID, groupID and serverChannelID, if any, lists only
+	// those of that chat.
+	ForSender(ctx context.Context, senderID, receiverID, groupID, serverChannelID string) ([]models.ScheduledMessage, error)
+	// Update changes the text and send time of a pending or failed message
+	// and queues it again. ErrConflict means it is being sent or is gone.
+	Update(ctx context.Context, id, text string, sendAt time.Time) error
+	// Cancel deletes a pending or failed message. ErrConflict means it is
+	// being sent or is gone.
+	Cancel(ctx context.Context, id string) error
+
+	// Release queues again the messages claimed before a time, whose
+	// process is assumed to have died before sending them
+	Release(ctx context.Context, claimedBefore time.Time) error
+	// Due returns the IDs of up to limit pending messages due at a time, soonest first
+	Due(ctx context.Context, at time.Time, limit int) ([]string, error)
+	// Claim marks a pending message as being sent and reports whether it
+	// was still pending
+	Claim(ctx context.Context, id string) (bool, error)
+	// Requeue puts a claimed message back in the queue
+	Requeue(ctx context.Context, id string) error
+	// Fail marks a claimed message as failed, saying why
+	Fail(ctx context.Context, id, reason string) error
+	// Delete removes a message from the queue
+	Delete(ctx context.Context, id string) error
+}
+
+type scheduledMessageStore struct {
+	db *sql.DB
+	d  dialect
+}
+
+const scheduledColumns = `id, sender_id, receiver_id, group_id, server_channel_id, text, reply_to_id,
+		       self_destruct_in, self_destruct_after_read, send_at, status, error, created_at, updated_at`
+
+func scanScheduled(row interface{ Scan(...interface{}) error }) (*models.ScheduledMessage, error) {
+	var msg models.ScheduledMessage
+	err := row.Scan(&msg.ID, &msg.SenderID, &msg.ReceiverID, &msg.GroupID, &msg.ServerChannelID, &msg.Text,
+		&msg.ReplyToID, &msg.SelfDestructIn, &msg.SelfDestructAfterRead, &msg.SendAt, &msg.Status, &msg.Error,
+		&msg.CreatedAt, &msg.UpdatedAt)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &msg, nil
+}
+
+func (s *scheduledMessageStore) Create(ctx context.Context, msg *models.ScheduledMessage) error {
+	msg.ID = utils.GenerateUUID()
+	at, createdAt := now()
+	_, err := s.db.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO scheduled_messages (id, sender_id, receiver_id, group_id, server_channel_id, text, reply_to_id,
+		                                self_destruct_in, self_destruct_after_read, send_at, status, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	`), msg.ID, msg.SenderID, msg.ReceiverID, msg.GroupID, msg.ServerChannelID, msg.Text, msg.ReplyToID,
+		msg.SelfDestructIn, msg.SelfDestructAfterRead, utils.DBTime(msg.SendAt), models.ScheduledPending, at)
+	if err != nil {
+		return err
+	}
+	msg.Status, msg.CreatedAt = models.ScheduledPending, createdAt
+	return nil
+}
+
+func (s *scheduledMessageStore) Get(ctx context.Context, id string) (*models.ScheduledMessage, error) {
+	return scanScheduled(s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT `+scheduledColumns+` FROM scheduled_messages WHERE id = $1
+	`), id))
+}
+
+func (s *scheduledMessageStore) ForSender(ctx context.Context, senderID, receiverID, groupID, serverChannelID string) ([]models.ScheduledMessage, error) {
+	query := `SELECT ` + scheduledColumns + ` FROM scheduled_messages WHERE sender_id = $1`
+	args := []interface{}{senderID}
+	switch {
+	case receiverID != "":
+		query += ` AND receiver_id = $2`
+		args = append(args, receiverID)
+	case groupID != "":
+		query += ` AND group_id = $2`
+		args = append(args, groupID)
+	case serverChannelID != "":
+		query += ` AND server_channel_id = $2`
+		args = append(args, serverChannelID)
+	}
+	query += ` ORDER BY send_at ASC`
+
+	rows, err := s.db.QueryContext(ctx, s.d.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []models.ScheduledMessage{}
+	for rows.Next() {
+		msg, err := scanScheduled(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, *msg)
+	}
+	return messages, rows.Err()
+}
+
+// conflict maps a statement that changed nothing to ErrConflict
+func conflict(result sql.Result, err error) error {
+	if err := affected(result, err); err != ErrNotFound {
+		return err
+	}
+	return ErrConflict
+}
+
+func (s *scheduledMessageStore) Update(ctx context.Context, id, text string, sendAt time.Time) error {
+	at, _ := now()
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE scheduled_messages
+		SET text = $1, send_at = $2, status = $3, error = NULL, updated_at = $4
+		WHERE id = $5 AND status IN ($6, $7)
+	`), text, utils.DBTime(sendAt), models.ScheduledPending, at, id, models.ScheduledPending, models.ScheduledFailed)
+	return conflict(result, err)
+}
+
+func (s *scheduledMessageStore) Cancel(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		DELETE FROM scheduled_messages WHERE id = $1 AND status IN ($2, $3)
+	`), id, models.ScheduledPending, models.ScheduledFailed)
+	return conflict(result, err)
+}
+
+func (s *scheduledMessageStore) Release(ctx context.Context, claimedBefore time.Time) error {
+	_, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE scheduled_messages SET status = $1, claimed_at = NULL
+		WHERE status = $2 AND claimed_at < $3
+	`), models.ScheduledPending, models.ScheduledSending, utils.DBTime(claimedBefore))
+	return err
+}
+
+func (s *scheduledMessageStore) Due(ctx context.Context, at time.Time, limit int) ([]string, error) {
+	return scanIDs(s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT id FROM scheduled_messages
+		WHERE status = $1 AND send_at <= $2
+		ORDER BY send_at ASC
+		LIMIT $3
+	`), models.ScheduledPending, utils.DBTime(at), limit))
+}
+
+func (s *scheduledMessageStore) Claim(ctx context.Context, id string) (bool, error) {
+	at, _ := now()
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE scheduled_messages SET status = $1, claimed_at = $2
+		WHERE id = $3 AND status = $4
+	`), models.ScheduledSending, at, id, models.ScheduledPending)
+	if err := affected(result, err); err != nil {
+		if err == ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *scheduledMessageStore) Requeue(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE scheduled_messages SET status = $1, claimed_at = NULL WHERE id = $2
+	`), models.ScheduledPending, id)
+	return err
+}
+
+func (s *scheduledMessageStore) Fail(ctx context.Context, id, reason string) error {
+	at, _ := now()
+	_, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE scheduled_messages SET status = $1, error = $2, claimed_at = NULL, updated_at = $3
+		WHERE id = $4
+	`), models.ScheduledFailed, reason, at, id)
+	return err
+}
+
+func (s *scheduledMessageStore) Delete(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		DELETE FROM scheduled_messages WHERE id = $1
+	`), id)
+	return affected(result, err)
+}
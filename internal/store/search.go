@@ -0,0 +1,162 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// SearchStore finds messages by the words of their text
+type SearchStore interface {
+	// Messages returns up to limit messages a user can see that contain every
+	// term, the last one as a prefix, newest first, and reports whether
+	// there are more. Terms are lowercase words of letters and digits. A
+	// before message ID only returns messages older than it.
+	Messages(ctx context.Context, userID string, terms []string, before string, limit int) ([]Match, bool, error)
+}
+
+// Match is a message found by a search
+type Match struct {
+	MessageID string
+	// Snippet is an excerpt of the text with the matches wrapped in <mark></mark>
+	Snippet string
+	// Chat is the conversation of the message as the searching user sees it
+	Chat Chat
+	// ChatName is the name of the group, channel or server channel, or the
+	// username of the other side of a direct chat
+	ChatName string
+}
+
+type searchStore struct {
+	db *sql.DB
+	d  dialect
+}
+
+// visibleToUser selects the messages the user ($1) can see in any of their
+// chats: direct messages they have not deleted, and messages of the groups,
+// subscribed channels and servers they belong to that they have not hidden
+const visibleToUser = `m.deleted_at IS NULL
+		  AND (
+		    (m.receiver_id IS NOT NULL AND (
+		      (m.sender_id = $1 AND m.deleted_for_sender = 0)
+		      OR (m.receiver_id = $1 AND m.deleted_for_receiver = 0)
+		    ))
+		    OR (m.receiver_id IS NULL
+		      AND NOT EXISTS (
+		        SELECT 1 FROM message_deletions d WHERE d.message_id = m.id AND d.user_id = $1
+		      )
+		      AND (
+		        m.group_id IN (SELECT group_id FROM group_members WHERE user_id = $1)
+		        OR m.channel_id IN (SELECT channel_id FROM channel_subscribers WHERE user_id = $1)
+		        OR m.server_channel_id IN (
+		          SELECT sc.id FROM server_channels sc
+		          JOIN server_members sm ON sm.server_id = sc.server_id
+		          WHERE sm.user_id = $1
+		        )
+		      ))
+		  )`
+
+func (s *searchStore) Messages(ctx context.Context, userID string, terms []string, before string, limit int) ([]Match, bool, error) {
+	if len(terms) == 0 {
+		return nil, false, nil
+	}
+
+	// The direct chat partner is whoever of sender and receiver is not the user
+	snippet, from, match := s.d.fullText()
+	query := `
+		SELECT m.id, ` + snippet + `, m.group_id, m.channel_id, m.server_channel_id,
+		       CASE WHEN m.sender_id = $1 THEN m.receiver_id ELSE m.sender_id END,
+		       COALESCE(g.name, ch.name, sc.name, ou.username, '')
+		FROM ` + from + `
+		LEFT JOIN groups g ON g.id = m.group_id
+		LEFT JOIN channels ch ON ch.id = m.channel_id
+		LEFT JOIN server_channels sc ON sc.id = m.server_channel_id
+		LEFT JOIN users ou ON m.receiver_id IS NOT NULL
+		  AND ou.id = CASE WHEN m.sender_id = $1 THEN m.receiver_id ELSE m.sender_id END
+		WHERE ` + match + `
+		  AND ` + visibleToUser
+	// One extra row tells whether there are more
+	args := []interface{}{userID, s.d.fullTextQuery(terms), limit + 1}
+
+	if before != "" {
+		query += `
+		  AND EXISTS (
+		    SELECT 1 FROM messages c
+		    WHERE c.id = $4
+		      AND (m.created_at < c.created_at OR (m.created_at = c.created_at AND m.id < c.id))
+		  )`
+		args = append(args, before)
+	}
+	query += `
+		ORDER BY m.created_at DESC, m.id DESC
+		LIMIT $3`
+
+	rows, err := s.db.QueryContext(ctx, s.d.rebind(query), args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	matches := []Match{}
+	for rows.Next() {
+		match := Match{Chat: Chat{UserID: userID}}
+		var groupID, channelID, serverChannelID, otherUserID *string
+		if err := rows.Scan(&match.MessageID, &match.Snippet, &groupID, &channelID, &serverChannelID, &otherUserID, &match.ChatName); err != nil {
+			return nil, false, err
+		}
+		switch {
+		case groupID != nil:
+			match.Chat.GroupID = *groupID
+		case channelID != nil:
+			match.Chat.ChannelID = *channelID
+		case serverChannelID != nil:
+			match.Chat.ServerChannelID = *serverChannelID
+		case otherUserID != nil:
+			match.Chat.OtherUserID = *otherUserID
+		default:
+			continue
+		}
+		matches = append(matches, match)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(matches) > limit
+	if hasMore {
+		matches = matches[:limit]
+	}
+	return matches, hasMore, nil
+}
+
+// The full-text engines: a tsvector column on PostgreSQL, an FTS5 table
+// keyed through messages_fts_keys on SQLite. Both tokenize text into words
+// of letters and digits, so the terms never need escaping beyond quotes.
+
+func (postgresDialect) fullText() (snippet, from, match string) {
+	return `ts_headline('simple', m.text, to_tsquery('simple', $2), 'StartSel=<mark>, StopSel=</mark>, MaxWords=24, MinWords=8')`,
+		`messages m`,
+		`m.search_vector @@ to_tsquery('simple', $2)`
+}
+
+// fullTextQuery ANDs the terms, the last one as a prefix so results update while typing
+func (postgresDialect) fullTextQuery(terms []string) string {
+	return strings.Join(terms, " & ") + ":*"
+}
+
+func (sqliteDialect) fullText() (snippet, from, match string) {
+	return `snippet(messages_fts, 0, '<mark>', '</mark>', '…', 16)`,
+		`messages_fts f JOIN messages_fts_keys k ON k.id = f.rowid JOIN messages m ON m.id = k.message_id`,
+		`messages_fts MATCH $2`
+}
+
+// fullTextQuery quotes each term, so words like OR and NEAR are not
+// operators, and makes the last one a prefix
+func (sqliteDialect) fullTextQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = fmt.Sprintf(`"%s"`, strings.ReplaceAll(term, `"`, `""`))
+	}
+	return strings.Join(quoted, " ") + "*"
+}
@@ -0,0 +1,27 @@
+package store
+
+import "testing"
+
+func TestFullTextQuery(t *testing.T) {
+	tests := []struct {
+		terms    []string
+		sqlite   string
+		postgres string
+	}{
+		{[]string{"hello"}, `"hello"*`, `hello:*`},
+		{[]string{"tea", "or", "coffee"}, `"tea" "or" "coffee"*`, `tea & or & coffee:*`},
+		// Words FTS5 reads as operators or column filters are plain terms
+		{[]string{"not", "near", "and"}, `"not" "near" "and"*`, `not & near & and:*`},
+		// searchTerms drops quotes, but FTS5 quoting escapes them anyway
+		{[]string{`say"hi`}, `"say""hi"*`, ""},
+		{[]string{"привет", "42"}, `"привет" "42"*`, `привет & 42:*`},
+	}
+	for _, tt := range tests {
+		if got := (sqliteDialect{}).fullTextQuery(tt.terms); got != tt.sqlite {
+			t.Errorf("SQLite query of %q = %s, want %s", tt.terms, got, tt.sqlite)
+		}
+		if got := (postgresDialect{}).fullTextQuery(tt.terms); tt.postgres != "" && got != tt.postgres {
+			t.Errorf("PostgreSQL query of %q = %s, want %s", tt.terms, got, tt.postgres)
+		}
+	}
+}
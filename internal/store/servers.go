@@ -0,0 +1,498 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// ServerStore keeps servers, their members and their text channels, sorted
+// into categories. A server counts its members in member_count, kept along
+// with them. Deleting a server deletes everything in it and its custom roles.
+type ServerStore interface {
+	// Create stores a new server with its owner as the first member and a
+	// "Text Channels" category holding #general. It sets ID, CreatedAt,
+	// MemberCount and MyRole, as the owner sees it. ErrConflict means the
+	// invite slug is taken.
+	Create(ctx context.Context, server *models.Server) error
+	// Get returns a server as seen by a user; MyRole is "" if they are not a member
+	Get(ctx context.Context, id, userID string) (*models.Server, error)
+	// GetBySlug returns the server of an invite slug as seen by a user
+	GetBySlug(ctx context.Context, slug, userID string) (*models.Server, error)
+	// ForUser returns the servers of a user, first joined first
+	ForUser(ctx context.Context, userID string) ([]models.Server, error)
+	// Update changes the fields of the request that are set; ErrConflict
+	// means the invite slug is taken
+	Update(ctx context.Context, id string, update models.UpdateServerRequest) error
+	Delete(ctx context.Context, id string) error
+
+	// Join adds a member and reports whether they were not one already
+	Join(ctx context.Context, serverID, userID string) (bool, error)
+	// RemoveMember removes a member; ErrNotFound means they were not one
+	RemoveMember(ctx context.Context, serverID, userID string) error
+	// Members returns the members of a server, first joined first
+	Members(ctx context.Context, serverID string) ([]models.ServerMember, error)
+	// UpdateMember changes the role and nickname of a member; nil ones are kept
+	UpdateMember(ctx context.Context, serverID, userID string, role, nickname *string) error
+	// MemberIDs returns the IDs of the members of a server
+	MemberIDs(ctx context.Context, serverID string) ([]string, error)
+	// Role returns the role of a member; ErrNotFound means they are not one
+	Role(ctx context.Context, serverID, userID string) (string, error)
+
+	// ChannelTree returns the categories of a server with their channels, in order
+	ChannelTree(ctx context.Context, serverID string) (*models.ServerChannelTree, error)
+	// CreateCategory stores a category at position, or below the others if
+	// position is nil. It sets ID, Position and CreatedAt.
+	CreateCategory(ctx context.Context, category *models.ServerCategory, position *int) error
+	// UpdateCategory changes the name and position of a category; nil ones are kept
+	UpdateCategory(ctx context.Context, serverID, categoryID string, name *string, position *int) error
+	// DeleteCategory deletes a category; its channels become uncategorized
+	DeleteCategory(ctx context.Context, serverID, categoryID string) error
+	// HasCategory reports whether the category belongs to the server
+	HasCategory(ctx context.Context, serverID, categoryID string) (bool, error)
+	// GetChannel returns a text channel of the server
+	GetChannel(ctx context.Context, serverID, channelID string) (*models.ServerChannel, error)
+	// CreateChannel stores a text channel at position, or below the others
+	// of its category if position is nil. It sets ID, Position and CreatedAt.
+	CreateChannel(ctx context.Context, channel *models.ServerChannel, position *int) error
+	// UpdateChannel stores the name, topic, position and category of a channel
+	UpdateChannel(ctx context.Context, channel *models.ServerChannel) error
+	DeleteChannel(ctx context.Context, serverID, channelID string) error
+	// ChannelServer returns the ID of the server a text channel belongs to
+	ChannelServer(ctx context.Context, channelID string) (string, error)
+}
+
+type serverStore struct {
+	db *sql.DB
+	d  dialect
+}
+
+// serverColumns select a server as seen by the user in $1
+const serverColumns = `s.id, s.name, s.description, s.icon_url, s.banner_url, s.owner_id, s.is_public,
+		       s.member_count, s.invite_slug, s.created_at,
+		       COALESCE((SELECT role FROM server_members WHERE server_id = s.id AND user_id = $1), '')`
+
+func scanServer(row interface{ Scan(...interface{}) error }) (*models.Server, error) {
+	var s models.Server
+	err := row.Scan(
+		&s.ID, &s.Name, &s.Description, &s.IconURL, &s.BannerURL,
+		&s.OwnerID, &s.IsPublic, &s.MemberCount, &s.InviteSlug, &s.CreatedAt, &s.MyRole,
+	)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &s, nil
+}
+
+const serverChannelColumns = `id, server_id, category_id, name, topic, position, created_at`
+
+func scanServerChannel(row interface{ Scan(...interface{}) error }) (*models.ServerChannel, error) {
+	var c models.ServerChannel
+	err := row.Scan(&c.ID, &c.ServerID, &c.CategoryID, &c.Name, &c.Topic, &c.Position, &c.CreatedAt)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &c, nil
+}
+
+func (s *serverStore) Create(ctx context.Context, server *models.Server) error {
+	server.ID = utils.GenerateUUID()
+	at, createdAt := now()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO servers (id, name, description, icon_url, banner_url, owner_id, is_public, member_count, invite_slug, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, 1, $8, $9)
+	`), server.ID, server.Name, server.Description, server.IconURL, server.BannerURL, server.OwnerID,
+		server.IsPublic, server.InviteSlug, at)
+	if s.d.isUniqueViolation(err) {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO server_members (id, server_id, user_id, role, joined_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`), utils.GenerateUUID(), server.ID, server.OwnerID, models.ServerRoleOwner, at)
+	if err != nil {
+		return err
+	}
+
+	categoryID := utils.GenerateUUID()
+	_, err = tx.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO server_categories (id, server_id, name, position, created_at)
+		VALUES ($1, $2, 'Text Channels', 0, $3)
+	`), categoryID, server.ID, at)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, s.d.rebind(`
+			INSERT INTO server_channels (id, server_id, category_id, name, position, created_at)
+			VALUES ($1, $2, $3, 'general', 0, $4)
+		`), utils.GenerateUUID(), server.ID, categoryID, at)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	server.CreatedAt, server.MemberCount, server.MyRole = createdAt, 1, models.ServerRoleOwner
+	return nil
+}
+
+func (s *serverStore) Get(ctx context.Context, id, userID string) (*models.Server, error) {
+	return scanServer(s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT `+serverColumns+`
+		FROM servers s
+		WHERE s.id = $2
+	`), userID, id))
+}
+
+func (s *serverStore) GetBySlug(ctx context.Context, slug, userID string) (*models.Server, error) {
+	return scanServer(s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT `+serverColumns+`
+		FROM servers s
+		WHERE s.invite_slug = $2
+	`), userID, slug))
+}
+
+func (s *serverStore) ForUser(ctx context.Context, userID string) ([]models.Server, error) {
+	rows, err := s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT `+serverColumns+`
+		FROM servers s
+		JOIN server_members sm ON sm.server_id = s.id
+		WHERE sm.user_id = $1
+		ORDER BY sm.joined_at ASC
+	`), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	servers := []models.Server{}
+	for rows.Next() {
+		server, err := scanServer(rows)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, *server)
+	}
+	return servers, rows.Err()
+}
+
+func (s *serverStore) Update(ctx context.Context, id string, update models.UpdateServerRequest) error {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE servers
+		SET name = COALESCE($1, name),
+		    description = COALESCE($2, description),
+		    icon_url = COALESCE($3, icon_url),
+		    banner_url = COALESCE($4, banner_url),
+		    is_public = COALESCE($5, is_public),
+		    invite_slug = COALESCE($6, invite_slug)
+		WHERE id = $7
+	`), update.Name, update.Description, update.IconURL, update.BannerURL, update.IsPublic, update.InviteSlug, id)
+	if s.d.isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return affected(result, err)
+}
+
+func (s *serverStore) Delete(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, s.d.rebind(`DELETE FROM servers WHERE id = $1`), id)
+	if err := affected(result, err); err != nil {
+		return err
+	}
+	// Roles have no foreign key to cascade from
+	_, err = tx.ExecContext(ctx, s.d.rebind(`
+		DELETE FROM roles WHERE scope_type = 'server' AND scope_id = $1
+	`), id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *serverStore) Join(ctx context.Context, serverID, userID string) (bool, error) {
+	at, _ := now()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO server_members (id, server_id, user_id, role, joined_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (server_id, user_id) DO NOTHING
+	`), utils.GenerateUUID(), serverID, userID, models.ServerRoleMember, at)
+	if err != nil {
+		return false, err
+	}
+	joined, _ := result.RowsAffected()
+	if joined > 0 {
+		_, err = tx.ExecContext(ctx, s.d.rebind(`
+			UPDATE servers SET member_count = member_count + 1 WHERE id = $1
+		`), serverID)
+		if err != nil {
+			return false, err
+		}
+	}
+	return joined > 0, tx.Commit()
+}
+
+func (s *serverStore) RemoveMember(ctx context.Context, serverID, userID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, s.d.rebind(`
+		DELETE FROM server_members WHERE server_id = $1 AND user_id = $2
+	`), serverID, userID)
+	if err := affected(result, err); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, s.d.rebind(`
+		UPDATE servers SET member_count = member_count - 1 WHERE id = $1 AND member_count > 0
+	`), serverID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *serverStore) Members(ctx context.Context, serverID string) ([]models.ServerMember, error) {
+	rows, err := s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT u.id, u.username, u.display_name, u.avatar_url, sm.nickname, sm.role, sm.joined_at
+		FROM server_members sm
+		JOIN users u ON u.id = sm.user_id
+		WHERE sm.server_id = $1
+		ORDER BY sm.joined_at ASC
+	`), serverID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []models.ServerMember{}
+	for rows.Next() {
+		var m models.ServerMember
+		if err := rows.Scan(&m.UserID, &m.Username, &m.DisplayName, &m.AvatarURL, &m.Nickname, &m.Role, &m.JoinedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func (s *serverStore) UpdateMember(ctx context.Context, serverID, userID string, role, nickname *string) error {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE server_members
+		SET role = COALESCE($1, role),
+		    nickname = COALESCE($2, nickname)
+		WHERE server_id = $3 AND user_id = $4
+	`), role, nickname, serverID, userID)
+	return affected(result, err)
+}
+
+func (s *serverStore) ChannelTree(ctx context.Context, serverID string) (*models.ServerChannelTree, error) {
+	tree := &models.ServerChannelTree{
+		Categories:    []models.ServerCategory{},
+		Uncategorized: []models.ServerChannel{},
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT id, server_id, name, position, created_at
+		FROM server_categories
+		WHERE server_id = $1
+		ORDER BY position ASC, created_at ASC
+	`), serverID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categoryIndex := make(map[string]int)
+	for rows.Next() {
+		var category models.ServerCategory
+		if err := rows.Scan(&category.ID, &category.ServerID, &category.Name, &category.Position, &category.CreatedAt); err != nil {
+			return nil, err
+		}
+		category.Channels = []models.ServerChannel{}
+		categoryIndex[category.ID] = len(tree.Categories)
+		tree.Categories = append(tree.Categories, category)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	channelRows, err := s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT `+serverChannelColumns+`
+		FROM server_channels
+		WHERE server_id = $1
+		ORDER BY position ASC, created_at ASC
+	`), serverID)
+	if err != nil {
+		return nil, err
+	}
+	defer channelRows.Close()
+
+	for channelRows.Next() {
+		channel, err := scanServerChannel(channelRows)
+		if err != nil {
+			return nil, err
+		}
+		if channel.CategoryID != nil {
+			if i, ok := categoryIndex[*channel.CategoryID]; ok {
+				tree.Categories[i].Channels = append(tree.Categories[i].Channels, *channel)
+				continue
+			}
+		}
+		tree.Uncategorized = append(tree.Uncategorized, *channel)
+	}
+	return tree, channelRows.Err()
+}
+
+func (s *serverStore) CreateCategory(ctx context.Context, category *models.ServerCategory, position *int) error {
+	if position != nil {
+		category.Position = *position
+	} else {
+		err := s.db.QueryRowContext(ctx, s.d.rebind(`
+			SELECT COALESCE(MAX(position), -1) + 1 FROM server_categories WHERE server_id = $1
+		`), category.ServerID).Scan(&category.Position)
+		if err != nil {
+			return err
+		}
+	}
+
+	category.ID = utils.GenerateUUID()
+	at, createdAt := now()
+	_, err := s.db.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO server_categories (id, server_id, name, position, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`), category.ID, category.ServerID, category.Name, category.Position, at)
+	if err != nil {
+		return err
+	}
+	category.CreatedAt = createdAt
+	return nil
+}
+
+func (s *serverStore) UpdateCategory(ctx context.Context, serverID, categoryID string, name *string, position *int) error {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE server_categories
+		SET name = COALESCE($1, name),
+		    position = COALESCE($2, position)
+		WHERE id = $3 AND server_id = $4
+	`), name, position, categoryID, serverID)
+	return affected(result, err)
+}
+
+func (s *serverStore) DeleteCategory(ctx context.Context, serverID, categoryID string) error {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		DELETE FROM server_categories WHERE id = $1 AND server_id = $2
+	`), categoryID, serverID)
+	return affected(result, err)
+}
+
+func (s *serverStore) HasCategory(ctx context.Context, serverID, categoryID string) (bool, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT COUNT(*) FROM server_categories WHERE id = $1 AND server_id = $2
+	`), categoryID, serverID).Scan(&count)
+	return count > 0, err
+}
+
+func (s *serverStore) GetChannel(ctx context.Context, serverID, channelID string) (*models.ServerChannel, error) {
+	return scanServerChannel(s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT `+serverChannelColumns+`
+		FROM server_channels
+		WHERE id = $1 AND server_id = $2
+	`), channelID, serverID))
+}
+
+func (s *serverStore) CreateChannel(ctx context.Context, channel *models.ServerChannel, position *int) error {
+	var err error
+	switch {
+	case position != nil:
+		channel.Position = *position
+	case channel.CategoryID != nil:
+		err = s.db.QueryRowContext(ctx, s.d.rebind(`
+			SELECT COALESCE(MAX(position), -1) + 1 FROM server_channels
+			WHERE server_id = $1 AND category_id = $2
+		`), channel.ServerID, *channel.CategoryID).Scan(&channel.Position)
+	default:
+		err = s.db.QueryRowContext(ctx, s.d.rebind(`
+			SELECT COALESCE(MAX(position), -1) + 1 FROM server_channels
+			WHERE server_id = $1 AND category_id IS NULL
+		`), channel.ServerID).Scan(&channel.Position)
+	}
+	if err != nil {
+		return err
+	}
+
+	channel.ID = utils.GenerateUUID()
+	at, createdAt := now()
+	_, err = s.db.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO server_channels (id, server_id, category_id, name, topic, position, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`), channel.ID, channel.ServerID, channel.CategoryID, channel.Name, channel.Topic, channel.Position, at)
+	if err != nil {
+		return err
+	}
+	channel.CreatedAt = createdAt
+	return nil
+}
+
+func (s *serverStore) UpdateChannel(ctx context.Context, channel *models.ServerChannel) error {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE server_channels
+		SET name = $1, topic = $2, position = $3, category_id = $4
+		WHERE id = $5 AND server_id = $6
+	`), channel.Name, channel.Topic, channel.Position, channel.CategoryID, channel.ID, channel.ServerID)
+	return affected(result, err)
+}
+
+func (s *serverStore) DeleteChannel(ctx context.Context, serverID, channelID string) error {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		DELETE FROM server_channels WHERE id = $1 AND server_id = $2
+	`), channelID, serverID)
+	return affected(result, err)
+}
+
+func (s *serverStore) MemberIDs(ctx context.Context, serverID string) ([]string, error) {
+	return scanIDs(s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT user_id FROM server_members WHERE server_id = $1
+	`), serverID))
+}
+
+func (s *serverStore) Role(ctx context.Context, serverID, userID string) (string, error) {
+	var role string
+	err := s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT role FROM server_members WHERE server_id = $1 AND user_id = $2
+	`), serverID, userID).Scan(&role)
+	return role, notFound(err)
+}
+
+func (s *serverStore) ChannelServer(ctx context.Context, channelID string) (string, error) {
+	var serverID string
+	err := s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT server_id FROM server_channels WHERE id = $1
+	`), channelID).Scan(&serverID)
+	return serverID, notFound(err)
+}
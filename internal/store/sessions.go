@@ -0,0 +1,206 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// ErrTokenReused is returned by SessionStore.Rotate for a refresh token that
+// was already exchanged for another
+var ErrTokenReused = errors.New("store: refresh token reused")
+
+// SessionStore keeps the logins of users. Access tokens name a session by
+// its ID; refresh tokens are only stored as hashes, and change on every
+// refresh. The hashes of the tokens a session spent are kept as long as the
+// session.
+type SessionStore interface {
+	// Create starts a session with a refresh token, setting its ID and times
+	Create(ctx context.Context, session *models.Session, refreshHash string) error
+	// Active returns a session unless it was revoked or has expired
+	Active(ctx context.Context, id string) (*models.Session, error)
+	// Rotate replaces the refresh token of an active session and extends it
+	// until expiresAt. Presenting any token the session spent before returns
+	// ErrTokenReused along with the session, which is revoked: either the
+	// client or someone who stole the token is replaying it.
+	Rotate(ctx context.Context, refreshHash, newHash string, expiresAt time.Time) (*models.Session, error)
+	// Touch records that a session is in use from an IP
+	Touch(ctx context.Context, id, ip string) error
+	// ListActive returns the active sessions of a user, last used first
+	ListActive(ctx context.Context, userID string) ([]models.Session, error)
+	// Revoke ends an active session of a user
+	Revoke(ctx context.Context, userID, id string) error
+	// RevokeOthers ends every active session of a user but keepID and returns their IDs
+	RevokeOthers(ctx context.Context, userID, keepID string) ([]string, error)
+	// DeleteEnded deletes the sessions that expired or were revoked before a time
+	DeleteEnded(ctx context.Context, before time.Time) (int64, error)
+}
+
+type sessionStore struct {
+	db *sql.DB
+	d  dialect
+}
+
+const sessionColumns = `id, user_id, device, ip, created_at, last_seen_at, expires_at`
+
+func scanSession(row interface{ Scan(...interface{}) error }) (*models.Session, error) {
+	var s models.Session
+	err := row.Scan(&s.ID, &s.UserID, &s.Device, &s.IP, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &s, nil
+}
+
+func (s *sessionStore) Create(ctx context.Context, session *models.Session, refreshHash string) error {
+	if session.ID == "" {
+		session.ID = utils.GenerateUUID()
+	}
+	at, createdAt := now()
+	_, err := s.db.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO sessions (id, user_id, refresh_hash, device, ip, created_at, last_seen_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $6, $7)
+	`), session.ID, session.UserID, refreshHash, session.Device, session.IP, at, utils.DBTime(session.ExpiresAt))
+	if err != nil {
+		return err
+	}
+	session.CreatedAt, session.LastSeenAt = createdAt, createdAt
+	return nil
+}
+
+func (s *sessionStore) Active(ctx context.Context, id string) (*models.Session, error) {
+	at, _ := now()
+	return scanSession(s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT `+sessionColumns+` FROM sessions
+		WHERE id = $1 AND revoked_at IS NULL AND expires_at > $2
+	`), id, at))
+}
+
+func (s *sessionStore) Rotate(ctx context.Context, refreshHash, newHash string, expiresAt time.Time) (*models.Session, error) {
+	at, _ := now()
+	session, err := s.rotate(ctx, refreshHash, newHash, at, expiresAt)
+	if err != ErrNotFound {
+		return session, err
+	}
+
+	session, err = scanSession(s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT `+sessionColumns+` FROM sessions
+		WHERE id = (SELECT session_id FROM retired_refresh_tokens WHERE token_hash = $1)
+	`), refreshHash))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE sessions SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL
+	`), at, session.ID); err != nil {
+		return nil, err
+	}
+	return session, ErrTokenReused
+}
+
+// rotate swaps the refresh token of an active session and retires the old one
+func (s *sessionStore) rotate(ctx context.Context, refreshHash, newHash, at string, expiresAt time.Time) (*models.Session, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// The condition on the old hash makes one of two concurrent refreshes lose
+	result, err := tx.ExecContext(ctx, s.d.rebind(`
+		UPDATE sessions SET refresh_hash = $1, last_seen_at = $2, expires_at = $3
+		WHERE refresh_hash = $4 AND revoked_at IS NULL AND expires_at > $2
+	`), newHash, at, utils.DBTime(expiresAt), refreshHash)
+	if err := affected(result, err); err != nil {
+		return nil, err
+	}
+	session, err := scanSession(tx.QueryRowContext(ctx, s.d.rebind(`
+		SELECT `+sessionColumns+` FROM sessions WHERE refresh_hash = $1
+	`), newHash))
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO retired_refresh_tokens (token_hash, session_id, retired_at) VALUES ($1, $2, $3)
+	`), refreshHash, session.ID, at)
+	if err != nil {
+		return nil, err
+	}
+	return session, tx.Commit()
+}
+
+func (s *sessionStore) Touch(ctx context.Context, id, ip string) error {
+	at, _ := now()
+	_, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE sessions SET last_seen_at = $1, ip = $2 WHERE id = $3
+	`), at, ip, id)
+	return err
+}
+
+func (s *sessionStore) ListActive(ctx context.Context, userID string) ([]models.Session, error) {
+	at, _ := now()
+	rows, err := s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT `+sessionColumns+` FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > $2
+		ORDER BY last_seen_at DESC
+	`), userID, at)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *sessionStore) Revoke(ctx context.Context, userID, id string) error {
+	at, _ := now()
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE sessions SET revoked_at = $1
+		WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL AND expires_at > $1
+	`), at, id, userID)
+	return affected(result, err)
+}
+
+func (s *sessionStore) RevokeOthers(ctx context.Context, userID, keepID string) ([]string, error) {
+	sessions, err := s.ListActive(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	var revoked []string
+	for _, session := range sessions {
+		if session.ID == keepID {
+			continue
+		}
+		switch err := s.Revoke(ctx, userID, session.ID); err {
+		case nil:
+			revoked = append(revoked, session.ID)
+		case ErrNotFound:
+			// Ended meanwhile
+		default:
+			return revoked, err
+		}
+	}
+	return revoked, nil
+}
+
+func (s *sessionStore) DeleteEnded(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		DELETE FROM sessions WHERE expires_at < $1 OR revoked_at < $1
+	`), utils.DBTime(before))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,162 @@
+// Package store keeps the SQL of users, messages, reactions, attachments,
+// sessions, two-factor enrollments, password resets, blocks, groups,
+// channels, servers, roles, scheduled messages, search and resumable
+// uploads behind typed stores.
+// Every store runs on PostgreSQL and SQLite alike; what differs between them
+// is confined to a dialect, and package storetest checks that both behave
+// the same.
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/kvant/messenger/pkg/utils"
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+var (
+	// ErrNotFound is returned when the requested row does not exist
+	ErrNotFound = errors.New("store: not found")
+	// ErrConflict is returned when a row with the same unique key exists
+	ErrConflict = errors.New("store: conflict")
+)
+
+// Stores are the stores of one database
+type Stores struct {
+	Users       UserStore
+	Messages    MessageStore
+	Reactions   ReactionStore
+	Attachments AttachmentStore
+	Sessions    SessionStore
+	TwoFactor   TwoFactorStore
+	Resets      PasswordResetStore
+	Blocks      BlockStore
+	Groups      GroupStore
+	Channels    ChannelStore
+	Servers     ServerStore
+	Roles       RoleStore
+	Scheduled   ScheduledMessageStore
+	Search      SearchStore
+	Uploads     UploadStore
+}
+
+// New returns the stores of db for the configured database, see utils.IsSQLite
+func New(db *sql.DB) *Stores {
+	if utils.IsSQLite() {
+		return NewSQLite(db)
+	}
+	return NewPostgres(db)
+}
+
+func NewPostgres(db *sql.DB) *Stores {
+	return newStores(db, postgresDialect{})
+}
+
+func NewSQLite(db *sql.DB) *Stores {
+	return newStores(db, sqliteDialect{})
+}
+
+func newStores(db *sql.DB, d dialect) *Stores {
+	return &Stores{
+		Users:       &userStore{db: db, d: d},
+		Messages:    &messageStore{db: db, d: d},
+		Reactions:   &reactionStore{db: db, d: d},
+		Attachments: &attachmentStore{db: db, d: d},
+		Sessions:    &sessionStore{db: db, d: d},
+		TwoFactor:   &twoFactorStore{db: db, d: d},
+		Resets:      &passwordResetStore{db: db, d: d},
+		Blocks:      &blockStore{db: db, d: d},
+		Groups:      &groupStore{db: db, d: d},
+		Channels:    &channelStore{db: db, d: d},
+		Servers:     &serverStore{db: db, d: d},
+		Roles:       &roleStore{db: db, d: d},
+		Scheduled:   &scheduledMessageStore{db: db, d: d},
+		Search:      &searchStore{db: db, d: d},
+		Uploads:     &uploadStore{db: db, d: d},
+	}
+}
+
+// dialect is what differs between the databases. Queries are written for
+// PostgreSQL and rebound for the driver.
+type dialect interface {
+	// rebind rewrites the $N placeholders of a query
+	rebind(query string) string
+	// ilike is the case-insensitive LIKE operator
+	ilike() string
+	// isUniqueViolation reports whether err comes from a unique constraint
+	isUniqueViolation(err error) bool
+	// fullText returns the snippet expression, the FROM clause binding the
+	// messages to m, and the condition matching the engine query in $2
+	fullText() (snippet, from, match string)
+	// fullTextQuery builds the engine query matching every term
+	fullTextQuery(terms []string) string
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) rebind(query string) string { return query }
+
+func (postgresDialect) ilike() string { return "ILIKE" }
+
+func (postgresDialect) isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+type sqliteDialect struct{}
+
+var placeholder = regexp.MustCompile(`\$(\d+)`)
+
+// rebind uses ?N, which like $N may repeat an argument
+func (sqliteDialect) rebind(query string) string {
+	return placeholder.ReplaceAllString(query, "?$1")
+}
+
+// ilike is LIKE, which SQLite matches case-insensitively for ASCII letters only
+func (sqliteDialect) ilike() string { return "LIKE" }
+
+func (sqliteDialect) isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+}
+
+// now returns the current time in the form stored in timestamp columns, see
+// utils.DBTime, and as the time it stands for
+func now() (string, time.Time) {
+	t := time.Now().UTC().Truncate(time.Microsecond)
+	return utils.DBTime(t), t
+}
+
+// scanIDs reads the rows of a query selecting one string column
+func scanIDs(rows *sql.Rows, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// notFound maps sql.ErrNoRows to ErrNotFound
+func notFound(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
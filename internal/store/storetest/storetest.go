@@ -0,0 +1,2013 @@
+// Package storetest is the contract every dialect of package store meets:
+// the same calls give the same results on PostgreSQL and SQLite. The
+// storecheck command runs it against both.
+package storetest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// Check is one behaviour of the stores. Checks share the database, so each
+// creates its own users.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context, s *store.Stores) error
+}
+
+// Checks is the contract, in the order Run runs it
+var Checks = []Check{
+	{"users/create", checkCreateUser},
+	{"users/search", checkSearchUsers},
+	{"users/update", checkUpdateUser},
+	{"messages/create", checkCreateMessage},
+	{"messages/edit", checkEditMessage},
+	{"messages/delete", checkDeleteMessage},
+	{"messages/pin", checkPinMessage},
+	{"messages/page", checkMessagePage},
+	{"messages/in-chat", checkMessageInChat},
+	{"messages/recent", checkRecentChats},
+	{"messages/mark-read", checkMarkRead},
+	{"search", checkSearch},
+	{"reactions", checkReactions},
+	{"attachments", checkAttachments},
+	{"uploads", checkUploads},
+	{"sessions", checkSessions},
+	{"two-factor", checkTwoFactor},
+	{"password-resets", checkPasswordResets},
+	{"account-deletion", checkAccountDeletion},
+	{"account-export", checkAccountExport},
+	{"blocks", checkBlocks},
+	{"groups", checkGroups},
+	{"channels", checkChannels},
+	{"servers", checkServers},
+	{"membership", checkMembership},
+	{"roles", checkRoles},
+	{"scheduled", checkScheduled},
+}
+
+// Failure is a check that did not pass
+type Failure struct {
+	Check string
+	Err   error
+}
+
+func (f Failure) Error() string {
+	return f.Check + ": " + f.Err.Error()
+}
+
+// Run runs every check against stores of a migrated database
+func Run(ctx context.Context, s *store.Stores) []Failure {
+	var failures []Failure
+	for _, check := range Checks {
+		if err := check.Run(ctx, s); err != nil {
+			failures = append(failures, Failure{check.Name, err})
+		}
+	}
+	return failures
+}
+
+// newUser creates a user with a unique name starting with prefix
+func newUser(ctx context.Context, s *store.Stores, prefix string) (*models.User, error) {
+	return s.Users.Create(ctx, prefix+utils.GenerateUUID()[:8], "hash")
+}
+
+// newDirectMessage stores a message from one user to another
+func newDirectMessage(ctx context.Context, s *store.Stores, from, to *models.User, text string) (*models.Message, error) {
+	msg := &models.Message{SenderID: from.ID, ReceiverID: &to.ID, Text: text}
+	if err := s.Messages.Create(ctx, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// recent reports whether t is within a minute of now, which fails if a
+// dialect stores local time instead of UTC
+func recent(t time.Time) bool {
+	d := time.Since(t)
+	return d > -time.Minute && d < time.Minute
+}
+
+func checkCreateUser(ctx context.Context, s *store.Stores) error {
+	user, err := newUser(ctx, s, "create")
+	if err != nil {
+		return err
+	}
+	if user.Role != "user" || user.Status != "online" || user.ProfileTheme != "default" || user.IsPremium {
+		return fmt.Errorf("new user has role %q, status %q, theme %q, premium %v", user.Role, user.Status, user.ProfileTheme, user.IsPremium)
+	}
+	if !recent(user.CreatedAt) {
+		return fmt.Errorf("created_at %v is not the current UTC time", user.CreatedAt)
+	}
+	if user.PasswordHash != "" {
+		return fmt.Errorf("Create returned the password hash")
+	}
+
+	if _, err := s.Users.Create(ctx, user.Username, "other"); err != store.ErrConflict {
+		return fmt.Errorf("creating a taken username returned %v, want ErrConflict", err)
+	}
+
+	found, err := s.Users.GetByUsername(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	if found.ID != user.ID || found.PasswordHash != "hash" {
+		return fmt.Errorf("GetByUsername returned user %s with hash %q", found.ID, found.PasswordHash)
+	}
+
+	if _, err := s.Users.Get(ctx, utils.GenerateUUID()); err != store.ErrNotFound {
+		return fmt.Errorf("getting an unknown user returned %v, want ErrNotFound", err)
+	}
+	return nil
+}
+
+func checkSearchUsers(ctx context.Context, s *store.Stores) error {
+	me, err := newUser(ctx, s, "Finder_")
+	if err != nil {
+		return err
+	}
+	other, err := newUser(ctx, s, "FINDER_")
+	if err != nil {
+		return err
+	}
+
+	users, err := s.Users.Search(ctx, "finder_", me.ID, 50)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, user := range users {
+		if user.ID == me.ID {
+			return fmt.Errorf("search returned the excluded user")
+		}
+		if user.PasswordHash != "" {
+			return fmt.Errorf("search returned a password hash")
+		}
+		found = found || user.ID == other.ID
+	}
+	if !found {
+		return fmt.Errorf("search is not case-insensitive")
+	}
+
+	// Wildcards in the query match themselves
+	users, err = s.Users.Search(ctx, "%", me.ID, 50)
+	if err != nil {
+		return err
+	}
+	if len(users) != 0 {
+		return fmt.Errorf("searching for %% returned %d users", len(users))
+	}
+	return nil
+}
+
+func checkUpdateUser(ctx context.Context, s *store.Stores) error {
+	user, err := newUser(ctx, s, "update")
+	if err != nil {
+		return err
+	}
+
+	name, bio := "Display", "About me"
+	if _, err := s.Users.UpdateProfile(ctx, user.ID, store.ProfileUpdate{DisplayName: &name, Bio: &bio}); err != nil {
+		return err
+	}
+	color := "#ff0000"
+	updated, err := s.Users.UpdateProfile(ctx, user.ID, store.ProfileUpdate{NameColor: &color})
+	if err != nil {
+		return err
+	}
+	if updated.DisplayName == nil || *updated.DisplayName != name || updated.Bio == nil || *updated.Bio != bio {
+		return fmt.Errorf("a partial update cleared other fields")
+	}
+	if updated.NameColor == nil || *updated.NameColor != color {
+		return fmt.Errorf("name color was not updated")
+	}
+	if !recent(updated.UpdatedAt) || updated.UpdatedAt.Before(user.UpdatedAt) {
+		return fmt.Errorf("updated_at %v did not advance from %v", updated.UpdatedAt, user.UpdatedAt)
+	}
+
+	blurhash := "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	if err := s.Users.SetAvatar(ctx, user.ID, "https://example.com/a.png", &blurhash); err != nil {
+		return err
+	}
+	if err := s.Users.SetBanner(ctx, utils.GenerateUUID(), "https://example.com/b.png", nil); err != store.ErrNotFound {
+		return fmt.Errorf("updating an unknown user returned %v, want ErrNotFound", err)
+	}
+	user, err = s.Users.Get(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	if user.AvatarURL == nil || *user.AvatarURL != "https://example.com/a.png" {
+		return fmt.Errorf("avatar was not set")
+	}
+	if user.AvatarBlurhash == nil || *user.AvatarBlurhash != blurhash || user.BannerBlurhash != nil {
+		return fmt.Errorf("avatar blurhash is %v, banner blurhash %v", user.AvatarBlurhash, user.BannerBlurhash)
+	}
+	return nil
+}
+
+func checkCreateMessage(ctx context.Context, s *store.Stores) error {
+	from, err := newUser(ctx, s, "sender")
+	if err != nil {
+		return err
+	}
+	to, err := newUser(ctx, s, "receiver")
+	if err != nil {
+		return err
+	}
+
+	clientID := "client-1"
+	timer := 60
+	destructAt := time.Now().Add(time.Minute)
+	msg := &models.Message{
+		SenderID: from.ID, ReceiverID: &to.ID, Text: "hello", ClientMessageID: &clientID,
+		SelfDestructIn: &timer, SelfDestructAt: &destructAt,
+	}
+	if err := s.Messages.Create(ctx, msg); err != nil {
+		return err
+	}
+	if msg.ID == "" || !recent(msg.CreatedAt) {
+		return fmt.Errorf("created message has id %q and created_at %v", msg.ID, msg.CreatedAt)
+	}
+
+	stored, err := s.Messages.Get(ctx, msg.ID)
+	if err != nil {
+		return err
+	}
+	if stored.Text != "hello" || stored.MessageType != "text" || stored.SenderName != from.Username || stored.IsRead {
+		return fmt.Errorf("stored message differs: %+v", stored)
+	}
+	// Create keeps the deadline as stored, to the microsecond
+	if stored.SelfDestructAt == nil || !stored.SelfDestructAt.Equal(*msg.SelfDestructAt) ||
+		destructAt.Sub(*stored.SelfDestructAt) >= time.Microsecond {
+		return fmt.Errorf("self_destruct_at %v, created with %v and kept as %v", stored.SelfDestructAt, destructAt, msg.SelfDestructAt)
+	}
+
+	again := &models.Message{SenderID: from.ID, ReceiverID: &to.ID, Text: "hello again", ClientMessageID: &clientID}
+	if err := s.Messages.Create(ctx, again); err != store.ErrConflict {
+		return fmt.Errorf("reusing a client message id returned %v, want ErrConflict", err)
+	}
+	found, err := s.Messages.FindByClientID(ctx, from.ID, clientID)
+	if err != nil {
+		return err
+	}
+	if found.ID != msg.ID {
+		return fmt.Errorf("FindByClientID returned %s, want %s", found.ID, msg.ID)
+	}
+
+	// Only the sender's own client ids collide
+	if _, err := newDirectMessage(ctx, s, to, from, "reply"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func checkEditMessage(ctx context.Context, s *store.Stores) error {
+	from, err := newUser(ctx, s, "editor")
+	if err != nil {
+		return err
+	}
+	msg, err := newDirectMessage(ctx, s, from, from, "draft")
+	if err != nil {
+		return err
+	}
+
+	edited, err := s.Messages.Edit(ctx, msg.ID, "final")
+	if err != nil {
+		return err
+	}
+	if edited.Text != "final" || edited.EditedAt == nil || !recent(*edited.EditedAt) {
+		return fmt.Errorf("edited message has text %q and edited_at %v", edited.Text, edited.EditedAt)
+	}
+	if !edited.CreatedAt.Equal(msg.CreatedAt) {
+		return fmt.Errorf("editing changed created_at")
+	}
+
+	if _, err := s.Messages.Edit(ctx, utils.GenerateUUID(), "x"); err != store.ErrNotFound {
+		return fmt.Errorf("editing an unknown message returned %v, want ErrNotFound", err)
+	}
+	return nil
+}
+
+func checkDeleteMessage(ctx context.Context, s *store.Stores) error {
+	from, err := newUser(ctx, s, "deleter")
+	if err != nil {
+		return err
+	}
+	to, err := newUser(ctx, s, "deletee")
+	if err != nil {
+		return err
+	}
+
+	msg, err := newDirectMessage(ctx, s, from, to, "secret")
+	if err != nil {
+		return err
+	}
+	if err := s.Messages.DeleteForUser(ctx, msg.ID, to.ID); err != nil {
+		return err
+	}
+	stored, err := s.Messages.Get(ctx, msg.ID)
+	if err != nil {
+		return err
+	}
+	if stored.DeletedForSender || !stored.DeletedForReceiver || stored.DeletedAt != nil {
+		return fmt.Errorf("deleting for the receiver set sender %v, receiver %v, everyone %v",
+			stored.DeletedForSender, stored.DeletedForReceiver, stored.DeletedAt != nil)
+	}
+
+	if err := s.Messages.DeleteForEveryone(ctx, msg.ID); err != nil {
+		return err
+	}
+	stored, err = s.Messages.Get(ctx, msg.ID)
+	if err != nil {
+		return err
+	}
+	if stored.Text != "[deleted]" || stored.DeletedAt == nil || !recent(*stored.DeletedAt) {
+		return fmt.Errorf("deleted message has text %q and deleted_at %v", stored.Text, stored.DeletedAt)
+	}
+
+	if err := s.Messages.DeleteForUser(ctx, utils.GenerateUUID(), to.ID); err != store.ErrNotFound {
+		return fmt.Errorf("deleting an unknown message returned %v, want ErrNotFound", err)
+	}
+	return nil
+}
+
+func checkPinMessage(ctx context.Context, s *store.Stores) error {
+	a, err := newUser(ctx, s, "pinner")
+	if err != nil {
+		return err
+	}
+	b, err := newUser(ctx, s, "pinnee")
+	if err != nil {
+		return err
+	}
+	first, err := newDirectMessage(ctx, s, a, b, "first")
+	if err != nil {
+		return err
+	}
+	second, err := newDirectMessage(ctx, s, b, a, "second")
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.Messages.Pin(ctx, first.ID); err != nil {
+		return err
+	}
+	pinnedAt, err := s.Messages.Pin(ctx, second.ID)
+	if err != nil {
+		return err
+	}
+
+	first, err = s.Messages.Get(ctx, first.ID)
+	if err != nil {
+		return err
+	}
+	second, err = s.Messages.Get(ctx, second.ID)
+	if err != nil {
+		return err
+	}
+	if first.PinnedAt != nil {
+		return fmt.Errorf("pinning a message left the previous one pinned")
+	}
+	if second.PinnedAt == nil || !second.PinnedAt.Equal(pinnedAt) {
+		return fmt.Errorf("pinned_at %v, want %v", second.PinnedAt, pinnedAt)
+	}
+
+	if err := s.Messages.Unpin(ctx, second.ID); err != nil {
+		return err
+	}
+	second, err = s.Messages.Get(ctx, second.ID)
+	if err != nil {
+		return err
+	}
+	if second.PinnedAt != nil {
+		return fmt.Errorf("unpinned message is still pinned")
+	}
+	return nil
+}
+
+func checkReactions(ctx context.Context, s *store.Stores) error {
+	a, err := newUser(ctx, s, "reactor")
+	if err != nil {
+		return err
+	}
+	b, err := newUser(ctx, s, "reactee")
+	if err != nil {
+		return err
+	}
+	msg, err := newDirectMessage(ctx, s, a, b, "react to me")
+	if err != nil {
+		return err
+	}
+	other, err := newDirectMessage(ctx, s, b, a, "no reactions")
+	if err != nil {
+		return err
+	}
+
+	for _, add := range []struct{ user, emoji string }{{a.ID, "👍"}, {a.ID, "👍"}, {b.ID, "👍"}, {b.ID, "🔥"}} {
+		if err := s.Reactions.Add(ctx, msg.ID, add.user, add.emoji); err != nil {
+			return err
+		}
+	}
+	if err := s.Reactions.Remove(ctx, msg.ID, b.ID, "👍"); err != nil {
+		return err
+	}
+
+	reactions, err := s.Reactions.ForMessages(ctx, []string{msg.ID, other.ID})
+	if err != nil {
+		return err
+	}
+	got := reactions[msg.ID]
+	if len(got) != 2 || got[0].UserID != a.ID || got[0].Emoji != "👍" || got[1].UserID != b.ID || got[1].Emoji != "🔥" {
+		return fmt.Errorf("reactions are %+v", got)
+	}
+	if len(reactions[other.ID]) != 0 {
+		return fmt.Errorf("message without reactions has %d", len(reactions[other.ID]))
+	}
+	return nil
+}
+
+func checkAttachments(ctx context.Context, s *store.Stores) error {
+	a, err := newUser(ctx, s, "uploader")
+	if err != nil {
+		return err
+	}
+	b, err := newUser(ctx, s, "other")
+	if err != nil {
+		return err
+	}
+
+	width, height := 640, 480
+	thumbnail, blurhash := "/uploads/photo_thumb.jpg", "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	photo := &models.Attachment{UploaderID: a.ID, URL: "/uploads/photo.jpg", Filename: "photo.jpg", MimeType: "image/jpeg",
+		Kind: "image", Size: 3 << 30, Width: &width, Height: &height, ThumbnailURL: &thumbnail, Blurhash: &blurhash, Checksum: "aa"}
+	doc := &models.Attachment{UploaderID: a.ID, URL: "/uploads/doc.pdf", Filename: "doc.pdf", MimeType: "application/pdf",
+		Kind: "document", Size: 1024, Checksum: "bb"}
+	foreign := &models.Attachment{UploaderID: b.ID, URL: "/uploads/b.pdf", Filename: "b.pdf", MimeType: "application/pdf",
+		Kind: "document", Size: 1, Checksum: "cc"}
+	for _, attachment := range []*models.Attachment{photo, doc, foreign} {
+		if err := s.Attachments.Create(ctx, attachment); err != nil {
+			return err
+		}
+	}
+	if !recent(photo.CreatedAt) {
+		return fmt.Errorf("created_at %v is not the current UTC time", photo.CreatedAt)
+	}
+
+	got, err := s.Attachments.Get(ctx, photo.ID)
+	if err != nil {
+		return err
+	}
+	if got.Size != photo.Size || got.Width == nil || *got.Width != width || got.DurationMS != nil || got.MessageID != nil ||
+		got.ThumbnailURL == nil || *got.ThumbnailURL != thumbnail || got.Blurhash == nil || *got.Blurhash != blurhash {
+		return fmt.Errorf("stored attachment is %+v", got)
+	}
+
+	unsent, err := s.Attachments.Unsent(ctx, time.Now().Add(time.Minute), 1000)
+	if err != nil {
+		return err
+	}
+	found := 0
+	for _, attachment := range unsent {
+		if attachment.ID == photo.ID || attachment.ID == doc.ID || attachment.ID == foreign.ID {
+			found++
+		}
+	}
+	if found != 3 {
+		return fmt.Errorf("%d of 3 new uploads are unsent", found)
+	}
+	if got, err := s.Attachments.FindUnsent(ctx, a.ID, doc.URL); err != nil || got.ID != doc.ID {
+		return fmt.Errorf("finding an unsent upload: %+v, %v", got, err)
+	}
+	if _, err := s.Attachments.FindUnsent(ctx, a.ID, foreign.URL); err != store.ErrNotFound {
+		return fmt.Errorf("finding another user's upload: %v, want ErrNotFound", err)
+	}
+
+	// Another user's upload fails the whole message
+	clientID := utils.GenerateUUID()
+	msg := &models.Message{SenderID: a.ID, ReceiverID: &b.ID, ClientMessageID: &clientID,
+		Attachments: []models.Attachment{{ID: doc.ID}, {ID: foreign.ID}}}
+	if err := s.Messages.Create(ctx, msg); err != store.ErrNotFound {
+		return fmt.Errorf("sending another user's upload: %v, want ErrNotFound", err)
+	}
+	if _, err := s.Messages.FindByClientID(ctx, a.ID, clientID); err != store.ErrNotFound {
+		return fmt.Errorf("failed message was stored: %v", err)
+	}
+
+	msg = &models.Message{SenderID: a.ID, ReceiverID: &b.ID, Attachments: []models.Attachment{{ID: doc.ID}, {ID: photo.ID}}}
+	if err := s.Messages.Create(ctx, msg); err != nil {
+		return err
+	}
+	if len(msg.Attachments) != 2 || msg.Attachments[0].ID != doc.ID || msg.Attachments[1].Filename != "photo.jpg" {
+		return fmt.Errorf("sent attachments are %+v", msg.Attachments)
+	}
+
+	if _, err := s.Attachments.FindUnsent(ctx, a.ID, photo.URL); err != store.ErrNotFound {
+		return fmt.Errorf("finding a sent upload: %v, want ErrNotFound", err)
+	}
+
+	again := &models.Message{SenderID: a.ID, ReceiverID: &b.ID, Attachments: []models.Attachment{{ID: photo.ID}}}
+	if err := s.Messages.Create(ctx, again); err != store.ErrNotFound {
+		return fmt.Errorf("sending an upload twice: %v, want ErrNotFound", err)
+	}
+
+	byMessage, err := s.Attachments.ForMessages(ctx, []string{msg.ID})
+	if err != nil {
+		return err
+	}
+	sent := byMessage[msg.ID]
+	if len(sent) != 2 || sent[0].ID != doc.ID || sent[1].ID != photo.ID || sent[0].MessageID == nil || *sent[0].MessageID != msg.ID {
+		return fmt.Errorf("attachments of the message are %+v", sent)
+	}
+
+	if err := s.Attachments.Delete(ctx, foreign.ID); err != nil {
+		return err
+	}
+	if _, err := s.Attachments.Get(ctx, foreign.ID); err != store.ErrNotFound {
+		return fmt.Errorf("deleted attachment: %v, want ErrNotFound", err)
+	}
+
+	// A file is in use while anything points to it
+	avatar := "/uploads/avatars/" + utils.GenerateUUID() + ".png"
+	if err := s.Users.SetAvatar(ctx, b.ID, avatar, nil); err != nil {
+		return err
+	}
+	unused := "/uploads/avatars/" + utils.GenerateUUID() + ".png"
+	for url, want := range map[string]int{avatar: 1, unused: 0} {
+		if uses, err := s.Attachments.FileUses(ctx, url); err != nil || uses != want {
+			return fmt.Errorf("uses of %s: %d, %v; want %d", url, uses, err, want)
+		}
+	}
+	if err := s.Users.SetBanner(ctx, a.ID, avatar, nil); err != nil {
+		return err
+	}
+	if uses, err := s.Attachments.FileUses(ctx, avatar); err != nil || uses != 2 {
+		return fmt.Errorf("uses of a banner that is also an avatar: %d, %v; want 2", uses, err)
+	}
+	return nil
+}
+
+func checkUploads(ctx context.Context, s *store.Stores) error {
+	user, err := newUser(ctx, s, "tus")
+	if err != nil {
+		return err
+	}
+
+	sum := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	upload := &models.Upload{ID: utils.GenerateUUID(), UserID: user.ID, Filename: "big.bin", Length: 10, Checksum: &sum,
+		ExpiresAt: time.Now().Add(time.Hour).UTC().Truncate(time.Second)}
+	if err := s.Uploads.Create(ctx, upload); err != nil {
+		return err
+	}
+	if !recent(upload.CreatedAt) {
+		return fmt.Errorf("created_at %v is not the current UTC time", upload.CreatedAt)
+	}
+	got, err := s.Uploads.Get(ctx, upload.ID)
+	if err != nil {
+		return err
+	}
+	if got.UserID != user.ID || got.Length != 10 || got.Offset != 0 || got.Checksum == nil || *got.Checksum != sum ||
+		!got.ExpiresAt.Equal(upload.ExpiresAt) || got.AttachmentID != nil {
+		return fmt.Errorf("stored upload is %+v", got)
+	}
+	if _, err := s.Uploads.Get(ctx, utils.GenerateUUID()); err != store.ErrNotFound {
+		return fmt.Errorf("getting an unknown upload: %v, want ErrNotFound", err)
+	}
+
+	// Advancing from a stale offset loses to the chunk that got there first
+	later := upload.ExpiresAt.Add(time.Hour)
+	if err := s.Uploads.Advance(ctx, upload.ID, 0, 4, later); err != nil {
+		return err
+	}
+	if err := s.Uploads.Advance(ctx, upload.ID, 0, 6, later); err != store.ErrConflict {
+		return fmt.Errorf("advancing from a stale offset: %v, want ErrConflict", err)
+	}
+	if got, err := s.Uploads.Get(ctx, upload.ID); err != nil || got.Offset != 4 || !got.ExpiresAt.Equal(later) {
+		return fmt.Errorf("advanced upload is %+v (%v)", got, err)
+	}
+
+	attachment := &models.Attachment{UploaderID: user.ID, URL: "/uploads/big.bin", Filename: "big.bin",
+		MimeType: "application/octet-stream", Kind: "document", Size: 10, Checksum: sum}
+	if err := s.Attachments.Create(ctx, attachment); err != nil {
+		return err
+	}
+	if err := s.Uploads.Complete(ctx, upload.ID, attachment.ID); err != nil {
+		return err
+	}
+	if got, err := s.Uploads.Get(ctx, upload.ID); err != nil || got.AttachmentID == nil || *got.AttachmentID != attachment.ID {
+		return fmt.Errorf("completed upload is %+v (%v)", got, err)
+	}
+
+	expired, err := s.Uploads.Expired(ctx, later, 1000)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, id := range expired {
+		found = found || id == upload.ID
+	}
+	if !found {
+		return fmt.Errorf("upload is not expired at its expiry")
+	}
+	if expired, err = s.Uploads.Expired(ctx, later.Add(-time.Second), 1000); err != nil {
+		return err
+	}
+	for _, id := range expired {
+		if id == upload.ID {
+			return fmt.Errorf("upload expired before its expiry")
+		}
+	}
+
+	if err := s.Uploads.Delete(ctx, upload.ID); err != nil {
+		return err
+	}
+	if err := s.Uploads.Delete(ctx, upload.ID); err != store.ErrNotFound {
+		return fmt.Errorf("deleting twice: %v, want ErrNotFound", err)
+	}
+	return nil
+}
+
+func checkSessions(ctx context.Context, s *store.Stores) error {
+	user, err := newUser(ctx, s, "session")
+	if err != nil {
+		return err
+	}
+	other, err := newUser(ctx, s, "intruder")
+	if err != nil {
+		return err
+	}
+
+	expires := time.Now().Add(time.Hour)
+	phone := &models.Session{UserID: user.ID, Device: "phone", IP: "10.0.0.1", ExpiresAt: expires}
+	laptop := &models.Session{UserID: user.ID, Device: "laptop", IP: "10.0.0.2", ExpiresAt: expires}
+	tablet := &models.Session{UserID: user.ID, Device: "tablet", IP: "10.0.0.3", ExpiresAt: expires}
+	for i, session := range []*models.Session{phone, laptop, tablet} {
+		if err := s.Sessions.Create(ctx, session, fmt.Sprintf("%s-%d", user.ID, i)); err != nil {
+			return err
+		}
+	}
+	if !recent(phone.CreatedAt) {
+		return fmt.Errorf("created_at %v is not the current UTC time", phone.CreatedAt)
+	}
+	if err := s.Sessions.Create(ctx, &models.Session{UserID: user.ID, ExpiresAt: expires}, user.ID+"-0"); err == nil {
+		return fmt.Errorf("created two sessions with the same refresh token")
+	}
+
+	// Rotating spends the old token
+	rotated, err := s.Sessions.Rotate(ctx, user.ID+"-0", user.ID+"-0b", time.Now().Add(2*time.Hour))
+	if err != nil {
+		return err
+	}
+	if rotated.ID != phone.ID || rotated.UserID != user.ID || !rotated.ExpiresAt.After(expires) {
+		return fmt.Errorf("rotated session is %+v", rotated)
+	}
+	if _, err := s.Sessions.Rotate(ctx, user.ID+"-unknown", user.ID+"-x", expires); err != store.ErrNotFound {
+		return fmt.Errorf("rotating an unknown token: %v, want ErrNotFound", err)
+	}
+	if _, err := s.Sessions.Rotate(ctx, user.ID+"-0b", user.ID+"-0c", expires); err != nil {
+		return err
+	}
+
+	// Any spent token gives the session away, not only the last one
+	reused, err := s.Sessions.Rotate(ctx, user.ID+"-0", user.ID+"-0d", expires)
+	if err != store.ErrTokenReused || reused == nil || reused.ID != phone.ID {
+		return fmt.Errorf("rotating a token spent two rotations ago: %v, want ErrTokenReused", err)
+	}
+	if _, err := s.Sessions.Active(ctx, phone.ID); err != store.ErrNotFound {
+		return fmt.Errorf("session of a reused token is active: %v", err)
+	}
+	if _, err := s.Sessions.Rotate(ctx, user.ID+"-0c", user.ID+"-0e", expires); err != store.ErrNotFound {
+		return fmt.Errorf("rotating the token of a revoked session: %v, want ErrNotFound", err)
+	}
+	if _, err := s.Sessions.Rotate(ctx, user.ID+"-0b", user.ID+"-0e", expires); err != store.ErrTokenReused {
+		return fmt.Errorf("replaying a spent token of a revoked session: %v, want ErrTokenReused", err)
+	}
+
+	if err := s.Sessions.Touch(ctx, tablet.ID, "10.0.0.4"); err != nil {
+		return err
+	}
+	sessions, err := s.Sessions.ListActive(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	if len(sessions) != 2 || sessions[0].ID != tablet.ID || sessions[0].IP != "10.0.0.4" || sessions[1].Device != "laptop" {
+		return fmt.Errorf("active sessions are %+v", sessions)
+	}
+
+	if err := s.Sessions.Revoke(ctx, other.ID, laptop.ID); err != store.ErrNotFound {
+		return fmt.Errorf("revoking another user's session: %v, want ErrNotFound", err)
+	}
+	revoked, err := s.Sessions.RevokeOthers(ctx, user.ID, tablet.ID)
+	if err != nil {
+		return err
+	}
+	if len(revoked) != 1 || revoked[0] != laptop.ID {
+		return fmt.Errorf("revoked %v, want the laptop", revoked)
+	}
+	if err := s.Sessions.Revoke(ctx, user.ID, tablet.ID); err != nil {
+		return err
+	}
+	if err := s.Sessions.Revoke(ctx, user.ID, tablet.ID); err != store.ErrNotFound {
+		return fmt.Errorf("revoking a session twice: %v, want ErrNotFound", err)
+	}
+
+	if _, err := s.Sessions.DeleteEnded(ctx, time.Now().Add(time.Minute)); err != nil {
+		return err
+	}
+	// Spent tokens go with their session
+	if _, err := s.Sessions.Rotate(ctx, user.ID+"-0", user.ID+"-0f", expires); err != store.ErrNotFound {
+		return fmt.Errorf("deleted session: %v, want ErrNotFound", err)
+	}
+	return nil
+}
+
+func checkTwoFactor(ctx context.Context, s *store.Stores) error {
+	user, err := newUser(ctx, s, "totp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.TwoFactor.Get(ctx, user.ID); err != store.ErrNotFound {
+		return fmt.Errorf("enrollment of a new user: %v, want ErrNotFound", err)
+	}
+	if err := s.TwoFactor.Enable(ctx, user.ID, 1, nil); err != store.ErrNotFound {
+		return fmt.Errorf("enabling without an enrollment: %v, want ErrNotFound", err)
+	}
+	if err := s.TwoFactor.Begin(ctx, user.ID, "first"); err != nil {
+		return err
+	}
+	// Starting over replaces a pending enrollment
+	if err := s.TwoFactor.Begin(ctx, user.ID, "second"); err != nil {
+		return err
+	}
+	tf, err := s.TwoFactor.Get(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	if tf.Secret != "second" || tf.EnabledAt != nil || !recent(tf.CreatedAt) {
+		return fmt.Errorf("pending enrollment is %+v", tf)
+	}
+
+	if err := s.TwoFactor.Enable(ctx, user.ID, 100, []string{"code-a", "code-b"}); err != nil {
+		return err
+	}
+	if err := s.TwoFactor.Begin(ctx, user.ID, "third"); err != store.ErrConflict {
+		return fmt.Errorf("enrolling again once enabled: %v, want ErrConflict", err)
+	}
+	if tf, err = s.TwoFactor.Get(ctx, user.ID); err != nil {
+		return err
+	}
+	if tf.EnabledAt == nil || !recent(*tf.EnabledAt) || tf.LastStep != 100 || tf.Secret != "second" {
+		return fmt.Errorf("enabled enrollment is %+v", tf)
+	}
+
+	// A step is accepted once, and never an earlier one
+	if err := s.TwoFactor.UseStep(ctx, user.ID, 100); err != store.ErrNotFound {
+		return fmt.Errorf("using a step twice: %v, want ErrNotFound", err)
+	}
+	if err := s.TwoFactor.UseStep(ctx, user.ID, 101); err != nil {
+		return err
+	}
+
+	lockUntil := time.Now().Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if err := s.TwoFactor.Fail(ctx, user.ID, 3, lockUntil); err != nil {
+			return err
+		}
+	}
+	if tf, err = s.TwoFactor.Get(ctx, user.ID); err != nil {
+		return err
+	}
+	if tf.LockedUntil == nil || tf.LockedUntil.Sub(lockUntil).Abs() > time.Second || tf.FailedAttempts != 0 {
+		return fmt.Errorf("after 3 wrong codes the enrollment is %+v", tf)
+	}
+	if err := s.TwoFactor.UseStep(ctx, user.ID, 102); err != nil {
+		return err
+	}
+	if tf, err = s.TwoFactor.Get(ctx, user.ID); err != nil {
+		return err
+	}
+	if tf.LockedUntil != nil || tf.FailedAttempts != 0 {
+		return fmt.Errorf("a right code left the enrollment %+v", tf)
+	}
+
+	if err := s.TwoFactor.UseRecoveryCode(ctx, user.ID, "code-a"); err != nil {
+		return err
+	}
+	if err := s.TwoFactor.UseRecoveryCode(ctx, user.ID, "code-a"); err != store.ErrNotFound {
+		return fmt.Errorf("using a recovery code twice: %v, want ErrNotFound", err)
+	}
+	if n, err := s.TwoFactor.RecoveryCodesLeft(ctx, user.ID); err != nil || n != 1 {
+		return fmt.Errorf("%d recovery codes left (%v), want 1", n, err)
+	}
+	if err := s.TwoFactor.ReplaceRecoveryCodes(ctx, user.ID, []string{"code-a", "code-c", "code-d"}); err != nil {
+		return err
+	}
+	if n, err := s.TwoFactor.RecoveryCodesLeft(ctx, user.ID); err != nil || n != 3 {
+		return fmt.Errorf("%d recovery codes left after replacing them (%v), want 3", n, err)
+	}
+
+	if err := s.TwoFactor.Disable(ctx, user.ID); err != nil {
+		return err
+	}
+	if _, err := s.TwoFactor.Get(ctx, user.ID); err != store.ErrNotFound {
+		return fmt.Errorf("disabled enrollment: %v, want ErrNotFound", err)
+	}
+	if n, err := s.TwoFactor.RecoveryCodesLeft(ctx, user.ID); err != nil || n != 0 {
+		return fmt.Errorf("%d recovery codes left after disabling (%v), want 0", n, err)
+	}
+	if err := s.TwoFactor.Disable(ctx, user.ID); err != store.ErrNotFound {
+		return fmt.Errorf("disabling twice: %v, want ErrNotFound", err)
+	}
+	return nil
+}
+
+func checkPasswordResets(ctx context.Context, s *store.Stores) error {
+	user, err := newUser(ctx, s, "reset")
+	if err != nil {
+		return err
+	}
+	other, err := newUser(ctx, s, "reset")
+	if err != nil {
+		return err
+	}
+
+	if email, err := s.Users.Email(ctx, user.ID); err != nil || email != nil {
+		return fmt.Errorf("email of a new user is %v (%v), want none", email, err)
+	}
+	address := user.Username + "@example.com"
+	if err := s.Users.SetEmail(ctx, user.ID, &address); err != nil {
+		return err
+	}
+	if err := s.Users.SetEmail(ctx, other.ID, &address); err != store.ErrConflict {
+		return fmt.Errorf("taking the address of another user: %v, want ErrConflict", err)
+	}
+	found, err := s.Users.GetByEmail(ctx, address)
+	if err != nil {
+		return err
+	}
+	if found.ID != user.ID || found.PasswordHash != "" {
+		return fmt.Errorf("user by email is %+v", found)
+	}
+	if err := s.Users.SetPassword(ctx, user.ID, "new-hash"); err != nil {
+		return err
+	}
+	if found, err = s.Users.GetByUsername(ctx, user.Username); err != nil || found.PasswordHash != "new-hash" {
+		return fmt.Errorf("password hash after setting it is %q (%v)", found.PasswordHash, err)
+	}
+
+	if err := s.Resets.Create(ctx, user.ID, "token-a", time.Now().Add(time.Hour)); err != nil {
+		return err
+	}
+	if err := s.Resets.Create(ctx, user.ID, "token-b", time.Now().Add(-time.Second)); err != nil {
+		return err
+	}
+	if userID, err := s.Resets.Use(ctx, "token-a"); err != nil || userID != user.ID {
+		return fmt.Errorf("using a token gave user %q (%v), want %q", userID, err, user.ID)
+	}
+	if _, err := s.Resets.Use(ctx, "token-a"); err != store.ErrNotFound {
+		return fmt.Errorf("using a token twice: %v, want ErrNotFound", err)
+	}
+	if _, err := s.Resets.Use(ctx, "token-b"); err != store.ErrNotFound {
+		return fmt.Errorf("using an expired token: %v, want ErrNotFound", err)
+	}
+
+	if err := s.Resets.Create(ctx, user.ID, "token-c", time.Now().Add(time.Hour)); err != nil {
+		return err
+	}
+	if err := s.Resets.DeleteForUser(ctx, user.ID); err != nil {
+		return err
+	}
+	if _, err := s.Resets.Use(ctx, "token-c"); err != store.ErrNotFound {
+		return fmt.Errorf("using a token after deleting those of the user: %v, want ErrNotFound", err)
+	}
+	return nil
+}
+
+func checkAccountDeletion(ctx context.Context, s *store.Stores) error {
+	user, err := newUser(ctx, s, "leaving")
+	if err != nil {
+		return err
+	}
+
+	if cancelled, err := s.Users.CancelDeletion(ctx, user.ID); err != nil || cancelled {
+		return fmt.Errorf("cancelling no deletion reported %v (%v)", cancelled, err)
+	}
+	if err := s.Users.ScheduleDeletion(ctx, user.ID, time.Now().Add(time.Hour)); err != nil {
+		return err
+	}
+	found, err := s.Users.Get(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	if found.DeletionScheduledAt == nil || found.DeletionScheduledAt.Before(time.Now()) {
+		return fmt.Errorf("deletion scheduled at %v, want in an hour", found.DeletionScheduledAt)
+	}
+
+	due, err := s.Users.DeletionsDue(ctx, time.Now(), 1000)
+	if err != nil {
+		return err
+	}
+	for _, id := range due {
+		if id == user.ID {
+			return fmt.Errorf("deletion is due before its time")
+		}
+	}
+	if due, err = s.Users.DeletionsDue(ctx, time.Now().Add(2*time.Hour), 1000); err != nil {
+		return err
+	}
+	found = nil
+	for _, id := range due {
+		if id == user.ID {
+			found = user
+		}
+	}
+	if found == nil {
+		return fmt.Errorf("deletion is not due after its time")
+	}
+
+	if cancelled, err := s.Users.CancelDeletion(ctx, user.ID); err != nil || !cancelled {
+		return fmt.Errorf("cancelling a deletion reported %v (%v)", cancelled, err)
+	}
+	if found, err = s.Users.Get(ctx, user.ID); err != nil || found.DeletionScheduledAt != nil {
+		return fmt.Errorf("deletion after cancelling it is %v (%v)", found.DeletionScheduledAt, err)
+	}
+	return nil
+}
+
+func checkAccountExport(ctx context.Context, s *store.Stores) error {
+	me, err := newUser(ctx, s, "export")
+	if err != nil {
+		return err
+	}
+	other, err := newUser(ctx, s, "export")
+	if err != nil {
+		return err
+	}
+	sent, err := newDirectMessage(ctx, s, me, other, "sent")
+	if err != nil {
+		return err
+	}
+	received, err := newDirectMessage(ctx, s, other, me, "received")
+	if err != nil {
+		return err
+	}
+	deleted, err := newDirectMessage(ctx, s, me, other, "deleted")
+	if err != nil {
+		return err
+	}
+	if err := s.Messages.DeleteForEveryone(ctx, deleted.ID); err != nil {
+		return err
+	}
+	if err := s.Reactions.Add(ctx, received.ID, me.ID, "👍"); err != nil {
+		return err
+	}
+	if err := s.Reactions.Add(ctx, received.ID, other.ID, "🔥"); err != nil {
+		return err
+	}
+
+	found := make(map[string]bool)
+	err = s.Messages.ForUser(ctx, me.ID, func(msg *models.Message) error {
+		found[msg.ID] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(found) != 2 || !found[sent.ID] || !found[received.ID] {
+		return fmt.Errorf("messages of the user are %v, want %s and %s", found, sent.ID, received.ID)
+	}
+
+	reactions, err := s.Reactions.ByUser(ctx, me.ID)
+	if err != nil {
+		return err
+	}
+	if len(reactions) != 1 || reactions[0].Emoji != "👍" {
+		return fmt.Errorf("reactions of the user are %+v", reactions)
+	}
+	return nil
+}
+
+func checkBlocks(ctx context.Context, s *store.Stores) error {
+	me, err := newUser(ctx, s, "blocker")
+	if err != nil {
+		return err
+	}
+	other, err := newUser(ctx, s, "blocked")
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.Blocks.Block(ctx, me.ID, other.ID); err != nil {
+			return fmt.Errorf("blocking %d times: %v", i+1, err)
+		}
+	}
+	blocked, err := s.Blocks.List(ctx, me.ID)
+	if err != nil {
+		return err
+	}
+	if len(blocked) != 1 || blocked[0].ID != other.ID || blocked[0].Username != other.Username || !recent(blocked[0].BlockedAt) {
+		return fmt.Errorf("block list is %+v", blocked)
+	}
+	for _, pair := range [][2]string{{me.ID, other.ID}, {other.ID, me.ID}} {
+		if between, err := s.Blocks.Between(ctx, pair[0], pair[1]); err != nil || !between {
+			return fmt.Errorf("block between %s and %s is %v (%v)", pair[0], pair[1], between, err)
+		}
+	}
+	related, err := s.Blocks.Related(ctx, other.ID)
+	if err != nil {
+		return err
+	}
+	if len(related) != 1 || related[0] != me.ID {
+		return fmt.Errorf("users related to the blocked user are %v", related)
+	}
+
+	// Neither finds the other
+	for _, pair := range [][2]*models.User{{me, other}, {other, me}} {
+		users, err := s.Users.Search(ctx, pair[1].Username, pair[0].ID, 10)
+		if err != nil {
+			return err
+		}
+		if len(users) != 0 {
+			return fmt.Errorf("search found %s, blocked by or blocking %s", pair[1].Username, pair[0].Username)
+		}
+	}
+
+	if err := s.Blocks.Unblock(ctx, me.ID, other.ID); err != nil {
+		return err
+	}
+	if err := s.Blocks.Unblock(ctx, me.ID, other.ID); err != store.ErrNotFound {
+		return fmt.Errorf("unblocking twice: %v, want ErrNotFound", err)
+	}
+	if between, err := s.Blocks.Between(ctx, other.ID, me.ID); err != nil || between {
+		return fmt.Errorf("block after unblocking is %v (%v)", between, err)
+	}
+	users, err := s.Users.Search(ctx, other.Username, me.ID, 10)
+	if err != nil {
+		return err
+	}
+	if len(users) != 1 {
+		return fmt.Errorf("search after unblocking found %d users", len(users))
+	}
+	return nil
+}
+
+func checkGroups(ctx context.Context, s *store.Stores) error {
+	owner, err := newUser(ctx, s, "gowner")
+	if err != nil {
+		return err
+	}
+	member, err := newUser(ctx, s, "gmember")
+	if err != nil {
+		return err
+	}
+	stranger, err := newUser(ctx, s, "gstranger")
+	if err != nil {
+		return err
+	}
+
+	// Repeats, the owner and unknown users are skipped
+	group := &models.Group{Name: "Group", OwnerID: owner.ID}
+	if err := s.Groups.Create(ctx, group, []string{member.ID, member.ID, owner.ID, utils.GenerateUUID()}); err != nil {
+		return err
+	}
+	if group.MemberCount != 2 || group.MyRole != models.GroupRoleOwner || !recent(group.CreatedAt) {
+		return fmt.Errorf("created group is %+v", group)
+	}
+	got, err := s.Groups.Get(ctx, group.ID, stranger.ID)
+	if err != nil {
+		return err
+	}
+	if got.Name != group.Name || got.MemberCount != 2 || got.MyRole != "" {
+		return fmt.Errorf("group seen by a stranger is %+v", got)
+	}
+
+	if err := s.Groups.AddMember(ctx, group.ID, stranger.ID, models.GroupRoleMember); err != nil {
+		return err
+	}
+	if err := s.Groups.AddMember(ctx, group.ID, stranger.ID, models.GroupRoleMember); err != store.ErrConflict {
+		return fmt.Errorf("adding a member twice: %v, want ErrConflict", err)
+	}
+	if err := s.Groups.AddMember(ctx, group.ID, utils.GenerateUUID(), models.GroupRoleMember); err != store.ErrNotFound {
+		return fmt.Errorf("adding an unknown user: %v, want ErrNotFound", err)
+	}
+	groups, err := s.Groups.ForUser(ctx, stranger.ID)
+	if err != nil {
+		return err
+	}
+	if len(groups) != 1 || groups[0].ID != group.ID || groups[0].MyRole != models.GroupRoleMember {
+		return fmt.Errorf("groups of the added member are %+v", groups)
+	}
+
+	if err := s.Groups.RemoveMember(ctx, group.ID, stranger.ID); err != nil {
+		return err
+	}
+	if err := s.Groups.RemoveMember(ctx, group.ID, stranger.ID); err != store.ErrNotFound {
+		return fmt.Errorf("removing a member twice: %v, want ErrNotFound", err)
+	}
+
+	// The owner leaving hands the group to the admin
+	if err := s.Groups.SetRole(ctx, group.ID, member.ID, models.GroupRoleAdmin); err != nil {
+		return err
+	}
+	newOwnerID, deleted, err := s.Groups.Leave(ctx, group.ID, owner.ID, true)
+	if err != nil {
+		return err
+	}
+	if newOwnerID != member.ID || deleted {
+		return fmt.Errorf("owner leaving gave the group to %q, deleted %v", newOwnerID, deleted)
+	}
+	got, err = s.Groups.Get(ctx, group.ID, member.ID)
+	if err != nil {
+		return err
+	}
+	if got.OwnerID != member.ID || got.MyRole != models.GroupRoleOwner || got.MemberCount != 1 {
+		return fmt.Errorf("group after the owner left is %+v", got)
+	}
+	members, err := s.Groups.Members(ctx, group.ID)
+	if err != nil {
+		return err
+	}
+	if len(members) != 1 || members[0].UserID != member.ID || members[0].Username != member.Username {
+		return fmt.Errorf("members after the owner left are %+v", members)
+	}
+
+	// The last member leaving deletes it
+	if _, deleted, err = s.Groups.Leave(ctx, group.ID, member.ID, true); err != nil || !deleted {
+		return fmt.Errorf("last member leaving deleted the group: %v (%v)", deleted, err)
+	}
+	if _, err := s.Groups.Get(ctx, group.ID, member.ID); err != store.ErrNotFound {
+		return fmt.Errorf("getting a deleted group: %v, want ErrNotFound", err)
+	}
+	return nil
+}
+
+func checkChannels(ctx context.Context, s *store.Stores) error {
+	owner, err := newUser(ctx, s, "cowner")
+	if err != nil {
+		return err
+	}
+	subscriber, err := newUser(ctx, s, "csub")
+	if err != nil {
+		return err
+	}
+
+	slug := utils.GenerateSlug()
+	channel := &models.Channel{Name: "Channel", OwnerID: owner.ID, IsPublic: true, InviteSlug: &slug}
+	if err := s.Channels.Create(ctx, channel); err != nil {
+		return err
+	}
+	if channel.SubscriberCount != 1 || channel.MyRole != models.ChannelRoleOwner || !recent(channel.CreatedAt) {
+		return fmt.Errorf("created channel is %+v", channel)
+	}
+	taken := &models.Channel{Name: "Taken", OwnerID: owner.ID, InviteSlug: &slug}
+	if err := s.Channels.Create(ctx, taken); err != store.ErrConflict {
+		return fmt.Errorf("creating a channel with a taken slug: %v, want ErrConflict", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.Channels.Subscribe(ctx, channel.ID, subscriber.ID); err != nil {
+			return fmt.Errorf("subscribing %d times: %v", i+1, err)
+		}
+	}
+	got, err := s.Channels.GetBySlug(ctx, slug, subscriber.ID)
+	if err != nil {
+		return err
+	}
+	if got.ID != channel.ID || got.SubscriberCount != 2 || got.MyRole != models.ChannelRoleSubscriber {
+		return fmt.Errorf("channel seen by its subscriber is %+v", got)
+	}
+	channels, err := s.Channels.ForUser(ctx, subscriber.ID)
+	if err != nil {
+		return err
+	}
+	if len(channels) != 1 || channels[0].ID != channel.ID {
+		return fmt.Errorf("channels of the subscriber are %+v", channels)
+	}
+
+	otherSlug := utils.GenerateSlug()
+	other := &models.Channel{Name: "Other", OwnerID: owner.ID, InviteSlug: &otherSlug}
+	if err := s.Channels.Create(ctx, other); err != nil {
+		return err
+	}
+	if err := s.Channels.Update(ctx, other.ID, models.UpdateChannelRequest{InviteSlug: &slug}); err != store.ErrConflict {
+		return fmt.Errorf("taking the slug of another channel: %v, want ErrConflict", err)
+	}
+	name := "Renamed"
+	if err := s.Channels.Update(ctx, other.ID, models.UpdateChannelRequest{Name: &name}); err != nil {
+		return err
+	}
+	if got, err := s.Channels.Get(ctx, other.ID, owner.ID); err != nil || got.Name != name || *got.InviteSlug != otherSlug {
+		return fmt.Errorf("renamed channel is %+v (%v)", got, err)
+	}
+
+	if err := s.Channels.SetRole(ctx, channel.ID, subscriber.ID, models.ChannelRoleAdmin); err != nil {
+		return err
+	}
+	subscribers, err := s.Channels.Subscribers(ctx, channel.ID)
+	if err != nil {
+		return err
+	}
+	if len(subscribers) != 2 || subscribers[1].UserID != subscriber.ID || subscribers[1].Role != models.ChannelRoleAdmin {
+		return fmt.Errorf("subscribers are %+v", subscribers)
+	}
+
+	if err := s.Channels.Unsubscribe(ctx, channel.ID, subscriber.ID); err != nil {
+		return err
+	}
+	if err := s.Channels.Unsubscribe(ctx, channel.ID, subscriber.ID); err != store.ErrNotFound {
+		return fmt.Errorf("unsubscribing twice: %v, want ErrNotFound", err)
+	}
+	if got, err := s.Channels.Get(ctx, channel.ID, subscriber.ID); err != nil || got.SubscriberCount != 1 || got.MyRole != "" {
+		return fmt.Errorf("channel after unsubscribing is %+v (%v)", got, err)
+	}
+
+	if err := s.Channels.Delete(ctx, channel.ID); err != nil {
+		return err
+	}
+	if _, err := s.Channels.Get(ctx, channel.ID, owner.ID); err != store.ErrNotFound {
+		return fmt.Errorf("getting a deleted channel: %v, want ErrNotFound", err)
+	}
+	return s.Channels.Delete(ctx, other.ID)
+}
+
+func checkServers(ctx context.Context, s *store.Stores) error {
+	owner, err := newUser(ctx, s, "sowner")
+	if err != nil {
+		return err
+	}
+	member, err := newUser(ctx, s, "smember")
+	if err != nil {
+		return err
+	}
+
+	slug := utils.GenerateSlug()
+	server := &models.Server{Name: "Server", OwnerID: owner.ID, IsPublic: true, InviteSlug: &slug}
+	if err := s.Servers.Create(ctx, server); err != nil {
+		return err
+	}
+	if server.MemberCount != 1 || server.MyRole != models.ServerRoleOwner || !recent(server.CreatedAt) {
+		return fmt.Errorf("created server is %+v", server)
+	}
+	if err := s.Servers.Create(ctx, &models.Server{Name: "Taken", OwnerID: owner.ID, InviteSlug: &slug}); err != store.ErrConflict {
+		return fmt.Errorf("creating a server with a taken slug: %v, want ErrConflict", err)
+	}
+
+	// New servers start with #general in "Text Channels"
+	tree, err := s.Servers.ChannelTree(ctx, server.ID)
+	if err != nil {
+		return err
+	}
+	if len(tree.Categories) != 1 || tree.Categories[0].Name != "Text Channels" || len(tree.Uncategorized) != 0 ||
+		len(tree.Categories[0].Channels) != 1 || tree.Categories[0].Channels[0].Name != "general" {
+		return fmt.Errorf("channel tree of a new server is %+v", tree)
+	}
+
+	for i, want := range []bool{true, false} {
+		if joined, err := s.Servers.Join(ctx, server.ID, member.ID); err != nil || joined != want {
+			return fmt.Errorf("joining %d times reported %v (%v)", i+1, joined, err)
+		}
+	}
+	got, err := s.Servers.GetBySlug(ctx, slug, member.ID)
+	if err != nil {
+		return err
+	}
+	if got.ID != server.ID || got.MemberCount != 2 || got.MyRole != models.ServerRoleMember {
+		return fmt.Errorf("server seen by its member is %+v", got)
+	}
+	servers, err := s.Servers.ForUser(ctx, member.ID)
+	if err != nil {
+		return err
+	}
+	if len(servers) != 1 || servers[0].ID != server.ID {
+		return fmt.Errorf("servers of the member are %+v", servers)
+	}
+
+	nickname := "nick"
+	if err := s.Servers.UpdateMember(ctx, server.ID, member.ID, nil, &nickname); err != nil {
+		return err
+	}
+	members, err := s.Servers.Members(ctx, server.ID)
+	if err != nil {
+		return err
+	}
+	if len(members) != 2 || members[1].UserID != member.ID || members[1].Role != models.ServerRoleMember ||
+		members[1].Nickname == nil || *members[1].Nickname != nickname {
+		return fmt.Errorf("members are %+v", members)
+	}
+
+	// New categories and channels go to the bottom
+	category := &models.ServerCategory{ServerID: server.ID, Name: "Voice"}
+	if err := s.Servers.CreateCategory(ctx, category, nil); err != nil {
+		return err
+	}
+	if category.Position != 1 {
+		return fmt.Errorf("new category is at %d, want 1", category.Position)
+	}
+	if ok, err := s.Servers.HasCategory(ctx, server.ID, category.ID); err != nil || !ok {
+		return fmt.Errorf("server has its new category: %v (%v)", ok, err)
+	}
+	channel := &models.ServerChannel{ServerID: server.ID, CategoryID: &tree.Categories[0].ID, Name: "random"}
+	if err := s.Servers.CreateChannel(ctx, channel, nil); err != nil {
+		return err
+	}
+	if channel.Position != 1 {
+		return fmt.Errorf("new channel is at %d, want 1", channel.Position)
+	}
+	channel.CategoryID = &category.ID
+	if err := s.Servers.UpdateChannel(ctx, channel); err != nil {
+		return err
+	}
+	if err := s.Servers.DeleteCategory(ctx, server.ID, category.ID); err != nil {
+		return err
+	}
+	if err := s.Servers.DeleteCategory(ctx, server.ID, category.ID); err != store.ErrNotFound {
+		return fmt.Errorf("deleting a category twice: %v, want ErrNotFound", err)
+	}
+	moved, err := s.Servers.GetChannel(ctx, server.ID, channel.ID)
+	if err != nil {
+		return err
+	}
+	if moved.CategoryID != nil || moved.Name != "random" {
+		return fmt.Errorf("channel of a deleted category is %+v", moved)
+	}
+	if err := s.Servers.DeleteChannel(ctx, server.ID, channel.ID); err != nil {
+		return err
+	}
+	if _, err := s.Servers.GetChannel(ctx, server.ID, channel.ID); err != store.ErrNotFound {
+		return fmt.Errorf("getting a deleted channel: %v, want ErrNotFound", err)
+	}
+
+	if err := s.Servers.RemoveMember(ctx, server.ID, member.ID); err != nil {
+		return err
+	}
+	if err := s.Servers.RemoveMember(ctx, server.ID, member.ID); err != store.ErrNotFound {
+		return fmt.Errorf("removing a member twice: %v, want ErrNotFound", err)
+	}
+	if got, err := s.Servers.Get(ctx, server.ID, member.ID); err != nil || got.MemberCount != 1 || got.MyRole != "" {
+		return fmt.Errorf("server after the member left is %+v (%v)", got, err)
+	}
+
+	if err := s.Servers.Delete(ctx, server.ID); err != nil {
+		return err
+	}
+	if _, err := s.Servers.Get(ctx, server.ID, owner.ID); err != store.ErrNotFound {
+		return fmt.Errorf("getting a deleted server: %v, want ErrNotFound", err)
+	}
+	return nil
+}
+
+// ids returns the IDs of messages in order
+func ids(messages []models.Message) []string {
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	return ids
+}
+
+func sameIDs(got []string, want ...string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func checkMessagePage(ctx context.Context, s *store.Stores) error {
+	me, err := newUser(ctx, s, "pager")
+	if err != nil {
+		return err
+	}
+	other, err := newUser(ctx, s, "paged")
+	if err != nil {
+		return err
+	}
+
+	var sent []string
+	for i := 0; i < 5; i++ {
+		msg, err := newDirectMessage(ctx, s, me, other, fmt.Sprintf("page %d", i))
+		if err != nil {
+			return err
+		}
+		sent = append(sent, msg.ID)
+	}
+	// Messages deleted for the user are skipped
+	hidden, err := newDirectMessage(ctx, s, other, me, "hidden")
+	if err != nil {
+		return err
+	}
+	if err := s.Messages.DeleteForUser(ctx, hidden.ID, me.ID); err != nil {
+		return err
+	}
+	chat := store.Chat{UserID: me.ID, OtherUserID: other.ID}
+
+	// Listed in the order sent, which is the order paging walks
+	all, hasMore, err := s.Messages.Page(ctx, chat, store.Cursor{}, false, 10)
+	if err != nil {
+		return err
+	}
+	if hasMore || !sameIDs(ids(all), sent...) {
+		return fmt.Errorf("the whole chat is %v (more %v), want %v", ids(all), hasMore, sent)
+	}
+
+	latest, hasMore, err := s.Messages.Page(ctx, chat, store.Cursor{}, false, 2)
+	if err != nil {
+		return err
+	}
+	if !hasMore || !sameIDs(ids(latest), sent[3:]...) {
+		return fmt.Errorf("the latest page is %v (more %v), want %v", ids(latest), hasMore, sent[3:])
+	}
+
+	// Walking one message at a time neither skips nor repeats messages that
+	// share a time
+	var older []string
+	cursor := store.Cursor{ID: sent[4]}
+	for {
+		page, hasMore, err := s.Messages.Page(ctx, chat, cursor, false, 1)
+		if err != nil {
+			return err
+		}
+		if len(page) == 1 {
+			older = append([]string{page[0].ID}, older...)
+			cursor.ID = page[0].ID
+		}
+		if !hasMore {
+			break
+		}
+	}
+	if !sameIDs(older, sent[:4]...) {
+		return fmt.Errorf("walking back from the newest gave %v, want %v", older, sent[:4])
+	}
+	var newer []string
+	cursor = store.Cursor{ID: sent[0]}
+	for {
+		page, hasMore, err := s.Messages.Page(ctx, chat, cursor, true, 1)
+		if err != nil {
+			return err
+		}
+		if len(page) == 1 {
+			newer = append(newer, page[0].ID)
+			cursor.ID = page[0].ID
+		}
+		if !hasMore {
+			break
+		}
+	}
+	if !sameIDs(newer, sent[1:]...) {
+		return fmt.Errorf("walking on from the oldest gave %v, want %v", newer, sent[1:])
+	}
+
+	// A time cursor pages from that time
+	first, err := s.Messages.Get(ctx, sent[0])
+	if err != nil {
+		return err
+	}
+	before, _, err := s.Messages.Page(ctx, chat, store.Cursor{At: first.CreatedAt}, false, 10)
+	if err != nil {
+		return err
+	}
+	if len(before) != 0 {
+		return fmt.Errorf("messages before the first one are %v", ids(before))
+	}
+	after, _, err := s.Messages.Page(ctx, chat, store.Cursor{At: first.CreatedAt.Add(-time.Second)}, true, 10)
+	if err != nil {
+		return err
+	}
+	if !sameIDs(ids(after), sent...) {
+		return fmt.Errorf("messages after a time before the first one are %v, want %v", ids(after), sent)
+	}
+	return nil
+}
+
+func checkMessageInChat(ctx context.Context, s *store.Stores) error {
+	me, err := newUser(ctx, s, "inchat")
+	if err != nil {
+		return err
+	}
+	other, err := newUser(ctx, s, "inchat")
+	if err != nil {
+		return err
+	}
+	stranger, err := newUser(ctx, s, "inchat")
+	if err != nil {
+		return err
+	}
+
+	msg, err := newDirectMessage(ctx, s, me, other, "in chat")
+	if err != nil {
+		return err
+	}
+	if got, err := s.Messages.InChat(ctx, store.Chat{UserID: other.ID, OtherUserID: me.ID}, msg.ID); err != nil || got.ID != msg.ID {
+		return fmt.Errorf("message seen from the other side is %+v (%v)", got, err)
+	}
+	if _, err := s.Messages.InChat(ctx, store.Chat{UserID: stranger.ID, OtherUserID: me.ID}, msg.ID); err != store.ErrNotFound {
+		return fmt.Errorf("message of another chat: %v, want ErrNotFound", err)
+	}
+	if err := s.Messages.DeleteForUser(ctx, msg.ID, other.ID); err != nil {
+		return err
+	}
+	if _, err := s.Messages.InChat(ctx, store.Chat{UserID: other.ID, OtherUserID: me.ID}, msg.ID); err != store.ErrNotFound {
+		return fmt.Errorf("message the user deleted: %v, want ErrNotFound", err)
+	}
+
+	listed, err := s.Messages.List(ctx, []string{msg.ID, utils.GenerateUUID()})
+	if err != nil {
+		return err
+	}
+	if len(listed) != 1 || listed[0].ID != msg.ID || listed[0].SenderName != me.Username {
+		return fmt.Errorf("listed messages are %+v", listed)
+	}
+	return nil
+}
+
+func checkRecentChats(ctx context.Context, s *store.Stores) error {
+	me, err := newUser(ctx, s, "recent")
+	if err != nil {
+		return err
+	}
+	first, err := newUser(ctx, s, "recent")
+	if err != nil {
+		return err
+	}
+	second, err := newUser(ctx, s, "recent")
+	if err != nil {
+		return err
+	}
+
+	if _, err := newDirectMessage(ctx, s, me, first, "old"); err != nil {
+		return err
+	}
+	if _, err := newDirectMessage(ctx, s, second, me, "new"); err != nil {
+		return err
+	}
+
+	chats, err := s.Messages.Recent(ctx, me.ID, 10)
+	if err != nil {
+		return err
+	}
+	if len(chats) != 2 || chats[0].ID != second.ID || chats[1].ID != first.ID || chats[0].Username != second.Username {
+		return fmt.Errorf("recent chats are %+v", chats)
+	}
+	if chats, err := s.Messages.Recent(ctx, me.ID, 1); err != nil || len(chats) != 1 {
+		return fmt.Errorf("one recent chat is %+v (%v)", chats, err)
+	}
+	return nil
+}
+
+func checkMarkRead(ctx context.Context, s *store.Stores) error {
+	sender, err := newUser(ctx, s, "rsender")
+	if err != nil {
+		return err
+	}
+	reader, err := newUser(ctx, s, "rreader")
+	if err != nil {
+		return err
+	}
+
+	plain, err := newDirectMessage(ctx, s, sender, reader, "plain")
+	if err != nil {
+		return err
+	}
+	seconds := 60
+	timed := &models.Message{SenderID: sender.ID, ReceiverID: &reader.ID, Text: "timed", SelfDestructIn: &seconds}
+	if err := s.Messages.Create(ctx, timed); err != nil {
+		return err
+	}
+	// The reader's own messages stay unread
+	if _, err := newDirectMessage(ctx, s, reader, sender, "reply"); err != nil {
+		return err
+	}
+
+	if n, err := s.Messages.MarkRead(ctx, sender.ID, reader.ID); err != nil || n != 2 {
+		return fmt.Errorf("marking read returned %d (%v), want 2", n, err)
+	}
+	if n, err := s.Messages.MarkRead(ctx, sender.ID, reader.ID); err != nil || n != 0 {
+		return fmt.Errorf("marking read again returned %d (%v), want 0", n, err)
+	}
+
+	got, err := s.Messages.Get(ctx, plain.ID)
+	if err != nil {
+		return err
+	}
+	if !got.IsRead || got.ReadAt == nil || !recent(*got.ReadAt) || got.SelfDestructAt != nil {
+		return fmt.Errorf("read message is %+v", got)
+	}
+	// The timer runs from reading, in UTC whatever the session time zone
+	got, err = s.Messages.Get(ctx, timed.ID)
+	if err != nil {
+		return err
+	}
+	if got.ReadAt == nil || got.SelfDestructAt == nil || !got.SelfDestructAt.Equal(got.ReadAt.Add(time.Minute)) {
+		return fmt.Errorf("read timed message was read at %v and self-destructs at %v", got.ReadAt, got.SelfDestructAt)
+	}
+	return nil
+}
+
+func checkSearch(ctx context.Context, s *store.Stores) error {
+	me, err := newUser(ctx, s, "searcher")
+	if err != nil {
+		return err
+	}
+	other, err := newUser(ctx, s, "searched")
+	if err != nil {
+		return err
+	}
+	stranger, err := newUser(ctx, s, "searched")
+	if err != nil {
+		return err
+	}
+
+	// A word unique to this run keeps other checks' messages out
+	word := "zq" + utils.GenerateSlug()[:6]
+	mine, err := newDirectMessage(ctx, s, me, other, "tea or coffee "+word+"suffix")
+	if err != nil {
+		return err
+	}
+	if _, err := newDirectMessage(ctx, s, me, other, "nothing to find"); err != nil {
+		return err
+	}
+	group := &models.Group{Name: "Searched", OwnerID: other.ID}
+	if err := s.Groups.Create(ctx, group, []string{me.ID}); err != nil {
+		return err
+	}
+	inGroup := &models.Message{SenderID: other.ID, GroupID: &group.ID, Text: word + " in the group"}
+	if err := s.Messages.Create(ctx, inGroup); err != nil {
+		return err
+	}
+	// Chats the searcher is not in never match
+	if _, err := newDirectMessage(ctx, s, other, stranger, word+" elsewhere"); err != nil {
+		return err
+	}
+	hidden, err := newDirectMessage(ctx, s, other, me, word+" hidden")
+	if err != nil {
+		return err
+	}
+	if err := s.Messages.DeleteForUser(ctx, hidden.ID, me.ID); err != nil {
+		return err
+	}
+
+	// The last term is a prefix, newest first
+	matches, hasMore, err := s.Search.Messages(ctx, me.ID, []string{word[:5]}, "", 10)
+	if err != nil {
+		return err
+	}
+	if hasMore || len(matches) != 2 || matches[0].MessageID != inGroup.ID || matches[1].MessageID != mine.ID {
+		return fmt.Errorf("prefix search found %+v (more %v)", matches, hasMore)
+	}
+	if matches[0].Chat.GroupID != group.ID || matches[0].ChatName != group.Name {
+		return fmt.Errorf("group match is %+v", matches[0])
+	}
+	if matches[1].Chat.OtherUserID != other.ID || matches[1].ChatName != other.Username {
+		return fmt.Errorf("direct match is %+v", matches[1])
+	}
+	if !strings.Contains(matches[1].Snippet, "<mark>") {
+		return fmt.Errorf("snippet %q marks nothing", matches[1].Snippet)
+	}
+
+	// Words the engines use as operators are plain terms
+	matches, _, err = s.Search.Messages(ctx, me.ID, []string{"or", word}, "", 10)
+	if err != nil {
+		return err
+	}
+	if len(matches) != 1 || matches[0].MessageID != mine.ID {
+		return fmt.Errorf("search with an operator word found %+v", matches)
+	}
+	// Every term must match; only the last is a prefix
+	if matches, _, err = s.Search.Messages(ctx, me.ID, []string{word[:5], "tea"}, "", 10); err != nil || len(matches) != 0 {
+		return fmt.Errorf("a prefix before the last term found %+v (%v)", matches, err)
+	}
+
+	// Paging
+	matches, hasMore, err = s.Search.Messages(ctx, me.ID, []string{word}, "", 1)
+	if err != nil {
+		return err
+	}
+	if !hasMore || len(matches) != 1 || matches[0].MessageID != inGroup.ID {
+		return fmt.Errorf("first page is %+v (more %v)", matches, hasMore)
+	}
+	matches, hasMore, err = s.Search.Messages(ctx, me.ID, []string{word}, inGroup.ID, 1)
+	if err != nil {
+		return err
+	}
+	if hasMore || len(matches) != 1 || matches[0].MessageID != mine.ID {
+		return fmt.Errorf("second page is %+v (more %v)", matches, hasMore)
+	}
+	return nil
+}
+
+func checkMembership(ctx context.Context, s *store.Stores) error {
+	owner, err := newUser(ctx, s, "mowner")
+	if err != nil {
+		return err
+	}
+	member, err := newUser(ctx, s, "mmember")
+	if err != nil {
+		return err
+	}
+	stranger, err := newUser(ctx, s, "mstranger")
+	if err != nil {
+		return err
+	}
+
+	group := &models.Group{Name: "Members", OwnerID: owner.ID}
+	if err := s.Groups.Create(ctx, group, []string{member.ID}); err != nil {
+		return err
+	}
+	if role, err := s.Groups.Role(ctx, group.ID, member.ID); err != nil || role != models.GroupRoleMember {
+		return fmt.Errorf("role in the group is %q (%v)", role, err)
+	}
+	if _, err := s.Groups.Role(ctx, group.ID, stranger.ID); err != store.ErrNotFound {
+		return fmt.Errorf("role of a stranger in the group: %v, want ErrNotFound", err)
+	}
+	if ids, err := s.Groups.MemberIDs(ctx, group.ID); err != nil || len(ids) != 2 {
+		return fmt.Errorf("group member IDs are %v (%v)", ids, err)
+	}
+
+	slug := utils.GenerateSlug()
+	channel := &models.Channel{Name: "Private", OwnerID: owner.ID, InviteSlug: &slug}
+	if err := s.Channels.Create(ctx, channel); err != nil {
+		return err
+	}
+	if err := s.Channels.Subscribe(ctx, channel.ID, member.ID); err != nil {
+		return err
+	}
+	if role, err := s.Channels.Role(ctx, channel.ID, owner.ID); err != nil || role != models.ChannelRoleOwner {
+		return fmt.Errorf("role in the channel is %q (%v)", role, err)
+	}
+	if _, err := s.Channels.Role(ctx, channel.ID, stranger.ID); err != store.ErrNotFound {
+		return fmt.Errorf("role of a stranger in the channel: %v, want ErrNotFound", err)
+	}
+	if ids, err := s.Channels.SubscriberIDs(ctx, channel.ID); err != nil || len(ids) != 2 {
+		return fmt.Errorf("channel subscriber IDs are %v (%v)", ids, err)
+	}
+	if ok, err := s.Channels.CanRead(ctx, channel.ID, member.ID); err != nil || !ok {
+		return fmt.Errorf("subscriber can read a private channel: %v (%v)", ok, err)
+	}
+	if ok, err := s.Channels.CanRead(ctx, channel.ID, stranger.ID); err != nil || ok {
+		return fmt.Errorf("stranger can read a private channel: %v (%v)", ok, err)
+	}
+	public := true
+	if err := s.Channels.Update(ctx, channel.ID, models.UpdateChannelRequest{IsPublic: &public}); err != nil {
+		return err
+	}
+	if ok, err := s.Channels.CanRead(ctx, channel.ID, stranger.ID); err != nil || !ok {
+		return fmt.Errorf("stranger can read a public channel: %v (%v)", ok, err)
+	}
+
+	serverSlug := utils.GenerateSlug()
+	server := &models.Server{Name: "Members", OwnerID: owner.ID, InviteSlug: &serverSlug}
+	if err := s.Servers.Create(ctx, server); err != nil {
+		return err
+	}
+	if _, err := s.Servers.Join(ctx, server.ID, member.ID); err != nil {
+		return err
+	}
+	if role, err := s.Servers.Role(ctx, server.ID, member.ID); err != nil || role != models.ServerRoleMember {
+		return fmt.Errorf("role in the server is %q (%v)", role, err)
+	}
+	if _, err := s.Servers.Role(ctx, server.ID, stranger.ID); err != store.ErrNotFound {
+		return fmt.Errorf("role of a stranger in the server: %v, want ErrNotFound", err)
+	}
+	if ids, err := s.Servers.MemberIDs(ctx, server.ID); err != nil || len(ids) != 2 {
+		return fmt.Errorf("server member IDs are %v (%v)", ids, err)
+	}
+	tree, err := s.Servers.ChannelTree(ctx, server.ID)
+	if err != nil {
+		return err
+	}
+	if id, err := s.Servers.ChannelServer(ctx, tree.Categories[0].Channels[0].ID); err != nil || id != server.ID {
+		return fmt.Errorf("server of #general is %q (%v)", id, err)
+	}
+	if _, err := s.Servers.ChannelServer(ctx, utils.GenerateUUID()); err != store.ErrNotFound {
+		return fmt.Errorf("server of an unknown channel: %v, want ErrNotFound", err)
+	}
+
+	if err := s.Servers.Delete(ctx, server.ID); err != nil {
+		return err
+	}
+	if err := s.Channels.Delete(ctx, channel.ID); err != nil {
+		return err
+	}
+	return s.Groups.Delete(ctx, group.ID)
+}
+
+func checkRoles(ctx context.Context, s *store.Stores) error {
+	owner, err := newUser(ctx, s, "rowner")
+	if err != nil {
+		return err
+	}
+	member, err := newUser(ctx, s, "rmember")
+	if err != nil {
+		return err
+	}
+	group := &models.Group{Name: "Roles", OwnerID: owner.ID}
+	if err := s.Groups.Create(ctx, group, []string{member.ID}); err != nil {
+		return err
+	}
+
+	mod := models.StoredRole{Name: "mod", Permissions: 7, Position: 5}
+	if err := s.Roles.Create(ctx, "group", group.ID, mod); err != nil {
+		return err
+	}
+	if err := s.Roles.Create(ctx, "group", group.ID, mod); err != store.ErrConflict {
+		return fmt.Errorf("creating a role twice: %v, want ErrConflict", err)
+	}
+	// Names are per group or server
+	if err := s.Roles.Create(ctx, "server", group.ID, mod); err != nil {
+		return err
+	}
+	if got, err := s.Roles.Get(ctx, "group", group.ID, "mod"); err != nil || *got != mod {
+		return fmt.Errorf("stored role is %+v (%v)", got, err)
+	}
+	if _, err := s.Roles.Get(ctx, "group", group.ID, "admin"); err != store.ErrNotFound {
+		return fmt.Errorf("getting an unchanged built-in role: %v, want ErrNotFound", err)
+	}
+
+	// Saving adds a row the first time and changes it after
+	admin := models.StoredRole{Name: "admin", Permissions: 1, Position: 100}
+	for _, permissions := range []int64{1, 3} {
+		admin.Permissions = permissions
+		if err := s.Roles.Save(ctx, "group", group.ID, admin); err != nil {
+			return err
+		}
+	}
+	roles, err := s.Roles.List(ctx, "group", group.ID)
+	if err != nil {
+		return err
+	}
+	if len(roles) != 2 {
+		return fmt.Errorf("roles are %+v", roles)
+	}
+	for _, role := range roles {
+		if role != mod && role != admin {
+			return fmt.Errorf("roles are %+v", roles)
+		}
+	}
+
+	// Deleting a role gives its holders the fallback
+	if err := s.Groups.SetRole(ctx, group.ID, member.ID, "mod"); err != nil {
+		return err
+	}
+	if err := s.Roles.Delete(ctx, "group", group.ID, "mod", models.GroupRoleMember); err != nil {
+		return err
+	}
+	if err := s.Roles.Delete(ctx, "group", group.ID, "mod", models.GroupRoleMember); err != store.ErrNotFound {
+		return fmt.Errorf("deleting a role twice: %v, want ErrNotFound", err)
+	}
+	if role, err := s.Groups.Role(ctx, group.ID, member.ID); err != nil || role != models.GroupRoleMember {
+		return fmt.Errorf("role after its deletion is %q (%v)", role, err)
+	}
+	if _, err := s.Roles.Get(ctx, "server", group.ID, "mod"); err != nil {
+		return fmt.Errorf("role of the same name elsewhere: %v", err)
+	}
+	return s.Groups.Delete(ctx, group.ID)
+}
+
+func checkScheduled(ctx context.Context, s *store.Stores) error {
+	sender, err := newUser(ctx, s, "ssender")
+	if err != nil {
+		return err
+	}
+	receiver, err := newUser(ctx, s, "sreceiver")
+	if err != nil {
+		return err
+	}
+
+	sendAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	msg := &models.ScheduledMessage{SenderID: sender.ID, ReceiverID: &receiver.ID, Text: "later", SendAt: sendAt}
+	if err := s.Scheduled.Create(ctx, msg); err != nil {
+		return err
+	}
+	if msg.ID == "" || msg.Status != models.ScheduledPending || !recent(msg.CreatedAt) {
+		return fmt.Errorf("created scheduled message is %+v", msg)
+	}
+	got, err := s.Scheduled.Get(ctx, msg.ID)
+	if err != nil {
+		return err
+	}
+	if got.SenderID != sender.ID || *got.ReceiverID != receiver.ID || !got.SendAt.Equal(sendAt) || got.Status != models.ScheduledPending {
+		return fmt.Errorf("stored scheduled message is %+v", got)
+	}
+	if _, err := s.Scheduled.Get(ctx, utils.GenerateUUID()); err != store.ErrNotFound {
+		return fmt.Errorf("getting an unknown scheduled message: %v, want ErrNotFound", err)
+	}
+	for _, filter := range [][3]string{{}, {receiver.ID, "", ""}} {
+		queued, err := s.Scheduled.ForSender(ctx, sender.ID, filter[0], filter[1], filter[2])
+		if err != nil || len(queued) != 1 || queued[0].ID != msg.ID {
+			return fmt.Errorf("queue filtered by %v is %+v (%v)", filter, queued, err)
+		}
+	}
+	if queued, err := s.Scheduled.ForSender(ctx, sender.ID, "", utils.GenerateUUID(), ""); err != nil || len(queued) != 0 {
+		return fmt.Errorf("queue of another chat is %+v (%v)", queued, err)
+	}
+
+	// Not due yet
+	due, err := s.Scheduled.Due(ctx, time.Now(), 100)
+	if err != nil {
+		return err
+	}
+	for _, id := range due {
+		if id == msg.ID {
+			return fmt.Errorf("a message an hour ahead is due")
+		}
+	}
+	if err := s.Scheduled.Update(ctx, msg.ID, "sooner", time.Now().Add(-time.Second)); err != nil {
+		return err
+	}
+	due, err = s.Scheduled.Due(ctx, time.Now(), 100)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, id := range due {
+		found = found || id == msg.ID
+	}
+	if !found {
+		return fmt.Errorf("a rescheduled message is not due")
+	}
+
+	// Only one claim wins, and a claimed message cannot be changed
+	if claimed, err := s.Scheduled.Claim(ctx, msg.ID); err != nil || !claimed {
+		return fmt.Errorf("claiming: %v (%v)", claimed, err)
+	}
+	if claimed, err := s.Scheduled.Claim(ctx, msg.ID); err != nil || claimed {
+		return fmt.Errorf("claiming twice: %v (%v)", claimed, err)
+	}
+	if err := s.Scheduled.Update(ctx, msg.ID, "edited", sendAt); err != store.ErrConflict {
+		return fmt.Errorf("updating a claimed message: %v, want ErrConflict", err)
+	}
+	if err := s.Scheduled.Cancel(ctx, msg.ID); err != store.ErrConflict {
+		return fmt.Errorf("cancelling a claimed message: %v, want ErrConflict", err)
+	}
+
+	// Claims older than the cutoff are released
+	if err := s.Scheduled.Release(ctx, time.Now().Add(-time.Minute)); err != nil {
+		return err
+	}
+	if got, err := s.Scheduled.Get(ctx, msg.ID); err != nil || got.Status != models.ScheduledSending {
+		return fmt.Errorf("a fresh claim was released: %+v (%v)", got, err)
+	}
+	if err := s.Scheduled.Release(ctx, time.Now().Add(time.Minute)); err != nil {
+		return err
+	}
+	if got, err := s.Scheduled.Get(ctx, msg.ID); err != nil || got.Status != models.ScheduledPending {
+		return fmt.Errorf("a stale claim was kept: %+v (%v)", got, err)
+	}
+
+	if _, err := s.Scheduled.Claim(ctx, msg.ID); err != nil {
+		return err
+	}
+	if err := s.Scheduled.Requeue(ctx, msg.ID); err != nil {
+		return err
+	}
+	if _, err := s.Scheduled.Claim(ctx, msg.ID); err != nil {
+		return err
+	}
+	if err := s.Scheduled.Fail(ctx, msg.ID, "left the chat"); err != nil {
+		return err
+	}
+	got, err = s.Scheduled.Get(ctx, msg.ID)
+	if err != nil {
+		return err
+	}
+	if got.Status != models.ScheduledFailed || got.Error == nil || *got.Error != "left the chat" || got.UpdatedAt == nil {
+		return fmt.Errorf("failed scheduled message is %+v", got)
+	}
+
+	// Rescheduling a failed message queues it again
+	if err := s.Scheduled.Update(ctx, msg.ID, "again", sendAt); err != nil {
+		return err
+	}
+	if got, err := s.Scheduled.Get(ctx, msg.ID); err != nil || got.Status != models.ScheduledPending || got.Error != nil || got.Text != "again" {
+		return fmt.Errorf("rescheduled message is %+v (%v)", got, err)
+	}
+	if err := s.Scheduled.Cancel(ctx, msg.ID); err != nil {
+		return err
+	}
+	if err := s.Scheduled.Cancel(ctx, msg.ID); err != store.ErrConflict {
+		return fmt.Errorf("cancelling twice: %v, want ErrConflict", err)
+	}
+
+	other := &models.ScheduledMessage{SenderID: sender.ID, ReceiverID: &receiver.ID, Text: "sent", SendAt: sendAt}
+	if err := s.Scheduled.Create(ctx, other); err != nil {
+		return err
+	}
+	if err := s.Scheduled.Delete(ctx, other.ID); err != nil {
+		return err
+	}
+	if err := s.Scheduled.Delete(ctx, other.ID); err != store.ErrNotFound {
+		return fmt.Errorf("deleting twice: %v, want ErrNotFound", err)
+	}
+	return nil
+}
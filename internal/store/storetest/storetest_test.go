@@ -0,0 +1,72 @@
+package storetest_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kvant/messenger/internal/database"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/internal/store/storetest"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+func TestSQLite(t *testing.T) {
+	t.Setenv("USE_SQLITE", "true")
+	t.Setenv("SQLITE_DB_PATH", filepath.Join(t.TempDir(), "storetest.db"))
+
+	db, err := database.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	runChecks(t, db)
+}
+
+// TestPostgres runs the contract in a scratch schema of the database DB_HOST
+// configures, like the storecheck command
+func TestPostgres(t *testing.T) {
+	if os.Getenv("DB_HOST") == "" {
+		t.Skip("DB_HOST is not set")
+	}
+	t.Setenv("USE_SQLITE", "false")
+
+	db, err := database.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	// One connection keeps the search_path of the scratch schema
+	db.SetMaxOpenConns(1)
+	schema := "storetest_" + strings.ReplaceAll(utils.GenerateUUID()[:8], "-", "")
+	for _, stmt := range []string{`CREATE SCHEMA ` + schema, `SET search_path TO ` + schema} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("creating scratch schema: %v", err)
+		}
+	}
+	t.Cleanup(func() {
+		if _, err := db.Exec(`DROP SCHEMA ` + schema + ` CASCADE`); err != nil {
+			t.Errorf("dropping scratch schema %s: %v", schema, err)
+		}
+	})
+	runChecks(t, db)
+}
+
+func runChecks(t *testing.T, db *sql.DB) {
+	if err := database.MigrateUp(db); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+
+	s := store.New(db)
+	for _, check := range storetest.Checks {
+		t.Run(check.Name, func(t *testing.T) {
+			if err := check.Run(context.Background(), s); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
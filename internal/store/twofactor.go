@@ -0,0 +1,183 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// TwoFactorStore keeps the TOTP enrollments of users and their recovery codes
+type TwoFactorStore interface {
+	// Get returns the enrollment of a user, pending or enabled
+	Get(ctx context.Context, userID string) (*models.TwoFactor, error)
+	// Begin starts an enrollment with a sealed secret, replacing a pending
+	// one. ErrConflict means 2FA is already enabled.
+	Begin(ctx context.Context, userID, secret string) error
+	// Enable confirms a pending enrollment with the step of its first code
+	// and sets the hashes of its recovery codes
+	Enable(ctx context.Context, userID string, step int64, recoveryHashes []string) error
+	// Disable removes the enrollment and the recovery codes of a user
+	Disable(ctx context.Context, userID string) error
+	// UseStep accepts a code of a time step and clears the failed attempts.
+	// ErrNotFound means a code of that step or a later one was accepted already.
+	UseStep(ctx context.Context, userID string, step int64) error
+	// Fail counts a wrong code. The maxAttempts-th one in a row locks
+	// codes out until lockUntil.
+	Fail(ctx context.Context, userID string, maxAttempts int, lockUntil time.Time) error
+	// UseRecoveryCode spends an unused recovery code; ErrNotFound means there is none with the hash
+	UseRecoveryCode(ctx context.Context, userID, codeHash string) error
+	// ReplaceRecoveryCodes discards the recovery codes of a user for new ones
+	ReplaceRecoveryCodes(ctx context.Context, userID string, recoveryHashes []string) error
+	// RecoveryCodesLeft counts the unused recovery codes of a user
+	RecoveryCodesLeft(ctx context.Context, userID string) (int, error)
+}
+
+type twoFactorStore struct {
+	db *sql.DB
+	d  dialect
+}
+
+func (s *twoFactorStore) Get(ctx context.Context, userID string) (*models.TwoFactor, error) {
+	var tf models.TwoFactor
+	err := s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT user_id, secret, enabled_at, last_step, failed_attempts, locked_until, created_at
+		FROM two_factor WHERE user_id = $1
+	`), userID).Scan(&tf.UserID, &tf.Secret, &tf.EnabledAt, &tf.LastStep, &tf.FailedAttempts, &tf.LockedUntil, &tf.CreatedAt)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &tf, nil
+}
+
+func (s *twoFactorStore) Begin(ctx context.Context, userID, secret string) error {
+	at, _ := now()
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO two_factor (user_id, secret, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET secret = $2, last_step = 0, failed_attempts = 0, locked_until = NULL, created_at = $3
+		WHERE two_factor.enabled_at IS NULL
+	`), userID, secret, at)
+	if err := affected(result, err); err == ErrNotFound {
+		return ErrConflict
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *twoFactorStore) Enable(ctx context.Context, userID string, step int64, recoveryHashes []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	at, _ := now()
+	result, err := tx.ExecContext(ctx, s.d.rebind(`
+		UPDATE two_factor SET enabled_at = $1, last_step = $2, failed_attempts = 0
+		WHERE user_id = $3 AND enabled_at IS NULL
+	`), at, step, userID)
+	if err := affected(result, err); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(ctx, tx, s.d, userID, recoveryHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *twoFactorStore) Disable(ctx context.Context, userID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, s.d.rebind(`DELETE FROM two_factor WHERE user_id = $1`), userID)
+	if err := affected(result, err); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.d.rebind(`DELETE FROM recovery_codes WHERE user_id = $1`), userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *twoFactorStore) UseStep(ctx context.Context, userID string, step int64) error {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE two_factor SET last_step = $1, failed_attempts = 0, locked_until = NULL
+		WHERE user_id = $2 AND last_step < $1
+	`), step, userID)
+	return affected(result, err)
+}
+
+func (s *twoFactorStore) Fail(ctx context.Context, userID string, maxAttempts int, lockUntil time.Time) error {
+	_, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE two_factor SET
+			locked_until = CASE WHEN failed_attempts + 1 >= $1 THEN $2 ELSE locked_until END,
+			failed_attempts = CASE WHEN failed_attempts + 1 >= $1 THEN 0 ELSE failed_attempts + 1 END
+		WHERE user_id = $3
+	`), maxAttempts, utils.DBTime(lockUntil), userID)
+	return err
+}
+
+func (s *twoFactorStore) UseRecoveryCode(ctx context.Context, userID, codeHash string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	at, _ := now()
+	result, err := tx.ExecContext(ctx, s.d.rebind(`
+		UPDATE recovery_codes SET used_at = $1
+		WHERE user_id = $2 AND code_hash = $3 AND used_at IS NULL
+	`), at, userID, codeHash)
+	if err := affected(result, err); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.d.rebind(`
+		UPDATE two_factor SET failed_attempts = 0, locked_until = NULL WHERE user_id = $1
+	`), userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *twoFactorStore) ReplaceRecoveryCodes(ctx context.Context, userID string, recoveryHashes []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(ctx, tx, s.d, userID, recoveryHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *twoFactorStore) RecoveryCodesLeft(ctx context.Context, userID string) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL
+	`), userID).Scan(&n)
+	return n, err
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, d dialect, userID string, hashes []string) error {
+	if _, err := tx.ExecContext(ctx, d.rebind(`DELETE FROM recovery_codes WHERE user_id = $1`), userID); err != nil {
+		return err
+	}
+	at, _ := now()
+	for _, hash := range hashes {
+		if _, err := tx.ExecContext(ctx, d.rebind(`
+			INSERT INTO recovery_codes (user_id, code_hash, created_at) VALUES ($1, $2, $3)
+		`), userID, hash, at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
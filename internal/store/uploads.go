@@ -0,0 +1,83 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// UploadStore keeps the progress of resumable uploads. The bytes of an
+// unfinished upload are in the upload spool; a complete one points to the
+// attachment it became.
+type UploadStore interface {
+	// Create stores a new upload at offset 0, setting its CreatedAt
+	Create(ctx context.Context, upload *models.Upload) error
+	Get(ctx context.Context, id string) (*models.Upload, error)
+	// Advance moves the offset of an upload from one offset to another and
+	// sets its expiry. ErrConflict means the offset is no longer from.
+	Advance(ctx context.Context, id string, from, to int64, expiresAt time.Time) error
+	// Complete records the attachment a finished upload became
+	Complete(ctx context.Context, id, attachmentID string) error
+	// Expired returns the IDs of up to limit uploads that expired by a time
+	Expired(ctx context.Context, at time.Time, limit int) ([]string, error)
+	Delete(ctx context.Context, id string) error
+}
+
+type uploadStore struct {
+	db *sql.DB
+	d  dialect
+}
+
+func (s *uploadStore) Create(ctx context.Context, upload *models.Upload) error {
+	at, createdAt := now()
+	_, err := s.db.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO uploads (id, user_id, filename, length, checksum, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`), upload.ID, upload.UserID, upload.Filename, upload.Length, upload.Checksum, utils.DBTime(upload.ExpiresAt), at)
+	if err != nil {
+		return err
+	}
+	upload.Offset, upload.CreatedAt = 0, createdAt
+	return nil
+}
+
+func (s *uploadStore) Get(ctx context.Context, id string) (*models.Upload, error) {
+	var upload models.Upload
+	err := s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT id, user_id, filename, length, upload_offset, checksum, attachment_id, expires_at, created_at
+		FROM uploads WHERE id = $1
+	`), id).Scan(&upload.ID, &upload.UserID, &upload.Filename, &upload.Length, &upload.Offset,
+		&upload.Checksum, &upload.AttachmentID, &upload.ExpiresAt, &upload.CreatedAt)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &upload, nil
+}
+
+func (s *uploadStore) Advance(ctx context.Context, id string, from, to int64, expiresAt time.Time) error {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE uploads SET upload_offset = $1, expires_at = $2 WHERE id = $3 AND upload_offset = $4
+	`), to, utils.DBTime(expiresAt), id, from)
+	return conflict(result, err)
+}
+
+func (s *uploadStore) Complete(ctx context.Context, id, attachmentID string) error {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE uploads SET attachment_id = $1 WHERE id = $2
+	`), attachmentID, id)
+	return affected(result, err)
+}
+
+func (s *uploadStore) Expired(ctx context.Context, at time.Time, limit int) ([]string, error) {
+	return scanIDs(s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT id FROM uploads WHERE expires_at <= $1 LIMIT $2
+	`), utils.DBTime(at), limit))
+}
+
+func (s *uploadStore) Delete(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`DELETE FROM uploads WHERE id = $1`), id)
+	return affected(result, err)
+}
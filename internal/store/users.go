@@ -0,0 +1,279 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// UserStore keeps user accounts and profiles
+type UserStore interface {
+	// Create registers a user; ErrConflict means the username is taken
+	Create(ctx context.Context, username, passwordHash string) (*models.User, error)
+	Get(ctx context.Context, id string) (*models.User, error)
+	// GetByUsername also returns the password hash, for logging in
+	GetByUsername(ctx context.Context, username string) (*models.User, error)
+	// Search finds users whose username or display name contains query,
+	// ignoring case, for the user searcherID: they are left out, as are
+	// deleted accounts and users blocked either way
+	Search(ctx context.Context, query, searcherID string, limit int) ([]models.User, error)
+	// UpdateProfile changes the fields of update that are set
+	UpdateProfile(ctx context.Context, id string, update ProfileUpdate) (*models.User, error)
+	// SetAvatar and SetBanner change an image of the profile with its blurhash
+	SetAvatar(ctx context.Context, id, url string, blurhash *string) error
+	SetBanner(ctx context.Context, id, url string, blurhash *string) error
+	// SetPassword replaces the password hash of a user
+	SetPassword(ctx context.Context, id, passwordHash string) error
+	// Email returns the address password resets of a user go to, nil if none
+	Email(ctx context.Context, id string) (*string, error)
+	// SetEmail changes the address, nil to remove it; ErrConflict means
+	// another user has it. Addresses are compared as given, so callers
+	// normalize them.
+	SetEmail(ctx context.Context, id string, email *string) error
+	// GetByEmail finds the user with an address
+	GetByEmail(ctx context.Context, email string) (*models.User, error)
+	// ScheduleDeletion marks an account to be purged at a time
+	ScheduleDeletion(ctx context.Context, id string, at time.Time) error
+	// CancelDeletion unmarks an account, reporting whether it was marked
+	CancelDeletion(ctx context.Context, id string) (bool, error)
+	// DeletionsDue returns up to limit accounts whose deletion is due at a time
+	DeletionsDue(ctx context.Context, at time.Time, limit int) ([]string, error)
+}
+
+// ProfileUpdate holds the profile fields to change; nil ones are kept
+type ProfileUpdate struct {
+	DisplayName *string
+	Bio         *string
+	NameColor   *string
+}
+
+type userStore struct {
+	db *sql.DB
+	d  dialect
+}
+
+const userColumns = `id, username, password_hash, display_name, bio, avatar_url, banner_url,
+		       avatar_blurhash, banner_blurhash, role, is_premium, premium_until, name_color,
+		       profile_theme, bubble_style, hide_online, status, created_at, updated_at,
+		       deletion_scheduled_at, deleted_at`
+
+func scanUser(row interface{ Scan(...interface{}) error }) (*models.User, error) {
+	var user models.User
+	err := row.Scan(
+		&user.ID, &user.Username, &user.PasswordHash, &user.DisplayName, &user.Bio,
+		&user.AvatarURL, &user.BannerURL, &user.AvatarBlurhash, &user.BannerBlurhash, &user.Role, &user.IsPremium,
+		&user.PremiumUntil, &user.NameColor, &user.ProfileTheme, &user.BubbleStyle,
+		&user.HideOnline, &user.Status, &user.CreatedAt, &user.UpdatedAt,
+		&user.DeletionScheduledAt, &user.DeletedAt,
+	)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &user, nil
+}
+
+func (s *userStore) Create(ctx context.Context, username, passwordHash string) (*models.User, error) {
+	id := utils.GenerateUUID()
+	_, err := s.db.ExecContext(ctx, s.d.rebind(`
+		INSERT INTO users (id, username, password_hash) VALUES ($1, $2, $3)
+	`), id, username, passwordHash)
+	if s.d.isUniqueViolation(err) {
+		return nil, ErrConflict
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *userStore) Get(ctx context.Context, id string) (*models.User, error) {
+	user, err := scanUser(s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT `+userColumns+` FROM users WHERE id = $1
+	`), id))
+	if err != nil {
+		return nil, err
+	}
+	user.PasswordHash = ""
+	return user, nil
+}
+
+func (s *userStore) GetByUsername(ctx context.Context, username string) (*models.User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT `+userColumns+` FROM users WHERE username = $1
+	`), username))
+}
+
+// likeEscaper makes LIKE match %, _ and \ literally, with ESCAPE '\'
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (s *userStore) Search(ctx context.Context, query, searcherID string, limit int) ([]models.User, error) {
+	rows, err := s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT `+userColumns+`
+		FROM users
+		WHERE (username `+s.d.ilike()+` $1 ESCAPE '\' OR display_name `+s.d.ilike()+` $1 ESCAPE '\')
+		  AND id != $2 AND deleted_at IS NULL
+		  AND NOT EXISTS (
+		    SELECT 1 FROM user_blocks b
+		    WHERE (b.blocker_id = $2 AND b.blocked_id = users.id) OR (b.blocker_id = users.id AND b.blocked_id = $2)
+		  )
+		ORDER BY username
+		LIMIT $3
+	`), "%"+likeEscaper.Replace(query)+"%", searcherID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []models.User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		user.PasswordHash = ""
+		users = append(users, *user)
+	}
+	return users, rows.Err()
+}
+
+func (s *userStore) UpdateProfile(ctx context.Context, id string, update ProfileUpdate) (*models.User, error) {
+	at, _ := now()
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE users
+		SET display_name = COALESCE($1, display_name),
+		    bio = COALESCE($2, bio),
+		    name_color = COALESCE($3, name_color),
+		    updated_at = $4
+		WHERE id = $5
+	`), update.DisplayName, update.Bio, update.NameColor, at, id)
+	if err := affected(result, err); err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, id)
+}
+
+func (s *userStore) SetAvatar(ctx context.Context, id, url string, blurhash *string) error {
+	return s.setImage(ctx, id, "avatar", url, blurhash)
+}
+
+func (s *userStore) SetBanner(ctx context.Context, id, url string, blurhash *string) error {
+	return s.setImage(ctx, id, "banner", url, blurhash)
+}
+
+// setImage sets the <image>_url and <image>_blurhash columns
+func (s *userStore) setImage(ctx context.Context, id, image, url string, blurhash *string) error {
+	at, _ := now()
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE users SET `+image+`_url = $1, `+image+`_blurhash = $2, updated_at = $3 WHERE id = $4
+	`), url, blurhash, at, id)
+	return affected(result, err)
+}
+
+func (s *userStore) SetPassword(ctx context.Context, id, passwordHash string) error {
+	at, _ := now()
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE users SET password_hash = $1, updated_at = $2 WHERE id = $3
+	`), passwordHash, at, id)
+	return affected(result, err)
+}
+
+func (s *userStore) Email(ctx context.Context, id string) (*string, error) {
+	var email *string
+	err := s.db.QueryRowContext(ctx, s.d.rebind(`SELECT email FROM users WHERE id = $1`), id).Scan(&email)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return email, nil
+}
+
+func (s *userStore) SetEmail(ctx context.Context, id string, email *string) error {
+	at, _ := now()
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE users SET email = $1, updated_at = $2 WHERE id = $3
+	`), email, at, id)
+	if s.d.isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return affected(result, err)
+}
+
+func (s *userStore) GetByEmail(ctx context.Context, email string) (*models.User, error) {
+	user, err := scanUser(s.db.QueryRowContext(ctx, s.d.rebind(`
+		SELECT `+userColumns+` FROM users WHERE email = $1
+	`), email))
+	if err != nil {
+		return nil, err
+	}
+	user.PasswordHash = ""
+	return user, nil
+}
+
+func (s *userStore) ScheduleDeletion(ctx context.Context, id string, at time.Time) error {
+	updated, _ := now()
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE users SET deletion_scheduled_at = $1, updated_at = $2 WHERE id = $3 AND deleted_at IS NULL
+	`), utils.DBTime(at), updated, id)
+	return affected(result, err)
+}
+
+func (s *userStore) CancelDeletion(ctx context.Context, id string) (bool, error) {
+	updated, _ := now()
+	result, err := s.db.ExecContext(ctx, s.d.rebind(`
+		UPDATE users SET deletion_scheduled_at = NULL, updated_at = $1
+		WHERE id = $2 AND deletion_scheduled_at IS NOT NULL
+	`), updated, id)
+	if err := affected(result, err); err != nil {
+		if err == ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *userStore) DeletionsDue(ctx context.Context, at time.Time, limit int) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, s.d.rebind(`
+		SELECT id FROM users
+		WHERE deletion_scheduled_at IS NOT NULL AND deletion_scheduled_at <= $1
+		ORDER BY deletion_scheduled_at
+		LIMIT $2
+	`), utils.DBTime(at), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// affected returns ErrNotFound if a statement changed no rows
+func affected(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key of RFC 6238 Appendix B, "12345678901234567890", in base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestCodeRFC6238 checks the SHA-1 vectors of RFC 6238 Appendix B. The RFC
+// gives eight digits; six-digit codes are their last six.
+func TestCodeRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		rfc  string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		step := Step(time.Unix(tt.unix, 0))
+		got, err := Code(rfcSecret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tt.rfc[len(tt.rfc)-Digits:]; got != want {
+			t.Errorf("code at %d is %s, want %s", tt.unix, got, want)
+		}
+	}
+}
+
+func TestCodeSecretForms(t *testing.T) {
+	want, err := Code(rfcSecret, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Apps show secrets in lower case and with padding too
+	for _, secret := range []string{strings.ToLower(rfcSecret), rfcSecret + "===="} {
+		if got, err := Code(secret, 1); err != nil || got != want {
+			t.Errorf("Code(%q) = %s, %v; want %s", secret, got, err, want)
+		}
+	}
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("Code accepted a secret that is not base32")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+	code := func(step int64) string {
+		c, err := Code(rfcSecret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current", code(step), step, true},
+		{"one step late", code(step - 1), step - 1, true},
+		{"one step early", code(step + 1), step + 1, true},
+		{"with a space", code(step)[:3] + " " + code(step)[3:], step, true},
+		{"two steps late", code(step - 2), 0, false},
+		{"two steps early", code(step + 2), 0, false},
+		{"too short", code(step)[:Digits-1], 0, false},
+		{"too long", code(step) + "0", 0, false},
+		{"empty", "", 0, false},
+	}
+	for _, tt := range tests {
+		gotStep, ok := Validate(rfcSecret, tt.code, now)
+		if ok != tt.wantOK || gotStep != tt.wantStep {
+			t.Errorf("%s: Validate(%q) = %d, %v; want %d, %v", tt.name, tt.code, gotStep, ok, tt.wantStep, tt.wantOK)
+		}
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	t.Setenv("TOTP_KEY", "first key")
+	sealed, err := Seal(rfcSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sealed, rfcSecret) {
+		t.Fatal("sealed secret contains the secret")
+	}
+	if opened, err := Open(sealed); err != nil || opened != rfcSecret {
+		t.Errorf("Open = %q, %v", opened, err)
+	}
+	if again, _ := Seal(rfcSecret); again == sealed {
+		t.Error("sealing twice gave the same result")
+	}
+
+	t.Setenv("TOTP_KEY", "second key")
+	if _, err := Open(sealed); err == nil {
+		t.Error("opened a secret sealed with another key")
+	}
+	if _, err := Open("not sealed"); err == nil {
+		t.Error("opened a malformed secret")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodeCount {
+		t.Fatalf("got %d codes, want %d", len(codes), RecoveryCodeCount)
+	}
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if len(code) != 14 || code[4] != '-' || code[9] != '-' {
+			t.Errorf("code %q is not XXXX-XXXX-XXXX", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q given twice", code)
+		}
+		seen[code] = true
+	}
+
+	// Case, dashes and spaces do not matter
+	hash := HashRecoveryCode("ABCD-EFGH-JKLM")
+	for _, typed := range []string{"abcd-efgh-jklm", "ABCDEFGHJKLM", "abcd efgh jklm"} {
+		if HashRecoveryCode(typed) != hash {
+			t.Errorf("%q hashes differently", typed)
+		}
+	}
+	if HashRecoveryCode("ABCD-EFGH-JKLN") == hash {
+		t.Error("different codes hash the same")
+	}
+}
@@ -0,0 +1,137 @@
+package websocket
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Backplane carries hub traffic between server processes, so that users
+// connected to different replicas receive each other's events and see each
+// other online. Every message published by any hub, including the subscriber's
+// own, is passed to the handlers registered with Subscribe in publish order.
+type Backplane interface {
+	Publish(data []byte) error
+	Subscribe(handler func(data []byte)) error
+	Close() error
+}
+
+// ErrPayloadTooLarge is returned by Publish for messages the backplane cannot carry
+var ErrPayloadTooLarge = errors.New("backplane: payload too large")
+
+// MemoryBackplane connects hubs running in the same process. It is the
+// single-node default and lets several hubs be wired together locally.
+type MemoryBackplane struct {
+	mu          sync.RWMutex
+	subscribers []chan []byte
+	closed      bool
+}
+
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{}
+}
+
+// Publish queues data for every subscriber without blocking; a subscriber
+// that has fallen too far behind misses it.
+func (b *MemoryBackplane) Publish(data []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, ch := range b.subscribers {
+		select {
+		case ch <- data:
+		default:
+			log.Printf("Backplane subscriber is full, dropping message")
+		}
+	}
+	return nil
+}
+
+// Subscribe runs handler on its own goroutine for every published message
+func (b *MemoryBackplane) Subscribe(handler func(data []byte)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errors.New("backplane: closed")
+	}
+
+	ch := make(chan []byte, 1024)
+	b.subscribers = append(b.subscribers, ch)
+	go func() {
+		for data := range ch {
+			handler(data)
+		}
+	}()
+	return nil
+}
+
+func (b *MemoryBackplane) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		for _, ch := range b.subscribers {
+			close(ch)
+		}
+		b.subscribers = nil
+	}
+	return nil
+}
+
+// maxNotifyPayload is the NOTIFY payload limit of a default PostgreSQL build, minus some slack
+const maxNotifyPayload = 7900
+
+// PostgresBackplane connects hubs of every process using the same PostgreSQL
+// database through LISTEN/NOTIFY. Messages are not persisted: a process that
+// is disconnected from the database misses what was published meanwhile.
+type PostgresBackplane struct {
+	db       *sql.DB
+	listener *pq.Listener
+	channel  string
+}
+
+// NewPostgresBackplane publishes through db and listens on a dedicated
+// connection opened with connStr
+func NewPostgresBackplane(db *sql.DB, connStr, channel string) (*PostgresBackplane, error) {
+	listener := pq.NewListener(connStr, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Backplane listener: %v", err)
+		}
+	})
+	if err := listener.Listen(channel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &PostgresBackplane{db: db, listener: listener, channel: channel}, nil
+}
+
+func (b *PostgresBackplane) Publish(data []byte) error {
+	if len(data) > maxNotifyPayload {
+		return ErrPayloadTooLarge
+	}
+	_, err := b.db.Exec(`SELECT pg_notify($1, $2)`, b.channel, string(data))
+	return err
+}
+
+// Subscribe runs handler for every notification. Only one handler is supported.
+func (b *PostgresBackplane) Subscribe(handler func(data []byte)) error {
+	go func() {
+		for n := range b.listener.Notify {
+			// nil means the connection was re-established; anything sent meanwhile is lost
+			if n == nil {
+				log.Printf("Backplane listener reconnected")
+				continue
+			}
+			handler([]byte(n.Extra))
+		}
+	}()
+	return nil
+}
+
+func (b *PostgresBackplane) Close() error {
+	return b.listener.Close()
+}
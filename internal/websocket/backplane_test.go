@@ -0,0 +1,149 @@
+package websocket
+
+import (
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kvant/messenger/internal/database"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+func TestTwoHubsShareDeliveryAndPresence(t *testing.T) {
+	db := newTestDB(t)
+	backplane := NewMemoryBackplane()
+	t.Cleanup(func() { backplane.Close() })
+	hub1, hub2 := newTestHub(t, db, backplane), newTestHub(t, db, backplane)
+	server1, server2 := serveHub(t, hub1, db), serveHub(t, hub2, db)
+	me := newTestUser(t, db, "me")
+	friend := newTestUser(t, db, "friend")
+
+	mine := dial(t, server1, me.ID, "phone", -1)
+	theirs := dial(t, server2, friend.ID, "phone", -1)
+
+	// Both nodes see both users online
+	mine.presence(friend.ID, true)
+	theirs.presence(me.ID, true)
+	if !hub1.IsOnline(friend.ID) || !hub2.IsOnline(me.ID) {
+		t.Fatal("the hubs do not agree on who is online")
+	}
+
+	// A message crosses nodes with the seq of its recipient
+	theirs.sendText(me.ID, "across", "m1")
+	msg := mine.next("new_message")
+	if msg["text"] != "across" || seq(t, msg) != mine.lastSeq+1 {
+		t.Fatalf("delivered %v", msg)
+	}
+	theirs.next("new_message")
+	mine.none("new_message", 200*time.Millisecond)
+
+	// So do transient events
+	theirs.send(map[string]interface{}{"type": "typing_start", "receiver_id": me.ID})
+	if typing := mine.next("typing_start"); typing["user_id"] != friend.ID || typing["seq"] != nil {
+		t.Errorf("typing %v", typing)
+	}
+
+	theirs.conn.Close()
+	mine.presence(friend.ID, false)
+	if hub1.IsOnline(friend.ID) || hub2.IsOnline(friend.ID) {
+		t.Error("the hubs do not agree that a user went offline")
+	}
+}
+
+// limitedBackplane refuses messages over the NOTIFY limit like PostgresBackplane
+type limitedBackplane struct {
+	*MemoryBackplane
+	refused atomic.Int32
+}
+
+func (b *limitedBackplane) Publish(data []byte) error {
+	if len(data) > maxNotifyPayload {
+		b.refused.Add(1)
+		return ErrPayloadTooLarge
+	}
+	return b.MemoryBackplane.Publish(data)
+}
+
+func TestLargeEventsGoThroughTheEventLog(t *testing.T) {
+	db := newTestDB(t)
+	backplane := &limitedBackplane{MemoryBackplane: NewMemoryBackplane()}
+	t.Cleanup(func() { backplane.Close() })
+	hub1, hub2 := newTestHub(t, db, backplane), newTestHub(t, db, backplane)
+	server1, server2 := serveHub(t, hub1, db), serveHub(t, hub2, db)
+	me := newTestUser(t, db, "me")
+	friend := newTestUser(t, db, "friend")
+
+	mine := dial(t, server1, me.ID, "phone", -1)
+	theirs := dial(t, server2, friend.ID, "phone", -1)
+	mine.presence(friend.ID, true)
+
+	// Too large for a notification, so the other node loads it by its seq
+	text := strings.Repeat("long ", 2000)
+	theirs.sendText(me.ID, text, "m1")
+	msg := mine.next("new_message")
+	if msg["text"] != text || seq(t, msg) != mine.lastSeq+1 {
+		t.Fatalf("delivered %d bytes at seq %v", len(msg["text"].(string)), msg["seq"])
+	}
+	if backplane.refused.Load() == 0 {
+		t.Error("the message fit the backplane")
+	}
+
+	// Small events still carry their data
+	theirs.sendText(me.ID, "short", "m2")
+	if msg := mine.next("new_message"); msg["text"] != "short" || seq(t, msg) != mine.lastSeq+2 {
+		t.Fatalf("delivered %v", msg)
+	}
+}
+
+// TestPostgresBackplane connects two hubs through LISTEN/NOTIFY of the
+// database given by DB_HOST and the other DB_ variables
+func TestPostgresBackplane(t *testing.T) {
+	if os.Getenv("DB_HOST") == "" {
+		t.Skip("DB_HOST is not set")
+	}
+	t.Setenv("USE_SQLITE", "false")
+	db, err := database.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	channel := "hub_test_" + strings.ReplaceAll(utils.GenerateUUID()[:8], "-", "")
+	newNode := func() *Hub {
+		backplane, err := NewPostgresBackplane(db, database.PostgresConnString(), channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { backplane.Close() })
+		// Without an event log delivery is unsequenced and needs no tables
+		hub := NewHub(nil, backplane, nil)
+		go hub.Run()
+		return hub
+	}
+	hub1, hub2 := newNode(), newNode()
+	me, friend := utils.GenerateUUID(), utils.GenerateUUID()
+	mine := dial(t, serveHub(t, hub1, nil), me, "phone", -1)
+	theirs := dial(t, serveHub(t, hub2, nil), friend, "phone", -1)
+
+	mine.presence(friend, true)
+	theirs.presence(me, true)
+
+	hub2.SendToUser(me, map[string]interface{}{"type": "message_edited", "text": "across"})
+	if edited := mine.next("message_edited"); edited["text"] != "across" {
+		t.Errorf("delivered %v", edited)
+	}
+
+	backplane, err := NewPostgresBackplane(db, database.PostgresConnString(), channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backplane.Close()
+	if err := backplane.Publish(make([]byte, maxNotifyPayload+1)); err != ErrPayloadTooLarge {
+		t.Errorf("publishing past the NOTIFY limit: %v, want ErrPayloadTooLarge", err)
+	}
+
+	theirs.conn.Close()
+	mine.presence(friend, false)
+}
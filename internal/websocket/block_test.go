@@ -0,0 +1,87 @@
+package websocket
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+func TestBlocksAreEnforced(t *testing.T) {
+	db := newTestDB(t)
+	hub := newTestHub(t, db, nil)
+	server := serveHub(t, hub, db)
+	stores := store.New(db)
+	ctx := context.Background()
+	me := newTestUser(t, db, "me")
+	pest := newTestUser(t, db, "pest")
+	friend := newTestUser(t, db, "friend")
+
+	group := &models.Group{Name: "All of us", OwnerID: me.ID}
+	if err := stores.Groups.Create(ctx, group, []string{pest.ID, friend.ID}); err != nil {
+		t.Fatal(err)
+	}
+	// Unread messages from before the block
+	for _, senderID := range []string{pest.ID, friend.ID} {
+		if err := stores.Messages.Create(ctx, &models.Message{SenderID: senderID, ReceiverID: &me.ID, Text: "unread"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mine := dial(t, server, me.ID, "phone", -1)
+	theirs := dial(t, server, pest.ID, "phone", -1)
+	friends := dial(t, server, friend.ID, "phone", -1)
+	mine.presence(pest.ID, true)
+
+	if err := stores.Blocks.Block(ctx, me.ID, pest.ID); err != nil {
+		t.Fatal(err)
+	}
+	hub.BlocksChanged(me.ID, pest.ID)
+
+	// Presence is hidden both ways
+	mine.presence(pest.ID, false)
+	theirs.presence(me.ID, false)
+
+	// Direct messages are refused both ways
+	theirs.sendText(me.ID, "hello?", "m1")
+	if e := theirs.next("message_error"); e["code"] != "blocked" || e["client_message_id"] != "m1" {
+		t.Errorf("error %v, want blocked", e)
+	}
+	mine.sendText(pest.ID, "go away", "m2")
+	if e := mine.next("message_error"); e["code"] != "blocked" {
+		t.Errorf("error %v, want blocked", e)
+	}
+
+	// Typing reaches the others in a group but not the blocker, and not at all in the direct chat
+	theirs.send(map[string]interface{}{"type": "typing_start", "receiver_id": me.ID})
+	theirs.send(map[string]interface{}{"type": "typing_start", "group_id": group.ID})
+	if typing := friends.next("typing_start"); typing["user_id"] != pest.ID || typing["group_id"] != group.ID {
+		t.Errorf("typing %v", typing)
+	}
+	mine.send(map[string]interface{}{"type": "typing_start", "group_id": group.ID})
+	friends.next("typing_start")
+
+	// Reading the chat with the blocked user neither marks it read nor tells them
+	mine.send(map[string]interface{}{"type": "mark_read", "sender_id": pest.ID})
+	mine.send(map[string]interface{}{"type": "mark_read", "sender_id": friend.ID})
+	if read := friends.next("messages_read"); read["reader_id"] != me.ID {
+		t.Errorf("read receipt %v", read)
+	}
+	var unread int
+	err := db.QueryRow(utils.AdaptQuery(`SELECT COUNT(*) FROM messages WHERE sender_id = $1 AND is_read = $2`), pest.ID, false).Scan(&unread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unread != 1 {
+		t.Errorf("%d unread messages from the blocked user, want 1", unread)
+	}
+
+	mine.none("new_message", 200*time.Millisecond)
+	mine.none("typing_start", 0)
+	theirs.none("new_message", 0)
+	theirs.none("typing_start", 0)
+	theirs.none("messages_read", 0)
+}
@@ -1,15 +1,15 @@
 package websocket
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"log"
-	"strings"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	"github.com/kvant/messenger/pkg/utils"
+	"github.com/kvant/messenger/internal/conversation"
+	"github.com/kvant/messenger/internal/store"
 )
 
 const (
@@ -24,16 +24,46 @@ type Client struct {
 	conn   *websocket.Conn
 	send   chan []byte
 	userID string
-	db     *sql.DB
+	// sessionID is the login the connection was opened with; revoking it closes the connection
+	sessionID string
+	// deviceID identifies this connection among the user's devices
+	deviceID string
+	// since is the last event seq the client saw before reconnecting, or -1
+	since int64
+	// replayed is the last event seq covered by the session frame or a replay;
+	// live events up to it are not delivered again. Guarded by the lock of the
+	// user's event shard.
+	replayed int64
+	db       *sql.DB
 }
 
-func NewClient(hub *Hub, conn *websocket.Conn, userID string, db *sql.DB) *Client {
+// NewClient creates a connection of the user's session. Pass since >= 0 to replay the
+// events after that seq before live delivery starts.
+func NewClient(hub *Hub, conn *websocket.Conn, userID, sessionID, deviceID string, since int64, db *sql.DB) *Client {
 	return &Client{
-		hub:    hub,
-		conn:   conn,
-		send:   make(chan []byte, 256),
-		userID: userID,
-		db:     db,
+		hub:  hub,
+		conn: conn,
+		// Room for a full replay (maxReplay) on top of live traffic
+		send:      make(chan []byte, 1024),
+		userID:    userID,
+		sessionID: sessionID,
+		deviceID:  deviceID,
+		since:     since,
+		db:        db,
+	}
+}
+
+// sendJSON queues a message for this connection only
+func (c *Client) sendJSON(message interface{}) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Failed to marshal message: %v", err)
+		return
+	}
+	select {
+	case c.send <- data:
+	default:
+		log.Printf("Failed to send message to user %s (device %s)", c.userID, c.deviceID)
 	}
 }
 
@@ -117,144 +147,141 @@ func (c *Client) handleMessage(data []byte) {
 		c.handleTyping(msg)
 	case "mark_read":
 		c.handleMarkRead(msg)
+	case "resume":
+		// Replays events after "since"; clients skip seqs they already have
+		if since, ok := msg["since"].(float64); ok && since >= 0 {
+			c.hub.Resume(c, int64(since))
+		}
 	}
 }
 
+// handleSendMessage stores a message and delivers it. The frame carries a
+// client-generated client_message_id; the sender gets a message_ack with the
+// server id, or a message_error. Resending the same client_message_id (e.g.
+// after a reconnect) acks the stored message again instead of inserting a
+// duplicate.
 func (c *Client) handleSendMessage(msg map[string]interface{}) {
-	receiverID, ok := msg["receiver_id"].(string)
-	if !ok {
-		return
-	}
-
-	text, ok := msg["text"].(string)
-	if !ok || text == "" {
-		return
+	out := Outgoing{SenderID: c.userID, Target: parseTarget(msg)}
+	out.ClientMessageID, _ = msg["client_message_id"].(string)
+	out.Text, _ = msg["text"].(string)
+	if replyTo, ok := msg["reply_to_id"].(string); ok && replyTo != "" {
+		out.ReplyToID = &replyTo
 	}
-
-	messageID := uuid.New().String()
-	
-	// Parse message for file attachments
-	var fileURL *string
-	var messageType string = "text"
-	
-	// Check if message contains file URL in format [type]url
-	if strings.HasPrefix(text, "[image]") {
-		url := strings.TrimPrefix(text, "[image]")
-		fileURL = &url
-		messageType = "image"
-		text = "" // Clear text for image-only messages
-	} else if strings.HasPrefix(text, "[file]") {
-		url := strings.TrimPrefix(text, "[file]")
-		fileURL = &url
-		messageType = "file"
+	if seconds, ok := msg["self_destruct_in"].(float64); ok {
+		out.SelfDestructIn = int(seconds)
 	}
-
-	// Get reply_to_id if present
-	var replyToID *string
-	if replyTo, ok := msg["reply_to_id"].(string); ok && replyTo != "" {
-		replyToID = &replyTo
+	out.SelfDestructAfterRead, _ = msg["self_destruct_after_read"].(bool)
+	if ids, ok := msg["attachment_ids"].([]interface{}); ok {
+		for _, id := range ids {
+			if id, ok := id.(string); ok {
+				out.AttachmentIDs = append(out.AttachmentIDs, id)
+			}
+		}
 	}
 
-	// Save to database
-	var err error
-	if fileURL != nil {
-		if replyToID != nil {
-			_, err = c.db.Exec(utils.AdaptQuery(`
-				INSERT INTO messages (id, sender_id, receiver_id, text, message_type, file_url, reply_to_id)
-				VALUES ($1, $2, $3, $4, $5, $6, $7)
-			`), messageID, c.userID, receiverID, text, messageType, *fileURL, *replyToID)
-		} else {
-			_, err = c.db.Exec(utils.AdaptQuery(`
-				INSERT INTO messages (id, sender_id, receiver_id, text, message_type, file_url)
-				VALUES ($1, $2, $3, $4, $5, $6)
-			`), messageID, c.userID, receiverID, text, messageType, *fileURL)
+	_, err := SendMessage(c.db, c.hub, out, func(sent Sent) {
+		ack := map[string]interface{}{
+			"type":              "message_ack",
+			"client_message_id": out.ClientMessageID,
+			"id":                sent.ID,
+			"created_at":        sent.CreatedAt,
+		}
+		if sent.Duplicate {
+			ack["duplicate"] = true
 		}
-	} else {
-		if replyToID != nil {
-			_, err = c.db.Exec(utils.AdaptQuery(`
-				INSERT INTO messages (id, sender_id, receiver_id, text, message_type, reply_to_id)
-				VALUES ($1, $2, $3, $4, 'text', $5)
-			`), messageID, c.userID, receiverID, text, *replyToID)
-		} else {
-			_, err = c.db.Exec(utils.AdaptQuery(`
-				INSERT INTO messages (id, sender_id, receiver_id, text, message_type)
-				VALUES ($1, $2, $3, $4, 'text')
-			`), messageID, c.userID, receiverID, text)
+		c.sendJSON(ack)
+	})
+	if sendErr, ok := err.(*SendError); ok {
+		clientMessageID := out.ClientMessageID
+		if len(clientMessageID) > 64 {
+			clientMessageID = ""
 		}
+		c.sendMessageError(clientMessageID, sendErr.Code, sendErr.Message)
 	}
+}
 
+// sendMessageError tells the sender why a send_message frame was rejected
+func (c *Client) sendMessageError(clientMessageID, code, message string) {
+	c.sendJSON(map[string]interface{}{
+		"type":              "message_error",
+		"client_message_id": clientMessageID,
+		"code":              code,
+		"error":             message,
+	})
+}
+
+// recipients returns the users that should receive events sent by this client
+// to the target, leaving out those blocked either way. Returns ok == false if
+// the client may not post there.
+func (c *Client) recipients(target conversation.Target) ([]string, bool) {
+	recipients, ok, err := conversation.Recipients(c.db, target, c.userID)
 	if err != nil {
-		log.Printf("Failed to save message: %v", err)
-		return
+		log.Printf("Failed to resolve recipients: %v", err)
+		return nil, false
 	}
-
-	// Get sender info
-	var username string
-	var avatarURL *string
-	c.db.QueryRow(`
-		SELECT username, avatar_url FROM users WHERE id = $1
-	`, c.userID).Scan(&username, &avatarURL)
-
-	// Get replied message if exists
-	var repliedMessage map[string]interface{}
-	if replyToID != nil {
-		var repliedText string
-		var repliedSenderID string
-		var repliedFileURL *string
-		var repliedMessageType string
-		err := c.db.QueryRow(`
-			SELECT text, sender_id, file_url, message_type
-			FROM messages WHERE id = $1
-		`, *replyToID).Scan(&repliedText, &repliedSenderID, &repliedFileURL, &repliedMessageType)
-		
-		if err == nil {
-			repliedMessage = map[string]interface{}{
-				"id":           *replyToID,
-				"text":         repliedText,
-				"sender_id":    repliedSenderID,
-				"message_type": repliedMessageType,
-			}
-			if repliedFileURL != nil {
-				repliedMessage["file_url"] = *repliedFileURL
-			}
-		}
+	related, err := store.New(c.db).Blocks.Related(context.Background(), c.userID)
+	if err != nil {
+		log.Printf("Failed to load blocks: %v", err)
+		return nil, false
 	}
+	return without(recipients, related), ok
+}
 
-	// Send to receiver
-	response := map[string]interface{}{
-		"type":         "new_message",
-		"id":           messageID,
-		"sender_id":    c.userID,
-		"receiver_id":  receiverID,
-		"text":         text,
-		"message_type": messageType,
-		"sender_name":  username,
-		"is_read":      false,
-		"read_at":      nil,
-		"created_at":   time.Now(),
+// without returns ids except those in exclude
+func without(ids, exclude []string) []string {
+	if len(exclude) == 0 {
+		return ids
 	}
-
-	if avatarURL != nil {
-		response["sender_avatar_url"] = *avatarURL
+	excluded := make(map[string]bool, len(exclude))
+	for _, id := range exclude {
+		excluded[id] = true
 	}
-	
-	if fileURL != nil {
-		response["file_url"] = *fileURL
+	kept := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !excluded[id] {
+			kept = append(kept, id)
+		}
 	}
+	return kept
+}
 
-	if replyToID != nil {
-		response["reply_to_id"] = *replyToID
-		if repliedMessage != nil {
-			response["replied_message"] = repliedMessage
-		}
+// parseTarget reads the destination of an incoming frame
+func parseTarget(msg map[string]interface{}) conversation.Target {
+	var target conversation.Target
+	target.ReceiverID, _ = msg["receiver_id"].(string)
+	target.GroupID, _ = msg["group_id"].(string)
+	target.ServerChannelID, _ = msg["server_channel_id"].(string)
+	return target
+}
+
+// setTargetFields copies the destination of a frame into an outgoing event
+func setTargetFields(response map[string]interface{}, target conversation.Target) {
+	switch {
+	case target.GroupID != "":
+		response["group_id"] = target.GroupID
+	case target.ServerChannelID != "":
+		response["server_channel_id"] = target.ServerChannelID
+	case target.ChannelID != "":
+		response["channel_id"] = target.ChannelID
+	default:
+		response["receiver_id"] = target.ReceiverID
 	}
+}
 
-	// Send only to receiver (sender will add it locally)
-	c.hub.SendToUser(receiverID, response)
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
 }
 
 func (c *Client) handleTyping(msg map[string]interface{}) {
-	receiverID, ok := msg["receiver_id"].(string)
+	target := parseTarget(msg)
+	if !target.Valid() {
+		return
+	}
+
+	recipients, ok := c.recipients(target)
 	if !ok {
 		return
 	}
@@ -269,8 +296,11 @@ func (c *Client) handleTyping(msg map[string]interface{}) {
 		"user_id": c.userID,
 		"typing":  typing,
 	}
+	if target.ReceiverID == "" {
+		setTargetFields(response, target)
+	}
 
-	c.hub.SendToUser(receiverID, response)
+	c.hub.SendTransient(recipients, response)
 }
 
 func (c *Client) handleMarkRead(msg map[string]interface{}) {
@@ -279,19 +309,24 @@ func (c *Client) handleMarkRead(msg map[string]interface{}) {
 		return
 	}
 
-	// Update messages as read in database
-	result, err := c.db.Exec(utils.AdaptQuery(`
-		UPDATE messages
-		SET is_read = true, read_at = CURRENT_TIMESTAMP
-		WHERE sender_id = $1 AND receiver_id = $2 AND is_read = false
-	`), senderID, c.userID)
+	// Between a blocked pair nothing is marked read, so the sender cannot
+	// learn it from the read state of their messages either
+	stores := store.New(c.db)
+	blocked, err := stores.Blocks.Between(context.Background(), c.userID, senderID)
+	if err != nil {
+		log.Printf("Failed to check blocks: %v", err)
+		return
+	}
+	if blocked {
+		return
+	}
 
+	// Update messages as read in database
+	rowsAffected, err := stores.Messages.MarkRead(context.Background(), senderID, c.userID)
 	if err != nil {
 		log.Printf("Failed to mark messages as read: %v", err)
 		return
 	}
-
-	rowsAffected, _ := result.RowsAffected()
 	if rowsAffected == 0 {
 		return
 	}
@@ -304,5 +339,6 @@ func (c *Client) handleMarkRead(msg map[string]interface{}) {
 		"read_at":     time.Now(),
 	}
 
-	c.hub.SendToUser(senderID, response)
+	// The reader's devices learn the chat was read, too
+	c.hub.SendToUsers([]string{senderID, c.userID}, response)
 }
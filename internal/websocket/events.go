@@ -0,0 +1,184 @@
+package websocket
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// EventLog persists the events sent to each user under a per-user, strictly
+// increasing sequence number, so that a client that lost its connection can
+// ask for everything after the last seq it saw.
+type EventLog struct {
+	db        *sql.DB
+	retention time.Duration
+}
+
+// Event is a stored event; Payload is the JSON frame including its seq
+type Event struct {
+	Seq     int64
+	Payload []byte
+}
+
+func NewEventLog(db *sql.DB, retention time.Duration) *EventLog {
+	return &EventLog{db: db, retention: retention}
+}
+
+// appendChunk bounds the users per statement of Append, keeping the
+// placeholders within the limits of both databases
+const appendChunk = 500
+
+// Append assigns the next seq of each user to the event and stores it, in one
+// transaction, returning the seqs in the order of userIDs. userIDs must not
+// repeat. data must be a JSON object; the stored payloads have "seq" added.
+func (l *EventLog) Append(userIDs []string, data []byte) ([]int64, error) {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Written here rather than defaulted, since the pruner compares it with
+	// UTC and CURRENT_TIMESTAMP is in the session's time zone on PostgreSQL
+	createdAt := utils.DBTime(time.Now())
+
+	seqs := make([]int64, 0, len(userIDs))
+	for start := 0; start < len(userIDs); start += appendChunk {
+		chunk, err := appendEvents(tx, userIDs[start:min(start+appendChunk, len(userIDs))], data, createdAt)
+		if err != nil {
+			return nil, err
+		}
+		seqs = append(seqs, chunk...)
+	}
+	return seqs, tx.Commit()
+}
+
+// appendEvents bumps the seqs of the users and inserts the event under them,
+// with one statement each
+func appendEvents(tx *sql.Tx, userIDs []string, data []byte, createdAt string) ([]int64, error) {
+	var values strings.Builder
+	args := make([]interface{}, 0, 3*len(userIDs))
+	for i, userID := range userIDs {
+		if i > 0 {
+			values.WriteString(", ")
+		}
+		fmt.Fprintf(&values, "($%d, 1)", i+1)
+		args = append(args, userID)
+	}
+	rows, err := tx.Query(utils.AdaptQuery(`
+		INSERT INTO user_event_seqs (user_id, last_seq) VALUES `+values.String()+`
+		ON CONFLICT (user_id) DO UPDATE SET last_seq = user_event_seqs.last_seq + 1
+		RETURNING user_id, last_seq
+	`), args...)
+	if err != nil {
+		return nil, err
+	}
+	assigned := make(map[string]int64, len(userIDs))
+	for rows.Next() {
+		var userID string
+		var seq int64
+		if err := rows.Scan(&userID, &seq); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		assigned[userID] = seq
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	seqs := make([]int64, len(userIDs))
+	values.Reset()
+	args = append(args[:0], createdAt)
+	for i, userID := range userIDs {
+		seq, ok := assigned[userID]
+		if !ok {
+			return nil, fmt.Errorf("no event seq assigned to user %s", userID)
+		}
+		seqs[i] = seq
+		if i > 0 {
+			values.WriteString(", ")
+		}
+		n := len(args)
+		fmt.Fprintf(&values, "($%d, $%d, $%d, $1)", n+1, n+2, n+3)
+		args = append(args, userID, seq, string(withSeq(data, seq)))
+	}
+	_, err = tx.Exec(utils.AdaptQuery(`
+		INSERT INTO user_events (user_id, seq, payload, created_at) VALUES `+values.String()), args...)
+	if err != nil {
+		return nil, err
+	}
+	return seqs, nil
+}
+
+// Since returns up to limit events of the user with seq greater than since, oldest first
+func (l *EventLog) Since(userID string, since int64, limit int) ([]Event, error) {
+	rows, err := l.db.Query(utils.AdaptQuery(`
+		SELECT seq, payload FROM user_events
+		WHERE user_id = $1 AND seq > $2
+		ORDER BY seq ASC
+		LIMIT $3
+	`), userID, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var event Event
+		var payload string
+		if err := rows.Scan(&event.Seq, &payload); err != nil {
+			return nil, err
+		}
+		event.Payload = []byte(payload)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// LastSeq returns the seq of the newest event of the user, or 0 if there is none
+func (l *EventLog) LastSeq(userID string) (int64, error) {
+	var seq int64
+	err := l.db.QueryRow(utils.AdaptQuery(`
+		SELECT last_seq FROM user_event_seqs WHERE user_id = $1
+	`), userID).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// RunPruner deletes events older than the retention period once an hour.
+// Sequence counters are kept so numbering never restarts.
+func (l *EventLog) RunPruner() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		cutoff := utils.DBTime(time.Now().Add(-l.retention))
+		if _, err := l.db.Exec(utils.AdaptQuery(`
+			DELETE FROM user_events WHERE created_at < $1
+		`), cutoff); err != nil {
+			log.Printf("Failed to prune events: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// withSeq adds a "seq" field to a JSON object
+func withSeq(data []byte, seq int64) []byte {
+	out := make([]byte, 0, len(data)+24)
+	out = append(out, `{"seq":`...)
+	out = strconv.AppendInt(out, seq, 10)
+	if len(data) > 2 {
+		out = append(out, ',')
+	}
+	return append(out, data[1:]...)
+}
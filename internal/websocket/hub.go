@@ -1,26 +1,128 @@
 package websocket
 
 import (
+	"context"
 	"encoding/json"
+	"hash/fnv"
 	"log"
 	"sync"
+	"time"
+
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// maxReplay is the most events replayed to a resuming client. Clients that
+// missed more get resync_required and reload their state over REST.
+const maxReplay = 500
+
+const (
+	// presenceInterval is how often a hub republishes the users connected to it
+	presenceInterval = 30 * time.Second
+	// presenceTTL is how long a user stays online without being republished,
+	// so users of a node that died go offline
+	presenceTTL = 3 * presenceInterval
+	// presenceChunk bounds the users per presence message to fit the backplane
+	presenceChunk = 100
+	// deliverChunk bounds the users per delivery message to fit the backplane
+	deliverChunk = 100
+)
+
+const (
+	// eventShards is how many locks and workers the users' sequenced events
+	// are spread over
+	eventShards = 16
+	// eventQueue bounds the sends waiting on a shard; senders block when it is full
+	eventQueue = 256
 )
 
 type Hub struct {
-	clients    map[string]*Client
-	broadcast  chan []byte
+	// clients holds every open connection: userID -> deviceID -> client.
+	// A user is online while at least one of their devices is connected.
+	clients    map[string]map[string]*Client
 	register   chan *Client
 	unregister chan *Client
-	mu         sync.RWMutex
+	// presence signals that online_users should be sent again; changes coalesce
+	presence chan struct{}
+	mu       sync.RWMutex
+
+	// events stores sequenced events for resume; nil disables sequencing.
+	// Each user's events are sequenced and delivered by the shard they hash to.
+	events *EventLog
+	shards [eventShards]eventShard
+
+	// backplane shares delivery and presence with the hubs of other processes;
+	// nil runs a single node. node tells this hub's messages apart.
+	backplane Backplane
+	node      string
+	// remote holds the users connected to other nodes: node -> userID -> last refresh
+	remote     map[string]map[string]time.Time
+	presenceMu sync.Mutex
+
+	// blocks hides the presence of users from those they blocked or were
+	// blocked by; nil hides nothing. hidden caches it per local user.
+	blocks  store.BlockStore
+	hidden  map[string]map[string]bool
+	blockMu sync.Mutex
+}
+
+// eventShard sequences and delivers the events of the users hashed to it, in
+// the order they were sent. mu orders seq assignment with delivery and replay,
+// so a client sees every user's events in seq order with no gaps. Taken before
+// Hub.mu.
+type eventShard struct {
+	mu    sync.Mutex
+	queue chan eventJob
 }
 
-func NewHub() *Hub {
-	return &Hub{
-		clients:    make(map[string]*Client),
-		broadcast:  make(chan []byte, 256),
+// eventJob is an event for users of one shard
+type eventJob struct {
+	userIDs []string
+	data    []byte
+}
+
+// envelope is a message on the backplane
+type envelope struct {
+	Node string `json:"node"`
+	// Kind is "deliver", "online", "offline", "sync", "revoke" or "blocks"
+	Kind  string   `json:"kind"`
+	Users []string `json:"users,omitempty"`
+	// Session is the revoked session of a revoke
+	Session string `json:"session,omitempty"`
+	// Data is the frame to deliver. Seqs holds the seq of each of Users for a
+	// sequenced frame, which is sent without its seq; sequenced frames too
+	// large for the backplane are sent without Data and loaded from the event log.
+	Data json.RawMessage `json:"data,omitempty"`
+	Seqs []int64         `json:"seqs,omitempty"`
+}
+
+func NewHub(events *EventLog, backplane Backplane, blocks store.BlockStore) *Hub {
+	h := &Hub{
+		clients:    make(map[string]map[string]*Client),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		presence:   make(chan struct{}, 1),
+		events:     events,
+		backplane:  backplane,
+		node:       utils.GenerateUUID(),
+		remote:     make(map[string]map[string]time.Time),
+		blocks:     blocks,
+		hidden:     make(map[string]map[string]bool),
+	}
+	if events != nil {
+		for i := range h.shards {
+			h.shards[i].queue = make(chan eventJob, eventQueue)
+			go h.runShard(&h.shards[i])
+		}
 	}
+	return h
+}
+
+// shard returns the event shard of the user
+func (h *Hub) shard(userID string) *eventShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(userID))
+	return &h.shards[hash.Sum32()%eventShards]
 }
 
 func (h *Hub) RegisterClient(client *Client) {
@@ -32,63 +134,420 @@ func (h *Hub) UnregisterClient(client *Client) {
 }
 
 func (h *Hub) Run() {
+	var heartbeat <-chan time.Time
+	if h.backplane != nil {
+		if err := h.backplane.Subscribe(h.receive); err != nil {
+			log.Printf("Failed to subscribe to backplane: %v", err)
+		}
+		// Ask the other nodes who is connected to them
+		h.publish(envelope{Kind: "sync"})
+
+		ticker := time.NewTicker(presenceInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
 	for {
 		select {
 		case client := <-h.register:
-			h.mu.Lock()
-			h.clients[client.userID] = client
-			h.mu.Unlock()
-			log.Printf("Client connected: %s", client.userID)
+			if h.attach(client) {
+				h.publish(envelope{Kind: "online", Users: []string{client.userID}})
+			}
+			log.Printf("Client connected: %s (device %s)", client.userID, client.deviceID)
 			h.broadcastOnlineUsers()
 
 		case client := <-h.unregister:
 			h.mu.Lock()
-			if _, ok := h.clients[client.userID]; ok {
-				delete(h.clients, client.userID)
-				close(client.send)
-			}
+			offline := h.remove(client)
 			h.mu.Unlock()
-			log.Printf("Client disconnected: %s", client.userID)
+			if offline {
+				h.publish(envelope{Kind: "offline", Users: []string{client.userID}})
+			}
+			log.Printf("Client disconnected: %s (device %s)", client.userID, client.deviceID)
 			h.broadcastOnlineUsers()
 
-		case message := <-h.broadcast:
-			h.mu.RLock()
-			for _, client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client.userID)
-				}
+		case <-h.presence:
+			h.sendOnlineUsers()
+
+		case <-heartbeat:
+			h.publishLocalUsers()
+			if h.expireRemote() {
+				h.broadcastOnlineUsers()
 			}
-			h.mu.RUnlock()
 		}
 	}
 }
 
-func (h *Hub) SendToUser(userID string, message interface{}) {
-	h.mu.RLock()
-	client, ok := h.clients[userID]
-	h.mu.RUnlock()
+// attach sends the session frame and any missed events to a new connection,
+// then adds it to the clients so it starts receiving live events. It reports
+// whether this is the first connected device of the user.
+func (h *Hub) attach(client *Client) bool {
+	shard := h.shard(client.userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	var lastSeq int64
+	if h.events != nil {
+		var err error
+		if lastSeq, err = h.events.LastSeq(client.userID); err != nil {
+			log.Printf("Failed to get last event seq of user %s: %v", client.userID, err)
+		}
+	}
+	client.sendJSON(map[string]interface{}{
+		"type":      "session",
+		"device_id": client.deviceID,
+		"last_seq":  lastSeq,
+	})
+	if client.since >= 0 {
+		h.replay(client, client.since, lastSeq)
+	}
+	// Events up to here are covered by the session frame or the replay
+	client.replayed = lastSeq
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
+	devices, ok := h.clients[client.userID]
 	if !ok {
+		devices = make(map[string]*Client)
+		h.clients[client.userID] = devices
+	}
+	// A device reconnecting before its old connection timed out replaces it
+	if old, ok := devices[client.deviceID]; ok {
+		close(old.send)
+	}
+	devices[client.deviceID] = client
+	return !ok
+}
+
+// Resume replays the events after since to a connected client, for the resume frame
+func (h *Hub) Resume(client *Client, since int64) {
+	shard := h.shard(client.userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	var lastSeq int64
+	if h.events != nil {
+		var err error
+		if lastSeq, err = h.events.LastSeq(client.userID); err != nil {
+			log.Printf("Failed to get last event seq of user %s: %v", client.userID, err)
+		}
+	}
+
+	// The send channel must not be closed while replaying into it
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.clients[client.userID][client.deviceID] == client {
+		h.replay(client, since, lastSeq)
+		if lastSeq > client.replayed {
+			client.replayed = lastSeq
+		}
+	}
+}
+
+// replay queues the stored events after since on the client, or resync_required
+// if they don't fit. Callers hold the lock of the user's shard.
+func (h *Hub) replay(client *Client, since, lastSeq int64) {
+	if h.events == nil || since >= lastSeq {
+		return
+	}
+
+	events, err := h.events.Since(client.userID, since, maxReplay+1)
+	if err != nil {
+		log.Printf("Failed to load events of user %s: %v", client.userID, err)
+	}
+	// Too many, failed to load, or the oldest missed events were already pruned
+	free := cap(client.send) - len(client.send)
+	if err != nil || len(events) > maxReplay || len(events) >= free ||
+		len(events) == 0 || events[0].Seq != since+1 {
+		client.sendJSON(map[string]interface{}{
+			"type":     "resync_required",
+			"last_seq": lastSeq,
+		})
+		return
+	}
+
+	for _, event := range events {
+		client.send <- event.Payload
+	}
+}
+
+// remove drops the connection and closes its send channel. It does nothing if
+// the device slot already belongs to a newer connection. It reports whether
+// the user has no devices left. Callers hold h.mu.
+func (h *Hub) remove(client *Client) bool {
+	devices := h.clients[client.userID]
+	if devices[client.deviceID] != client {
+		return false
+	}
+	delete(devices, client.deviceID)
+	close(client.send)
+	if len(devices) == 0 {
+		delete(h.clients, client.userID)
+		return true
+	}
+	return false
+}
+
+// RevokeSession closes the connections of a session of the user on every
+// node, telling them first with session_revoked
+func (h *Hub) RevokeSession(userID, sessionID string) {
+	h.disconnectSession(userID, sessionID)
+	h.publish(envelope{Kind: "revoke", Users: []string{userID}, Session: sessionID})
+}
+
+// disconnectSession closes the local connections of a session. Frames already
+// queued on them are still written before the close.
+func (h *Hub) disconnectSession(userID, sessionID string) {
+	data, _ := json.Marshal(map[string]interface{}{
+		"type":       "session_revoked",
+		"session_id": sessionID,
+	})
+
+	offline := false
+	h.mu.Lock()
+	for _, client := range h.clients[userID] {
+		if client.sessionID == sessionID {
+			h.deliver(client, data)
+			offline = h.remove(client) || offline
+			log.Printf("Session %s revoked: disconnecting %s (device %s)", sessionID, client.userID, client.deviceID)
+		}
+	}
+	h.mu.Unlock()
+	if offline {
+		h.publish(envelope{Kind: "offline", Users: []string{userID}})
+		h.broadcastOnlineUsers()
+	}
+}
+
+// SendToUser sends the message to every connected device of the user
+func (h *Hub) SendToUser(userID string, message interface{}) {
+	h.SendToUsers([]string{userID}, message)
+}
+
+// SendToUsers sends the message to every connected device of the listed users,
+// on any node. Each user gets it under their next event seq and can replay it
+// after a reconnect, whether or not they were online. The message is stored
+// and delivered in the background; each user still gets their events in the
+// order they were sent.
+//
+// Events of one user sent from different nodes may arrive out of seq order;
+// clients that notice a gap resume from the last seq they saw.
+func (h *Hub) SendToUsers(userIDs []string, message interface{}) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Failed to marshal message: %v", err)
 		return
 	}
 
+	if h.events == nil {
+		h.sendData(userIDs, data, 0)
+		h.publishDelivery(userIDs, data, nil)
+		return
+	}
+
+	jobs := make(map[*eventShard][]string)
+	seen := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		if !seen[userID] {
+			seen[userID] = true
+			shard := h.shard(userID)
+			jobs[shard] = append(jobs[shard], userID)
+		}
+	}
+	for shard, ids := range jobs {
+		shard.queue <- eventJob{userIDs: ids, data: data}
+	}
+}
+
+// runShard stores and delivers the events queued on the shard, one batch per send
+func (h *Hub) runShard(shard *eventShard) {
+	for job := range shard.queue {
+		shard.mu.Lock()
+		seqs, err := h.events.Append(job.userIDs, job.data)
+		if err != nil {
+			// Deliver unsequenced rather than drop it; the clients will see a gap on their next resume
+			log.Printf("Failed to store event for %d users: %v", len(job.userIDs), err)
+			seqs = nil
+		}
+		if seqs == nil {
+			h.sendData(job.userIDs, job.data, 0)
+		} else {
+			for i, userID := range job.userIDs {
+				h.sendData([]string{userID}, withSeq(job.data, seqs[i]), seqs[i])
+			}
+		}
+		shard.mu.Unlock()
+
+		h.publishDelivery(job.userIDs, job.data, seqs)
+	}
+}
+
+// SendTransient sends the message to every connected device of the listed users
+// without sequencing or storing it, for events like typing that are useless later
+func (h *Hub) SendTransient(userIDs []string, message interface{}) {
 	data, err := json.Marshal(message)
 	if err != nil {
 		log.Printf("Failed to marshal message: %v", err)
 		return
 	}
+	h.sendData(userIDs, data, 0)
+	h.publishDelivery(userIDs, data, nil)
+}
 
+// sendData delivers data to the local devices of the users. A sequenced event
+// is skipped on devices that already got it in their replay.
+func (h *Hub) sendData(userIDs []string, data []byte, seq int64) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, userID := range userIDs {
+		for _, client := range h.clients[userID] {
+			if seq == 0 || seq > client.replayed {
+				h.deliver(client, data)
+			}
+		}
+	}
+}
+
+// deliver queues data on the client without blocking. Callers hold h.mu.
+func (h *Hub) deliver(client *Client, data []byte) {
 	select {
 	case client.send <- data:
 	default:
-		log.Printf("Failed to send message to user %s", userID)
+		log.Printf("Failed to send message to user %s (device %s)", client.userID, client.deviceID)
 	}
 }
 
-func (h *Hub) broadcastOnlineUsers() {
+// publishDelivery sends a frame for the users to the other nodes, with their
+// seqs if it is sequenced, in as few messages as the backplane allows
+func (h *Hub) publishDelivery(userIDs []string, data []byte, seqs []int64) {
+	if h.backplane == nil {
+		return
+	}
+	for start := 0; start < len(userIDs); start += deliverChunk {
+		end := min(start+deliverChunk, len(userIDs))
+		msg := envelope{Kind: "deliver", Users: userIDs[start:end], Data: data}
+		if seqs != nil {
+			msg.Seqs = seqs[start:end]
+		}
+		h.publish(msg)
+	}
+}
+
+// publish sends a message to the other nodes. A sequenced frame the backplane
+// cannot carry is sent as a reference to the event log instead.
+func (h *Hub) publish(msg envelope) {
+	if h.backplane == nil {
+		return
+	}
+	msg.Node = h.node
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to marshal backplane message: %v", err)
+		return
+	}
+	err = h.backplane.Publish(data)
+	if err == ErrPayloadTooLarge && len(msg.Seqs) > 0 {
+		msg.Data = nil
+		if data, err = json.Marshal(msg); err == nil {
+			err = h.backplane.Publish(data)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to publish %s to backplane: %v", msg.Kind, err)
+	}
+}
+
+// receive handles a message from the backplane
+func (h *Hub) receive(data []byte) {
+	var msg envelope
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Printf("Invalid backplane message: %v", err)
+		return
+	}
+	if msg.Node == h.node {
+		return
+	}
+
+	switch msg.Kind {
+	case "deliver":
+		h.receiveDelivery(msg)
+
+	case "online", "offline":
+		now := time.Now()
+		h.presenceMu.Lock()
+		users, ok := h.remote[msg.Node]
+		if !ok {
+			users = make(map[string]time.Time)
+			h.remote[msg.Node] = users
+		}
+		for _, userID := range msg.Users {
+			if msg.Kind == "online" {
+				users[userID] = now
+			} else {
+				delete(users, userID)
+			}
+		}
+		h.presenceMu.Unlock()
+		h.broadcastOnlineUsers()
+
+	case "sync":
+		h.publishLocalUsers()
+
+	case "revoke":
+		for _, userID := range msg.Users {
+			h.disconnectSession(userID, msg.Session)
+		}
+
+	case "blocks":
+		h.forgetBlocks(msg.Users)
+		h.broadcastOnlineUsers()
+	}
+}
+
+func (h *Hub) receiveDelivery(msg envelope) {
+	if len(msg.Seqs) == 0 {
+		h.sendData(msg.Users, msg.Data, 0)
+		return
+	}
+	if len(msg.Seqs) != len(msg.Users) {
+		log.Printf("Invalid delivery from node %s: %d seqs for %d users", msg.Node, len(msg.Seqs), len(msg.Users))
+		return
+	}
+
+	for i, userID := range msg.Users {
+		seq := msg.Seqs[i]
+		var payload []byte
+		if len(msg.Data) > 0 {
+			payload = withSeq(msg.Data, seq)
+		} else if h.events != nil {
+			events, err := h.events.Since(userID, seq-1, 1)
+			if err != nil || len(events) == 0 || events[0].Seq != seq {
+				log.Printf("Failed to load event %d of user %s: %v", seq, userID, err)
+				continue
+			}
+			payload = events[0].Payload
+		} else {
+			continue
+		}
+
+		// Ordered with attach so that an event is either replayed or delivered live
+		shard := h.shard(userID)
+		shard.mu.Lock()
+		h.sendData([]string{userID}, payload, seq)
+		shard.mu.Unlock()
+	}
+}
+
+// publishLocalUsers announces every user connected to this node, refreshing
+// them on the other nodes
+func (h *Hub) publishLocalUsers() {
+	if h.backplane == nil {
+		return
+	}
+
 	h.mu.RLock()
 	userIDs := make([]string, 0, len(h.clients))
 	for userID := range h.clients {
@@ -96,18 +555,184 @@ func (h *Hub) broadcastOnlineUsers() {
 	}
 	h.mu.RUnlock()
 
+	for len(userIDs) > 0 {
+		n := len(userIDs)
+		if n > presenceChunk {
+			n = presenceChunk
+		}
+		h.publish(envelope{Kind: "online", Users: userIDs[:n]})
+		userIDs = userIDs[n:]
+	}
+}
+
+// expireRemote forgets remote users that were not refreshed in time and
+// reports whether there were any
+func (h *Hub) expireRemote() bool {
+	cutoff := time.Now().Add(-presenceTTL)
+	expired := false
+
+	h.presenceMu.Lock()
+	defer h.presenceMu.Unlock()
+	for node, users := range h.remote {
+		for userID, seen := range users {
+			if seen.Before(cutoff) {
+				delete(users, userID)
+				expired = true
+			}
+		}
+		if len(users) == 0 {
+			delete(h.remote, node)
+		}
+	}
+	return expired
+}
+
+// broadcastOnlineUsers schedules sending online_users to the local clients
+func (h *Hub) broadcastOnlineUsers() {
+	select {
+	case h.presence <- struct{}{}:
+	default:
+	}
+}
+
+// sendOnlineUsers sends the users online on any node to every local client.
+// Clients too slow to take it are dropped.
+func (h *Hub) sendOnlineUsers() {
+	online := make(map[string]bool)
+	h.mu.RLock()
+	local := make([]string, 0, len(h.clients))
+	for userID := range h.clients {
+		online[userID] = true
+		local = append(local, userID)
+	}
+	h.mu.RUnlock()
+
+	cutoff := time.Now().Add(-presenceTTL)
+	h.presenceMu.Lock()
+	for _, users := range h.remote {
+		for userID, seen := range users {
+			if seen.After(cutoff) {
+				online[userID] = true
+			}
+		}
+	}
+	h.presenceMu.Unlock()
+
+	userIDs := make([]string, 0, len(online))
+	for userID := range online {
+		userIDs = append(userIDs, userID)
+	}
+
 	message := map[string]interface{}{
 		"type":  "online_users",
 		"users": userIDs,
 	}
-
 	data, _ := json.Marshal(message)
-	h.broadcast <- data
+
+	// Users with blocks get the list without the users on either side of them
+	filtered := make(map[string][]byte)
+	for userID, hidden := range h.hiddenFrom(local) {
+		if len(hidden) == 0 {
+			continue
+		}
+		visible := make([]string, 0, len(userIDs))
+		for _, id := range userIDs {
+			if !hidden[id] {
+				visible = append(visible, id)
+			}
+		}
+		filtered[userID], _ = json.Marshal(map[string]interface{}{
+			"type":  "online_users",
+			"users": visible,
+		})
+	}
+
+	var offline []string
+	h.mu.Lock()
+	for userID, devices := range h.clients {
+		payload, ok := filtered[userID]
+		if !ok {
+			payload = data
+		}
+		for _, client := range devices {
+			select {
+			case client.send <- payload:
+			default:
+				if h.remove(client) {
+					offline = append(offline, client.userID)
+				}
+			}
+		}
+	}
+	h.mu.Unlock()
+	if len(offline) > 0 {
+		h.publish(envelope{Kind: "offline", Users: offline})
+		h.broadcastOnlineUsers()
+	}
+}
+
+// hiddenFrom returns, for each of the local users, the users whose presence
+// they do not see. Only those users stay cached.
+func (h *Hub) hiddenFrom(userIDs []string) map[string]map[string]bool {
+	if h.blocks == nil {
+		return nil
+	}
+
+	h.blockMu.Lock()
+	defer h.blockMu.Unlock()
+	cached := make(map[string]map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		hidden, ok := h.hidden[userID]
+		if !ok {
+			related, err := h.blocks.Related(context.Background(), userID)
+			if err != nil {
+				log.Printf("Failed to load blocks of user %s: %v", userID, err)
+				continue
+			}
+			hidden = make(map[string]bool, len(related))
+			for _, id := range related {
+				hidden[id] = true
+			}
+		}
+		cached[userID] = hidden
+	}
+	h.hidden = cached
+	return cached
+}
+
+// BlocksChanged resends presence on every node after users blocked or
+// unblocked each other
+func (h *Hub) BlocksChanged(userIDs ...string) {
+	h.forgetBlocks(userIDs)
+	h.broadcastOnlineUsers()
+	h.publish(envelope{Kind: "blocks", Users: userIDs})
+}
+
+// forgetBlocks drops the cached blocks of users so they are loaded again
+func (h *Hub) forgetBlocks(userIDs []string) {
+	h.blockMu.Lock()
+	for _, userID := range userIDs {
+		delete(h.hidden, userID)
+	}
+	h.blockMu.Unlock()
 }
 
+// IsOnline reports whether any device of the user is connected to any node
 func (h *Hub) IsOnline(userID string) bool {
 	h.mu.RLock()
-	defer h.mu.RUnlock()
-	_, ok := h.clients[userID]
-	return ok
+	local := len(h.clients[userID]) > 0
+	h.mu.RUnlock()
+	if local {
+		return true
+	}
+
+	cutoff := time.Now().Add(-presenceTTL)
+	h.presenceMu.Lock()
+	defer h.presenceMu.Unlock()
+	for _, users := range h.remote {
+		if seen, ok := users[userID]; ok && seen.After(cutoff) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,487 @@
+package websocket
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kvant/messenger/internal/database"
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// frameWait is how long a test waits for a frame that should arrive
+const frameWait = 5 * time.Second
+
+// newTestDB returns a migrated SQLite database that lives as long as the test
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	t.Setenv("USE_SQLITE", "true")
+	t.Setenv("SQLITE_DB_PATH", filepath.Join(t.TempDir(), "websocket.db"))
+
+	db, err := database.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.MigrateUp(db); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	return db
+}
+
+// newTestUser creates a user with a unique name starting with prefix
+func newTestUser(t *testing.T, db *sql.DB, prefix string) *models.User {
+	t.Helper()
+	user, err := store.New(db).Users.Create(context.Background(), prefix+utils.GenerateUUID()[:8], "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// newTestHub runs a hub with an event log in db, like the server does
+func newTestHub(t *testing.T, db *sql.DB, backplane Backplane) *Hub {
+	t.Helper()
+	hub := NewHub(NewEventLog(db, time.Hour), backplane, store.New(db).Blocks)
+	go hub.Run()
+	return hub
+}
+
+// serveHub serves WebSocket connections to hub like /api/ws, taking the user
+// from the user query parameter instead of a token
+func serveHub(t *testing.T, hub *Hub, db *sql.DB) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		since := int64(-1)
+		if v := query.Get("since"); v != "" {
+			since, _ = strconv.ParseInt(v, 10, 64)
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := NewClient(hub, conn, query.Get("user"), "session", query.Get("device"), since, db)
+		hub.RegisterClient(client)
+		go client.WritePump()
+		go client.ReadPump()
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// testConn is a device connected to a test server
+type testConn struct {
+	t    *testing.T
+	conn *websocket.Conn
+	// frames carries what the server sent, and is closed with the connection
+	frames chan map[string]interface{}
+	// skipped holds the frames passed over by next, in order
+	skipped []map[string]interface{}
+	// lastSeq is the last_seq of the session frame
+	lastSeq int64
+}
+
+// dial connects a device of the user, passing since unless it is negative,
+// and returns once the hub delivers events to it
+func dial(t *testing.T, server *httptest.Server, userID, deviceID string, since int64) *testConn {
+	t.Helper()
+	query := url.Values{"user": {userID}, "device": {deviceID}}
+	if since >= 0 {
+		query.Set("since", strconv.FormatInt(since, 10))
+	}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &testConn{t: t, conn: conn, frames: make(chan map[string]interface{}, 1024)}
+	go func() {
+		defer close(c.frames)
+		for {
+			var frame map[string]interface{}
+			if err := conn.ReadJSON(&frame); err != nil {
+				return
+			}
+			c.frames <- frame
+		}
+	}()
+
+	session := c.next("session")
+	if session["device_id"] != deviceID {
+		t.Fatalf("session of device %v, want %s", session["device_id"], deviceID)
+	}
+	c.lastSeq = int64(session["last_seq"].(float64))
+	// Presence goes to the clients of the hub, so this one is attached. The
+	// frame is kept for presence.
+	c.skipped = append(c.skipped, c.next("online_users"))
+	return c
+}
+
+// send writes a frame to the server
+func (c *testConn) send(frame map[string]interface{}) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(frame); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// next returns the next frame of a type. Frames of other types are kept
+// for later calls.
+func (c *testConn) next(frameType string) map[string]interface{} {
+	c.t.Helper()
+	for i, frame := range c.skipped {
+		if frame["type"] == frameType {
+			c.skipped = append(c.skipped[:i], c.skipped[i+1:]...)
+			return frame
+		}
+	}
+	timeout := time.After(frameWait)
+	for {
+		select {
+		case frame, ok := <-c.frames:
+			if !ok {
+				c.t.Fatalf("connection closed waiting for %s", frameType)
+			}
+			if frame["type"] == frameType {
+				return frame
+			}
+			c.skipped = append(c.skipped, frame)
+		case <-timeout:
+			c.t.Fatalf("no %s frame", frameType)
+		}
+	}
+}
+
+// none fails if a frame of a type arrived or arrives within wait
+func (c *testConn) none(frameType string, wait time.Duration) {
+	c.t.Helper()
+	timeout := time.After(wait)
+	for {
+		for _, frame := range c.skipped {
+			if frame["type"] == frameType {
+				c.t.Fatalf("unexpected %s frame: %v", frameType, frame)
+			}
+		}
+		select {
+		case frame, ok := <-c.frames:
+			if !ok {
+				return
+			}
+			c.skipped = append(c.skipped, frame)
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// closed waits for the server to close the connection
+func (c *testConn) closed() {
+	c.t.Helper()
+	timeout := time.After(frameWait)
+	for {
+		select {
+		case _, ok := <-c.frames:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			c.t.Fatal("connection was not closed")
+		}
+	}
+}
+
+// presence waits for online_users to show a user online or offline
+func (c *testConn) presence(userID string, online bool) {
+	c.t.Helper()
+	for {
+		frame := c.next("online_users")
+		found := false
+		for _, id := range frame["users"].([]interface{}) {
+			found = found || id == userID
+		}
+		if found == online {
+			return
+		}
+	}
+}
+
+// sendText sends a direct message from the device
+func (c *testConn) sendText(receiverID, text, clientMessageID string) {
+	c.t.Helper()
+	c.send(map[string]interface{}{
+		"type":              "send_message",
+		"receiver_id":       receiverID,
+		"text":              text,
+		"client_message_id": clientMessageID,
+	})
+}
+
+// eventually waits for cond to hold
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(frameWait)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// seq returns the event seq of a frame
+func seq(t *testing.T, frame map[string]interface{}) int64 {
+	t.Helper()
+	n, ok := frame["seq"].(float64)
+	if !ok {
+		t.Fatalf("frame has no seq: %v", frame)
+	}
+	return int64(n)
+}
+
+// devices returns the connected devices of a user
+func devices(hub *Hub, userID string) int {
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	return len(hub.clients[userID])
+}
+
+func TestDeliveryToEveryDevice(t *testing.T) {
+	db := newTestDB(t)
+	hub := newTestHub(t, db, nil)
+	server := serveHub(t, hub, db)
+	me := newTestUser(t, db, "me")
+	friend := newTestUser(t, db, "friend")
+
+	phone := dial(t, server, me.ID, "phone", -1)
+	desktop := dial(t, server, me.ID, "desktop", -1)
+	sender := dial(t, server, friend.ID, "web", -1)
+	sender2 := dial(t, server, friend.ID, "tablet", -1)
+	if devices(hub, me.ID) != 2 || !hub.IsOnline(me.ID) {
+		t.Fatalf("%d devices of the user are connected, want 2", devices(hub, me.ID))
+	}
+
+	// Every device of both users gets the message, the sending one included
+	sender.sendText(me.ID, "hello", "m1")
+	var id interface{}
+	for _, c := range []*testConn{phone, desktop, sender, sender2} {
+		msg := c.next("new_message")
+		if id == nil {
+			id = msg["id"]
+		}
+		if msg["id"] != id || msg["text"] != "hello" || msg["sender_id"] != friend.ID || msg["receiver_id"] != me.ID {
+			t.Errorf("delivered %v", msg)
+		}
+	}
+
+	// Presence lasts while any device is connected
+	phone.conn.Close()
+	eventually(t, "the device is gone", func() bool { return devices(hub, me.ID) == 1 })
+	if !hub.IsOnline(me.ID) {
+		t.Fatal("a user with a connected device is offline")
+	}
+	desktop.conn.Close()
+	sender.presence(me.ID, false)
+	if hub.IsOnline(me.ID) {
+		t.Error("a user with no devices is online")
+	}
+}
+
+func TestReconnectReplacesDevice(t *testing.T) {
+	db := newTestDB(t)
+	hub := newTestHub(t, db, nil)
+	server := serveHub(t, hub, db)
+	me := newTestUser(t, db, "me")
+	friend := newTestUser(t, db, "friend")
+
+	// The old connection of a device is closed when it connects again
+	stale := dial(t, server, me.ID, "phone", -1)
+	fresh := dial(t, server, me.ID, "phone", -1)
+	stale.closed()
+	if devices(hub, me.ID) != 1 {
+		t.Fatalf("%d devices after a reconnect, want 1", devices(hub, me.ID))
+	}
+
+	// The stale connection going away does not take the new one with it
+	sender := dial(t, server, friend.ID, "web", -1)
+	sender.sendText(me.ID, "still there?", "m1")
+	if msg := fresh.next("new_message"); msg["text"] != "still there?" {
+		t.Errorf("delivered %v", msg)
+	}
+	fresh.none("new_message", 200*time.Millisecond)
+	if !hub.IsOnline(me.ID) {
+		t.Error("the reconnected user is offline")
+	}
+}
+
+func TestSendMessageAck(t *testing.T) {
+	db := newTestDB(t)
+	hub := newTestHub(t, db, nil)
+	server := serveHub(t, hub, db)
+	me := newTestUser(t, db, "me")
+	friend := newTestUser(t, db, "friend")
+	receiver := dial(t, server, friend.ID, "phone", -1)
+	sender := dial(t, server, me.ID, "phone", -1)
+
+	sender.sendText(friend.ID, "once", "m1")
+	ack := sender.next("message_ack")
+	if ack["client_message_id"] != "m1" || ack["id"] == nil || ack["created_at"] == nil || ack["duplicate"] != nil {
+		t.Fatalf("ack %v", ack)
+	}
+	if msg := receiver.next("new_message"); msg["id"] != ack["id"] || msg["client_message_id"] != "m1" {
+		t.Fatalf("delivered %v", msg)
+	}
+
+	// A resend after a reconnect is acked with the stored message and not delivered again
+	sender.conn.Close()
+	sender = dial(t, server, me.ID, "phone", -1)
+	sender.sendText(friend.ID, "once", "m1")
+	again := sender.next("message_ack")
+	if again["id"] != ack["id"] || again["duplicate"] != true {
+		t.Fatalf("ack of a resend %v, want a duplicate of %v", again, ack["id"])
+	}
+	receiver.none("new_message", 200*time.Millisecond)
+
+	var stored int
+	if err := db.QueryRow(utils.AdaptQuery(`SELECT COUNT(*) FROM messages WHERE sender_id = $1`), me.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 1 {
+		t.Errorf("%d messages stored, want 1", stored)
+	}
+
+	// Rejected messages get an error frame with the reason
+	tests := []struct {
+		frame           map[string]interface{}
+		clientMessageID string
+		code            string
+	}{
+		{map[string]interface{}{"receiver_id": friend.ID, "text": "", "client_message_id": "m2"}, "m2", "invalid_request"},
+		{map[string]interface{}{"receiver_id": friend.ID, "text": "x", "client_message_id": strings.Repeat("m", 65)}, "", "invalid_request"},
+		{map[string]interface{}{"group_id": utils.GenerateUUID(), "text": "x", "client_message_id": "m3"}, "m3", "forbidden"},
+	}
+	for _, tt := range tests {
+		tt.frame["type"] = "send_message"
+		sender.send(tt.frame)
+		if e := sender.next("message_error"); e["client_message_id"] != tt.clientMessageID || e["code"] != tt.code || e["error"] == "" {
+			t.Errorf("error for %v: %v", tt.frame, e)
+		}
+	}
+	receiver.none("new_message", 200*time.Millisecond)
+}
+
+func TestResumeReplaysMissedEvents(t *testing.T) {
+	db := newTestDB(t)
+	hub := newTestHub(t, db, nil)
+	server := serveHub(t, hub, db)
+	me := newTestUser(t, db, "me")
+	friend := newTestUser(t, db, "friend")
+	sender := dial(t, server, friend.ID, "phone", -1)
+	phone := dial(t, server, me.ID, "phone", -1)
+	start := phone.lastSeq
+
+	// expect reads new_message frames with consecutive seqs after a seq
+	expect := func(c *testConn, after int64, texts ...string) {
+		t.Helper()
+		for i, text := range texts {
+			msg := c.next("new_message")
+			if got := seq(t, msg); got != after+int64(i)+1 || msg["text"] != text {
+				t.Fatalf("got %q at seq %d, want %q at %d", msg["text"], got, text, after+int64(i)+1)
+			}
+		}
+	}
+	send := func(texts ...string) {
+		t.Helper()
+		for _, text := range texts {
+			sender.sendText(me.ID, text, utils.GenerateUUID())
+			sender.next("message_ack")
+		}
+	}
+
+	send("one", "two")
+	expect(phone, start, "one", "two")
+
+	// Events sent while the device is away are replayed after since, in order,
+	// and the live ones follow without a gap or a repeat
+	phone.conn.Close()
+	eventually(t, "the device is gone", func() bool { return devices(hub, me.ID) == 0 })
+	send("three", "four")
+	phone = dial(t, server, me.ID, "phone", start+2)
+	if phone.lastSeq != start+4 {
+		t.Fatalf("last_seq %d after a reconnect, want %d", phone.lastSeq, start+4)
+	}
+	expect(phone, start+2, "three", "four")
+	send("five")
+	expect(phone, start+4, "five")
+	phone.none("new_message", 200*time.Millisecond)
+
+	// Any event is sequenced, not only messages
+	hub.SendToUser(me.ID, map[string]interface{}{"type": "message_edited"})
+	if edited := phone.next("message_edited"); seq(t, edited) != start+6 {
+		t.Errorf("edit has seq %d, want %d", seq(t, edited), start+6)
+	}
+
+	// A connected device can ask for a replay, too
+	phone.send(map[string]interface{}{"type": "resume", "since": start + 3})
+	expect(phone, start+3, "four", "five")
+
+	// Missed events that were pruned cannot be replayed; the client reloads
+	if _, err := db.Exec(utils.AdaptQuery(`DELETE FROM user_events WHERE user_id = $1 AND seq <= $2`), me.ID, start+2); err != nil {
+		t.Fatal(err)
+	}
+	phone.conn.Close()
+	eventually(t, "the device is gone", func() bool { return devices(hub, me.ID) == 0 })
+	phone = dial(t, server, me.ID, "phone", start+1)
+	if resync := phone.next("resync_required"); int64(resync["last_seq"].(float64)) != start+6 {
+		t.Errorf("resync_required %v, want last_seq %d", resync, start+6)
+	}
+	phone.none("new_message", 200*time.Millisecond)
+
+	// A device that is up to date gets nothing replayed
+	phone.conn.Close()
+	eventually(t, "the device is gone", func() bool { return devices(hub, me.ID) == 0 })
+	phone = dial(t, server, me.ID, "phone", start+6)
+	phone.none("new_message", 200*time.Millisecond)
+	phone.none("resync_required", 0)
+}
+
+func TestSelfDestructDeadlineIsEchoed(t *testing.T) {
+	db := newTestDB(t)
+	hub := newTestHub(t, db, nil)
+	server := serveHub(t, hub, db)
+	me := newTestUser(t, db, "me")
+	friend := newTestUser(t, db, "friend")
+	sender := dial(t, server, me.ID, "phone", -1)
+
+	sender.send(map[string]interface{}{
+		"type":              "send_message",
+		"receiver_id":       friend.ID,
+		"text":              "burn after reading",
+		"client_message_id": "m1",
+		"self_destruct_in":  60,
+	})
+	msg := sender.next("new_message")
+	stored, err := store.New(db).Messages.Get(context.Background(), msg["id"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.SelfDestructAt == nil {
+		t.Fatal("no deadline is stored")
+	}
+	echoed, err := time.Parse(time.RFC3339Nano, msg["self_destruct_at"].(string))
+	if err != nil || !echoed.Equal(*stored.SelfDestructAt) {
+		t.Errorf("echoed deadline %v, stored %v", msg["self_destruct_at"], *stored.SelfDestructAt)
+	}
+}
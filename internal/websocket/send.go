@@ -0,0 +1,345 @@
+package websocket
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/kvant/messenger/internal/conversation"
+	"github.com/kvant/messenger/internal/models"
+	"github.com/kvant/messenger/internal/permissions"
+	"github.com/kvant/messenger/internal/store"
+	"github.com/kvant/messenger/pkg/utils"
+)
+
+// MaxSelfDestructIn is the longest self-destruct timer, in seconds
+const MaxSelfDestructIn = 7 * 24 * 60 * 60
+
+// MaxAttachments is the most files sent with one message
+const MaxAttachments = 10
+
+// Outgoing is a message a user sends to a direct chat, group, server channel
+// or broadcast channel
+type Outgoing struct {
+	SenderID string
+	Target   conversation.Target
+	// Text may carry a file as [image]url or [file]url
+	Text      string
+	ReplyToID *string
+	// AttachmentIDs are uploads of the sender to send with the message, in order
+	AttachmentIDs []string
+	// ClientMessageID makes resending idempotent; empty disables that
+	ClientMessageID string
+	// SelfDestructIn deletes the message that many seconds after it is sent,
+	// or after it is read if SelfDestructAfterRead is set. Zero keeps it.
+	SelfDestructIn        int
+	SelfDestructAfterRead bool
+}
+
+// Sent identifies a stored message
+type Sent struct {
+	ID        string
+	CreatedAt time.Time
+	// Duplicate is set when the client_message_id was already stored
+	Duplicate bool
+}
+
+// SendError is a rejected message. Code is invalid_request, forbidden,
+// blocked or internal.
+type SendError struct {
+	Code    string
+	Message string
+}
+
+func (e *SendError) Error() string {
+	return e.Message
+}
+
+// SendMessage validates and stores a message, calls stored (if not nil) and
+// then delivers new_message to the recipients and every device of the sender.
+// A message already stored under the same client_message_id is not stored or
+// delivered again; its Sent has Duplicate set.
+func SendMessage(db *sql.DB, hub *Hub, out Outgoing, stored func(Sent)) (*Sent, error) {
+	if len(out.ClientMessageID) > 64 {
+		return nil, &SendError{"invalid_request", "client_message_id is too long"}
+	}
+	if !out.Target.Valid() {
+		return nil, &SendError{"invalid_request", "Exactly one of receiver_id, group_id or server_channel_id is required"}
+	}
+	if out.Text == "" && len(out.AttachmentIDs) == 0 {
+		return nil, &SendError{"invalid_request", "Message text cannot be empty"}
+	}
+	if len(out.AttachmentIDs) > MaxAttachments {
+		return nil, &SendError{"invalid_request", "A message can have at most 10 attachments"}
+	}
+	if out.SelfDestructIn < 0 || out.SelfDestructIn > MaxSelfDestructIn {
+		return nil, &SendError{"invalid_request", "self_destruct_in must be between 1 second and 7 days"}
+	}
+	if out.SelfDestructAfterRead && (out.SelfDestructIn == 0 || out.Target.ReceiverID == "") {
+		return nil, &SendError{"invalid_request", "self_destruct_after_read needs self_destruct_in and a direct chat"}
+	}
+
+	stores := store.New(db)
+	messages := stores.Messages
+
+	// A retry of a message that is already stored only needs the ack
+	if out.ClientMessageID != "" {
+		if sent := findSent(messages, out.SenderID, out.ClientMessageID); sent != nil {
+			return done(sent, stored), nil
+		}
+	}
+
+	recipients, ok, err := conversation.Recipients(db, out.Target, out.SenderID)
+	if err != nil {
+		log.Printf("Failed to resolve recipients: %v", err)
+		return nil, &SendError{"internal", "Failed to send message"}
+	}
+	if !ok {
+		return nil, &SendError{"forbidden", "You are not a member of this chat"}
+	}
+	if out.Target.ReceiverID != "" {
+		blocked, err := stores.Blocks.Between(context.Background(), out.SenderID, out.Target.ReceiverID)
+		if err != nil {
+			log.Printf("Failed to check blocks: %v", err)
+			return nil, &SendError{"internal", "Failed to send message"}
+		}
+		if blocked {
+			return nil, &SendError{"blocked", "You cannot message this user"}
+		}
+	}
+
+	text := out.Text
+
+	// Parse message for file attachments
+	var fileURL *string
+	var messageType string = "text"
+
+	// Check if message contains file URL in format [type]url
+	if strings.HasPrefix(text, "[image]") {
+		url := strings.TrimPrefix(text, "[image]")
+		fileURL = &url
+		messageType = "image"
+		text = "" // Clear text for image-only messages
+	} else if strings.HasPrefix(text, "[file]") {
+		url := strings.TrimPrefix(text, "[file]")
+		fileURL = &url
+		messageType = "file"
+	}
+
+	// Attachments must be unsent uploads of the sender. The first one is
+	// also the file_url of the message, for clients that show only one.
+	attachments := make([]models.Attachment, len(out.AttachmentIDs))
+	for i, id := range out.AttachmentIDs {
+		var attachment *models.Attachment
+		if utils.IsUUID(id) {
+			attachment, err = stores.Attachments.Get(context.Background(), id)
+		} else {
+			err = store.ErrNotFound
+		}
+		if err == nil && (attachment.UploaderID != out.SenderID || attachment.MessageID != nil) {
+			err = store.ErrNotFound
+		}
+		if err == store.ErrNotFound {
+			return nil, &SendError{"invalid_request", "Attachment not found"}
+		}
+		if err != nil {
+			log.Printf("Failed to load attachment %s: %v", id, err)
+			return nil, &SendError{"internal", "Failed to send message"}
+		}
+		attachments[i] = *attachment
+	}
+	if len(attachments) > 0 && fileURL == nil {
+		fileURL = &attachments[0].URL
+		messageType = "file"
+		if attachments[0].Kind == "image" {
+			messageType = "image"
+		}
+	}
+
+	// Groups and servers need the send permission, and the attach permission for files
+	if !canSend(db, out.SenderID, out.Target, messageType != "text") {
+		return nil, &SendError{"forbidden", "You don't have permission to send this message"}
+	}
+
+	// The quoted message goes out with the reply, so it has to be one the
+	// recipients can already see
+	var repliedMessage map[string]interface{}
+	if out.ReplyToID != nil {
+		repliedMessage, err = loadReplied(messages, *out.ReplyToID, out.SenderID, out.Target)
+		if err == store.ErrNotFound {
+			return nil, &SendError{"invalid_request", "Replied message not found"}
+		}
+		if err != nil {
+			log.Printf("Failed to load replied message: %v", err)
+			return nil, &SendError{"internal", "Failed to send message"}
+		}
+	}
+
+	msg := &models.Message{
+		SenderID:        out.SenderID,
+		ReceiverID:      nullString(out.Target.ReceiverID),
+		GroupID:         nullString(out.Target.GroupID),
+		ServerChannelID: nullString(out.Target.ServerChannelID),
+		ChannelID:       nullString(out.Target.ChannelID),
+		ClientMessageID: nullString(out.ClientMessageID),
+		Text:            text,
+		MessageType:     messageType,
+		FileURL:         fileURL,
+		ReplyToID:       out.ReplyToID,
+		Attachments:     attachments,
+	}
+
+	// A timer that starts on read has no deadline until then
+	if out.SelfDestructIn > 0 {
+		msg.SelfDestructIn = &out.SelfDestructIn
+		if !out.SelfDestructAfterRead {
+			at := time.Now().Add(time.Duration(out.SelfDestructIn) * time.Second)
+			msg.SelfDestructAt = &at
+		}
+	}
+
+	// Save to database. A concurrent retry with the same client_message_id
+	// loses the race on the unique index and is acked with the stored row.
+	err = messages.Create(context.Background(), msg)
+	if err == store.ErrConflict {
+		if sent := findSent(messages, out.SenderID, out.ClientMessageID); sent != nil {
+			return done(sent, stored), nil
+		}
+	}
+	// An attachment was sent by a concurrent message meanwhile
+	if err == store.ErrNotFound {
+		return nil, &SendError{"invalid_request", "Attachment not found"}
+	}
+	if err != nil {
+		log.Printf("Failed to save message: %v", err)
+		return nil, &SendError{"internal", "Failed to send message"}
+	}
+
+	messageID, createdAt := msg.ID, msg.CreatedAt
+	sent := done(&Sent{ID: messageID, CreatedAt: createdAt}, stored)
+
+	// Get sender info
+	var username string
+	var avatarURL *string
+	if sender, err := stores.Users.Get(context.Background(), out.SenderID); err == nil {
+		username, avatarURL = sender.Username, sender.AvatarURL
+	}
+
+	// Send to receiver
+	response := map[string]interface{}{
+		"type":         "new_message",
+		"id":           messageID,
+		"sender_id":    out.SenderID,
+		"text":         text,
+		"message_type": messageType,
+		"sender_name":  username,
+		"is_read":      false,
+		"read_at":      nil,
+		"created_at":   createdAt,
+	}
+
+	setTargetFields(response, out.Target)
+
+	if avatarURL != nil {
+		response["sender_avatar_url"] = *avatarURL
+	}
+
+	if fileURL != nil {
+		response["file_url"] = *fileURL
+	}
+
+	if len(msg.Attachments) > 0 {
+		response["attachments"] = msg.Attachments
+	}
+
+	if out.ClientMessageID != "" {
+		response["client_message_id"] = out.ClientMessageID
+	}
+
+	if out.ReplyToID != nil {
+		response["reply_to_id"] = *out.ReplyToID
+		if repliedMessage != nil {
+			response["replied_message"] = repliedMessage
+		}
+	}
+
+	if msg.SelfDestructIn != nil {
+		response["self_destruct_in"] = *msg.SelfDestructIn
+	}
+	if msg.SelfDestructAt != nil {
+		response["self_destruct_at"] = *msg.SelfDestructAt
+	}
+
+	// Send to recipients and to all of the sender's devices. The sending device
+	// matches it to its pending message by client_message_id.
+	if out.Target.ReceiverID != out.SenderID {
+		recipients = append(recipients, out.SenderID)
+	}
+	hub.SendToUsers(recipients, response)
+
+	return sent, nil
+}
+
+// loadReplied returns the replied_message of a reply to a message, which
+// must be a message of the same conversation that the sender can see.
+// Returns store.ErrNotFound otherwise.
+func loadReplied(messages store.MessageStore, messageID, senderID string, target conversation.Target) (map[string]interface{}, error) {
+	if !utils.IsUUID(messageID) {
+		return nil, store.ErrNotFound
+	}
+	msg, err := messages.InChat(context.Background(), target.Chat(senderID), messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	replied := map[string]interface{}{
+		"id":           msg.ID,
+		"text":         msg.Text,
+		"sender_id":    msg.SenderID,
+		"message_type": msg.MessageType,
+	}
+	if msg.FileURL != nil {
+		replied["file_url"] = *msg.FileURL
+	}
+	return replied, nil
+}
+
+func done(sent *Sent, stored func(Sent)) *Sent {
+	if stored != nil {
+		stored(*sent)
+	}
+	return sent
+}
+
+// findSent returns the message the user already stored under clientMessageID, or nil
+func findSent(messages store.MessageStore, senderID, clientMessageID string) *Sent {
+	msg, err := messages.FindByClientID(context.Background(), senderID, clientMessageID)
+	if err != nil {
+		if err != store.ErrNotFound {
+			log.Printf("Failed to look up client message %s: %v", clientMessageID, err)
+		}
+		return nil
+	}
+	return &Sent{ID: msg.ID, CreatedAt: msg.CreatedAt, Duplicate: true}
+}
+
+// canSend reports whether the user's role in the target group or server lets
+// them send messages, and attach files if withFile is set. Direct chats have no roles.
+func canSend(db *sql.DB, userID string, target conversation.Target, withFile bool) bool {
+	member, err := permissions.ForTarget(db, target, userID)
+	if err != nil {
+		log.Printf("Failed to check permissions: %v", err)
+		return false
+	}
+	// Direct chats have no permissions; channels only take posts from admins,
+	// which Recipients checked
+	if member == nil {
+		return target.ReceiverID != "" || target.ChannelID != ""
+	}
+	if !member.Can(permissions.SendMessages) {
+		return false
+	}
+	return !withFile || member.Can(permissions.AttachFiles)
+}
@@ -3,13 +3,18 @@ package utils
 import (
 	"os"
 	"regexp"
+	"time"
 )
 
+// IsSQLite reports whether the configuration selects SQLite over PostgreSQL:
+// USE_SQLITE is set or DB_HOST is empty.
+func IsSQLite() bool {
+	return os.Getenv("USE_SQLITE") == "true" || os.Getenv("DB_HOST") == ""
+}
+
 // AdaptQuery adapts a PostgreSQL query (using $1, $2, etc.) for SQLite (using ?1, ?2, etc.) if needed.
-// It checks the USE_SQLITE environment variable or if DB_HOST is empty.
 func AdaptQuery(query string) string {
-	useSQLite := os.Getenv("USE_SQLITE")
-	if useSQLite == "true" || os.Getenv("DB_HOST") == "" {
+	if IsSQLite() {
 		// SQLite supports ?NNN for positional arguments, which allows reusing arguments just like $NNN.
 		// We simply replace $ with ? for the placeholders.
 		re := regexp.MustCompile(`\$(\d+)`)
@@ -17,3 +22,9 @@ func AdaptQuery(query string) string {
 	}
 	return query
 }
+
+// DBTime formats t like CURRENT_TIMESTAMP, so it compares correctly with
+// timestamp columns on PostgreSQL and with SQLite's text dates
+func DBTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05.999999")
+}
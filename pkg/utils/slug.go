@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"crypto/rand"
+	"regexp"
+)
+
+const slugAlphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9_-]{3,50}$`)
+
+// GenerateSlug returns a random invite slug that is hard to guess
+func GenerateSlug() string {
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		// crypto/rand never fails on supported platforms
+		panic(err)
+	}
+	for i, b := range buf {
+		buf[i] = slugAlphabet[int(b)%len(slugAlphabet)]
+	}
+	return string(buf)
+}
+
+// ValidSlug reports whether s can be used as an invite slug
+func ValidSlug(s string) bool {
+	return slugPattern.MatchString(s)
+}
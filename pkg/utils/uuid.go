@@ -5,3 +5,9 @@ import "github.com/google/uuid"
 func GenerateUUID() string {
 	return uuid.New().String()
 }
+
+// IsUUID reports whether s is a UUID, as UUID columns require
+func IsUUID(s string) bool {
+	_, err := uuid.Parse(s)
+	return err == nil
+}